@@ -0,0 +1,85 @@
+package reign
+
+import (
+	"errors"
+)
+
+// ErrNodeUnavailable is returned by a send that fails fast, rather than
+// queueing the message, because the circuit breaker for the node it is
+// for is open; see SendFailFast.
+var ErrNodeUnavailable = errors.New("the node is unavailable; its circuit breaker is open")
+
+// CircuitBreakerFailures is how many consecutive failed attempts to
+// connect to a node open its circuit breaker, as does abandoning it; see
+// ReconnectMaxAttempts. The breaker closes again as soon as a connection
+// is made. Zero opens it only for abandoned nodes. Defaults to 3.
+//
+// Only the node with the lower NodeID dials, so this only counts for the
+// nodes this one dials. The breaker for a node that dials this one opens
+// instead once the link to it has been down for LinkGracePeriod; with no
+// grace period, those nodes are never failed fast.
+var CircuitBreakerFailures = 3
+
+// SendFailFast sends the message like Send, unless the mailbox is on a
+// node whose circuit breaker is open, because this node has failed to
+// connect to it CircuitBreakerFailures times in a row or has given up on
+// it, or, for a node that dials this one, it has been gone for
+// LinkGracePeriod, in which case ErrNodeUnavailable is returned at once,
+// and the message isn't queued. This lets the caller shed the load, or send it
+// somewhere else, rather than piling messages up for a node that isn't
+// coming back soon. ClusterSpec.FailFastSends has every Send to a remote
+// mailbox do this.
+//
+// For local mailboxes this is the same as Send.
+func (a *Address) SendFailFast(m interface{}) error {
+	if bra, isRemote := a.getAddress().(boundRemoteAddress); isRemote && bra.remoteMailboxes.breakerOpen() {
+		return ErrNodeUnavailable
+	}
+	return a.Send(m)
+}
+
+// failFast returns ErrNodeUnavailable if the cluster has FailFastSends and
+// the circuit breaker for the node is open. A message from
+// SendWithRetries is exempt, as waiting out the outage is what it is for.
+func (rm *remoteMailboxes) failFast(message interface{}) error {
+	if _, isRetried := message.(retriedMessage); isRetried {
+		return nil
+	}
+	if rm.connectionServer.Cluster.FailFastSends && rm.breakerOpen() {
+		return ErrNodeUnavailable
+	}
+	return nil
+}
+
+// breakerOpen returns whether the circuit breaker for the remote node is
+// open; see CircuitBreakerFailures.
+func (rm *remoteMailboxes) breakerOpen() bool {
+	rm.Lock()
+	connected, dormant := rm.connection != nil, rm.dormant
+	disconnectedSince := rm.disconnectedSince
+	rm.Unlock()
+	if connected {
+		return false
+	}
+
+	nc := rm.connectionServer.nodeConnectors[rm.remoteNode]
+	if nc == nil {
+		// There are no attempts to count for a node that dials this
+		// one, only how long it has been gone.
+		return !dormant && LinkGracePeriod > 0 &&
+			rm.connectionServer.clock.Now().Sub(disconnectedSince) >= LinkGracePeriod
+	}
+	return nc.breakerOpen()
+}
+
+// breakerOpen returns whether connecting has failed often enough, or been
+// given up on, to open the circuit breaker for the node. A connection
+// that was made doesn't reset the failures until it ends, so this is only
+// meaningful while the node isn't connected.
+func (nc *nodeConnector) breakerOpen() bool {
+	nc.Lock()
+	defer nc.Unlock()
+
+	return nc.abandoned ||
+		(CircuitBreakerFailures > 0 && nc.failures >= CircuitBreakerFailures)
+}
@@ -0,0 +1,149 @@
+package reign
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendFailFast(t *testing.T) {
+	defer func(min time.Duration, failures int) {
+		ReconnectMinDelay = min
+		CircuitBreakerFailures = failures
+	}(ReconnectMinDelay, CircuitBreakerFailures)
+	ReconnectMinDelay = time.Millisecond
+	CircuitBreakerFailures = 2
+
+	// Node 2 isn't up yet, so every attempt to reach it fails.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+	go ntb.c1.Serve()
+
+	deadline := time.Now().Add(timeout)
+	for ntb.rem1_2.SendFailFast("queued") != ErrNodeUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("Circuit breaker never opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Plain sends are still queued, unless the cluster fails them fast.
+	if err := ntb.rem1_2.Send("queued"); err != nil {
+		t.Fatal("Send failed fast by default:", err)
+	}
+	if err := ntb.rem1_2.SendFailFast("failed"); err != ErrNodeUnavailable {
+		t.Fatal("Send did not fail fast:", err)
+	}
+	if err := ntb.addr1_1.SendFailFast("local"); err != nil {
+		t.Fatal("Local send failed fast:", err)
+	}
+
+	// Once the node is reached, the breaker closes.
+	go ntb.c2.Serve()
+	ntb.c1.waitForConnection(2)
+	if err := ntb.rem1_2.SendFailFast("connected"); err != nil {
+		t.Fatal("Send failed fast once connected:", err)
+	}
+	// What was queued while the node was down may have been dropped, but
+	// what failed fast was never sent.
+	for {
+		msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+		if !ok {
+			t.Fatal("Message not delivered once connected")
+		}
+		if msg == "failed" {
+			t.Fatal("Message that failed fast was sent")
+		}
+		if msg == "connected" {
+			break
+		}
+	}
+
+	// An abandoned node's breaker is open whatever the failures.
+	nc := ntb.c1.nodeConnectors[2]
+	nc.Lock()
+	nc.abandoned = true
+	nc.failures = 0
+	nc.Unlock()
+	if !nc.breakerOpen() {
+		t.Fatal("Abandoned node's breaker is closed")
+	}
+}
+
+func TestFailFastSends(t *testing.T) {
+	defer func(min time.Duration) {
+		ReconnectMinDelay = min
+	}(ReconnectMinDelay)
+	ReconnectMinDelay = time.Millisecond
+
+	spec := testSpec()
+	spec.FailFastSends = true
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+	go ntb.c1.Serve()
+
+	deadline := time.Now().Add(timeout)
+	for ntb.rem1_2.Send("queued") != ErrNodeUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("Send never failed fast")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ntb.rem1_2.SendWithDeadline("failed", time.Now().Add(time.Hour)); err != ErrNodeUnavailable {
+		t.Fatal("SendWithDeadline did not fail fast:", err)
+	}
+	if err := ntb.rem1_2.SendCompressed("failed"); err != ErrNodeUnavailable {
+		t.Fatal("SendCompressed did not fail fast:", err)
+	}
+	if err := ntb.rem1_2.SendReliable("failed"); err != ErrNodeUnavailable {
+		t.Fatal("SendReliable did not fail fast:", err)
+	}
+	if pending, _ := ntb.c1.PendingReliable(2); pending != 0 {
+		t.Fatal("Reliable message that failed fast is still pending:", pending)
+	}
+	if err := ntb.rem1_2.SendStream(strings.NewReader("failed")); err != ErrNodeUnavailable {
+		t.Fatal("SendStream did not fail fast:", err)
+	}
+	if results := Broadcast([]*Address{ntb.rem1_2}, "failed"); results[0].Err != ErrNodeUnavailable {
+		t.Fatal("Broadcast did not fail fast:", results[0].Err)
+	}
+	// Retried messages wait for the node, as they are meant to.
+	if err := ntb.rem1_2.SendWithRetries("retried", 1, nil); err != nil {
+		t.Fatal("SendWithRetries failed fast:", err)
+	}
+}
+
+func TestFailFastUndialedNode(t *testing.T) {
+	defer func(grace time.Duration) {
+		LinkGracePeriod = grace
+	}(LinkGracePeriod)
+	LinkGracePeriod = 0
+
+	spec := testSpec()
+	spec.FailFastSends = true
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+
+	// Node 2 never dials node 1, which isn't up, so there are no failed
+	// attempts to count; without a grace period, it never fails fast.
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	if err := ntb.rem2_1.Send("queued"); err != nil {
+		t.Fatal("Send failed fast without a grace period:", err)
+	}
+
+	LinkGracePeriod = 20 * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	for ntb.rem2_1.Send("queued") != ErrNodeUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("Send never failed fast")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once it dials in, the breaker closes.
+	go ntb.c1.Serve()
+	ntb.c2.waitForConnection(1)
+	if err := ntb.rem2_1.Send("connected"); err != nil {
+		t.Fatal("Send failed fast once connected:", err)
+	}
+}
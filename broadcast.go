@@ -0,0 +1,103 @@
+package reign
+
+// A DeliveryStatus says what became of the message sent to one of the
+// Addresses given to Broadcast.
+type DeliveryStatus int
+
+// The available DeliveryStatus values.
+//
+// DeliverySucceeded means the message was accepted: it is in the
+// mailbox, or in the outgoing queue to the mailbox's node, with the same
+// lack of guarantee as Send beyond that. DeliveryWouldBlock means there
+// was no room for it, because the outgoing queue to the node is at the
+// cluster's OutgoingQueueLimit, or the mailbox's MailboxStore returned
+// ErrMailboxFull. DeliveryTerminated means the mailbox has terminated,
+// or this node is shutting down. DeliveryFailed covers any other error,
+// which is in the DeliveryResult.
+const (
+	DeliverySucceeded DeliveryStatus = iota
+	DeliveryWouldBlock
+	DeliveryTerminated
+	DeliveryFailed
+)
+
+func (ds DeliveryStatus) String() string {
+	switch ds {
+	case DeliverySucceeded:
+		return "delivered"
+	case DeliveryWouldBlock:
+		return "would block"
+	case DeliveryTerminated:
+		return "terminated"
+	default:
+		return "failed"
+	}
+}
+
+// A DeliveryResult is the outcome of sending to one Address in a
+// Broadcast. Err is the error the send returned, if any.
+type DeliveryResult struct {
+	Address *Address
+	Status  DeliveryStatus
+	Err     error
+}
+
+// Broadcast sends the message to each of the given Addresses, returning
+// what became of each of them, in the same order.
+//
+// Unlike calling Send on each, Broadcast never waits for room: a member
+// whose outgoing queue is full is reported as DeliveryWouldBlock rather
+// than holding up the rest, whatever the cluster's OutgoingQueuePolicy,
+// and no older message is dropped to make room. The caller can then
+// retry just the members that could not take the message.
+func Broadcast(addresses []*Address, msg interface{}) []DeliveryResult {
+	results := make([]DeliveryResult, len(addresses))
+	for i, addr := range addresses {
+		err := addr.trySend(msg)
+		results[i] = DeliveryResult{
+			Address: addr,
+			Status:  deliveryStatus(err),
+			Err:     err,
+		}
+	}
+	return results
+}
+
+// trySend is Send, except a remote mailbox fails with ErrMailboxFull
+// rather than waiting for room in the outgoing queue to its node.
+func (a *Address) trySend(m interface{}) error {
+	if bra, isRemote := a.getAddress().(boundRemoteAddress); isRemote {
+		return bra.remoteMailboxes.queueOutgoing(bra.MailboxID, m, OverflowError)
+	}
+	return a.Send(m)
+}
+
+func deliveryStatus(err error) DeliveryStatus {
+	switch err {
+	case nil:
+		return DeliverySucceeded
+	case ErrMailboxFull:
+		return DeliveryWouldBlock
+	case ErrMailboxTerminated:
+		return DeliveryTerminated
+	default:
+		return DeliveryFailed
+	}
+}
+
+// Broadcast sends the message to every mailbox with a claim on the given
+// name, returning what became of each; see the package-level Broadcast.
+// The claims are those this node knows of at the time, as with Lookup.
+func (r *registry) Broadcast(name string, msg interface{}) []DeliveryResult {
+	r.mu.Lock()
+	claimants := make([]*Address, 0, len(r.claims[name]))
+	for claimant := range r.claims[name] {
+		claimants = append(claimants, &Address{
+			mailboxID:        claimant,
+			connectionServer: r.connectionServer,
+		})
+	}
+	r.mu.Unlock()
+
+	return Broadcast(claimants, msg)
+}
@@ -0,0 +1,112 @@
+package reign
+
+import (
+	"testing"
+	"time"
+)
+
+// boundedStore is a MailboxStore that holds at most limit messages.
+type boundedStore struct {
+	*memoryStore
+	limit int
+}
+
+func (bs *boundedStore) Enqueue(msg interface{}) error {
+	if bs.Len() >= bs.limit {
+		return ErrMailboxFull
+	}
+	return bs.memoryStore.Enqueue(msg)
+}
+
+func TestBroadcast(t *testing.T) {
+	// Nothing is serving the remote mailboxes, so the queue never drains.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	ntb.c1.Cluster.OutgoingQueueLimit = 1
+
+	full, fullMailbox := ntb.c1.NewMailboxWithStore(&boundedStore{newMemoryStore(), 1})
+	defer fullMailbox.Terminate()
+	terminated, terminatedMailbox := ntb.c1.NewMailbox()
+	terminatedMailbox.Terminate()
+
+	for _, addr := range []*Address{full, ntb.rem1_2} {
+		if err := addr.Send("filler"); err != nil {
+			t.Fatal("Could not fill the mailbox:", err)
+		}
+	}
+
+	done := make(chan []DeliveryResult)
+	go func() {
+		done <- Broadcast([]*Address{ntb.addr1_1, full, terminated, ntb.rem1_2}, "hello")
+	}()
+	var results []DeliveryResult
+	select {
+	case results = <-done:
+	case <-time.After(timeout):
+		t.Fatal("Broadcast blocked on a full queue")
+	}
+
+	expected := []DeliveryStatus{DeliverySucceeded, DeliveryWouldBlock, DeliveryTerminated, DeliveryWouldBlock}
+	if len(results) != len(expected) {
+		t.Fatal("Wrong number of results:", results)
+	}
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Fatalf("Result %d is %s, not %s: %v", i, result.Status, expected[i], result.Err)
+		}
+	}
+	if !results[3].Address.Equal(ntb.rem1_2) {
+		t.Fatal("Results are out of order")
+	}
+
+	if msg, ok := ntb.mailbox1_1.ReceiveNextAsync(); !ok || msg != "hello" {
+		t.Fatal("Message was not delivered:", msg)
+	}
+	if msgs := queuedMessages(ntb.remote1to2); len(msgs) != 1 || msgs[0] != "filler" {
+		t.Fatal("Full queue was changed:", msgs)
+	}
+}
+
+func TestNamesBroadcast(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	addr1, mbx1 := cs.NewMailbox()
+	defer mbx1.Terminate()
+	addr2, mbx2 := cs.NewMailbox()
+	defer mbx2.Terminate()
+
+	name := "group"
+	r.Register(name, addr1)
+	r.Register(name, addr2)
+	r.Sync()
+	// The second claim makes a MultipleClaim for both.
+	for _, mbx := range []*Mailbox{mbx1, mbx2} {
+		msg, _ := mbx.ReceiveNextTimeout(timeout)
+		if _, isClaim := msg.(MultipleClaim); !isClaim {
+			t.Fatal("No MultipleClaim:", msg)
+		}
+	}
+
+	results := r.Broadcast(name, "hello")
+	if len(results) != 2 {
+		t.Fatal("Wrong number of results:", results)
+	}
+	for _, result := range results {
+		if result.Status != DeliverySucceeded {
+			t.Fatal("Broadcast was not delivered:", result)
+		}
+	}
+	for _, mbx := range []*Mailbox{mbx1, mbx2} {
+		if msg, ok := mbx.ReceiveNextAsync(); !ok || msg != "hello" {
+			t.Fatal("Message was not delivered:", msg)
+		}
+	}
+
+	if results := r.Broadcast("nobody", "hello"); len(results) != 0 {
+		t.Fatal("Broadcast to an unclaimed name had results:", results)
+	}
+}
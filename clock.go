@@ -0,0 +1,58 @@
+package reign
+
+import "time"
+
+// A clock tells the time and makes timers for everything in reign that is
+// driven by time passing: the deadlines of expiring messages, the
+// reconnection and accept backoffs, the idle, grace, batching, and stream
+// timeouts, pings, the incoming rate limit, the age of pending reliable
+// messages, and so on. The connectionServer's clock is the real one; the
+// tests replace it with one they can move on by hand before starting the
+// connectionServer, so those can be tested without waiting for them.
+//
+// What waits on other goroutines, such as ReceiveNextTimeout,
+// SendWithConnectionWait, SendStream, Close, Flush, and WaitQuiescent,
+// along with the deadlines of the network connections and the
+// measurements for the metrics and WaiterStats, always goes by the real
+// time.
+type clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+	NewTimer(time.Duration) clockTimer
+	AfterFunc(time.Duration, func()) clockTimer
+}
+
+// A clockTimer is a time.Timer from a clock. Chan is the timer's C, which
+// is nil for one made by AfterFunc.
+type clockTimer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(time.Duration) bool
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (rt realTimer) Chan() <-chan time.Time {
+	return rt.C
+}
@@ -0,0 +1,259 @@
+package reign
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// fakeClock is a clock that only moves when Advance is called, firing the
+// timers that come due as it goes.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	sync.Mutex
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	return fc.NewTimer(d).Chan()
+}
+
+func (fc *fakeClock) NewTimer(d time.Duration) clockTimer {
+	ft := &fakeTimer{clock: fc, c: make(chan time.Time, 1)}
+	ft.Reset(d)
+	return ft
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	ft := &fakeTimer{clock: fc, f: f}
+	ft.Reset(d)
+	return ft
+}
+
+// Advance moves the clock on by d, firing the timers that come due, in
+// the order they do.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.Lock()
+	fc.now = fc.now.Add(d)
+	var due, waiting []*fakeTimer
+	for _, ft := range fc.timers {
+		switch {
+		case !ft.active:
+			ft.listed = false
+		case !ft.when.After(fc.now):
+			ft.active, ft.listed = false, false
+			due = append(due, ft)
+		default:
+			waiting = append(waiting, ft)
+		}
+	}
+	fc.timers = waiting
+	now := fc.now
+	fc.Unlock()
+
+	sort.Sort(timersByWhen(due))
+	for _, ft := range due {
+		ft.fire(now)
+	}
+}
+
+// awaitTimers waits for at least n timers to be set on the clock, for a
+// test to be sure what it is about to fire has been set up.
+func (fc *fakeClock) awaitTimers(t *testing.T, n int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fc.Lock()
+		set := 0
+		for _, ft := range fc.timers {
+			if ft.active {
+				set++
+			}
+		}
+		fc.Unlock()
+		if set >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timers were never set:", set, "of", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	f      func()
+	c      chan time.Time
+	active bool
+	listed bool
+}
+
+func (ft *fakeTimer) Chan() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *fakeTimer) Stop() bool {
+	ft.clock.Lock()
+	defer ft.clock.Unlock()
+	wasActive := ft.active
+	ft.active = false
+	return wasActive
+}
+
+func (ft *fakeTimer) Reset(d time.Duration) bool {
+	ft.clock.Lock()
+	wasActive := ft.active
+	now := ft.clock.now
+	if d <= 0 {
+		ft.active = false
+		ft.clock.Unlock()
+		ft.fire(now)
+		return wasActive
+	}
+	ft.when = now.Add(d)
+	ft.active = true
+	if !ft.listed {
+		ft.listed = true
+		ft.clock.timers = append(ft.clock.timers, ft)
+	}
+	ft.clock.Unlock()
+	return wasActive
+}
+
+// fire runs the function of a timer from AfterFunc in its own goroutine,
+// as time.AfterFunc does, or sends the time on the channel of one from
+// NewTimer.
+func (ft *fakeTimer) fire(now time.Time) {
+	if ft.f != nil {
+		go ft.f()
+		return
+	}
+	select {
+	case ft.c <- now:
+	default:
+	}
+}
+
+type timersByWhen []*fakeTimer
+
+func (t timersByWhen) Len() int           { return len(t) }
+func (t timersByWhen) Less(i, j int) bool { return t[i].when.Before(t[j].when) }
+func (t timersByWhen) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+func TestClockMessageExpiry(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+	fc := newFakeClock()
+	cs.clock = fc
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+	addr.SendWithTTL("short", time.Minute)
+	addr.SendWithTTL("long", time.Hour)
+
+	fc.Advance(2 * time.Minute)
+	if msg, _ := mbox.ReceiveNextAsync(); msg != "long" {
+		t.Fatal("Message did not expire by the clock:", msg)
+	}
+
+	mbox.RecordQueueTimes(true)
+	addr.Send("timed")
+	fc.Advance(time.Second)
+	if msg, waited := mbox.ReceiveTimed(); msg != "timed" || waited != time.Second {
+		t.Fatal("Queue time not measured by the clock:", msg, waited)
+	}
+}
+
+func TestClockReconnectBackoff(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	fc := newFakeClock()
+	ntb.c1.clock = fc
+
+	nc := ntb.c1.nodeConnectors[2]
+	nc.Lock()
+	nc.failures = 100
+	nc.failingSince = fc.Now()
+	nc.Unlock()
+
+	dial := make(chan bool)
+	go func() {
+		dial <- nc.awaitReconnect()
+	}()
+	fc.awaitTimers(t, 1)
+	select {
+	case <-dial:
+		t.Fatal("Backoff was not waited out")
+	default:
+	}
+
+	fc.Advance(ReconnectMaxDelay)
+	select {
+	case redial := <-dial:
+		if !redial {
+			t.Fatal("Connector gave up")
+		}
+	case <-time.After(timeout):
+		t.Fatal("Backoff did not end when the clock passed it")
+	}
+}
+
+func TestClockIncomingThrottle(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	fc := newFakeClock()
+	ntb.c1.clock = fc
+	ntb.remote1to2.incomingLimit = newRateLimiter(1, 1, fc)
+
+	msg := internal.IncomingMailboxMessage{Target: 1, Message: "moo"}
+	admitted := make(chan bool)
+	go func() {
+		admitted <- ntb.remote1to2.admitIncoming(msg)
+		admitted <- ntb.remote1to2.admitIncoming(msg)
+	}()
+	<-admitted
+	fc.awaitTimers(t, 1)
+	select {
+	case <-admitted:
+		t.Fatal("Throttle was not waited out")
+	default:
+	}
+	fc.Advance(time.Second)
+	select {
+	case <-admitted:
+	case <-time.After(timeout):
+		t.Fatal("Throttle did not go by the clock")
+	}
+}
+
+func TestClockPendingReliable(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	fc := newFakeClock()
+	ntb.c1.clock = fc
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	if err := ntb.rem1_2.SendReliable("moo"); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(time.Minute)
+	if count, oldest := ntb.c1.PendingReliable(2); count != 1 || oldest != time.Minute {
+		t.Fatal("Pending message not aged by the clock:", count, oldest)
+	}
+}
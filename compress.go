@@ -0,0 +1,96 @@
+package reign
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// SendCompressed sends the message like Send, but if the mailbox is on
+// another node, the message is compressed on its way there. This is for
+// messages the sender knows to be large and repetitive, such as text or
+// JSON; for most messages, the time spent compressing is more than is
+// saved on the network. With ClusterSpec.EncodeWorkers, the compressing
+// is done by the workers, like the rest of the encoding.
+//
+// Nodes running a version of reign from before this are sent the message
+// uncompressed. For local mailboxes this is the same as Send.
+func (a *Address) SendCompressed(m interface{}) error {
+	bra, isRemote := a.getAddress().(boundRemoteAddress)
+	if !isRemote {
+		return a.Send(m)
+	}
+	return bra.remoteMailboxes.sendOutgoing(bra.MailboxID, compressedMessage{m})
+}
+
+// compressedMessage is a message sent with SendCompressed, as it waits in
+// the outgoing queue.
+type compressedMessage struct {
+	message interface{}
+}
+
+// maxDecompressedSize caps how large a compressed message from another
+// node may decompress to, so that a small one can't exhaust the memory of
+// this one.
+var maxDecompressedSize int64 = 64 << 20
+
+// compressMessage is encodeMessage, compressing what it encodes.
+func compressMessage(message interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if err = gob.NewEncoder(w).Encode(encodedMessage{message}); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressMessage decodes what compressMessage encoded, refusing it if
+// it decompresses to more than maxDecompressedSize.
+func decompressMessage(compressed []byte) (interface{}, error) {
+	r := flate.NewReader(bytes.NewReader(compressed))
+	defer r.Close()
+	limited := &io.LimitedReader{R: r, N: maxDecompressedSize}
+	var em encodedMessage
+	if err := gob.NewDecoder(limited).Decode(&em); err != nil {
+		if limited.N == 0 {
+			return nil, fmt.Errorf("compressed message is larger than %d bytes", maxDecompressedSize)
+		}
+		return nil, err
+	}
+	return em.Message, nil
+}
+
+// compress marks the message about to be sent to be compressed, if the
+// remote node can take it. It is encoded along with the rest, by an encode
+// worker if there are any, rather than holding up Serve; see
+// encodeCompressed.
+func (rm *remoteMailboxes) compress(imm *internal.IncomingMailboxMessage, msg compressedMessage) {
+	imm.Message = msg.message
+	imm.Compressed = rm.peerVersion() >= 10
+}
+
+// encodeCompressed returns the message as it goes over the wire, if it is
+// to be compressed and hasn't been yet. The Message itself is left in
+// place in cm for the metrics, and only left out of what is written.
+func encodeCompressed(cm internal.ClusterMessage) (internal.ClusterMessage, error) {
+	imm, isIncoming := cm.(internal.IncomingMailboxMessage)
+	if !isIncoming || !imm.Compressed || imm.Encoded != nil {
+		return cm, nil
+	}
+	encoded, err := compressMessage(imm.Message)
+	if err != nil {
+		return nil, err
+	}
+	imm.Encoded, imm.Message = encoded, nil
+	return imm, nil
+}
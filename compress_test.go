@@ -0,0 +1,96 @@
+package reign
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+func TestSendCompressed(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	text := strings.Repeat("all work and no play ", 1000)
+	if err := ntb.rem1_2.SendCompressed(text); err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !ok || msg != text {
+		t.Fatal("Compressed message not received intact")
+	}
+
+	if err := ntb.rem1_2.SendCompressed(func() {}); err == nil {
+		t.Fatal("Message that can't be sent was accepted")
+	}
+
+	// Local messages are simply delivered.
+	addr, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	addr.SendCompressed("local")
+	if msg, ok := mbox.ReceiveNextTimeout(timeout); !ok || msg != "local" {
+		t.Fatal("Local message not received:", msg)
+	}
+}
+
+func TestSendCompressedWire(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	next := func() internal.IncomingMailboxMessage {
+		select {
+		case cm := <-conn.sent:
+			return cm.(internal.IncomingMailboxMessage)
+		case <-time.After(timeout):
+			t.Fatal("Nothing was sent")
+		}
+		return internal.IncomingMailboxMessage{}
+	}
+
+	text := strings.Repeat("moo", 1000)
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.rem1_2.SendCompressed(text)
+	imm := next()
+	if !imm.Compressed || imm.Message != nil || len(imm.Encoded) >= len(text) {
+		t.Fatal("Message was not compressed:", imm.Compressed, len(imm.Encoded))
+	}
+	if msg, err := decompressMessage(imm.Encoded); err != nil || msg != text {
+		t.Fatal("Compressed message did not decompress:", err)
+	}
+
+	// Older nodes get it as it is.
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, 9, "")
+	ntb.rem1_2.SendCompressed(text)
+	if imm := next(); imm.Compressed || imm.Encoded != nil || imm.Message != text {
+		t.Fatal("Message to an older node was compressed")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	defer func(max int64) {
+		maxDecompressedSize = max
+	}(maxDecompressedSize)
+	maxDecompressedSize = 1000
+
+	small, err := compressMessage(strings.Repeat("a", 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompressMessage(small); err != nil {
+		t.Fatal("Message within the limit was refused:", err)
+	}
+
+	large, err := compressMessage(strings.Repeat("a", 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(large) >= 1000 {
+		t.Fatal("Test message didn't compress:", len(large))
+	}
+	if _, err := decompressMessage(large); err == nil {
+		t.Fatal("Message over the limit was decompressed")
+	}
+}
@@ -0,0 +1,145 @@
+package reign
+
+import (
+	"errors"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// ErrNotifyUnconfirmed is returned by NotifyAddressOnTerminateConfirmed
+// when the remote node doesn't confirm the notification in time, or the
+// connection to it goes down first.
+var ErrNotifyUnconfirmed = errors.New("the remote node did not confirm the termination notification")
+
+// ErrNotifyConfirmUnsupported is returned by
+// NotifyAddressOnTerminateConfirmed for a node running a version of reign
+// from before confirmed notifications, which would never confirm them.
+var ErrNotifyConfirmUnsupported = errors.New("the remote node does not support confirming termination notifications")
+
+// NotifyAddressOnTerminateConfirmed is NotifyAddressOnTerminate, but for
+// a mailbox on another node it waits for that node to confirm it has
+// registered the notification, so the caller knows it will be notified.
+// A timeout of zero or less waits for as long as it takes, which is no
+// longer than the connection to the node stays up.
+//
+// If the confirmation doesn't arrive, ErrNotifyUnconfirmed is returned,
+// but the link is still in place on this side, just as one made with
+// NotifyAddressOnTerminate is: the notification may yet be registered,
+// and if the node goes down, the address is told the mailbox terminated.
+// Use RemoveNotifyAddress to give up on it. Any other error means no link
+// was made, whether because there is no connection to the node, or the
+// node runs a version of reign from before this, which gets
+// ErrNotifyConfirmUnsupported.
+//
+// Notifications from local mailboxes are in place as soon as they are
+// asked for, so for them this is the same as NotifyAddressOnTerminate.
+func (a *Address) NotifyAddressOnTerminateConfirmed(addr *Address, timeout time.Duration) error {
+	bra, isRemote := a.getAddress().(boundRemoteAddress)
+	if !isRemote {
+		a.NotifyAddressOnTerminate(addr)
+		return nil
+	}
+	return bra.remoteMailboxes.notifyConfirmed(bra.MailboxID, addr.mailboxID, timeout)
+}
+
+// confirmedNotify asks Serve to register a link with the remote node,
+// and send the result of waiting for its confirmation on result.
+type confirmedNotify struct {
+	remote MailboxID
+	local  MailboxID
+	result chan error
+}
+
+// forgetConfirmation tells Serve the confirmation for result is no longer
+// being waited for.
+type forgetConfirmation struct {
+	result chan error
+}
+
+func (rm *remoteMailboxes) notifyConfirmed(remote, local MailboxID, timeout time.Duration) error {
+	if version := rm.peerVersion(); version != 0 && version < 11 {
+		return ErrNotifyConfirmUnsupported
+	}
+
+	cn := confirmedNotify{remote, local, make(chan error, 1)}
+	if err := rm.Send(cn); err != nil {
+		return err
+	}
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := rm.connectionServer.clock.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.Chan()
+	}
+	select {
+	case err := <-cn.result:
+		return err
+	case <-timedOut:
+		_ = rm.Send(forgetConfirmation{cn.result})
+		return ErrNotifyUnconfirmed
+	}
+}
+
+// registerConfirmed sends the registration for a confirmedNotify, and
+// records the link once it has gone out. Registering a remote mailbox
+// that's already registered is harmless, so this doesn't care whether
+// there are other links to it.
+func (rm *remoteMailboxes) registerConfirmed(cn confirmedNotify) {
+	if version := rm.peerVersion(); version != 0 && version < 11 {
+		cn.result <- ErrNotifyConfirmUnsupported
+		return
+	}
+
+	rm.lastConfirm++
+	id := rm.lastConfirm
+	err := rm.send(
+		&internal.NotifyNodeOnTerminate{
+			IntMailboxID: internal.IntMailboxID(cn.remote),
+			ConfirmID:    id,
+		},
+		"confirmed termination notification",
+	)
+	if err != nil {
+		cn.result <- err
+		return
+	}
+	rm.confirming[id] = cn.result
+
+	rm.linksL.Lock()
+	linksToRemote, remoteLinksExist := rm.linksToRemote[cn.remote]
+	if !remoteLinksExist {
+		linksToRemote = make(map[MailboxID]voidtype)
+		rm.linksToRemote[cn.remote] = linksToRemote
+	}
+	linksToRemote[cn.local] = void
+	rm.linksL.Unlock()
+}
+
+// confirmed handles the remote node's confirmation of a registration.
+func (rm *remoteMailboxes) confirmed(nc internal.NotifyConfirmed) {
+	if result, waiting := rm.confirming[nc.ID]; waiting {
+		result <- nil
+		delete(rm.confirming, nc.ID)
+	}
+}
+
+// dropConfirmation stops waiting for the given confirmation.
+func (rm *remoteMailboxes) dropConfirmation(result chan error) {
+	for id, waiting := range rm.confirming {
+		if waiting == result {
+			delete(rm.confirming, id)
+			return
+		}
+	}
+}
+
+// failConfirmations gives up on all the confirmations being waited for,
+// as the connection they would have come over is gone.
+func (rm *remoteMailboxes) failConfirmations() {
+	for id, result := range rm.confirming {
+		result <- ErrNotifyUnconfirmed
+		delete(rm.confirming, id)
+	}
+}
@@ -0,0 +1,64 @@
+package reign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+func TestNotifyAddressOnTerminateConfirmed(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	if err := ntb.rem1_2.NotifyAddressOnTerminateConfirmed(ntb.addr1_1, timeout); err != nil {
+		t.Fatal("Notification was not confirmed:", err)
+	}
+	ntb.mailbox1_2.Terminate()
+	msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+	if !ok || MailboxID(msg.(MailboxTerminated)) != ntb.mailbox1_2.id {
+		t.Fatal("Confirmed notification did not arrive:", msg)
+	}
+
+	// Local notifications are just made.
+	if err := ntb.addr2_1.NotifyAddressOnTerminateConfirmed(ntb.addr1_1, timeout); err != nil {
+		t.Fatal(err)
+	}
+	ntb.mailbox2_1.Terminate()
+	if msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout); !ok || MailboxID(msg.(MailboxTerminated)) != ntb.mailbox2_1.id {
+		t.Fatal("Local notification did not arrive:", msg)
+	}
+
+	ntb.remote1to2.Lock()
+	ntb.remote1to2.version = 10
+	ntb.remote1to2.Unlock()
+	if err := ntb.rem2_2.NotifyAddressOnTerminateConfirmed(ntb.addr1_1, timeout); err != ErrNotifyConfirmUnsupported {
+		t.Fatal("An older node was asked to confirm a notification:", err)
+	}
+}
+
+func TestNotifyAddressOnTerminateUnconfirmed(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	// This connection never answers.
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+
+	err := ntb.rem1_2.NotifyAddressOnTerminateConfirmed(ntb.addr1_1, 50*time.Millisecond)
+	if err != ErrNotifyUnconfirmed {
+		t.Fatal("Unanswered notification was confirmed:", err)
+	}
+	select {
+	case cm := <-conn.sent:
+		if nnot := cm.(*internal.NotifyNodeOnTerminate); nnot.ConfirmID == 0 {
+			t.Fatal("Notification was not sent for confirmation")
+		}
+	default:
+		t.Fatal("Notification was not sent")
+	}
+	if links := ntb.remote1to2.links(); len(links[ntb.mailbox1_2.id]) != 1 {
+		t.Fatal("Unconfirmed link was not kept:", links)
+	}
+}
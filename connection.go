@@ -1,10 +1,14 @@
 package reign
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/thejerf/reign/internal"
 	"github.com/thejerf/suture"
 )
 
@@ -60,8 +64,18 @@ var void = voidtype{}
 
 // ConnectionService provides an interface to the reign connectionServer and registry objects. It
 // inherits from suture.Service and reign.Cluster.
+//
+// The rest of what a node offers is in smaller interfaces, Drainer,
+// LinkInspector, LinkController, ReliableSender, NodeBroadcaster, and
+// Diagnostics, which every ConnectionService returned by this package
+// also implements. Type assert it to the one that's wanted:
+//
+//	if err := cs.(reign.Drainer).Close(ctx); err != nil {
+//	    // ...
+//	}
 type ConnectionService interface {
 	NewMailbox() (*Address, *Mailbox)
+	NewMailboxWithStore(MailboxStore) (*Address, *Mailbox)
 	Terminate()
 
 	// Inherited from suture.Service
@@ -70,17 +84,89 @@ type ConnectionService interface {
 
 	// Inherited from reign.Cluster
 	AddConnectionStatusCallback(f func(NodeID, bool))
+	OnLinkReady(f func(NodeID))
+
+	ReloadTLS(*tls.Config) error
+	SetMetrics(Metrics)
+	SetUnroutableHandler(UnroutableHandler)
+	SetControlHandler(ControlHandler)
+	DropStats() map[string]uint64
+	SendControl(NodeID, interface{}) error
+	RemoteLinks(NodeID) map[MailboxID][]MailboxID
+	OutgoingDepth(NodeID) (int, bool)
+	LocalMailboxes() []MailboxInfo
+	EncodeAddress(*Address) (string, error)
+	DecodeAddress(string) (*Address, error)
+	SubscribeLinkEvents(*Address)
+	UnsubscribeLinkEvents(*Address)
+}
+
+// A Drainer can shut a node down once its outgoing messages have been
+// sent, or wait for those of one node to be.
+type Drainer interface {
+	Close(context.Context) error
+	Flush(NodeID, time.Duration) error
+}
+
+// A LinkInspector reports on the connections to the other nodes, and on
+// the nodes at the other end of them.
+type LinkInspector interface {
+	RemoteInstance(NodeID) (string, bool)
+	NodeMetadata(NodeID) (map[string]string, bool)
+	LinkTLSState(NodeID) (tls.ConnectionState, bool)
+	LinkLatency(NodeID) (time.Duration, bool)
+}
+
+// A LinkController can force the connections to other nodes to be made
+// again.
+type LinkController interface {
+	Reconnect(NodeID) error
+	ReviveNode(NodeID) error
+}
+
+// A ReliableSender keeps the messages sent with SendReliable in a
+// ReliableStore until they are acknowledged.
+type ReliableSender interface {
+	SetReliableStore(ReliableStore) error
+	PendingReliable(NodeID) (int, time.Duration)
+}
+
+// A NodeBroadcaster sends control messages to every node at once.
+type NodeBroadcaster interface {
+	BroadcastToNodes(interface{}) ([]NodeID, []NodeID, error)
 }
 
+// Diagnostics reports on what a node is doing, for debugging it, and for
+// tests that need to know when it has settled.
+type Diagnostics interface {
+	OnNodeDownFanout(f func(NodeID, int))
+	RecentEvents(int) []ClusterEvent
+	Goroutines() map[string]int
+	TerminationWatchers(MailboxID) []NodeID
+	WaitQuiescent(time.Duration) error
+}
+
+var (
+	_ Drainer         = (*connectionServer)(nil)
+	_ LinkInspector   = (*connectionServer)(nil)
+	_ LinkController  = (*connectionServer)(nil)
+	_ ReliableSender  = (*connectionServer)(nil)
+	_ NodeBroadcaster = (*connectionServer)(nil)
+	_ Diagnostics     = (*connectionServer)(nil)
+)
+
 // A connection serve manages the connections, both incoming and outgoing.
 // So it maintains a listener (if necessary), and maintains the outgoing
 // connections. This could, arguably, be named "node".
 type connectionServer struct {
 	listener *nodeListener
 
+	// one per alternate listen address of this node
+	alternateListeners []*nodeListener
+
 	remoteMailboxes map[NodeID]*remoteMailboxes
 
-	// referenced only by tests
+	// the connectors for the nodes this one dials
 	nodeConnectors map[NodeID]*nodeConnector
 
 	// This supervises the nodeListener, and any nodeConnections
@@ -90,6 +176,34 @@ type connectionServer struct {
 
 	registry *registry
 
+	metrics metricsHolder
+
+	unroutable unroutableHolder
+
+	control controlHolder
+
+	reliable reliableHolder
+
+	drops dropCounter
+
+	events eventLog
+
+	goroutines goroutineCounter
+
+	linkEvents linkEvents
+
+	// closed is closed once the shutdown started by the first Close is
+	// done.
+	closeL sync.Mutex
+	closed chan struct{}
+
+	// Only the tests set this. Otherwise anything that can get a message
+	// into a remoteMailboxes could crash the node.
+	allowPanicHandler bool
+
+	// what the time-driven parts of the node go by; see clock
+	clock clock
+
 	*Cluster
 }
 
@@ -107,6 +221,186 @@ func (cs *connectionServer) NewMailbox() (*Address, *Mailbox) {
 	return cs.newLocalMailbox()
 }
 
+// RemoteLinks returns a snapshot of the links from local mailboxes to
+// mailboxes on the given node, as set up by NotifyAddressOnTerminate. The
+// result maps each remote mailbox being watched to the local mailboxes
+// that will be notified of its termination. It returns nil if the node
+// is this node or isn't in the cluster.
+//
+// This is intended for debugging; the links may already have changed by
+// the time it returns.
+func (cs *connectionServer) RemoteLinks(node NodeID) map[MailboxID][]MailboxID {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return nil
+	}
+	return rm.links()
+}
+
+// TerminationWatchers returns the remote nodes that will be told when the
+// given local mailbox terminates, because mailboxes on them are linked to
+// it, in order. This is the other side of RemoteLinks: there is one
+// entry per node, however many of its mailboxes are linked. It returns
+// nil if the mailbox is not on this node, or has terminated.
+//
+// Like RemoteLinks, this is intended for debugging; the links may already
+// have changed by the time it returns.
+func (cs *connectionServer) TerminationWatchers(local MailboxID) []NodeID {
+	mbox, err := cs.mailboxes.mailboxByID(local)
+	if err != nil {
+		return nil
+	}
+
+	mbox.cond.L.Lock()
+	defer mbox.cond.L.Unlock()
+	if mbox.terminated {
+		return nil
+	}
+	watchers := nodeIDs{}
+	for node, rm := range cs.remoteMailboxes {
+		if _, watching := mbox.notificationAddresses[rm.outgoingMailbox.id]; watching {
+			watchers = append(watchers, node)
+		}
+	}
+	sort.Sort(watchers)
+	return watchers
+}
+
+type nodeIDs []NodeID
+
+func (ni nodeIDs) Len() int           { return len(ni) }
+func (ni nodeIDs) Less(i, j int) bool { return ni[i] < ni[j] }
+func (ni nodeIDs) Swap(i, j int)      { ni[i], ni[j] = ni[j], ni[i] }
+
+// EncodeAddress returns a compact string token for the given Address, for
+// handing to systems outside of the cluster. DecodeAddress turns it back
+// into an Address on any node in the cluster.
+//
+// This is the same as the Address's MarshalText, except that it works for
+// any Address that refers to a mailbox, however it was obtained. Like
+// that, it carries the cluster's Namespace, if it has one.
+func (cs *connectionServer) EncodeAddress(a *Address) (string, error) {
+	if a == nil || a.mailboxID == 0 {
+		return "", ErrIllegalAddressFormat
+	}
+	return textAddress(a.mailboxID, cs.Cluster.Namespace), nil
+}
+
+// DecodeAddress returns the Address for a token produced by EncodeAddress
+// (or MarshalText). The Address routes to the mailbox regardless of which
+// node in the cluster it is on.
+//
+// Tokens that are malformed, that refer to a node that is not in this
+// cluster, or that were encoded in another Namespace, are rejected with
+// ErrIllegalAddressFormat rather than producing an Address that can't be
+// used, or that reaches whatever mailbox now has the ID. A well-formed token for a mailbox that
+// has since terminated still decodes, just as an Address to a terminated
+// mailbox can still be held.
+func (cs *connectionServer) DecodeAddress(token string) (*Address, error) {
+	a := &Address{}
+	if err := a.unmarshalText([]byte(token), cs.Cluster.Namespace); err != nil {
+		return nil, ErrIllegalAddressFormat
+	}
+	if a.mailboxID.mailboxOnlyID() == 0 {
+		return nil, ErrIllegalAddressFormat
+	}
+	if _, defined := cs.Nodes[a.mailboxID.NodeID()]; !defined {
+		return nil, ErrIllegalAddressFormat
+	}
+
+	a.mailbox = nil
+	a.connectionServer = cs
+	return a, nil
+}
+
+// LocalMailboxes returns a snapshot of all the live mailboxes on this node,
+// in order of their IDs, including the ones reign uses internally. This is
+// meant for debugging, to find mailboxes that have been leaked or that
+// nothing is receiving from; none of the messages themselves are
+// included.
+func (cs *connectionServer) LocalMailboxes() []MailboxInfo {
+	return cs.mailboxes.info()
+}
+
+// ErrNotQuiescent is returned by WaitQuiescent when the node is still busy
+// at the timeout.
+var ErrNotQuiescent = errors.New("node did not become quiescent before the timeout")
+
+// WaitQuiescent waits until every mailbox on this node is empty and none
+// of reign's own loops is in the middle of handling a message, returning
+// ErrNotQuiescent if that hasn't happened within the timeout. This is
+// meant for tests, to wait for the effects of a message to settle instead
+// of sleeping.
+//
+// Only this node is examined: messages on their way across the network,
+// and the other nodes' mailboxes, are not. What your own goroutines are
+// doing is invisible, too, except as far as they leave messages sitting
+// in their mailboxes, so a mailbox nothing is receiving from will keep
+// the node from ever becoming quiescent.
+func (cs *connectionServer) WaitQuiescent(timeout time.Duration) error {
+	if !cs.mailboxes.awaitSettled(cs.mailboxes.quiescent, time.Now().Add(timeout), nil) {
+		return ErrNotQuiescent
+	}
+	return nil
+}
+
+// OutgoingDepth returns how many messages are waiting to be handled by the
+// loop that sends to the given node, along with whether the node is in
+// the cluster at all. This includes reign's own bookkeeping messages as
+// well as those sent to remote mailboxes.
+//
+// A depth that stays above zero means the messages are piling up; check
+// the connection status to tell whether the link is down or the other
+// node is just slow.
+func (cs *connectionServer) OutgoingDepth(node NodeID) (int, bool) {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return 0, false
+	}
+	return rm.outgoingMailbox.len(), true
+}
+
+// RemoteInstance returns the Instance the given node sent the last time
+// it connected to this one, along with whether it has connected at all.
+// See ClusterSpec.Instance.
+func (cs *connectionServer) RemoteInstance(node NodeID) (string, bool) {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return "", false
+	}
+	instance := rm.peerInstance()
+	return instance, instance != ""
+}
+
+// LinkTLSState returns the state of the TLS connection to the given
+// node, with the negotiated version and cipher suite, along with whether
+// there is a TLS connection to it at all. It is false while the link is
+// down.
+//
+// Only the node that listens presents a certificate, so the
+// PeerCertificates are only there on the node that made the connection,
+// the one with the lower NodeID.
+func (cs *connectionServer) LinkTLSState(node NodeID) (tls.ConnectionState, bool) {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return tls.ConnectionState{}, false
+	}
+	return rm.tlsState()
+}
+
+// LinkLatency returns the round trip time to the given node, as measured
+// by the last ping answered over the current connection, along with
+// whether there is such a measurement. A ping is only sent once the
+// PingInterval passes without anything arriving from the node, so a link
+// that is always busy may not have one.
+func (cs *connectionServer) LinkLatency(node NodeID) (time.Duration, bool) {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return 0, false
+	}
+	return rm.peerLatency()
+}
+
 func (cs *connectionServer) getNodes() []NodeID {
 	nodes := []NodeID{}
 	for nodeID := range cs.nodeConnectors {
@@ -125,27 +419,122 @@ func (cs *connectionServer) waitForConnection(node NodeID) {
 func (cs *connectionServer) waitForListen() {
 	// nodeListener handles the nil case
 	cs.listener.waitForListen()
+	for _, nl := range cs.alternateListeners {
+		nl.waitForListen()
+	}
 }
 
+// Terminate shuts down this node's mailboxes, including the registry and
+// every Mailbox created from it, so that anything still blocked receiving
+// on one of them wakes up with a MailboxTerminated. Call this after the
+// ConnectionService has been stopped.
 func (cs *connectionServer) Terminate() {
 	if cs.registry != nil {
 		cs.registry.Terminate()
 	}
+	// Terminating the outgoing mailboxes would discard what is still
+	// queued on them without a word, so it is abandoned first, as a Stop
+	// would.
+	for _, rm := range cs.remoteMailboxes {
+		rm.abandonQueued()
+	}
+	if cs.mailboxes != nil {
+		cs.mailboxes.terminateAll()
+	}
+	for _, rm := range cs.remoteMailboxes {
+		rm.wakeSenders()
+	}
 
 	setConnections(nil)
 }
 
+// Close shuts this node down gracefully. It waits for the messages queued
+// for each connected node to be written to the connection, stops the
+// ConnectionService, which closes the listener and the connections, and
+// finally does a Terminate, waking up anything blocked receiving on this
+// node's mailboxes with a MailboxTerminated. It returns once all that is
+// done, or with the context's error if it is done first, in which case
+// the shutdown carries on without waiting for the queues any longer.
+//
+// Close may be called more than once, and from several goroutines; the
+// later calls wait for the shutdown the first one started, which waits
+// for the queues no longer than the first one's context allows.
+func (cs *connectionServer) Close(ctx context.Context) error {
+	cs.closeL.Lock()
+	if cs.closed == nil {
+		cs.closed = make(chan struct{})
+		closed := cs.closed
+		cs.goroutine("shutdown", func() { cs.shutdown(ctx, closed) })
+	}
+	closed := cs.closed
+	cs.closeL.Unlock()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrFlushTimeout is returned by Flush when the messages for the node have
+// not all been written to the connection before the timeout.
+var ErrFlushTimeout = errors.New("messages for the node were not all written before the timeout")
+
+// Flush waits until everything queued to be sent to the given node has
+// been written to the connection to it, returning ErrFlushTimeout if that
+// hasn't happened within the timeout. Send only queues the message; this
+// is for when it matters that it has actually gone, such as before
+// deliberately breaking the connection in a test, or stopping a node.
+// What has been written may still be on its way across the network, and
+// the other node may not have handled it yet.
+//
+// It returns ErrUnknownNode if the node isn't in the cluster, and
+// ErrNoConnection if the link to it is down, or goes down while waiting,
+// as what is queued can't be written until it is back. A link closed for
+// being idle isn't down; it is made again for whatever is waiting.
+func (cs *connectionServer) Flush(node NodeID, timeout time.Duration) error {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return ErrUnknownNode
+	}
+
+	var err error
+	flushed := cs.mailboxes.awaitSettled(func() bool {
+		var flushed bool
+		flushed, err = rm.flushed()
+		return flushed || err != nil
+	}, time.Now().Add(timeout), nil)
+	if !flushed {
+		return ErrFlushTimeout
+	}
+	return err
+}
+
+func (cs *connectionServer) shutdown(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	drainBy, _ := ctx.Deadline()
+	cs.mailboxes.awaitSettled(func() bool {
+		for _, rm := range cs.remoteMailboxes {
+			if !rm.drained() {
+				return false
+			}
+		}
+		return true
+	}, drainBy, ctx.Done())
+	cs.Stop()
+	cs.Terminate()
+}
+
 func (cs *connectionServer) send(mID MailboxID, msg interface{}) (err error) {
 	if mID.NodeID() == cs.ThisNode.ID {
 		err = cs.mailboxes.sendByID(mID, msg)
 	} else {
-		err = cs.remoteMailboxes[mID.NodeID()].send(
-			internal.OutgoingMailboxMessage{
-				Target:  internal.IntMailboxID(mID),
-				Message: msg,
-			},
-			"remote mailbox message",
-		)
+		// This must go through the outgoing queue like Address.Send does,
+		// rather than straight to the connection, or it could overtake
+		// messages already waiting there.
+		err = cs.remoteMailboxes[mID.NodeID()].sendOutgoing(mID, msg)
 	}
 	return
 }
@@ -164,6 +553,7 @@ func newConnections(cluster *Cluster, myNodeID NodeID) *connectionServer {
 	newConnections := &connectionServer{
 		Cluster:        cluster,
 		nodeConnectors: make(map[NodeID]*nodeConnector),
+		clock:          realClock{},
 	}
 	newConnections.mailboxes = newMailboxes(newConnections, myNodeID)
 	newConnections.registry = newRegistry(newConnections, myNodeID, cluster.ClusterLogger)
@@ -199,14 +589,14 @@ func newConnections(cluster *Cluster, myNodeID NodeID) *connectionServer {
 				// expect to connect to us. If we are the highest node,
 				// then we don't have to bother with a listener.
 				needListener = true
-				newConnections.remoteMailboxes[nodeID] = newRemoteMailboxes(newConnections, newConnections.mailboxes, l, myNodeID)
+				newConnections.remoteMailboxes[nodeID] = newRemoteMailboxes(newConnections, newConnections.mailboxes, l, myNodeID, nodeID)
 				newConnections.Add(newConnections.remoteMailboxes[nodeID])
 			}
 			// myNodeID == nodeID falls out here, we do nothing
 			continue
 		}
 
-		nodeRemoteMailboxes := newRemoteMailboxes(newConnections, newConnections.mailboxes, l, myNodeID)
+		nodeRemoteMailboxes := newRemoteMailboxes(newConnections, newConnections.mailboxes, l, myNodeID, nodeID)
 		newConnections.remoteMailboxes[nodeID] = nodeRemoteMailboxes
 		connection := &nodeConnector{
 			source:           myNode,
@@ -226,6 +616,14 @@ func newConnections(cluster *Cluster, myNodeID NodeID) *connectionServer {
 		newConnections.Add(nl)
 		newConnections.listener = nl
 		nl.remoteMailboxes = newConnections.remoteMailboxes
+
+		for _, addr := range myNode.altlistenaddrs {
+			alt := newNodeListener(myNode, newConnections)
+			alt.addr = addr
+			alt.remoteMailboxes = newConnections.remoteMailboxes
+			newConnections.Add(alt)
+			newConnections.alternateListeners = append(newConnections.alternateListeners, alt)
+		}
 	}
 
 	return newConnections
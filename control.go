@@ -0,0 +1,192 @@
+package reign
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// ErrControlUnsupported is returned by SendControl when the remote node
+// is running a version of reign that can't receive control messages.
+var ErrControlUnsupported = errors.New("the remote node does not support control messages")
+
+// ErrUnknownNode is returned when a node is named that is not in the
+// cluster.
+var ErrUnknownNode = errors.New("no such node in the cluster")
+
+// ErrReservedControlMessage is returned by SendControl when asked to send
+// one of reign's own messages.
+var ErrReservedControlMessage = errors.New("reign's own cluster messages can not be sent as control messages")
+
+// A ControlHandler is called with the control messages that arrive from
+// other nodes, sent to this one with SendControl, along with the node
+// that sent each.
+//
+// Control messages are for building protocols between the nodes
+// themselves, rather than between mailboxes, such as coordinating a
+// rolling upgrade. They travel over the same connection as everything
+// else sent to the node, in order with it, but they are only ever handed
+// to the ControlHandler; nothing a remote node sends this way can reach
+// reign's own handling of the cluster's traffic. Any type registered
+// with RegisterMessageType may be sent, except reign's own internal
+// messages, which are refused when sent and dropped when received.
+//
+// Like the UnroutableHandler, the handler is called synchronously by the
+// loop that receives everything from the sending node, so it must not
+// block, or that whole node's traffic will wait on it.
+type ControlHandler func(from NodeID, msg interface{})
+
+// controlHolder lets the ControlHandler be installed or replaced while
+// the internal loops are running.
+type controlHolder struct {
+	handler ControlHandler
+	sync.RWMutex
+}
+
+func (ch *controlHolder) get() ControlHandler {
+	ch.RLock()
+	defer ch.RUnlock()
+	return ch.handler
+}
+
+// outgoingControl is a control message waiting in the queue to the remote
+// node.
+type outgoingControl struct {
+	message interface{}
+}
+
+// SetControlHandler installs the handler for control messages from other
+// nodes. Pass nil, the default, to just drop them.
+func (cs *connectionServer) SetControlHandler(handler ControlHandler) {
+	cs.control.Lock()
+	defer cs.control.Unlock()
+	cs.control.handler = handler
+}
+
+// SendControl sends a control message to the given node, for its
+// ControlHandler. See ControlHandler.
+//
+// Like Address.Send, this does not wait for the message to be sent, and
+// it is lost if the connection to the node is down.
+func (cs *connectionServer) SendControl(node NodeID, msg interface{}) error {
+	if isInternalMessage(msg) {
+		return ErrReservedControlMessage
+	}
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return ErrUnknownNode
+	}
+	if version := rm.peerVersion(); version != 0 && version < 4 {
+		return ErrControlUnsupported
+	}
+	if err := rm.denySend(msg, "control message"); err != nil {
+		return err
+	}
+	return rm.Send(outgoingControl{msg})
+}
+
+// BroadcastToNodes sends a control message to every node in the cluster,
+// for coordinating the nodes as a whole, such as to have them all reload
+// their configuration. It goes to each node's ControlHandler, just as if
+// it had been sent to each of them with SendControl, and this node's own
+// handler is called with it too, with this node as the sender. Unlike
+// registry broadcasts, this is addressed to the nodes, not to mailboxes
+// that have claimed a name; a handler that wants a mailbox to deal with
+// it can pass it on to one.
+//
+// This returns the nodes the message was sent to, including this one if
+// it has a ControlHandler, and those that were skipped: the nodes that
+// aren't connected, or that can't receive control messages, or that may
+// not be sent its type; see NodeDefinition.DeniedTypes. A node whose link
+// has gone idle counts as reached, as the message is held for it while
+// the link is brought back up; see ClusterSpec.LinkIdleTimeout. This never
+// waits on a node itself, and, as with SendControl, the message may still
+// be lost if a connection drops before it has been sent.
+func (cs *connectionServer) BroadcastToNodes(msg interface{}) (reached, skipped []NodeID, err error) {
+	if isInternalMessage(msg) {
+		return nil, nil, ErrReservedControlMessage
+	}
+
+	for node, rm := range cs.remoteMailboxes {
+		if rm.reachable() && cs.SendControl(node, msg) == nil {
+			reached = append(reached, node)
+		} else {
+			skipped = append(skipped, node)
+		}
+	}
+
+	if handler := cs.control.get(); handler != nil {
+		handler(cs.nodeID, msg)
+		reached = append(reached, cs.nodeID)
+	} else {
+		skipped = append(skipped, cs.nodeID)
+	}
+
+	sort.Sort(nodeIDs(reached))
+	sort.Sort(nodeIDs(skipped))
+	return reached, skipped, nil
+}
+
+// reachable returns whether a message sent to the node now will be sent:
+// it is connected, or its link is idle, and will be woken for the message.
+// Otherwise the message waits on the connection coming back, if it ever
+// does.
+func (rm *remoteMailboxes) reachable() bool {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.connection != nil || rm.dormant
+}
+
+// sendControl sends a control message from the queue to the remote node.
+func (rm *remoteMailboxes) sendControl(msg outgoingControl) {
+	// The node may have been replaced by an older one since the message
+	// was queued; sending it would fail the decoding on the other end,
+	// and drop the connection.
+	if version := rm.peerVersion(); version != 0 && version < 4 {
+		rm.Errorf("Dropping a control message for node %d, which no longer supports them", rm.remoteNode)
+		rm.connectionServer.dropped(DropUnsupported, rm.remoteNode, 1)
+		return
+	}
+	cm := &internal.ControlMessage{Message: msg.message}
+	if err := rm.send(cm, "control message"); err != nil {
+		rm.unsent(cm, err)
+	}
+}
+
+// receiveControl hands a control message from the remote node to the
+// ControlHandler.
+func (rm *remoteMailboxes) receiveControl(msg internal.ControlMessage) {
+	if isInternalMessage(msg.Message) {
+		rm.Errorf("Dropping a control message from node %d carrying an internal %T", rm.remoteNode, msg.Message)
+		rm.connectionServer.dropped(DropFiltered, rm.remoteNode, 1)
+		return
+	}
+	if rm.denyReceive(msg.Message, "control message") {
+		return
+	}
+	handler := rm.connectionServer.control.get()
+	if handler == nil {
+		rm.Tracef("Dropping control message from node %d, as there is no handler: %#v", rm.remoteNode, msg.Message)
+		rm.connectionServer.dropped(DropUnhandled, rm.remoteNode, 1)
+		return
+	}
+	handler(rm.remoteNode, msg.Message)
+}
+
+var internalPackage = reflect.TypeOf(internal.ControlMessage{}).PkgPath()
+
+// isInternalMessage returns whether msg is, or points to, one of the
+// types of reign's internal package.
+func isInternalMessage(msg interface{}) bool {
+	t := reflect.TypeOf(msg)
+	if t == nil {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.PkgPath() == internalPackage
+}
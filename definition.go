@@ -19,8 +19,12 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/thejerf/reign/internal"
 )
 
 // The gob unmarshaling interface has no provisions for state in it,
@@ -70,6 +74,15 @@ var defaultPermittedProtocols = []uint16{
 
 // NodeID is used to identify the current node's ID.
 //
+// A NodeID is a byte, so a cluster can have at most 256 nodes. MailboxIDs
+// carry the NodeID in their low 8 bits, so widening it would change the
+// wire format and every MailboxID already in circulation.
+//
+// Every node in a cluster must have a distinct NodeID. The cluster
+// specification is rejected if two nodes share one, and a node refuses
+// the handshake of any peer claiming an ID that doesn't match the
+// definition, or that is already connected.
+//
 // This type may be privitized in later versions of reign.
 type NodeID byte
 
@@ -82,19 +95,54 @@ type NodeID byte
 // required field.
 //
 // The ListenAddress is what the cluster will actually bind to. If this is
-// the same as the address, you may leave it unspecified.
+// the same as the address, you may leave it unspecified. Behind NAT, or in
+// a container, set the Address to the one the other nodes can route to,
+// and the ListenAddress to the local interface the traffic arrives on,
+// such as "0.0.0.0:29876"; the ports may differ, too. The Address is then
+// checked to be one the other nodes could dial, not an unspecified or
+// loopback address.
 //
 // The LocalAddress is the address to use for the outgoing connections to
 // the cluster. If blank, net.DialTCP will be passed nil for the laddr.
+//
+// The AlternateAddresses are more addresses the other nodes can reach this
+// node on, such as its IPv6 address when the Address is its IPv4 one. If
+// the node can't be reached on its Address, these are tried in order; see
+// DialTimeout. The AlternateListenAddresses are more addresses for the
+// node to bind to, alongside the ListenAddress. If neither the
+// ListenAddress nor the AlternateListenAddresses are specified, the node
+// binds to each of its AlternateAddresses too.
+//
+// The DeniedTypes are the types of message that may not be sent to this
+// node, nor received from it, named as %T prints them, such as
+// "billing.Refund", so that a node in a lower tier of trust can be kept
+// from seeing privileged messages. A pointer is named as a different
+// type, "*billing.Refund", so list both if both are used. This applies to
+// messages for mailboxes, including relayed ones, and control messages.
+// A message of a denied type is dropped and logged as a warning on
+// whichever side catches it, and a Send of one to this node fails with
+// ErrDeniedType. Since every node has the same NodeDefinitions, every
+// other node applies them to its link with this one.
+//
+// Only the type of the message itself is checked, and that of the Message
+// in an Envelope. A denied type can still cross the link inside a field of
+// some other message, such as one of type interface{}, so a message that
+// carries others that way should be denied as well.
 type NodeDefinition struct {
-	ID            NodeID `json:"id"`
-	Address       string `json:"address"`
-	ListenAddress string `json:"listen_address,omit_empty"`
-	LocalAddress  string `json:"local_address,omit_empty"`
+	ID                       NodeID   `json:"id"`
+	Address                  string   `json:"address"`
+	ListenAddress            string   `json:"listen_address,omit_empty"`
+	LocalAddress             string   `json:"local_address,omit_empty"`
+	AlternateAddresses       []string `json:"alternate_addresses,omitempty"`
+	AlternateListenAddresses []string `json:"alternate_listen_addresses,omitempty"`
+	DeniedTypes              []string `json:"denied_types,omitempty"`
 
 	ipaddr     *net.TCPAddr
 	listenaddr *net.TCPAddr
 	localaddr  *net.TCPAddr
+
+	altipaddrs     []*net.TCPAddr
+	altlistenaddrs []*net.TCPAddr
 }
 
 // ClusterSpec defines how to create a cluster. The primary purpose of
@@ -125,6 +173,270 @@ type ClusterSpec struct {
 	// the nodes.
 	ClusterCertPath string `json:"cluster_cert_path,omitempty"`
 	ClusterCertPEM  string `json:"cluster_cert_pem,omitempty"`
+
+	// Namespace optionally names this logical cluster, or this generation
+	// of it. Nodes only connect to nodes that claim the same namespace, so
+	// a node left over from a previous generation of the cluster, or one
+	// belonging to another cluster that reuses the same node identities,
+	// can not deliver messages into this one. Marshalled Addresses, and
+	// those from EncodeAddress, carry the namespace too, and are refused
+	// in any other, so one kept from a previous generation can't reach
+	// whatever mailbox has its ID in this one.
+	Namespace string `json:"namespace,omitempty"`
+
+	// Instance optionally describes this run of this node, such as the
+	// host, the time it started, and the version of the software, in up
+	// to 256 bytes of whatever text is useful. It is sent to the other
+	// nodes when connecting, which log it and report it in LinkEvents and
+	// RemoteInstance, so a node that restarted can be told apart from one
+	// whose connection merely blipped. It defaults to the hostname,
+	// process ID, and the time the process started.
+	Instance string `json:"instance,omitempty"`
+
+	// Metadata is a small map describing this node, such as its region,
+	// zone, role, or version, which it sends to the other nodes when
+	// connecting, so they can go by it, such as to prefer mailboxes in
+	// their own zone; see LinkInspector.NodeMetadata. It is fixed for
+	// as long as the node runs. The keys and values can't add up to more
+	// than 4096 bytes, and a node that sends more is treated as having
+	// sent none.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// DevelopmentMode removes the need to create any certificates, for
+	// local development and testing. Instead of loading certificates,
+	// each node gets one minted from a CA that is generated in memory
+	// when first needed, and which is shared by everything in the
+	// process. As a result, development mode clusters only work when all
+	// the nodes are created within the same OS process; nodes in other
+	// processes will not trust the certificates.
+	//
+	// Since this provides no meaningful security, it is refused unless
+	// every node's addresses are on the loopback interface, and it can
+	// not be combined with any of the certificate settings above.
+	DevelopmentMode bool `json:"development_mode,omitempty"`
+
+	// OutgoingQueueLimit caps how many messages may be waiting to be sent
+	// to any one remote node. Zero, the default, means there is no cap.
+	// Only messages to remote mailboxes count towards it; reign's own
+	// bookkeeping messages are always queued.
+	//
+	// OutgoingQueuePolicy says what happens to a Send that would exceed
+	// the cap: "block" (the default) waits for room, "drop_oldest"
+	// discards the oldest waiting message to make room, and "error"
+	// returns ErrMailboxFull to the sender.
+	OutgoingQueueLimit  int    `json:"outgoing_queue_limit,omitempty"`
+	OutgoingQueuePolicy string `json:"outgoing_queue_policy,omitempty"`
+
+	// OutgoingQueueMaxAge caps how long a message may wait to be sent to
+	// a remote node, as a duration like "30s"; older ones are evicted
+	// from the queue, whether or not it is full, rather than delivered
+	// late. A Send waiting for room under "block" evicts them as they
+	// reach the age, rather than waiting for them to be sent. If an
+	// UnroutableHandler is installed, it gets the evicted messages, so
+	// it can dead-letter them. Empty, the default, means there is no
+	// cap.
+	OutgoingQueueMaxAge string `json:"outgoing_queue_max_age,omitempty"`
+
+	// FailFastSends has every send to a mailbox on a node whose circuit
+	// breaker is open, whether by Send, SendCompressed, SendReliable,
+	// SendStream or Broadcast, return ErrNodeUnavailable at once, rather
+	// than queueing the message for when the node is reached again; see
+	// Address.SendFailFast and CircuitBreakerFailures. SendWithRetries
+	// still waits for the node. The default queues them.
+	FailFastSends bool `json:"fail_fast_sends,omitempty"`
+
+	// MaxClockSkew is how far, as a duration like "2s", this node's clock
+	// may be behind those of the other nodes, for messages sent with
+	// SendWithDeadline by a node that sends the deadline itself rather
+	// than the time left until it, which only those running a version of
+	// reign from before this setting do. Such a deadline is extended by
+	// this much, so that the message isn't expired before its time, at
+	// the cost of keeping it up to this much too long. Empty, the
+	// default, means none, as the nodes' clocks are expected to agree.
+	MaxClockSkew string `json:"max_clock_skew,omitempty"`
+
+	// EncodeWorkers, if positive, is how many goroutines encode the
+	// messages sent to each remote node, so that the loop sending them
+	// doesn't wait on gob while a large message is encoded. The messages
+	// still go over the connection in the order they were sent. This only
+	// pays for itself for large messages, on machines with the cores to
+	// spare, as each message is copied once more on its way. Nodes
+	// running a version of reign from before this setting are sent
+	// messages as usual. Zero, the default, encodes them in the loop; it
+	// can't be more than 255.
+	EncodeWorkers int `json:"encode_workers,omitempty"`
+
+	// IncomingRateLimit caps how many messages per second this node will
+	// accept for its mailboxes from any one remote node, shielding it
+	// from a peer that floods it. Zero, the default, means there is no
+	// cap. IncomingRateBurst is how many messages may arrive at once
+	// before the cap applies; it defaults to one second's worth.
+	//
+	// IncomingRatePolicy says what happens to messages over the cap:
+	// "throttle" (the default) stops reading from the connection until
+	// they are within it, pushing back on the sender, and "drop" discards
+	// them, logging how many were lost.
+	IncomingRateLimit  float64 `json:"incoming_rate_limit,omitempty"`
+	IncomingRateBurst  int     `json:"incoming_rate_burst,omitempty"`
+	IncomingRatePolicy string  `json:"incoming_rate_policy,omitempty"`
+
+	// MaxHops caps how many times a message may be relayed from node to
+	// node on its way to its mailbox. A node only relays a message that
+	// arrives for a mailbox on some other node, which means the nodes
+	// disagree about the cluster, so a message relayed more than this is
+	// taken to be going around in a loop. It is dropped with a warning, and
+	// passed to the UnroutableHandler. Zero means the DefaultMaxHops; it
+	// can't be more than 255.
+	//
+	// Only reign's own relaying is counted; a message that your code
+	// receives and sends on is a new message as far as reign can tell.
+	MaxHops int `json:"max_hops,omitempty"`
+
+	// MisroutedPolicy says what this node does with a message that
+	// arrives for a mailbox on some other node, which should only happen
+	// if the nodes disagree about the cluster, or the sender is
+	// misbehaving. "relay" (the default) passes it on to the right node,
+	// subject to MaxHops. "drop" discards it with a warning, passing it to
+	// the UnroutableHandler, so nothing a peer sends can make this node
+	// forward its messages.
+	MisroutedPolicy string `json:"misrouted_policy,omitempty"`
+
+	// RegistryMode says what the registry does with the names claimed by
+	// mailboxes on a node whose connection has gone down. "strict" (the
+	// default) forgets them at once, so Lookup only returns Addresses on
+	// nodes that are connected. "cached" keeps them as they last were,
+	// which keeps service discovery working through a brief partition; a
+	// Lookup prefers the claims of nodes that are up, and
+	// LookupWithStaleness reports when a claim it returns went stale. The
+	// claims are brought up to date when the node connects again.
+	RegistryMode string `json:"registry_mode,omitempty"`
+
+	// LinkIdleTimeout, as a duration like "10m", closes the link to a
+	// remote node once nothing but pings has crossed it in either
+	// direction for that long, so that a large cluster whose nodes rarely
+	// talk to most of the others doesn't keep all of its links open. It
+	// is not an outage: the other node isn't treated as down, the links to
+	// its mailboxes and its claims in the registry are kept, and anything
+	// sent to it waits in the outgoing queue rather than being dropped,
+	// subject to the OutgoingQueueLimit and OutgoingQueueMaxAge.
+	//
+	// Only the node of the pair that dials, the one with the lower NodeID,
+	// closes the link, going by its own setting, and only it can bring the
+	// link back, which it does as soon as it has something to send. So
+	// that what the other node sends isn't stuck, it also reconnects each
+	// time the link has been closed for the timeout, and closes it again
+	// once it has been idle for IdleCheckInWindow. Messages from the
+	// node with the higher NodeID may therefore wait for up to the timeout,
+	// and so may the termination notices for the links to its mailboxes;
+	// use this where the lower node starts the conversations, or where
+	// that latency is acceptable. If the redial fails, the link is down,
+	// just as if the connection had dropped; the other node concludes the
+	// same if it hasn't been reconnected to within twice the timeout.
+	// Links to nodes running a version of reign from before this setting
+	// are never closed. Empty, the default, keeps links open.
+	LinkIdleTimeout string `json:"link_idle_timeout,omitempty"`
+
+	// ReliableDedupWindow, as a duration like "10m", has this node
+	// remember the messages sent to it with SendReliable for that long
+	// after they arrive, and discard any that arrive again in that time,
+	// so that the resends after a reconnection aren't delivered twice.
+	// This is best effort: a resend that comes after the window, or after
+	// this node restarts, is delivered again, so the window should be
+	// longer than the nodes are expected to stay disconnected. Each
+	// message costs a little memory for the window, up to the
+	// ReliableDedupLimit, and duplicates are still acknowledged. Empty,
+	// the default, delivers every copy.
+	ReliableDedupWindow string `json:"reliable_dedup_window,omitempty"`
+
+	// ReliableDedupLimit caps how many messages from each node are
+	// remembered for the ReliableDedupWindow, so that a node sending
+	// reliable messages faster than expected can't exhaust this one's
+	// memory. Beyond it the oldest are forgotten early, and duplicates of
+	// those are delivered again. Zero means the DefaultReliableDedupLimit.
+	ReliableDedupLimit int `json:"reliable_dedup_limit,omitempty"`
+
+	// EventLogSize is how many of the most recent ClusterEvents the node
+	// keeps for Diagnostics.RecentEvents. Zero means the
+	// DefaultEventLogSize.
+	EventLogSize int `json:"event_log_size,omitempty"`
+
+	// EarlyMessagePolicy says what happens to a message for a remote node
+	// that comes up to be sent while a new connection to the node is
+	// still having its handshake, such as just after a reconnection,
+	// when the connection exists but the nodes are still exchanging
+	// their registries over it. "buffer" (the default) holds it, and
+	// everything queued behind it, until the handshake is done, sending
+	// it then, or treating it as having no connection if the handshake
+	// fails. "reject" treats it as having no connection at once, so that
+	// it is dropped right away, or held by SendWithRetries. Either way,
+	// nothing is written to a connection before its handshake is done.
+	EarlyMessagePolicy string `json:"early_message_policy,omitempty"`
+
+	// Dialer, if set, makes the connections to the other nodes in place
+	// of the standard dialer, such as to go through a SOCKS proxy, or a
+	// transport that enforces the source address. The TLS handshake is
+	// done over whatever it returns. It can only be set from code; see
+	// DialFunc. The default dials directly, from the node's LocalAddress.
+	Dialer DialFunc `json:"-"`
+}
+
+// DefaultMaxHops is the default for ClusterSpec.MaxHops. A message for a
+// mailbox normally goes straight to its node, so this is generous.
+const DefaultMaxHops = 16
+
+// DefaultEventLogSize is the default for ClusterSpec.EventLogSize.
+const DefaultEventLogSize = 256
+
+// DefaultReliableDedupLimit is the default for
+// ClusterSpec.ReliableDedupLimit.
+const DefaultReliableDedupLimit = 100000
+
+// A MisroutedPolicy says what to do with a message that arrives for a
+// mailbox on another node. See ClusterSpec.MisroutedPolicy.
+type MisroutedPolicy int
+
+// The available MisroutedPolicy values.
+const (
+	MisroutedRelay MisroutedPolicy = iota
+	MisroutedDrop
+)
+
+var misroutedPolicies = map[string]MisroutedPolicy{
+	"relay": MisroutedRelay,
+	"drop":  MisroutedDrop,
+}
+
+// An EarlyMessagePolicy says what to do with a message for a remote node
+// whose connection is still having its handshake. See
+// ClusterSpec.EarlyMessagePolicy.
+type EarlyMessagePolicy int
+
+// The available EarlyMessagePolicy values.
+const (
+	EarlyMessageBuffer EarlyMessagePolicy = iota
+	EarlyMessageReject
+)
+
+var earlyMessagePolicies = map[string]EarlyMessagePolicy{
+	"buffer": EarlyMessageBuffer,
+	"reject": EarlyMessageReject,
+}
+
+// An OverflowPolicy says what to do with a message sent to a remote node
+// whose outgoing queue is full. See ClusterSpec.OutgoingQueueLimit.
+type OverflowPolicy int
+
+// The available OverflowPolicy values.
+const (
+	OverflowBlock OverflowPolicy = iota
+	OverflowDropOldest
+	OverflowError
+)
+
+var overflowPolicies = map[string]OverflowPolicy{
+	"block":       OverflowBlock,
+	"drop_oldest": OverflowDropOldest,
+	"error":       OverflowError,
 }
 
 // clarifying that point about only Go strings can be keys: Yes, in JSON,
@@ -148,6 +460,82 @@ type Cluster struct {
 	// The CertPool containing that certificate
 	RootCAs *x509.CertPool
 
+	// tlsL guards RootCAs and Certificate once the cluster is running, as
+	// ReloadTLS may replace them.
+	tlsL sync.RWMutex
+
+	// The namespace of this cluster; see ClusterSpec.Namespace.
+	Namespace string
+
+	// The description of this run of this node; see ClusterSpec.Instance.
+	Instance string
+
+	// What this node tells the others about itself; see
+	// ClusterSpec.Metadata.
+	Metadata map[string]string
+
+	// The cap on the messages waiting to be sent to each remote node, and
+	// what to do when it is reached; see ClusterSpec.OutgoingQueueLimit.
+	OutgoingQueueLimit  int
+	OutgoingQueuePolicy OverflowPolicy
+	OutgoingQueueMaxAge time.Duration
+
+	// Whether sends to nodes whose circuit breakers are open fail at
+	// once; see ClusterSpec.FailFastSends.
+	FailFastSends bool
+
+	// The allowance for the clocks of older nodes; see
+	// ClusterSpec.MaxClockSkew.
+	MaxClockSkew time.Duration
+
+	// How many goroutines encode the messages to each remote node; see
+	// ClusterSpec.EncodeWorkers.
+	EncodeWorkers int
+
+	// The cap on the rate of messages accepted from each remote node; see
+	// ClusterSpec.IncomingRateLimit. Unlike the above, these can't be
+	// changed once the cluster is created.
+	IncomingRateLimit  float64
+	IncomingRateBurst  int
+	IncomingRatePolicy RateLimitPolicy
+
+	// The cap on how many times a message may be relayed; see
+	// ClusterSpec.MaxHops. Zero means DefaultMaxHops.
+	MaxHops int
+
+	// What to do with messages for mailboxes on other nodes; see
+	// ClusterSpec.MisroutedPolicy.
+	MisroutedPolicy MisroutedPolicy
+
+	// What the registry does with the claims of nodes that go down; see
+	// ClusterSpec.RegistryMode.
+	RegistryMode RegistryMode
+
+	// How long a link may be idle before it is closed; see
+	// ClusterSpec.LinkIdleTimeout.
+	LinkIdleTimeout time.Duration
+
+	// How long reliable messages are remembered to discard duplicates;
+	// see ClusterSpec.ReliableDedupWindow.
+	ReliableDedupWindow time.Duration
+
+	// How many reliable messages from each node are remembered at most;
+	// see ClusterSpec.ReliableDedupLimit. Zero means
+	// DefaultReliableDedupLimit.
+	ReliableDedupLimit int
+
+	// How many ClusterEvents are kept; see ClusterSpec.EventLogSize. Zero
+	// means DefaultEventLogSize.
+	EventLogSize int
+
+	// What to do with messages for a node whose connection is still
+	// having its handshake; see ClusterSpec.EarlyMessagePolicy.
+	EarlyMessagePolicy EarlyMessagePolicy
+
+	// What makes the connections to the other nodes; see
+	// ClusterSpec.Dialer. Nil means the standard dialer.
+	Dialer DialFunc
+
 	// This node's certificate
 	Certificate tls.Certificate
 
@@ -163,6 +551,14 @@ type Cluster struct {
 	// the connectivity to a certain node.
 	connectionStatusCallbacks []func(NodeID, bool)
 
+	// linkReadyCallbacks are called when a connection to a node is ready
+	// for use.
+	linkReadyCallbacks []func(NodeID)
+
+	// nodeDownFanoutCallbacks are called after the local mailboxes linked
+	// to a node that went down have been told about it.
+	nodeDownFanoutCallbacks []func(NodeID, int)
+
 	// this represents how to get the updated configuration when requested
 	source func() (*ClusterSpec, error)
 
@@ -178,29 +574,172 @@ func RegisterType(value interface{}) {
 	gob.Register(value)
 }
 
+// RegisterMessageType registers a type to be sent across the cluster,
+// like RegisterType, but also checks that values of the type can actually
+// be encoded, returning an error describing the problem if not. Without
+// this, a type that can't be sent, such as one with no exported fields,
+// only fails when a message of that type is first sent to another node.
+// A type whose name clashes with one already registered is also returned
+// as an error, where RegisterType panics.
+func RegisterMessageType(value interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("can't register %T: %v", value, r)
+		}
+	}()
+
+	gob.Register(value)
+	return checkEncodable(value)
+}
+
+// checkEncodable returns why the given message can't be sent to another
+// node, if it can't.
+func checkEncodable(msg interface{}) error {
+	var cm internal.ClusterMessage = internal.IncomingMailboxMessage{Message: msg}
+	err := gob.NewEncoder(ioutil.Discard).Encode(&cm)
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "type not registered") {
+		return fmt.Errorf("%T can not be sent to other nodes, as a type in it has not been registered; see RegisterMessageType: %s",
+			msg, err.Error())
+	}
+	return fmt.Errorf("%T can not be sent to other nodes: %s", msg, err.Error())
+}
+
+// encodable holds the types of the messages checkSendable has already
+// found can be encoded.
+var encodable = struct {
+	types map[reflect.Type]voidtype
+	sync.RWMutex
+}{types: make(map[reflect.Type]voidtype)}
+
+// checkSendable is checkEncodable for a message on its way to a remote
+// mailbox, which only encodes the first message of each type that can be
+// sent, rather than every message. Those that can't are checked every
+// time, as their type may be registered later.
+//
+// This only catches a message whose own type is the problem; one that
+// holds an unregistered type in a field of interface type is caught for
+// the first value of its type, at most. Any others still fail when they
+// are written to the connection, which logs the error and drops them.
+//
+// The first message of each type that can be sent also has its
+// WireWarnings logged.
+func checkSendable(msg interface{}, log ClusterLogger) error {
+	switch wrapped := msg.(type) {
+	case nil:
+		return nil
+	case expiringMessage:
+		return checkSendable(wrapped.message, log)
+	case relayedMessage:
+		// This arrived from another node, so it decoded just fine.
+		return nil
+	case reliableMessage:
+		return checkSendable(wrapped.message, log)
+	case compressedMessage:
+		return checkSendable(wrapped.message, log)
+	case retriedMessage:
+		return checkSendable(wrapped.message, log)
+	}
+
+	t := reflect.TypeOf(msg)
+	encodable.RLock()
+	_, known := encodable.types[t]
+	encodable.RUnlock()
+	if known {
+		return nil
+	}
+
+	if err := checkEncodable(msg); err != nil {
+		return err
+	}
+	warnLossy(msg, log)
+	encodable.Lock()
+	encodable.types[t] = void
+	encodable.Unlock()
+	return nil
+}
+
+// checkWireTypes checks that everything reign itself sends to other nodes
+// can be encoded, so a type that was never registered with gob fails the
+// cluster's creation rather than its first send.
+func checkWireTypes() error {
+	for _, wireType := range internal.WireTypes {
+		cm, isClusterMessage := wireType.(internal.ClusterMessage)
+		if !isClusterMessage {
+			if err := checkEncodable(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		err := gob.NewEncoder(ioutil.Discard).Encode(&cm)
+		if err != nil {
+			return fmt.Errorf("cluster message %T can not be sent: %s", cm, err.Error())
+		}
+	}
+
+	// Addresses marshal themselves, and that takes a running cluster, so
+	// the samples use one with nothing to look up.
+	addr := Address{mailbox: noMailbox{}}
+	for _, msg := range []interface{}{
+		&MultipleClaim{Claimants: []Address{addr}},
+		&Registered{Address: addr},
+		&Unregistered{Address: addr},
+		MailboxTerminated(0),
+		TerminatedWithReason{},
+	} {
+		if err := checkEncodable(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NoClustering is called to say you have no interest in clustering.
 //
 // This configures reign to work in a no-clustering state. You can use
 // all mailbox functionality, and there will be no network activity or
 // configuration required.
+//
+// This is the same as NewLocalOnly.
 func NoClustering() (ConnectionService, Names) {
 	return noClustering(NullLogger)
 }
 
-func noClustering(log ClusterLogger) (cs *connectionServer, r *registry) {
+// NewLocalOnly creates a single node that is not part of any cluster, for
+// using reign purely as an in-process actor library, or for testing
+// application code without a cluster.
+//
+// No specification, certificates, or DNS resolution are involved, and no
+// sockets are ever opened. Mailboxes, Addresses, and the registry all
+// work exactly as they do in a cluster; every Address is simply local.
+// The node is node 0, so moving to a cluster later only requires
+// replacing this call with one of the CreateFrom* functions.
+//
+// As with the other constructors, the returned ConnectionService should
+// be run with Serve, or added to a supervisor, for the registry to work.
+func NewLocalOnly() (ConnectionService, Names) {
+	return noClustering(NullLogger)
+}
+
+func noClustering(log ClusterLogger) (*connectionServer, *registry) {
+	if connections != nil {
+		panic("redefining the cluster is not permitted")
+	}
+
 	nodeID := NodeID(0)
-	clusterSpec := &ClusterSpec{
-		Nodes: []*NodeDefinition{
-			&NodeDefinition{
-				ID:      nodeID,
-				Address: "127.0.0.1:65530",
-			},
-		},
+	thisNode := &NodeDefinition{ID: nodeID}
+	cluster := &Cluster{
+		Nodes:         map[NodeID]*NodeDefinition{nodeID: thisNode},
+		ThisNode:      thisNode,
+		ClusterLogger: resolveLog(log),
 	}
 
-	cs, r, _ = createFromSpec(clusterSpec, nodeID, log)
+	cs := newConnections(cluster, nodeID)
+	setConnections(cs)
 
-	return
+	return cs, cs.registry
 }
 
 func setConnections(c *connectionServer) {
@@ -272,8 +811,10 @@ func CreateFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (cs C
 func (c *Cluster) tlsConfig(serverNode NodeID) *tls.Config {
 	var tlsConfig = new(tls.Config)
 
+	c.tlsL.RLock()
 	tlsConfig.RootCAs = c.RootCAs
 	tlsConfig.Certificates = []tls.Certificate{c.Certificate}
+	c.tlsL.RUnlock()
 	tlsConfig.CipherSuites = c.PermittedProtocols
 	tlsConfig.SessionTicketsDisabled = true
 	tlsConfig.MinVersion = tls.VersionTLS12
@@ -282,6 +823,86 @@ func (c *Cluster) tlsConfig(serverNode NodeID) *tls.Config {
 	return tlsConfig
 }
 
+// parseNodeCertificate parses the leaf of the given certificate, and checks
+// that it belongs to the given node.
+func parseNodeCertificate(cert tls.Certificate, node NodeID) (*x509.Certificate, error) {
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if nodeID := fmt.Sprintf("%d", node); x509Cert.Subject.CommonName != nodeID {
+		return nil, fmt.Errorf("The current node ID (%s) does not match the certificate's common name (%s)", nodeID, x509Cert.Subject.CommonName)
+	}
+	return x509Cert, nil
+}
+
+// ReloadTLS replaces this node's certificate, and optionally the pool of
+// cluster certificates it trusts, for all the connections made from now
+// on. Connections that are already up carry on with what they negotiated,
+// so rotating certificates doesn't drop any links.
+//
+// The first certificate in cfg.Certificates becomes this node's
+// certificate; if cfg.RootCAs is nil, the current pool is kept. Nothing
+// else in the config is used. If the certificate has no private key,
+// isn't for this node, or isn't signed by a certificate in the pool, an
+// error is returned and the current configuration is left alone.
+func (cs *connectionServer) ReloadTLS(cfg *tls.Config) error {
+	if cfg == nil || len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return errors.New("no certificate to reload")
+	}
+	cert := cfg.Certificates[0]
+	if cert.PrivateKey == nil {
+		return errors.New("the certificate has no private key")
+	}
+
+	leaf, err := parseNodeCertificate(cert, cs.ThisNode.ID)
+	if err != nil {
+		return err
+	}
+
+	cs.tlsL.Lock()
+	defer cs.tlsL.Unlock()
+
+	roots := cfg.RootCAs
+	if roots == nil {
+		roots = cs.RootCAs
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if intermediate, parseErr := x509.ParseCertificate(der); parseErr == nil {
+			intermediates.AddCert(intermediate)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("the certificate is not trusted by the cluster: %s", err)
+	}
+
+	cs.Certificate = cert
+	cs.RootCAs = roots
+	cs.Infof("Reloaded the TLS certificate for node %d", cs.ThisNode.ID)
+	return nil
+}
+
+// advertisedAddressProblem describes what is wrong with advertising the
+// given address to the other nodes while listening on a different one,
+// or returns "" if it looks like something they can dial.
+func advertisedAddressProblem(advertised, listen *net.TCPAddr) string {
+	switch {
+	case advertised.IP == nil || advertised.IP.IsUnspecified():
+		return fmt.Sprintf("has the unspecified address %s, which the other nodes can not dial; it must be the address they reach it on",
+			advertised)
+	case advertised.IP.IsLoopback() && !listen.IP.IsLoopback():
+		return fmt.Sprintf("has the loopback address %s, but listens on %s; the other nodes can only reach it on an address for that interface",
+			advertised, listen)
+	}
+	return ""
+}
+
 func resolveLog(cl ClusterLogger) ClusterLogger {
 	if cl == nil {
 		return StdLogger
@@ -305,9 +926,18 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 		errs = append(errs, "no nodes specified in cluster definition")
 	}
 
+	seenNodes := map[NodeID]bool{}
 	log.Info("beginning DNS resolution (if you don't see DNS resolution completed, suspect DNS issues)")
 	for _, nodeDef := range spec.Nodes {
+		if seenNodes[nodeDef.ID] {
+			errs = append(errs, fmt.Sprintf("node %d is defined more than once", byte(nodeDef.ID)))
+		}
+		seenNodes[nodeDef.ID] = true
 		log.Infof("About to try to resolve: %s", nodeDef.Address)
+		altListen := nodeDef.AlternateListenAddresses
+		if nodeDef.ListenAddress == "" && altListen == nil {
+			altListen = nodeDef.AlternateAddresses
+		}
 		if nodeDef.Address == "" {
 			errs = append(errs, fmt.Sprintf("node %d has empty or missing address", byte(nodeDef.ID)))
 		} else {
@@ -329,6 +959,11 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 				nodeDef.listenaddr = addr
 			}
 		}
+		if nodeDef.ipaddr != nil && nodeDef.listenaddr != nil && nodeDef.ListenAddress != nodeDef.Address {
+			if problem := advertisedAddressProblem(nodeDef.ipaddr, nodeDef.listenaddr); problem != "" {
+				errs = append(errs, fmt.Sprintf("node %d %s", byte(nodeDef.ID), problem))
+			}
+		}
 		if nodeDef.LocalAddress != "" {
 			addr, err := net.ResolveTCPAddr("tcp", nodeDef.LocalAddress)
 			if err != nil {
@@ -337,6 +972,29 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 				nodeDef.localaddr = addr
 			}
 		}
+		nodeDef.altipaddrs = nil
+		for _, alternate := range nodeDef.AlternateAddresses {
+			addr, err := net.ResolveTCPAddr("tcp", alternate)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("node %d has invalid alternate address: %s", byte(nodeDef.ID), err.Error()))
+			} else {
+				nodeDef.altipaddrs = append(nodeDef.altipaddrs, addr)
+			}
+		}
+		nodeDef.altlistenaddrs = nil
+		for _, alternate := range altListen {
+			addr, err := net.ResolveTCPAddr("tcp", alternate)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("node %d has invalid alternate listen address: %s", byte(nodeDef.ID), err.Error()))
+			} else {
+				nodeDef.altlistenaddrs = append(nodeDef.altlistenaddrs, addr)
+			}
+		}
+		for _, name := range nodeDef.DeniedTypes {
+			if name == "" {
+				errs = append(errs, fmt.Sprintf("node %d has an empty denied type", byte(nodeDef.ID)))
+			}
+		}
 	}
 	log.Info("DNS resolution completed")
 
@@ -354,13 +1012,187 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 		permittedProtocols = defaultPermittedProtocols
 	}
 
+	instance := spec.Instance
+	if len(instance) > maxInstanceLength {
+		errs = append(errs, fmt.Sprintf("instance can not be longer than %d bytes", maxInstanceLength))
+	}
+	if instance == "" {
+		instance = defaultInstance()
+	}
+	if size := metadataSize(spec.Metadata); size > maxMetadataSize {
+		errs = append(errs, fmt.Sprintf("metadata can not be more than %d bytes, but is %d", maxMetadataSize, size))
+	}
+
+	if spec.OutgoingQueueLimit < 0 {
+		errs = append(errs, "outgoing queue limit can not be negative")
+	}
+	var overflowPolicy OverflowPolicy
+	if spec.OutgoingQueuePolicy != "" {
+		policy, exists := overflowPolicies[spec.OutgoingQueuePolicy]
+		if exists {
+			overflowPolicy = policy
+		} else {
+			errs = append(errs, fmt.Sprintf("Illegal outgoing queue policy: %s", spec.OutgoingQueuePolicy))
+		}
+	}
+
+	var maxAge time.Duration
+	if spec.OutgoingQueueMaxAge != "" {
+		age, err := time.ParseDuration(spec.OutgoingQueueMaxAge)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Illegal outgoing queue max age: %s", err.Error()))
+		} else if age < 0 {
+			errs = append(errs, "outgoing queue max age can not be negative")
+		} else {
+			maxAge = age
+		}
+	}
+
+	var maxSkew time.Duration
+	if spec.MaxClockSkew != "" {
+		skew, err := time.ParseDuration(spec.MaxClockSkew)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Illegal max clock skew: %s", err.Error()))
+		} else if skew < 0 {
+			errs = append(errs, "max clock skew can not be negative")
+		} else {
+			maxSkew = skew
+		}
+	}
+
+	if spec.EncodeWorkers < 0 {
+		errs = append(errs, "encode workers can not be negative")
+	} else if spec.EncodeWorkers > maxEncodeWorkers {
+		errs = append(errs, fmt.Sprintf("encode workers can not be more than %d", maxEncodeWorkers))
+	}
+
+	if spec.IncomingRateLimit < 0 {
+		errs = append(errs, "incoming rate limit can not be negative")
+	}
+	if spec.IncomingRateBurst < 0 {
+		errs = append(errs, "incoming rate burst can not be negative")
+	}
+	var rateLimitPolicy RateLimitPolicy
+	if spec.IncomingRatePolicy != "" {
+		policy, exists := rateLimitPolicies[spec.IncomingRatePolicy]
+		if exists {
+			rateLimitPolicy = policy
+		} else {
+			errs = append(errs, fmt.Sprintf("Illegal incoming rate policy: %s", spec.IncomingRatePolicy))
+		}
+	}
+
+	if spec.MaxHops < 0 {
+		errs = append(errs, "max hops can not be negative")
+	} else if spec.MaxHops > 255 {
+		errs = append(errs, "max hops can not be more than 255")
+	}
+
+	var misroutedPolicy MisroutedPolicy
+	if spec.MisroutedPolicy != "" {
+		policy, exists := misroutedPolicies[spec.MisroutedPolicy]
+		if exists {
+			misroutedPolicy = policy
+		} else {
+			errs = append(errs, fmt.Sprintf("Illegal misrouted policy: %s", spec.MisroutedPolicy))
+		}
+	}
+
+	var registryMode RegistryMode
+	if spec.RegistryMode != "" {
+		mode, exists := registryModes[spec.RegistryMode]
+		if exists {
+			registryMode = mode
+		} else {
+			errs = append(errs, fmt.Sprintf("Illegal registry mode: %s", spec.RegistryMode))
+		}
+	}
+
+	var idleTimeout time.Duration
+	if spec.LinkIdleTimeout != "" {
+		timeout, err := time.ParseDuration(spec.LinkIdleTimeout)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Illegal link idle timeout: %s", err.Error()))
+		} else if timeout < 0 {
+			errs = append(errs, "link idle timeout can not be negative")
+		} else {
+			idleTimeout = timeout
+		}
+	}
+
+	var dedupWindow time.Duration
+	if spec.ReliableDedupWindow != "" {
+		window, err := time.ParseDuration(spec.ReliableDedupWindow)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("Illegal reliable dedup window: %s", err.Error()))
+		} else if window < 0 {
+			errs = append(errs, "reliable dedup window can not be negative")
+		} else {
+			dedupWindow = window
+		}
+	}
+
+	if spec.ReliableDedupLimit < 0 {
+		errs = append(errs, "reliable dedup limit can not be negative")
+	}
+
+	if spec.EventLogSize < 0 {
+		errs = append(errs, "event log size can not be negative")
+	}
+
+	var earlyMessagePolicy EarlyMessagePolicy
+	if spec.EarlyMessagePolicy != "" {
+		policy, exists := earlyMessagePolicies[spec.EarlyMessagePolicy]
+		if exists {
+			earlyMessagePolicy = policy
+		} else {
+			errs = append(errs, fmt.Sprintf("Illegal early message policy: %s", spec.EarlyMessagePolicy))
+		}
+	}
+
 	cluster := &Cluster{
-		PermittedProtocols: permittedProtocols,
+		PermittedProtocols:  permittedProtocols,
+		Namespace:           spec.Namespace,
+		Instance:            instance,
+		Metadata:            copyMetadata(spec.Metadata),
+		OutgoingQueueLimit:  spec.OutgoingQueueLimit,
+		OutgoingQueuePolicy: overflowPolicy,
+		OutgoingQueueMaxAge: maxAge,
+		FailFastSends:       spec.FailFastSends,
+		MaxClockSkew:        maxSkew,
+		EncodeWorkers:       spec.EncodeWorkers,
+		IncomingRateLimit:   spec.IncomingRateLimit,
+		IncomingRateBurst:   spec.IncomingRateBurst,
+		IncomingRatePolicy:  rateLimitPolicy,
+		MaxHops:             spec.MaxHops,
+		MisroutedPolicy:     misroutedPolicy,
+		RegistryMode:        registryMode,
+		LinkIdleTimeout:     idleTimeout,
+		ReliableDedupWindow: dedupWindow,
+		ReliableDedupLimit:  spec.ReliableDedupLimit,
+		EventLogSize:        spec.EventLogSize,
+		EarlyMessagePolicy:  earlyMessagePolicy,
+		Dialer:              spec.Dialer,
 	}
 	var cert tls.Certificate
 	var err error
 
-	if spec.NodeKeyPath != "" && spec.NodeCertPath != "" {
+	if spec.DevelopmentMode {
+		errs = append(errs, loopbackErrors(spec.Nodes)...)
+		if spec.NodeKeyPath != "" || spec.NodeCertPath != "" ||
+			spec.NodeKeyPEM != "" || spec.NodeCertPEM != "" ||
+			spec.ClusterCertPath != "" || spec.ClusterCertPEM != "" {
+			errs = append(errs, "development mode can not be used with certificates")
+		}
+		var pool *x509.CertPool
+		cert, pool, err = developmentCertificates(thisNode)
+		if err != nil {
+			errs = append(errs, "Error creating the development certificates: "+err.Error())
+		}
+		cluster.Certificate = cert
+		cluster.RootCAs = pool
+		log.Warn("cluster is in development mode; this is not secure, and only works for nodes within this process")
+	} else if spec.NodeKeyPath != "" && spec.NodeCertPath != "" {
 		cert, err = tls.LoadX509KeyPair(spec.NodeCertPath, spec.NodeKeyPath)
 		if err != nil {
 			errs = append(errs, "Error from loading the node cert from the disk: "+err.Error())
@@ -381,11 +1213,8 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 
 	// Validate the cert's node is the common name for the cert
 	if len(cert.Certificate) > 0 {
-		x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
+		if _, err := parseNodeCertificate(cert, thisNode); err != nil {
 			errs = append(errs, err.Error())
-		} else if nodeID := fmt.Sprintf("%d", thisNode); x509Cert.Subject.CommonName != nodeID {
-			errs = append(errs, fmt.Sprintf("The current node ID (%s) does not match the certificate's common name (%s)", nodeID, x509Cert.Subject.CommonName))
 		}
 	}
 
@@ -399,7 +1228,9 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 	} else if spec.ClusterCertPEM != "" {
 		clusterCertPEM = []byte(spec.ClusterCertPEM)
 	}
-	if clusterCertPEM != nil {
+	if spec.DevelopmentMode {
+		// RootCAs was set along with the development certificate.
+	} else if clusterCertPEM != nil {
 		// assume the CERT is the first block
 		certDERBlock, _ := pem.Decode(clusterCertPEM)
 		if certDERBlock == nil {
@@ -452,6 +1283,11 @@ func createFromSpec(spec *ClusterSpec, thisNode NodeID, log ClusterLogger) (*con
 		)
 	}
 
+	err = checkWireTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	cluster.ClusterLogger = log
 
 	connectionServer := newConnections(cluster, thisNode)
@@ -512,3 +1348,50 @@ func (c *Cluster) changeConnectionStatus(node NodeID, connected bool) {
 		callback(node, connected)
 	}
 }
+
+// OnLinkReady registers a callback to be called each time a connection to
+// a node becomes fully usable: the handshakes are done, the protocol
+// version is agreed on, and the registries have been synchronized. It is
+// called exactly once per connection, after messages can be sent over it,
+// so this is the place to re-announce anything the other node needs to
+// know after a reconnect.
+//
+// The callback is called by the goroutine that reads from the connection,
+// before it starts reading, so it must not wait on a reply from that
+// node. Sending is fine.
+//
+// As with AddConnectionStatusCallback, callbacks should be added before
+// the cluster is started, and can not be removed.
+func (c *Cluster) OnLinkReady(f func(NodeID)) {
+	c.linkReadyCallbacks = append(c.linkReadyCallbacks, f)
+}
+
+func (c *Cluster) linkReady(node NodeID) {
+	for _, callback := range c.linkReadyCallbacks {
+		callback(node)
+	}
+}
+
+// OnNodeDownFanout registers a callback to be called each time the local
+// mailboxes linked to mailboxes on a node have been sent
+// MailboxTerminated because the node went down, with how many
+// notifications were sent. This happens once the connection has been
+// down for LinkGracePeriod, or when the cluster shuts down, and the
+// callback is called once, after all of them have been sent, so a node
+// going down shows up as one event rather than as scattered activity in
+// thousands of mailboxes. It is not called if nothing was linked.
+//
+// The callback is called by the goroutine that handles the traffic with
+// that node, so it should return promptly.
+//
+// As with AddConnectionStatusCallback, callbacks should be added before
+// the cluster is started, and can not be removed.
+func (c *Cluster) OnNodeDownFanout(f func(node NodeID, notified int)) {
+	c.nodeDownFanoutCallbacks = append(c.nodeDownFanoutCallbacks, f)
+}
+
+func (c *Cluster) nodeDownFanout(node NodeID, notified int) {
+	for _, callback := range c.nodeDownFanoutCallbacks {
+		callback(node, notified)
+	}
+}
@@ -1,12 +1,17 @@
 package reign
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/thejerf/reign/internal"
 )
 
 func jsonbytes(b []byte) string {
@@ -136,9 +141,25 @@ func TestJSONSpecErrors(t *testing.T) {
         "1": {},
         "2": {"address": "localhost", "local_address": "127.0.0.2:10000"},
         "3": {"address": "localhost", "listen_address": "‽", "local_address": "‽"},
-        "4": {"address": "288.88.222.8888"}
+        "4": {"address": "288.88.222.8888"},
+        "5": {"address": "localhost", "denied_types": [""]}
     },
     "permitted_protocols": ["TLS_RSA_WITH_RC4_128_SHA", "TLS_SOMETHING_ACTUALLY_SECURE"],
+    "outgoing_queue_limit": -1,
+    "outgoing_queue_policy": "drop_everything",
+    "outgoing_queue_max_age": "forever",
+    "max_clock_skew": "-1s",
+    "encode_workers": -1,
+    "incoming_rate_limit": -1,
+    "incoming_rate_burst": -1,
+    "incoming_rate_policy": "ignore",
+    "max_hops": 256,
+    "misrouted_policy": "reroute",
+    "registry_mode": "eventual",
+    "link_idle_timeout": "a while",
+    "reliable_dedup_window": "-1m",
+    "event_log_size": -1,
+    "early_message_policy": "maybe",
     "node_key_path": "` + node1_1KeyFile + `",
     "node_cert_path": "` + node1_1CertFile + `",
     "cluster_cert_path": "` + clusterCert + `"
@@ -189,6 +210,14 @@ func TestJSONSpecErrors(t *testing.T) {
 		t.Fatal("Unexpectedly successful cluster creation #1")
 	}
 
+	nodeErrors = []byte(`{
+    "nodes": [{"id": 1, "address": "127.0.0.1:29876"}, {"id": 1, "address": "127.0.0.1:29877"}]
+    }`)
+	cluster, _, err = createFromJSON(nodeErrors, 1, NullLogger)
+	if cluster != nil || err == nil || !strings.Contains(err.Error(), "node 1 is defined more than once") {
+		t.Fatal("Duplicate node IDs were accepted:", err)
+	}
+
 	nodeErrors = []byte(`{
     "nodes": {"0": {}, "1": {}}
     }`)
@@ -198,6 +227,70 @@ func TestJSONSpecErrors(t *testing.T) {
 	}
 }
 
+func TestAdvertisedAddress(t *testing.T) {
+	defer setConnections(nil)
+
+	for _, tc := range []struct {
+		address, listen string
+		problem         string
+	}{
+		// listening on every interface, for addresses that are NATed to it
+		{"10.1.2.3:29876", "0.0.0.0:29876", ""},
+		{"10.1.2.3:80", ":29876", ""},
+		{"127.0.0.1:29876", "127.0.0.2:29876", ""},
+		{"0.0.0.0:29876", "127.0.0.1:29876", "node 1 has the unspecified address 0.0.0.0:29876"},
+		{"127.0.0.1:29876", "0.0.0.0:29876", "node 1 has the loopback address 127.0.0.1:29876, but listens on 0.0.0.0:29876"},
+	} {
+		setConnections(nil)
+		spec := testSpec()
+		spec.NodeKeyPEM = string(node1_1Key)
+		spec.NodeCertPEM = string(node1_1Cert)
+		spec.Nodes[0].Address = tc.address
+		spec.Nodes[0].ListenAddress = tc.listen
+
+		_, _, err := createFromSpec(spec, 1, NullLogger)
+		if tc.problem == "" && err != nil {
+			t.Fatalf("%s listening on %s was rejected: %s", tc.address, tc.listen, err)
+		}
+		if tc.problem != "" && (err == nil || !strings.Contains(err.Error(), tc.problem)) {
+			t.Fatalf("%s listening on %s was not rejected properly: %v", tc.address, tc.listen, err)
+		}
+	}
+}
+
+type wireable struct {
+	Value int
+}
+
+func TestRegisterMessageType(t *testing.T) {
+	if err := checkWireTypes(); err != nil {
+		t.Fatal("reign's own messages can't be sent:", err)
+	}
+	// Everything on the wire is decoded as a pointer, which the handlers
+	// must never see.
+	for _, wireType := range internal.WireTypes {
+		cm, isClusterMessage := wireType.(internal.ClusterMessage)
+		if !isClusterMessage {
+			cm = &internal.IncomingMailboxMessage{Message: wireType}
+		}
+		normalized := interface{}(internal.Normalize(cm))
+		if !isClusterMessage {
+			normalized = normalized.(internal.IncomingMailboxMessage).Message
+		}
+		if reflect.TypeOf(normalized).Kind() == reflect.Ptr {
+			t.Fatalf("%T is not normalized", wireType)
+		}
+	}
+
+	if err := RegisterMessageType(&wireable{}); err != nil {
+		t.Fatal("Could not register a sendable type:", err)
+	}
+	err := RegisterMessageType(B{})
+	if err == nil || !strings.Contains(err.Error(), "reign.B can not be sent") {
+		t.Fatal("Type with no exported fields registered:", err)
+	}
+}
+
 func TestCoverNoClustering(t *testing.T) {
 	NoClustering()
 	connections.Terminate()
@@ -207,6 +300,97 @@ func TestCoverNoClustering(t *testing.T) {
 	}
 }
 
+func TestNewLocalOnly(t *testing.T) {
+	connectionService, names := NewLocalOnly()
+	cs := connectionService.(*connectionServer)
+	defer cs.Terminate()
+
+	if cs.listener != nil || len(cs.remoteMailboxes) != 0 || len(cs.nodeConnectors) != 0 {
+		t.Fatal("Local-only node is set up to talk to other nodes")
+	}
+
+	go cs.Serve()
+	defer cs.Stop()
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+
+	names.Register("local", addr)
+	names.Sync()
+	if err := names.Lookup("local").Send("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := mbox.ReceiveNext(); msg != "hello" {
+		t.Fatal("Received the wrong message:", msg)
+	}
+
+	// Addresses still marshal, and come back as the same mailbox.
+	text, err := addr.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshaled Address
+	if err = unmarshaled.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !unmarshaled.Equal(addr) {
+		t.Fatal("Unmarshaled address is not the original")
+	}
+}
+
+func TestReloadTLS(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	original := ntb.c1.tlsConfig(2).Certificates[0]
+
+	devCert, devPool, err := developmentCertificates(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongNode, _, err := developmentCertificates(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noKey := node1_1
+	noKey.PrivateKey = nil
+
+	for _, bad := range []*tls.Config{
+		nil,
+		&tls.Config{},
+		&tls.Config{Certificates: []tls.Certificate{noKey}},
+		&tls.Config{Certificates: []tls.Certificate{wrongNode}, RootCAs: devPool},
+		// not signed by the current cluster certificate
+		&tls.Config{Certificates: []tls.Certificate{devCert}},
+	} {
+		if ntb.c1.ReloadTLS(bad) == nil {
+			t.Fatalf("Reloaded a bad configuration: %#v", bad)
+		}
+		current := ntb.c1.tlsConfig(2).Certificates[0]
+		if !bytes.Equal(current.Certificate[0], original.Certificate[0]) {
+			t.Fatal("Bad configuration replaced the certificate")
+		}
+	}
+
+	err = ntb.c1.ReloadTLS(&tls.Config{
+		Certificates: []tls.Certificate{devCert},
+		RootCAs:      devPool,
+	})
+	if err != nil {
+		t.Fatal("Could not reload:", err)
+	}
+	config := ntb.c1.tlsConfig(2)
+	if !bytes.Equal(config.Certificates[0].Certificate[0], devCert.Certificate[0]) || config.RootCAs != devPool {
+		t.Fatal("Reload did not take effect")
+	}
+
+	// The existing link is unaffected.
+	ntb.rem1_2.Send("still connected")
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "still connected" {
+		t.Fatal("Existing connection did not survive the reload:", msg)
+	}
+}
+
 func TestResolveLog(t *testing.T) {
 	t.Parallel()
 
@@ -247,3 +431,41 @@ func tmpFile(prefix string, contents []byte) (string, func()) {
 		}
 	}
 }
+
+func TestDevelopmentMode(t *testing.T) {
+	spec := testSpec()
+	spec.ClusterCertPEM = ""
+	spec.DevelopmentMode = true
+
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	ntb.rem1_2.Send("hello")
+	msg := ntb.mailbox1_2.ReceiveNext()
+	if msg != "hello" {
+		t.Fatal("Could not send a message in development mode:", msg)
+	}
+
+	// Development mode refuses to run on anything but loopback.
+	setConnections(nil)
+	spec = &ClusterSpec{
+		Nodes: []*NodeDefinition{
+			{ID: NodeID(1), Address: "127.0.0.1:29876"},
+			{ID: NodeID(2), Address: "10.2.8.33:90"},
+		},
+		DevelopmentMode: true,
+	}
+	_, _, err := createFromSpec(spec, 1, NullLogger)
+	if err == nil || !strings.Contains(err.Error(), "loopback") {
+		t.Fatal("Development mode permitted a non-loopback address:", err)
+	}
+
+	// and it won't be mixed up with real certificates.
+	spec = testSpec()
+	spec.DevelopmentMode = true
+	_, _, err = createFromSpec(spec, 1, NullLogger)
+	if err == nil {
+		t.Fatal("Development mode permitted a cluster certificate")
+	}
+	setConnections(nil)
+}
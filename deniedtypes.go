@@ -0,0 +1,89 @@
+package reign
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDeniedType is returned when sending a message of a type that the
+// remote node's NodeDefinition lists in its DeniedTypes.
+var ErrDeniedType = errors.New("the message's type may not be sent to the remote node")
+
+// deniedTypeSet makes the set of the DeniedTypes of the given node, which
+// is nil if it has none.
+func deniedTypeSet(node *NodeDefinition) map[string]voidtype {
+	if node == nil || len(node.DeniedTypes) == 0 {
+		return nil
+	}
+	denied := make(map[string]voidtype, len(node.DeniedTypes))
+	for _, name := range node.DeniedTypes {
+		denied[name] = void
+	}
+	return denied
+}
+
+// deniedType returns whether the message may not cross the link with the
+// remote node, and if so, the name of the type that is denied. The
+// wrappers the message may be queued in are looked through, as is an
+// Envelope, whose Message is denied as if it had been sent on its own.
+func (rm *remoteMailboxes) deniedType(msg interface{}) (string, bool) {
+	if rm.deniedTypes == nil {
+		return "", false
+	}
+	msg = unwrapQueued(msg)
+	for {
+		name := fmt.Sprintf("%T", msg)
+		if _, denied := rm.deniedTypes[name]; denied {
+			return name, true
+		}
+		switch envelope := msg.(type) {
+		case Envelope:
+			msg = envelope.Message
+		case *Envelope:
+			if envelope == nil {
+				return "", false
+			}
+			msg = envelope.Message
+		default:
+			return "", false
+		}
+	}
+}
+
+func unwrapQueued(msg interface{}) interface{} {
+	switch wrapped := msg.(type) {
+	case expiringMessage:
+		return unwrapQueued(wrapped.message)
+	case relayedMessage:
+		return unwrapQueued(wrapped.message)
+	case reliableMessage:
+		return unwrapQueued(wrapped.message)
+	case compressedMessage:
+		return unwrapQueued(wrapped.message)
+	case retriedMessage:
+		return unwrapQueued(wrapped.message)
+	}
+	return msg
+}
+
+// denySend returns ErrDeniedType if the message may not be sent to the
+// remote node, logging that it was dropped.
+func (rm *remoteMailboxes) denySend(msg interface{}, kind string) error {
+	name, denied := rm.deniedType(msg)
+	if !denied {
+		return nil
+	}
+	rm.Warnf("Dropping a %s of type %s for node %d, which it may not be sent", kind, name, rm.remoteNode)
+	return &SendError{Node: rm.remoteNode, Err: ErrDeniedType}
+}
+
+// denyReceive returns whether the message from the remote node is of a
+// type it may not send, logging that it was dropped.
+func (rm *remoteMailboxes) denyReceive(msg interface{}, kind string) bool {
+	name, denied := rm.deniedType(msg)
+	if denied {
+		rm.Warnf("Dropping a %s of type %s from node %d, which it may not send", kind, name, rm.remoteNode)
+		rm.connectionServer.dropped(DropFiltered, rm.remoteNode, 1)
+	}
+	return denied
+}
@@ -0,0 +1,64 @@
+package reign
+
+import (
+	"testing"
+	"time"
+)
+
+type privileged struct {
+	Order string
+}
+
+func init() {
+	RegisterType(privileged{})
+}
+
+func TestDeniedTypes(t *testing.T) {
+	spec := testSpec()
+	spec.Nodes[1].DeniedTypes = []string{"reign.privileged"}
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	isDenied := func(err error) bool {
+		sendErr, isSendErr := err.(*SendError)
+		return isSendErr && sendErr.Err == ErrDeniedType && sendErr.Node == 2
+	}
+
+	// Node 1 won't send them to node 2...
+	if err := ntb.rem1_2.Send(privileged{"shutdown"}); !isDenied(err) {
+		t.Fatal("Denied message was sent:", err)
+	}
+	if err := ntb.rem1_2.SendWithDeadline(privileged{"shutdown"}, time.Now().Add(time.Hour)); !isDenied(err) {
+		t.Fatal("Denied message with a deadline was sent:", err)
+	}
+	if err := ntb.c1.SendControl(2, privileged{"shutdown"}); !isDenied(err) {
+		t.Fatal("Denied control message was sent:", err)
+	}
+	if err := ntb.rem1_2.SendWithReply(privileged{"shutdown"}, ntb.addr1_1); !isDenied(err) {
+		t.Fatal("Denied message in an Envelope was sent:", err)
+	}
+	if err := ntb.rem1_2.Send(&Envelope{Message: Envelope{Message: privileged{"shutdown"}}}); !isDenied(err) {
+		t.Fatal("Denied message in nested Envelopes was sent:", err)
+	}
+	if err := ntb.rem1_2.Send("allowed"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "allowed" {
+		t.Fatal("Unexpected message:", msg)
+	}
+
+	// ... and won't accept them from it, though node 2 has nothing
+	// against sending them.
+	if err := ntb.rem1_1.Send(privileged{"shutdown"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ntb.rem1_1.SendWithReply(privileged{"shutdown"}, ntb.addr1_1); err != nil {
+		t.Fatal(err)
+	}
+	if err := ntb.rem1_1.Send("allowed"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "allowed" {
+		t.Fatal("Denied message was received:", msg)
+	}
+}
@@ -0,0 +1,131 @@
+package reign
+
+// This file implements the development mode of the cluster, where the
+// certificates are generated on the fly so a cluster can be brought up
+// without any setup. See ClusterSpec.DevelopmentMode.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// The development CA is shared by every cluster node in the process, which
+// is what lets them all trust each other. It never leaves memory.
+var (
+	developmentCA     *x509.Certificate
+	developmentCAKey  *ecdsa.PrivateKey
+	developmentCAErr  error
+	developmentCAOnce sync.Once
+)
+
+func makeDevelopmentCA() {
+	developmentCAKey, developmentCAErr = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if developmentCAErr != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "reign development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * 365 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&developmentCAKey.PublicKey, developmentCAKey)
+	if err != nil {
+		developmentCAErr = err
+		return
+	}
+	developmentCA, developmentCAErr = x509.ParseCertificate(der)
+}
+
+// developmentCertificates mints a certificate for the given node from
+// the development CA, returning it along with a pool containing the CA.
+func developmentCertificates(node NodeID) (tls.Certificate, *x509.CertPool, error) {
+	developmentCAOnce.Do(makeDevelopmentCA)
+	if developmentCAErr != nil {
+		return tls.Certificate{}, nil, developmentCAErr
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	name := fmt.Sprintf("%d", node)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * 365 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, developmentCA,
+		&key.PublicKey, developmentCAKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(developmentCA)
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, pool, nil
+}
+
+// loopbackErrors returns a description of each node address in the
+// spec that is not on the loopback interface. Addresses that failed to
+// resolve are skipped, as they have already been reported.
+func loopbackErrors(nodes []*NodeDefinition) (errs []string) {
+	for _, nodeDef := range nodes {
+		addrs := []struct {
+			desc string
+			addr *net.TCPAddr
+		}{
+			{"address", nodeDef.ipaddr},
+			{"listen address", nodeDef.listenaddr},
+			{"local address", nodeDef.localaddr},
+		}
+		for _, addr := range nodeDef.altipaddrs {
+			addrs = append(addrs, struct {
+				desc string
+				addr *net.TCPAddr
+			}{"alternate address", addr})
+		}
+		for _, addr := range nodeDef.altlistenaddrs {
+			addrs = append(addrs, struct {
+				desc string
+				addr *net.TCPAddr
+			}{"alternate listen address", addr})
+		}
+		for _, a := range addrs {
+			if a.addr != nil && !a.addr.IP.IsLoopback() {
+				errs = append(errs, fmt.Sprintf(
+					"development mode requires loopback addresses, but node %d has %s %s",
+					byte(nodeDef.ID), a.desc, a.addr))
+			}
+		}
+	}
+	return
+}
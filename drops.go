@@ -0,0 +1,148 @@
+package reign
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// The reasons a message can be dropped, which DropStats and
+// MetricMessagesDropped break the drops down by.
+//
+// Only messages for mailboxes and control messages are counted, and only
+// once they're on their way; one that is refused when it is sent, with an
+// error returned to the sender, such as ErrMailboxFull or ErrDeniedType,
+// is not counted. Nor are reliable messages that fail to be sent, as they
+// are resent, and those passed to the UnroutableHandler that it handles.
+const (
+	// There was no connection to the remote node when the message's turn
+	// came to be sent.
+	DropNoConnection = "no_connection"
+
+	// The connection failed while the message was being written to it.
+	DropSendFailed = "send_failed"
+
+	// The message could not be encoded, usually because its type was
+	// never passed to RegisterType.
+	DropUnencodable = "unencodable"
+
+	// The message arrived from the remote node encoded ahead of time, for
+	// EncodeWorkers or SendCompressed, and could not be decoded, usually
+	// because its type was never passed to RegisterType on this node.
+	DropUndecodable = "undecodable"
+
+	// The message was discarded from a full outgoing queue by the
+	// OverflowDropOldest policy.
+	DropQueueFull = "queue_full"
+
+	// The message waited in the outgoing queue for longer than the
+	// OutgoingQueueMaxAge.
+	DropEvicted = "evicted"
+
+	// The message was still in the outgoing queue when the link was
+	// stopped.
+	DropAbandoned = "abandoned"
+
+	// The message's deadline passed while it waited, whether in the
+	// outgoing queue or in the mailbox; see SendWithDeadline.
+	DropExpired = "expired"
+
+	// The message went over the incoming rate limit, with the "drop"
+	// policy; see ClusterSpec.IncomingRateLimit.
+	DropRateLimited = "rate_limited"
+
+	// The message had been relayed more than ClusterSpec.MaxHops times.
+	DropLoopDetected = "loop_detected"
+
+	// The message arrived for a mailbox on another node, which this node
+	// doesn't relay to, or which is not in the cluster; see
+	// ClusterSpec.MisroutedPolicy.
+	DropMisrouted = "misrouted"
+
+	// The message arrived for a mailbox that has terminated.
+	DropUnroutable = "unroutable"
+
+	// The message arrived for a mailbox that refused it, because its
+	// MailboxStore returned an error; see NewMailboxWithStore.
+	DropRefused = "refused"
+
+	// A reliable message arrived again within the
+	// ClusterSpec.ReliableDedupWindow.
+	DropDuplicate = "duplicate"
+
+	// The message arrived with a type the remote node may not send,
+	// whether by ClusterSpec.DeniedTypes or carrying one of reign's own
+	// messages as a control message.
+	DropFiltered = "filtered"
+
+	// A control message arrived with no ControlHandler installed.
+	DropUnhandled = "unhandled"
+
+	// A control message was queued for a node that has since been
+	// replaced by one that doesn't support them.
+	DropUnsupported = "unsupported"
+)
+
+// dropCounter totals the dropped messages by reason.
+type dropCounter struct {
+	counts map[string]uint64
+	sync.Mutex
+}
+
+// dropped counts n messages dropped for the given reason, on their way
+// from or to the given node, or within it for this node.
+func (cs *connectionServer) dropped(reason string, node NodeID, n uint64) {
+	cs.drops.Lock()
+	if cs.drops.counts == nil {
+		cs.drops.counts = map[string]uint64{}
+	}
+	cs.drops.counts[reason] += n
+	cs.drops.Unlock()
+
+	if metrics := cs.metrics.get(); metrics != nil {
+		metrics.AddCounter(MetricMessagesDropped, map[string]string{
+			"node":   strconv.Itoa(int(node)),
+			"reason": reason,
+		}, n)
+	}
+}
+
+// DropStats returns how many messages this node has dropped since it
+// started, by reason; see DropNoConnection and the rest for the reasons.
+// Reasons nothing has been dropped for are left out.
+func (cs *connectionServer) DropStats() map[string]uint64 {
+	cs.drops.Lock()
+	defer cs.drops.Unlock()
+
+	stats := make(map[string]uint64, len(cs.drops.counts))
+	for reason, count := range cs.drops.counts {
+		stats[reason] = count
+	}
+	return stats
+}
+
+// unsent counts cm as dropped for failing to be sent to the remote node
+// with err, if it's one that DropStats counts: a message for a mailbox
+// that isn't reliable, or a control message. It's for the sends whose
+// errors aren't returned to anything that could do something about them.
+func (rm *remoteMailboxes) unsent(cm internal.ClusterMessage, err error) {
+	switch msg := cm.(type) {
+	case internal.IncomingMailboxMessage:
+		if msg.ReliableID != 0 {
+			return
+		}
+	case *internal.ControlMessage:
+	default:
+		return
+	}
+
+	reason := DropUnencodable
+	switch {
+	case err == ErrNoConnection:
+		reason = DropNoConnection
+	case IsRetryable(err):
+		reason = DropSendFailed
+	}
+	rm.connectionServer.dropped(reason, rm.remoteNode, 1)
+}
@@ -0,0 +1,131 @@
+package reign
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// awaitDrops waits for the node to have counted the given drops.
+func awaitDrops(t *testing.T, cs *connectionServer, expected map[string]uint64) {
+	var stats map[string]uint64
+	awaitCondition(t, func() bool {
+		stats = cs.DropStats()
+		matched := len(stats) == len(expected)
+		for reason, count := range expected {
+			if stats[reason] != count {
+				matched = false
+			}
+		}
+		return matched
+	}, func() string {
+		return fmt.Sprint("Wrong drops counted: ", stats, " expected ", expected)
+	})
+}
+
+func TestDropStats(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	metrics := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics)
+	ntb.c2.SetMetrics(metrics)
+
+	if stats := ntb.c2.DropStats(); len(stats) != 0 {
+		t.Fatal("Drops counted before any were made:", stats)
+	}
+
+	// What the UnroutableHandler takes isn't dropped.
+	ntb.mailbox1_2.Terminate()
+	ntb.c2.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		return msg == "handled"
+	})
+	ntb.rem1_2.Send("handled")
+	ntb.rem1_2.Send("unroutable")
+
+	ntb.remote2to1.Send(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_1.id),
+		Message: "looping",
+		Hops:    DefaultMaxHops,
+	})
+	awaitDrops(t, ntb.c2, map[string]uint64{
+		DropUnroutable:   1,
+		DropLoopDetected: 1,
+	})
+
+	ntb.addr1_1.SendWithDeadline("expired", time.Now().Add(-time.Second))
+	if msg, ok := ntb.mailbox1_1.ReceiveNextAsync(); ok {
+		t.Fatal("Expired message was received:", msg)
+	}
+	awaitDrops(t, ntb.c1, map[string]uint64{DropExpired: 1})
+
+	if n := metrics.counted(MetricMessagesDropped, map[string]string{
+		"reason": DropUnroutable,
+		"node":   "1",
+	}); n != 1 {
+		t.Fatal("Unroutable drop not in the metrics:", n)
+	}
+	if n := metrics.counted(MetricMessagesDropped, map[string]string{
+		"reason": DropExpired,
+		"node":   "1",
+	}); n != 1 {
+		t.Fatal("Expired drop not in the metrics:", n)
+	}
+
+	// The stats are a copy.
+	ntb.c1.DropStats()[DropExpired] = 10
+	awaitDrops(t, ntb.c1, map[string]uint64{DropExpired: 1})
+}
+
+func TestDropStatsNoConnection(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	rm := ntb.c1.remoteMailboxes[2]
+	rm.Lock()
+	conn := rm.connection
+	rm.connection = nil
+	rm.Unlock()
+	defer func() {
+		rm.Lock()
+		rm.connection = conn
+		rm.Unlock()
+	}()
+
+	rm.sendMessage(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_2.id),
+		Message: "lost",
+	})
+	// Reliable messages will be resent, so they aren't lost.
+	rm.sendMessage(internal.IncomingMailboxMessage{
+		Target:     internal.IntMailboxID(ntb.mailbox1_2.id),
+		Message:    "resent",
+		ReliableID: 1,
+	})
+	awaitDrops(t, ntb.c1, map[string]uint64{DropNoConnection: 1})
+}
+
+func TestDropStatsRefused(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// A store that's full, and one that can't encode what arrives.
+	capped, cappedMbox := ntb.c1.NewMailboxWithStore(&cappedStore{capacity: 1})
+	defer cappedMbox.Terminate()
+	sealed, sealedMbox := ntb.c1.NewMailboxWithStore(NewSealedStore(newMemoryStore(), testSealingKeys(t)))
+	defer sealedMbox.Terminate()
+
+	for _, msg := range []internal.IncomingMailboxMessage{
+		{Target: internal.IntMailboxID(capped.mailboxID), Message: "kept"},
+		{Target: internal.IntMailboxID(capped.mailboxID), Message: "refused"},
+		{Target: internal.IntMailboxID(sealed.mailboxID), Message: func() {}},
+	} {
+		ntb.remote1to2.Send(msg)
+	}
+	awaitDrops(t, ntb.c1, map[string]uint64{DropRefused: 2})
+	if msg, _ := cappedMbox.ReceiveNextAsync(); msg != "kept" {
+		t.Fatal("Wrong message kept:", msg)
+	}
+}
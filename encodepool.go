@@ -0,0 +1,330 @@
+package reign
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// maxEncodeWorkers caps ClusterSpec.EncodeWorkers, as the EncodeStream of
+// each worker is numbered by a byte.
+const maxEncodeWorkers = 255
+
+// An encodePool writes the messages for one connection, encoding those
+// for remote mailboxes on several goroutines at once, for
+// Cluster.EncodeWorkers.
+//
+// A gob stream can't be shared out between encoders, since the
+// description of each type is only written the first time it is used.
+// Instead, each worker encodes its messages for mailboxes into a stream of
+// its own, each part of which travels as the Encoded field of its
+// IncomingMailboxMessage, and everything is then written to the
+// connection by a single goroutine, in the order it was sent. A worker
+// takes its messages in the order they were sent, so the parts of its
+// stream arrive in order too, and the receiving node keeps a decoder for
+// each stream; see encodeStreams. Nodes older than protocol version 13
+// are sent each message encoded on its own instead.
+type encodePool struct {
+	// pending counts the messages sent that haven't been written yet. It
+	// comes first to be aligned for atomic access.
+	pending int64
+
+	rm   *remoteMailboxes
+	conn messageSender
+
+	// streams is whether the remote node takes EncodeStreams.
+	streams bool
+
+	// jobs holds the messages waiting for a worker to encode them, and
+	// frames everything waiting to be written, in order.
+	jobs   chan *encodeJob
+	frames chan *encodeJob
+
+	stopped chan struct{}
+	stop    sync.Once
+
+	// idleCond is broadcast on whenever pending falls to zero, and when
+	// the pool is stopped; see awaitIdle.
+	idleL    sync.Mutex
+	idleCond *sync.Cond
+}
+
+// An encodeJob is a message on its way through an encodePool.
+type encodeJob struct {
+	// cm is the message as it was sent, and wire the form it is written
+	// in, once encoded is closed.
+	cm      internal.ClusterMessage
+	wire    internal.ClusterMessage
+	desc    string
+	encoded chan struct{}
+	err     error
+
+	// written gets the result of the write, if the sender is waiting for
+	// it.
+	written chan error
+}
+
+// encodedMessage is the value that is gob-encoded for an Encoded
+// message; an interface value can't be encoded on its own.
+type encodedMessage struct {
+	Message interface{}
+}
+
+func encodeMessage(message interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(encodedMessage{message}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(encoded []byte) (interface{}, error) {
+	var em encodedMessage
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&em); err != nil {
+		return nil, err
+	}
+	return em.Message, nil
+}
+
+// A streamEncoder encodes one worker's messages as the parts of a single
+// gob stream.
+type streamEncoder struct {
+	buf bytes.Buffer
+	enc *gob.Encoder
+}
+
+// encode encodes the next part of the stream, returning whether it starts
+// a new one.
+func (se *streamEncoder) encode(message interface{}) ([]byte, bool, error) {
+	fresh := se.enc == nil
+	if fresh {
+		se.enc = gob.NewEncoder(&se.buf)
+	}
+	se.buf.Reset()
+	if err := se.enc.Encode(encodedMessage{message}); err != nil {
+		// The encoder may think it has described types that won't be
+		// sent, so the next message starts the stream over.
+		se.enc = nil
+		return nil, false, err
+	}
+	return append([]byte(nil), se.buf.Bytes()...), fresh, nil
+}
+
+// encodeStreams holds the decoders for the EncodeStreams arriving on one
+// connection. The zero value is ready to use.
+type encodeStreams struct {
+	decoders map[uint8]*streamDecoder
+}
+
+type streamDecoder struct {
+	buf bytes.Buffer
+	dec *gob.Decoder
+}
+
+// decode decodes the message from the next part of its stream.
+func (es *encodeStreams) decode(imm *internal.IncomingMailboxMessage) (interface{}, error) {
+	sd := es.decoders[imm.EncodeStream]
+	if imm.NewEncodeStream {
+		if es.decoders == nil {
+			es.decoders = map[uint8]*streamDecoder{}
+		}
+		sd = &streamDecoder{}
+		sd.dec = gob.NewDecoder(&sd.buf)
+		es.decoders[imm.EncodeStream] = sd
+	} else if sd == nil {
+		return nil, fmt.Errorf("encode stream %d was never started", imm.EncodeStream)
+	}
+
+	sd.buf.Write(imm.Encoded)
+	var em encodedMessage
+	err := sd.dec.Decode(&em)
+	// Whatever a failed decode leaves behind is only this message's.
+	sd.buf.Reset()
+	if err != nil {
+		return nil, err
+	}
+	return em.Message, nil
+}
+
+// A payloadError is a failure to decode the Encoded message carried by an
+// IncomingMailboxMessage. Unlike an error in the connection's own gob
+// stream, it only loses that message.
+type payloadError struct {
+	target internal.IntMailboxID
+	err    error
+}
+
+func (pe payloadError) Error() string {
+	return fmt.Sprintf("could not decode the message for mailbox %x: %s", MailboxID(pe.target), pe.err)
+}
+
+// undecodable logs and counts a message from the remote node that is
+// dropped because it could not be decoded.
+func (rm *remoteMailboxes) undecodable(pe payloadError) {
+	rm.Errorf("Dropping a message from node %d: %s", rm.remoteNode, pe)
+	rm.connectionServer.dropped(DropUndecodable, rm.remoteNode, 1)
+}
+
+// newEncodePool starts an encodePool writing to conn, with the given
+// number of workers, which must be no more than maxEncodeWorkers. streams
+// is whether the remote node takes EncodeStreams.
+func newEncodePool(rm *remoteMailboxes, conn messageSender, workers int, streams bool) *encodePool {
+	ep := &encodePool{
+		rm:      rm,
+		conn:    conn,
+		streams: streams,
+		jobs:    make(chan *encodeJob, 4*workers),
+		frames:  make(chan *encodeJob, 4*workers),
+		stopped: make(chan struct{}),
+	}
+	ep.idleCond = sync.NewCond(&ep.idleL)
+	for i := 0; i < workers; i++ {
+		stream := uint8(i + 1)
+		rm.connectionServer.goroutine(fmt.Sprintf("encoder for node %d", rm.remoteNode), func() {
+			ep.encode(stream)
+		})
+	}
+	rm.connectionServer.goroutine(fmt.Sprintf("writer for node %d", rm.remoteNode), ep.write)
+	return ep
+}
+
+// send queues the message to be written, returning once it has been if
+// wait is set. Otherwise the result is only logged and counted, as it is
+// by remoteMailboxes.sendMessage. Anything still queued when the pool is stopped
+// is dropped, as it would be in the connection's buffers.
+func (ep *encodePool) send(cm internal.ClusterMessage, desc string, wait bool) error {
+	job := &encodeJob{
+		cm:      cm,
+		wire:    cm,
+		desc:    desc,
+		encoded: make(chan struct{}),
+	}
+	if wait {
+		job.written = make(chan error, 1)
+	}
+
+	atomic.AddInt64(&ep.pending, 1)
+	select {
+	case ep.frames <- job:
+	case <-ep.stopped:
+		return ErrNoConnection
+	}
+	if _, isMailboxMessage := cm.(internal.IncomingMailboxMessage); isMailboxMessage {
+		select {
+		case ep.jobs <- job:
+		case <-ep.stopped:
+			return ErrNoConnection
+		}
+	} else {
+		close(job.encoded)
+	}
+
+	if !wait {
+		return nil
+	}
+	select {
+	case err := <-job.written:
+		return err
+	case <-ep.stopped:
+		return ErrNoConnection
+	}
+}
+
+// encode is a worker, encoding its messages as the given EncodeStream, if
+// the remote node takes them.
+func (ep *encodePool) encode(stream uint8) {
+	var se streamEncoder
+	for {
+		select {
+		case job := <-ep.jobs:
+			if imm := job.cm.(internal.IncomingMailboxMessage); imm.Compressed {
+				// Compressed messages are each a stream of their own.
+				job.wire, job.err = encodeCompressed(imm)
+			} else {
+				if ep.streams {
+					imm.Encoded, imm.NewEncodeStream, job.err = se.encode(imm.Message)
+					imm.EncodeStream = stream
+				} else {
+					imm.Encoded, job.err = encodeMessage(imm.Message)
+				}
+				imm.Message = nil
+				job.wire = imm
+			}
+			close(job.encoded)
+		case <-ep.stopped:
+			return
+		}
+	}
+}
+
+func (ep *encodePool) write() {
+	for {
+		var job *encodeJob
+		select {
+		case job = <-ep.frames:
+		case <-ep.stopped:
+			return
+		}
+		select {
+		case <-job.encoded:
+		case <-ep.stopped:
+			return
+		}
+
+		err := job.err
+		if err == nil {
+			err = ep.rm.write(ep.conn, job.wire, job.cm, job.desc)
+		} else {
+			err = ep.rm.sendFailed(ep.conn, job.cm, job.desc, err)
+		}
+		if atomic.AddInt64(&ep.pending, -1) == 0 {
+			ep.idleL.Lock()
+			ep.idleCond.Broadcast()
+			ep.idleL.Unlock()
+			ep.rm.parent.changed()
+		}
+		if job.written != nil {
+			job.written <- err
+		} else if err != nil {
+			ep.rm.unsent(job.cm, err)
+		}
+	}
+}
+
+// idle returns whether everything sent has been written.
+func (ep *encodePool) idle() bool {
+	return atomic.LoadInt64(&ep.pending) == 0
+}
+
+// awaitIdle waits until everything sent has been written, or the pool is
+// stopped.
+func (ep *encodePool) awaitIdle() {
+	ep.idleL.Lock()
+	defer ep.idleL.Unlock()
+	for !ep.idle() && !ep.isStopped() {
+		ep.idleCond.Wait()
+	}
+}
+
+func (ep *encodePool) isStopped() bool {
+	select {
+	case <-ep.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// shutdown stops the pool, dropping whatever it has not yet written.
+func (ep *encodePool) shutdown() {
+	ep.stop.Do(func() {
+		close(ep.stopped)
+		ep.idleL.Lock()
+		ep.idleCond.Broadcast()
+		ep.idleL.Unlock()
+	})
+}
@@ -0,0 +1,227 @@
+package reign
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+type largeRow struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+// largeMessage is expensive enough to encode for EncodeWorkers to matter.
+type largeMessage struct {
+	Seq  int
+	Rows []largeRow
+}
+
+func init() {
+	RegisterType(largeMessage{})
+}
+
+func newLargeMessage(seq, rows int) largeMessage {
+	lm := largeMessage{Seq: seq, Rows: make([]largeRow, rows)}
+	for i := range lm.Rows {
+		lm.Rows[i] = largeRow{
+			ID:   i,
+			Name: "row " + strconv.Itoa(i),
+			Tags: []string{"a", "b", strconv.Itoa(seq)},
+		}
+	}
+	return lm
+}
+
+func TestEncodeWorkers(t *testing.T) {
+	spec := testSpec()
+	spec.EncodeWorkers = 4
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	for i := 0; i < 100; i++ {
+		var msg interface{} = i
+		if i%3 == 0 {
+			msg = newLargeMessage(i, i)
+		}
+		// Compressed messages are encoded by the workers too.
+		send := ntb.rem1_2.Send
+		if i%5 == 1 {
+			send = ntb.rem1_2.SendCompressed
+		}
+		if err := send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+		if !ok {
+			t.Fatal("Message not received:", i)
+		}
+		if lm, isLarge := msg.(largeMessage); isLarge {
+			if lm.Seq != i || len(lm.Rows) != i || (i > 0 && lm.Rows[i-1].Name != "row "+strconv.Itoa(i-1)) {
+				t.Fatal("Large message out of order or garbled:", i, lm.Seq)
+			}
+		} else if msg != i {
+			t.Fatal("Message out of order:", i, msg)
+		}
+	}
+}
+
+func TestEncodeWorkersWire(t *testing.T) {
+	spec := testSpec()
+	spec.EncodeWorkers = 2
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 100)}
+	next := func() internal.ClusterMessage {
+		select {
+		case cm := <-conn.sent:
+			return cm
+		case <-time.After(timeout):
+			t.Fatal("Nothing was sent")
+		}
+		return nil
+	}
+
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	for i := 0; i < 20; i++ {
+		ntb.rem1_2.Send(i)
+	}
+	// Bookkeeping messages keep their place in line.
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	// Each worker's messages are parts of a stream of its own.
+	var streams encodeStreams
+	started := map[uint8]bool{}
+	for i := 0; i < 20; i++ {
+		imm := next().(internal.IncomingMailboxMessage)
+		if imm.Message != nil || imm.Encoded == nil {
+			t.Fatal("Message was not encoded ahead of time:", imm)
+		}
+		if imm.EncodeStream < 1 || imm.EncodeStream > 2 || imm.NewEncodeStream == started[imm.EncodeStream] {
+			t.Fatal("Message not on a worker's stream:", imm.EncodeStream, imm.NewEncodeStream)
+		}
+		started[imm.EncodeStream] = true
+		if msg, err := streams.decode(&imm); err != nil || msg != i {
+			t.Fatal("Message out of order:", i, msg, err)
+		}
+	}
+	if _, isNotify := next().(*internal.NotifyNodeOnTerminate); !isNotify {
+		t.Fatal("The link was not registered in its turn")
+	}
+
+	// Until version 13, each is encoded on its own...
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, 12, "")
+	ntb.rem1_2.Send("alone")
+	imm := next().(internal.IncomingMailboxMessage)
+	if msg, err := decodeMessage(imm.Encoded); err != nil || msg != "alone" || imm.EncodeStream != 0 {
+		t.Fatal("Message to a version 12 node not encoded on its own:", msg, err, imm.EncodeStream)
+	}
+
+	// ... and older nodes get them the old way.
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, 5, "")
+	ntb.rem1_2.Send("moo")
+	if imm := next().(internal.IncomingMailboxMessage); imm.Message != "moo" || imm.Encoded != nil {
+		t.Fatal("Message to an older node was encoded ahead of time:", imm)
+	}
+}
+
+func TestEncodeStreams(t *testing.T) {
+	var se streamEncoder
+	var streams encodeStreams
+	decode := func(msg interface{}, fresh bool) {
+		encoded, started, err := se.encode(msg)
+		if err != nil || started != fresh {
+			t.Fatal("Unexpected encoding:", err, started)
+		}
+		imm := internal.IncomingMailboxMessage{Encoded: encoded, EncodeStream: 1, NewEncodeStream: started}
+		if decoded, err := streams.decode(&imm); err != nil || !reflect.DeepEqual(decoded, msg) {
+			t.Fatal("Stream not decoded:", decoded, err)
+		}
+	}
+
+	// The type is only described the first time.
+	decode(newLargeMessage(0, 2), true)
+	first := se.buf.Len()
+	decode(newLargeMessage(0, 2), false)
+	if se.buf.Len() >= first {
+		t.Fatal("The type was described again:", first, se.buf.Len())
+	}
+
+	// A failure starts the stream over.
+	if _, _, err := se.encode(unregisteredMessage{}); err == nil {
+		t.Fatal("Unregistered type encoded")
+	}
+	decode(newLargeMessage(1, 2), true)
+
+	// A part of a stream that was never started is an error, as is one
+	// that doesn't decode, and neither stops what follows.
+	if _, err := streams.decode(&internal.IncomingMailboxMessage{Encoded: []byte{1}, EncodeStream: 2}); err == nil {
+		t.Fatal("Decoded a stream that was never started")
+	}
+	if _, err := streams.decode(&internal.IncomingMailboxMessage{Encoded: []byte("garbage"), EncodeStream: 1}); err == nil {
+		t.Fatal("Decoded garbage")
+	}
+	decode(newLargeMessage(2, 2), false)
+}
+
+// A message whose payload can't be decoded is dropped, and the connection
+// carries on.
+func TestUndecodablePayload(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	garbage := internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_2.id),
+		Encoded: []byte("garbage"),
+	}
+	if err := ntb.remote1to2.sendWaiting(garbage, "garbage", true); err != nil {
+		t.Fatal(err)
+	}
+	ntb.rem1_2.Send("after")
+	if msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !ok || msg != "after" {
+		t.Fatal("Connection did not carry on:", msg, ok)
+	}
+	awaitDrops(t, ntb.c2, map[string]uint64{DropUndecodable: 1})
+}
+
+func benchmarkLargeMessageSend(b *testing.B, workers int) {
+	spec := testSpec()
+	spec.EncodeWorkers = workers
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	msg := newLargeMessage(0, 1000)
+	done := make(chan struct{})
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			ntb.mailbox1_2.ReceiveNext()
+		}
+		close(done)
+	}()
+	for i := 0; i < b.N; i++ {
+		ntb.rem1_2.Send(msg)
+	}
+	<-done
+}
+
+// This measures the throughput of large messages between nodes, encoded
+// by the loop sending them.
+func BenchmarkLargeMessageSend(b *testing.B) {
+	benchmarkLargeMessageSend(b, 0)
+}
+
+// Compare with BenchmarkLargeMessageSend to see what EncodeWorkers buys.
+func BenchmarkLargeMessageSendEncodeWorkers(b *testing.B) {
+	benchmarkLargeMessageSend(b, 4)
+}
@@ -0,0 +1,40 @@
+package reign
+
+func init() {
+	RegisterType(Envelope{})
+}
+
+// An Envelope carries a message along with the Address its receiver
+// should reply to, so that a handler can acknowledge it, or answer it,
+// without having to know who sent it. Send one with SendWithReply, or
+// use one as the message of a Request:
+//
+//	r, err := addr.Request(func(replyTo *reign.Address) interface{} {
+//	    return reign.Envelope{Message: msg, ReplyTo: replyTo}
+//	})
+//
+// Like any Address, the ReplyTo can be sent to other nodes, so an
+// Envelope may be sent anywhere its Message can.
+type Envelope struct {
+	Message interface{}
+	ReplyTo *Address
+}
+
+// ReplyWith sends the given reply to the Envelope's ReplyTo, returning
+// any error from sending it. If there is no ReplyTo, it does nothing but
+// log that the reply was dropped.
+func (e Envelope) ReplyWith(reply interface{}) error {
+	if e.ReplyTo == nil {
+		if c := connections; c != nil {
+			c.Warnf("Dropping a reply to a %T, which has no address to reply to", e.Message)
+		}
+		return nil
+	}
+	return e.ReplyTo.Send(reply)
+}
+
+// SendWithReply sends the message to the Address in an Envelope, asking
+// for replies to go to the given Address.
+func (a *Address) SendWithReply(msg interface{}, replyTo *Address) error {
+	return a.Send(Envelope{Message: msg, ReplyTo: replyTo})
+}
@@ -0,0 +1,48 @@
+package reign
+
+import "testing"
+
+func TestEnvelope(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	server, serverMailbox := cs.NewMailbox()
+	defer serverMailbox.Terminate()
+	go func() {
+		for {
+			envelope, isEnvelope := serverMailbox.ReceiveNext().(Envelope)
+			if !isEnvelope {
+				return
+			}
+			envelope.ReplyWith("ack " + envelope.Message.(string))
+		}
+	}()
+
+	r, err := server.Request(func(replyTo *Address) interface{} {
+		return Envelope{Message: "request", ReplyTo: replyTo}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := r.Wait(timeout); err != nil || reply != "ack request" {
+		t.Fatal("Unexpected reply:", reply, err)
+	}
+
+	client, clientMailbox := cs.NewMailbox()
+	defer clientMailbox.Terminate()
+	if err := server.SendWithReply("sent", client); err != nil {
+		t.Fatal(err)
+	}
+	if reply, _ := clientMailbox.ReceiveNextTimeout(timeout); reply != "ack sent" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	// Without anywhere to reply to, the reply goes nowhere.
+	if err := (Envelope{Message: "lost"}).ReplyWith("ack"); err != nil {
+		t.Fatal("Unexpected error replying to nobody:", err)
+	}
+
+	if err := checkEncodable(Envelope{Message: "sent", ReplyTo: client}); err != nil {
+		t.Fatal("Envelopes can't be sent to other nodes:", err)
+	}
+}
@@ -0,0 +1,149 @@
+package reign
+
+import (
+	"sync"
+	"time"
+)
+
+// ClusterEventType is the kind of thing a ClusterEvent records.
+type ClusterEventType int
+
+// The ClusterEventTypes the node records.
+const (
+	// The link to the node came up.
+	EventConnected ClusterEventType = iota
+	// The link to the node went down.
+	EventDisconnected
+	// The local mailboxes linked to mailboxes on the node were told they
+	// had terminated, as the node was down; see OnNodeDownFanout.
+	EventNodeDown
+	// Reconnecting to the node was given up on; see ReconnectGiveUpAfter.
+	EventAbandoned
+	// A connection to or from the node failed the TLS or cluster
+	// handshake, which includes being refused for a certificate that
+	// isn't signed by the cluster's CA, or node definitions that don't
+	// agree.
+	EventRejected
+)
+
+func (cet ClusterEventType) String() string {
+	switch cet {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventNodeDown:
+		return "node down"
+	case EventAbandoned:
+		return "abandoned"
+	case EventRejected:
+		return "rejected"
+	default:
+		return "unknown cluster event"
+	}
+}
+
+// A ClusterEvent is one of the significant events in the life of the
+// cluster that the node keeps a record of; see RecentEvents. Detail says
+// more about it, such as why a connection was rejected, or how many
+// mailboxes were told about a node going down.
+//
+// An incoming connection rejected in the TLS handshake can't be told
+// apart from the other nodes yet, so its Node is this node's own, and
+// the Detail gives the address it came from. Anything on the network can
+// make such a connection, so those that are rejected one after another
+// are recorded as one event, lest they push everything else out of the
+// log; Count says how many there were, and the Time and Detail are those
+// of the last. Count is 1 for every other event.
+type ClusterEvent struct {
+	Time   time.Time
+	Node   NodeID
+	Type   ClusterEventType
+	Detail string
+	Count  int
+}
+
+// eventLog is a ring buffer of the most recent ClusterEvents.
+type eventLog struct {
+	events []ClusterEvent
+	// where the next event goes, and whether the buffer has wrapped
+	next    int
+	wrapped bool
+	// whether the last event is an unidentified rejection, which the next
+	// one is coalesced with
+	coalescing bool
+	sync.Mutex
+}
+
+// clusterEvent records an event in the event log.
+func (cs *connectionServer) clusterEvent(eventType ClusterEventType, node NodeID, detail string) {
+	cs.recordEvent(eventType, node, detail, false)
+}
+
+// unidentifiedRejection records the rejection of an incoming connection
+// that never said which node it was, coalescing it with the one before if
+// that was too.
+func (cs *connectionServer) unidentifiedRejection(detail string) {
+	cs.recordEvent(EventRejected, cs.nodeID, detail, true)
+}
+
+func (cs *connectionServer) recordEvent(eventType ClusterEventType, node NodeID, detail string, coalesce bool) {
+	event := ClusterEvent{
+		Time:   cs.clock.Now(),
+		Node:   node,
+		Type:   eventType,
+		Detail: detail,
+		Count:  1,
+	}
+
+	cs.events.Lock()
+	defer cs.events.Unlock()
+
+	if coalesce && cs.events.coalescing {
+		last := cs.events.next - 1
+		if last < 0 {
+			last = len(cs.events.events) - 1
+		}
+		event.Count += cs.events.events[last].Count
+		cs.events.events[last] = event
+		return
+	}
+	cs.events.coalescing = coalesce
+
+	if cs.events.events == nil {
+		size := cs.Cluster.EventLogSize
+		if size == 0 {
+			size = DefaultEventLogSize
+		}
+		cs.events.events = make([]ClusterEvent, size)
+	}
+	cs.events.events[cs.events.next] = event
+	cs.events.next++
+	if cs.events.next == len(cs.events.events) {
+		cs.events.next = 0
+		cs.events.wrapped = true
+	}
+}
+
+// RecentEvents returns up to the last n ClusterEvents this node has
+// recorded, oldest first. Zero or less returns all of them. Only the last
+// ClusterSpec.EventLogSize events are kept.
+//
+// Where SubscribeLinkEvents is for reacting to the links as they change,
+// this is for looking back at what happened after the fact, such as
+// after an incident, without depending on the logs having made it
+// anywhere.
+func (cs *connectionServer) RecentEvents(n int) []ClusterEvent {
+	cs.events.Lock()
+	defer cs.events.Unlock()
+
+	recorded := make([]ClusterEvent, 0, len(cs.events.events))
+	if cs.events.wrapped {
+		recorded = append(recorded, cs.events.events[cs.events.next:]...)
+	}
+	recorded = append(recorded, cs.events.events[:cs.events.next]...)
+	if n > 0 && n < len(recorded) {
+		recorded = recorded[len(recorded)-n:]
+	}
+	return recorded
+}
@@ -0,0 +1,133 @@
+package reign
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+func TestRecentEvents(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+	cs.Cluster.EventLogSize = 3
+
+	if events := cs.RecentEvents(0); len(events) != 0 {
+		t.Fatal("Events recorded before any happened:", events)
+	}
+
+	for node := NodeID(1); node <= 2; node++ {
+		cs.clusterEvent(EventConnected, node, "")
+	}
+	if events := cs.RecentEvents(5); len(events) != 2 || events[0].Node != 1 || events[1].Node != 2 {
+		t.Fatal("Wrong events before the log wrapped:", events)
+	}
+
+	for node := NodeID(3); node <= 5; node++ {
+		cs.clusterEvent(EventDisconnected, node, "")
+	}
+	events := cs.RecentEvents(0)
+	if len(events) != 3 {
+		t.Fatal("Wrong number of events kept:", events)
+	}
+	for i, event := range events {
+		if event.Node != NodeID(3+i) || event.Type != EventDisconnected || event.Time.IsZero() {
+			t.Fatal("Wrong events after the log wrapped:", events)
+		}
+	}
+	if events = cs.RecentEvents(1); len(events) != 1 || events[0].Node != 5 {
+		t.Fatal("Wrong most recent event:", events)
+	}
+
+	// A run of rejections of unidentified connections takes up one event.
+	cs.clusterEvent(EventConnected, 6, "")
+	for i := 0; i < 10; i++ {
+		cs.unidentifiedRejection(fmt.Sprintf("attempt %d", i))
+	}
+	events = cs.RecentEvents(0)
+	if last := events[2]; last.Type != EventRejected || last.Count != 10 || last.Detail != "attempt 9" ||
+		events[1].Node != 6 || events[1].Count != 1 {
+		t.Fatal("Rejections not coalesced:", events)
+	}
+	// Until something else happens.
+	cs.clusterEvent(EventDisconnected, 6, "")
+	cs.unidentifiedRejection("again")
+	events = cs.RecentEvents(0)
+	if events[0].Count != 10 || events[1].Type != EventDisconnected || events[2].Count != 1 {
+		t.Fatal("Rejection after another event coalesced:", events)
+	}
+
+	if EventRejected.String() != "rejected" || ClusterEventType(-1).String() != "unknown cluster event" {
+		t.Fatal("Wrong names for the event types")
+	}
+}
+
+// hasEvent returns whether the node records the given event, waiting for
+// it to do so.
+func hasEvent(cs *connectionServer, eventType ClusterEventType, node NodeID) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, event := range cs.RecentEvents(0) {
+			if event.Type == eventType && event.Node == node {
+				return true
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return false
+}
+
+func TestClusterEvents(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	if !hasEvent(ntb.c1, EventConnected, 2) {
+		t.Fatal("Connection not recorded:", ntb.c1.RecentEvents(0))
+	}
+
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	deadline := time.Now().Add(timeout)
+	for len(ntb.c1.RemoteLinks(2)[ntb.mailbox1_2.id]) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Link was not made:", ntb.c1.RemoteLinks(2))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ntb.remote1to2.unsetConnection(conn)
+	if !hasEvent(ntb.c1, EventDisconnected, 2) {
+		t.Fatal("Disconnection not recorded:", ntb.c1.RecentEvents(0))
+	}
+	ntb.remote1to2.Stop()
+	<-done
+	if !hasEvent(ntb.c1, EventNodeDown, 2) {
+		t.Fatal("Node down fan-out not recorded:", ntb.c1.RecentEvents(0))
+	}
+}
+
+func TestClusterEventsRejected(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	ntb.c1.Cluster.Namespace = "generation 2"
+	ntb.c2.Cluster.Namespace = "generation 1"
+	thingsTerminateOnFailure(t, ntb)
+
+	if !hasEvent(ntb.c1, EventRejected, 2) || !hasEvent(ntb.c2, EventRejected, 1) {
+		t.Fatal("Rejections not recorded:", ntb.c1.RecentEvents(0), ntb.c2.RecentEvents(0))
+	}
+	for _, event := range ntb.c2.RecentEvents(0) {
+		if !strings.Contains(event.Detail, "namespace") {
+			t.Fatal("Rejection does not say why:", event)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package reign
+
+// TerminateDrained terminates the mailbox like Terminate, returning the
+// messages that were still waiting in it, in the order they would have
+// been received, minus any that had expired. Taking them out and
+// terminating are one step, so no message can arrive in between and be
+// lost with the mailbox. If the mailbox was already terminated, it
+// returns nil.
+func (m *Mailbox) TerminateDrained() []interface{} {
+	drained := m.terminate(TerminatedNormally, true)
+	for i, msg := range drained {
+		if em, isExpiring := msg.(expiringMessage); isExpiring {
+			drained[i] = em.message
+		}
+	}
+	return drained
+}
+
+// TerminateForwarding is TerminateDrained, sending the messages that were
+// waiting in the mailbox on to the given address, in order, rather than
+// returning them. This is for handing the work of a mailbox over to
+// another, which may be on another node, such as the one a Handover moved
+// its name to, without losing what was sent to it before the move.
+// Messages sent with SendWithDeadline keep their deadlines.
+//
+// The new mailbox gets the forwarded messages after whatever was sent
+// straight to it before they arrive; if that matters, hand the name over
+// before anything else knows the new address. If a message can't be
+// forwarded, that message and the rest are returned with the error, so
+// they aren't lost with the mailbox.
+func (m *Mailbox) TerminateForwarding(to *Address) ([]interface{}, error) {
+	drained := m.terminate(TerminatedNormally, true)
+	dest := to.getAddress()
+	for i, msg := range drained {
+		if err := dest.send(msg); err != nil {
+			unsent := drained[i:]
+			for j, msg := range unsent {
+				if em, isExpiring := msg.(expiringMessage); isExpiring {
+					unsent[j] = em.message
+				}
+			}
+			return unsent, err
+		}
+	}
+	return nil, nil
+}
+
+// drainLocked takes the messages waiting in the mailbox out of it, in
+// order, discarding the expired ones. Those with deadlines are still
+// wrapped in their expiringMessage. It must be called with the lock
+// held.
+func (m *Mailbox) drainLocked() []interface{} {
+	now := m.now()
+	drained := make([]interface{}, 0, m.store.Len())
+	for m.store.Len() > 0 {
+		msg := m.store.Dequeue()
+		if tm, isTimed := msg.(timedMessage); isTimed {
+			msg = tm.message
+		}
+		if _, live := liveMessage(msg, now); !live {
+			m.expired()
+			continue
+		}
+		drained = append(drained, msg)
+	}
+	return drained
+}
@@ -0,0 +1,77 @@
+package reign
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTerminateDrained(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	addr.Send(1)
+	addr.SendWithDeadline(2, time.Now().Add(-time.Second))
+	addr.SendWithDeadline(3, time.Now().Add(time.Hour))
+	addr.Send(4)
+
+	drained := mbox.TerminateDrained()
+	if len(drained) != 3 || drained[0] != 1 || drained[1] != 3 || drained[2] != 4 {
+		t.Fatal("Wrong messages drained:", drained)
+	}
+	if err := addr.Send(5); err != ErrMailboxTerminated {
+		t.Fatal("Drained mailbox still takes messages:", err)
+	}
+	if drained = mbox.TerminateDrained(); drained != nil {
+		t.Fatal("Terminated mailbox drained twice:", drained)
+	}
+}
+
+func TestTerminateForwarding(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	toAddr, to := cs.NewMailbox()
+	defer to.Terminate()
+
+	toAddr.Send("first")
+	addr.Send(1)
+	addr.SendWithDeadline(2, time.Now().Add(time.Hour))
+	addr.Send(3)
+	if unsent, err := mbox.TerminateForwarding(toAddr); err != nil || unsent != nil {
+		t.Fatal("Could not forward:", unsent, err)
+	}
+	for _, expected := range []interface{}{"first", 1, 2, 3} {
+		if msg, _ := to.ReceiveNextTimeout(timeout); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+
+	// What can't be forwarded is handed back.
+	addr, mbox = cs.NewMailbox()
+	addr.Send(1)
+	addr.SendWithDeadline(2, time.Now().Add(time.Hour))
+	to.Terminate()
+	unsent, err := mbox.TerminateForwarding(toAddr)
+	if err != ErrMailboxTerminated || len(unsent) != 2 || unsent[0] != 1 || unsent[1] != 2 {
+		t.Fatal("Unforwarded messages not returned:", unsent, err)
+	}
+}
+
+func TestTerminateForwardingRemote(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	addr, mbox := ntb.c1.NewMailbox()
+	addr.Send("one")
+	addr.Send("two")
+	if _, err := mbox.TerminateForwarding(ntb.rem1_2); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"one", "two"} {
+		if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+}
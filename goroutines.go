@@ -0,0 +1,69 @@
+package reign
+
+import (
+	"sync"
+)
+
+// goroutineCounter counts the goroutines a node is running, by what they
+// are for, so that tests can check they are all gone once the node has
+// been shut down; see Goroutines.
+type goroutineCounter struct {
+	running map[string]int
+	sync.Mutex
+}
+
+// goroutine runs f in a new goroutine, counted under the given label until
+// it returns. Every long-lived goroutine reign starts should go through
+// this, or through running, so that one that outlives its node shows up.
+func (cs *connectionServer) goroutine(label string, f func()) {
+	done := cs.running(label)
+	go func() {
+		defer done()
+		f()
+	}()
+}
+
+// running counts the calling goroutine under the given label until the
+// function it returns is called. It is for the Serve methods, whose
+// goroutines are started by the supervisor:
+//
+//	defer rm.connectionServer.running("remote mailboxes for node 2")()
+func (cs *connectionServer) running(label string) func() {
+	gc := &cs.goroutines
+	gc.Lock()
+	if gc.running == nil {
+		gc.running = make(map[string]int)
+	}
+	gc.running[label]++
+	gc.Unlock()
+
+	return func() {
+		gc.Lock()
+		defer gc.Unlock()
+		if gc.running[label] <= 1 {
+			delete(gc.running, label)
+		} else {
+			gc.running[label]--
+		}
+	}
+}
+
+// Goroutines returns how many of the goroutines reign started for this
+// node are still running, by what they are for, such as "connector to
+// node 2" or "pings to node 3". Once the node has been shut down with
+// Close, or stopped and terminated, they should all exit shortly; one
+// that doesn't is a leak. Goroutines started for the callbacks and
+// handlers set by the application, and for ReceiveConcurrent, are not
+// counted.
+//
+// reigntest.AssertGoroutinesExited wraps this for tests.
+func (cs *connectionServer) Goroutines() map[string]int {
+	cs.goroutines.Lock()
+	defer cs.goroutines.Unlock()
+
+	running := make(map[string]int, len(cs.goroutines.running))
+	for label, count := range cs.goroutines.running {
+		running[label] = count
+	}
+	return running
+}
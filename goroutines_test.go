@@ -0,0 +1,56 @@
+package reign
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// awaitGoroutines waits for the node to be running exactly the expected
+// goroutines, which is none if expected is nil.
+func awaitGoroutines(t *testing.T, cs *connectionServer, expected map[string]int) {
+	var running map[string]int
+	awaitCondition(t, func() bool {
+		running = cs.Goroutines()
+		matches := len(running) == len(expected)
+		for label, count := range expected {
+			if running[label] != count {
+				matches = false
+			}
+		}
+		return matches
+	}, func() string {
+		return fmt.Sprint("Wrong goroutines running: ", running, " expected ", expected)
+	})
+}
+
+func TestGoroutines(t *testing.T) {
+	spec := testSpec()
+	spec.EncodeWorkers = 2
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	awaitGoroutines(t, ntb.c1, map[string]int{
+		"registry":                    1,
+		"remote mailboxes for node 2": 1,
+		"connector to node 2":         1,
+		"pings to node 2":             1,
+		"encoder for node 2":          2,
+		"writer for node 2":           1,
+	})
+	// Node 2 is dialed rather than dialing, so it runs the listener.
+	if running := ntb.c2.Goroutines(); running["listener on 127.0.0.1:29877"] != 1 {
+		t.Fatal("Listener not counted:", running)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ntb.c1.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ntb.c2.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	awaitGoroutines(t, ntb.c1, nil)
+	awaitGoroutines(t, ntb.c2, nil)
+}
@@ -0,0 +1,85 @@
+package reign
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+)
+
+// ringReplicas is how many points each member has on a hashRing. The more
+// there are, the more evenly the keys are shared out.
+const ringReplicas = 128
+
+// A hashRing is a consistent-hash ring over the members of a registry
+// name, for RouteKey. It is not changed once made, so it can be used
+// without the registry's lock.
+//
+// Where a member's points go on the ring depends only on its MailboxID, so
+// every node with the same claims for a name builds the same ring.
+type hashRing struct {
+	points  []uint64
+	members []MailboxID
+}
+
+func newHashRing(members []MailboxID) *hashRing {
+	hr := &hashRing{
+		points:  make([]uint64, 0, len(members)*ringReplicas),
+		members: make([]MailboxID, 0, len(members)*ringReplicas),
+	}
+	var buf [12]byte
+	for _, member := range members {
+		binary.BigEndian.PutUint64(buf[:8], uint64(member))
+		for replica := uint32(0); replica < ringReplicas; replica++ {
+			binary.BigEndian.PutUint32(buf[8:], replica)
+			hr.points = append(hr.points, ringHash(buf[:]))
+			hr.members = append(hr.members, member)
+		}
+	}
+	sort.Sort(hr)
+	return hr
+}
+
+// ringHash is FNV-1a, with the bits mixed afterwards, as FNV on its own
+// leaves similar inputs, such as our points, bunched together.
+func ringHash(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (hr *hashRing) Len() int { return len(hr.points) }
+
+func (hr *hashRing) Less(i, j int) bool {
+	if hr.points[i] != hr.points[j] {
+		return hr.points[i] < hr.points[j]
+	}
+	// Two members' points could collide; this keeps the ring the same
+	// everywhere even then.
+	return hr.members[i] < hr.members[j]
+}
+
+func (hr *hashRing) Swap(i, j int) {
+	hr.points[i], hr.points[j] = hr.points[j], hr.points[i]
+	hr.members[i], hr.members[j] = hr.members[j], hr.members[i]
+}
+
+// get returns the member the key belongs to: the one with the first point
+// at or after the key's, going around the ring. It is false if the ring is
+// empty.
+func (hr *hashRing) get(key []byte) (MailboxID, bool) {
+	if len(hr.points) == 0 {
+		return 0, false
+	}
+	h := ringHash(key)
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= h })
+	if i == len(hr.points) {
+		i = 0
+	}
+	return hr.members[i], true
+}
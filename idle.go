@@ -0,0 +1,311 @@
+package reign
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// IdleCheckInWindow is how long a link that was made again only to check
+// in with the other node stays up once it is idle; see
+// ClusterSpec.LinkIdleTimeout. Defaults to 1 second.
+var IdleCheckInWindow = time.Second
+
+// idleCheck tells Serve to see whether the connection has been idle for
+// long enough to be closed. The epoch is the linkEpoch it was scheduled
+// in, so a check for a previous connection can be ignored.
+type idleCheck struct {
+	epoch uint64
+}
+
+// active records that something other than a ping crossed the link.
+func (rm *remoteMailboxes) active() {
+	atomic.StoreInt64(&rm.lastActive, rm.connectionServer.clock.Now().UnixNano())
+}
+
+// idleTimeout returns how long the current connection may be idle before
+// it is closed, or zero if it never is. Only the dialing node closes
+// links, and only to nodes that know what it means.
+func (rm *remoteMailboxes) idleTimeout() time.Duration {
+	timeout := rm.connectionServer.Cluster.LinkIdleTimeout
+	if timeout <= 0 || rm.connectionServer.nodeConnectors[rm.remoteNode] == nil {
+		return 0
+	}
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.version < 9 {
+		return 0
+	}
+	if rm.checkIn {
+		return IdleCheckInWindow
+	}
+	return timeout
+}
+
+// scheduleIdleCheck has Serve check the connection for idleness after d.
+// Only Serve calls this.
+func (rm *remoteMailboxes) scheduleIdleCheck(d time.Duration) {
+	if rm.idleTimer != nil {
+		rm.idleTimer.Stop()
+	}
+	epoch := rm.linkEpoch
+	rm.idleTimer = rm.connectionServer.clock.AfterFunc(d, func() {
+		rm.Send(idleCheck{epoch})
+	})
+}
+
+// closeIfIdle starts closing the connection if nothing has crossed it for
+// the idle timeout, and nothing is waiting to, by telling the other node.
+// Until it answers and the connection is closed, and from then on, the
+// link is dormant: messages for the node are held rather than refused,
+// and the first of them has the link made again. Only Serve calls this.
+func (rm *remoteMailboxes) closeIfIdle(check idleCheck) {
+	if check.epoch != rm.linkEpoch {
+		return
+	}
+	timeout := rm.idleTimeout()
+	if timeout <= 0 {
+		return
+	}
+
+	idleFor := rm.connectionServer.clock.Now().Sub(time.Unix(0, atomic.LoadInt64(&rm.lastActive)))
+	rm.Lock()
+	conn := rm.connection
+	if conn == nil {
+		rm.Unlock()
+		return
+	}
+	busy := rm.outgoingMailbox.len() > 0 || len(rm.streams) > 0 ||
+		(rm.encoder != nil && !rm.encoder.idle())
+	if idleFor < timeout || busy {
+		rm.Unlock()
+		wait := timeout - idleFor
+		if busy {
+			wait = timeout
+		}
+		rm.scheduleIdleCheck(wait)
+		return
+	}
+
+	rm.connection = nil
+	rm.dormant = true
+	rm.dormantSince = rm.connectionServer.clock.Now()
+	rm.idled = conn
+	rm.stopEncoder()
+	var cm internal.ClusterMessage = &internal.LinkIdle{
+		Timeout: rm.connectionServer.Cluster.LinkIdleTimeout,
+	}
+	err := conn.send(&cm)
+	if err != nil {
+		// The connection is gone anyhow; treat it as having dropped.
+		rm.dormant = false
+		rm.idled = nil
+		rm.disconnectedSince = rm.connectionServer.clock.Now()
+		rm.parent.changed()
+	}
+	rm.Unlock()
+
+	if err != nil {
+		rm.Errorf("Could not close the idle connection to node %d, dropping it: %s", rm.remoteNode, myString(err))
+		conn.terminate()
+		rm.Send(connectionLost{})
+		rm.connectionServer.linkEvent(rm.remoteNode, LinkDisconnected)
+		return
+	}
+	rm.Infof("Closing the connection to node %d, which has been idle for %v", rm.remoteNode, idleFor)
+	rm.connectionServer.linkEvent(rm.remoteNode, LinkIdle)
+}
+
+// goDormant handles the other node closing the connection for being
+// idle: once whatever is being written to it is done, the link goes
+// dormant, and the other node is told it can close the connection. If it
+// hasn't reconnected within twice the timeout it sent, it is taken to be
+// down after all.
+func (rm *remoteMailboxes) goDormant(ms messageSender, idle internal.LinkIdle) {
+	rm.Lock()
+	if rm.connection != ms {
+		rm.Unlock()
+		return
+	}
+	rm.connection = nil
+	rm.dormant = true
+	since := rm.connectionServer.clock.Now()
+	rm.dormantSince = since
+	rm.idled = ms
+	encoder := rm.encoder
+	rm.Unlock()
+
+	// Nothing new is given to the encoder once the connection is unset,
+	// so this only waits for the writes already under way.
+	if encoder != nil {
+		encoder.awaitIdle()
+	}
+	rm.Lock()
+	rm.stopEncoder()
+	rm.Unlock()
+
+	var cm internal.ClusterMessage = &internal.LinkIdle{}
+	if err := ms.send(&cm); err != nil {
+		rm.Warnf("Could not acknowledge node %d closing the idle connection: %s", rm.remoteNode, myString(err))
+	}
+	rm.Infof("Node %d is closing the connection for being idle", rm.remoteNode)
+	rm.connectionServer.linkEvent(rm.remoteNode, LinkIdle)
+
+	if idle.Timeout > 0 {
+		rm.connectionServer.clock.AfterFunc(2*idle.Timeout, func() {
+			rm.endDormancy(since)
+		})
+	}
+}
+
+// isDormant returns whether the link was closed for being idle and hasn't
+// been made again.
+func (rm *remoteMailboxes) isDormant() bool {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.dormant
+}
+
+// closedIdle returns whether ms is the last connection closed for being
+// idle, so its loop can end quietly, without reporting the node down.
+func (rm *remoteMailboxes) closedIdle(ms messageSender) bool {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.idled == ms
+}
+
+// endDormancy gives up on the dormant link being made again, reporting
+// the node as down just as if the connection had dropped. If since is
+// set, it only does so if the link has been dormant since then.
+func (rm *remoteMailboxes) endDormancy(since time.Time) {
+	rm.Lock()
+	if !rm.dormant || (!since.IsZero() && !rm.dormantSince.Equal(since)) {
+		rm.Unlock()
+		return
+	}
+	rm.dormant = false
+	rm.disconnectedSince = rm.dormantSince
+	rm.condition.Broadcast()
+	rm.parent.changed()
+	rm.Unlock()
+
+	rm.Warnf("The idle link to node %d could not be made again; it is down", rm.remoteNode)
+	rm.Send(connectionLost{})
+	rm.reportStatus(false)
+	rm.connectionServer.linkEvent(rm.remoteNode, LinkDisconnected)
+}
+
+// A parkedSend is a message Serve was sending when the link went dormant,
+// to be sent once the dormancy is over.
+type parkedSend struct {
+	cm   internal.ClusterMessage
+	desc string
+}
+
+// linkWaiting returns whether messages for the node are being held until
+// the link can take them, in which case Serve only takes what it can
+// handle without the link; see receiveAwaitingLink. Otherwise it returns
+// what was parked while they were, for Serve to send, or drop, now.
+func (rm *remoteMailboxes) linkWaiting() (bool, []parkedSend) {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.holdingForLink() {
+		return true, nil
+	}
+	parked := rm.parked
+	rm.parked = nil
+	return false, parked
+}
+
+// holdingForLink returns whether messages for the node are held until the
+// link can take them: while it is dormant, and while a new connection is
+// having its handshake, if the Cluster's EarlyMessagePolicy is to buffer
+// them. rm must be locked.
+func (rm *remoteMailboxes) holdingForLink() bool {
+	if rm.connection == nil {
+		return rm.dormant
+	}
+	return !rm.ready && rm.connectionServer.Cluster.EarlyMessagePolicy == EarlyMessageBuffer
+}
+
+// receiveAwaitingLink receives the next message Serve can handle while
+// messages are held for the link, leaving those that need it in the
+// outgoing queue, in order, until the link is ready or given up on, which
+// Serve hears of with a handshakeDone, connectionReady or connectionLost.
+// If the link is dormant and this node is the one that dials, the first
+// message that needs the link has it made again.
+func (rm *remoteMailboxes) receiveAwaitingLink() interface{} {
+	nc := rm.connectionServer.nodeConnectors[rm.remoteNode]
+	for {
+		var needsLink func(interface{}) bool
+		if nc != nil && !rm.linkWoken && rm.isDormant() {
+			needsLink = func(interface{}) bool { return true }
+		}
+		msg, received := rm.outgoingMailbox.receiveFirstIf(rm.servedWithoutLink, needsLink)
+		if received {
+			return msg
+		}
+		rm.linkWoken = true
+		nc.wake()
+	}
+}
+
+// servedWithoutLink returns whether Serve can handle the message while
+// messages are held for the link, as it sends nothing to the remote node.
+func (rm *remoteMailboxes) servedWithoutLink(message interface{}) bool {
+	switch msg := message.(type) {
+	case handshakeDone, connectionReady, connectionLost, terminateRemoteMailbox, idleCheck,
+		linkGraceExpired, newExamineMessages, newDoneProcessing, internal.PanicHandler:
+		return true
+	case MailboxTerminated, TerminatedWithReason:
+		return terminationOf(msg).ID == rm.outgoingMailbox.id
+	}
+	return false
+}
+
+// abandonParked gives up on what was parked, as Serve is stopping. The
+// messages for mailboxes are abandoned just like those still in the
+// outgoing queue; see abandonQueued.
+func (rm *remoteMailboxes) abandonParked() {
+	rm.Lock()
+	parked := rm.parked
+	rm.parked = nil
+	rm.Unlock()
+	for _, p := range parked {
+		if imm, isMailboxMessage := p.cm.(internal.IncomingMailboxMessage); isMailboxMessage {
+			rm.connectionServer.handleAbandoned(MailboxID(imm.Target), imm.Message)
+		}
+	}
+}
+
+// reportStatus calls the cluster's connection status callbacks, if the
+// node's status has changed. A link closed for being idle is still
+// reported as connected.
+func (rm *remoteMailboxes) reportStatus(connected bool) {
+	rm.Lock()
+	changed := rm.reported != connected
+	rm.reported = connected
+	rm.Unlock()
+	if changed {
+		rm.connectionServer.changeConnectionStatus(rm.remoteNode, connected)
+	}
+}
+
+// connectionEnded reports the node as disconnected when the loop reading
+// ms ends, unless it was closed for being idle.
+func (rm *remoteMailboxes) connectionEnded(ms messageSender) {
+	if !rm.closedIdle(ms) {
+		rm.reportStatus(false)
+	}
+}
+
+// wake has a connector waiting on a dormant link dial it right away.
+func (nc *nodeConnector) wake() {
+	nc.Lock()
+	defer nc.Unlock()
+	nc.woken = true
+	if nc.stopCond != nil {
+		nc.stopCond.Broadcast()
+	}
+}
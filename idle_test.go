@@ -0,0 +1,169 @@
+package reign
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// awaitIdleLink waits for the link to the node to be closed for being
+// idle, failing if it is reported down first.
+func awaitIdleLink(t *testing.T, m *Mailbox, node NodeID) {
+	for {
+		msg, ok := m.ReceiveNextTimeout(5 * time.Second)
+		if !ok {
+			t.Fatalf("link to node %d never became idle", node)
+		}
+		event := msg.(LinkEvent)
+		if event.Node != node {
+			continue
+		}
+		switch event.State {
+		case LinkIdle:
+			return
+		case LinkDisconnected, LinkReconnectScheduled:
+			t.Fatalf("idle link to node %d was reported as %s", node, event.State)
+		}
+	}
+}
+
+func TestLinkIdleTimeout(t *testing.T) {
+	defer func(window time.Duration) { IdleCheckInWindow = window }(IdleCheckInWindow)
+	IdleCheckInWindow = 50 * time.Millisecond
+
+	spec := testSpec()
+	// This has to leave the accepting node time to see the check-in,
+	// handshakes and all, before it gives up on the dialing node.
+	spec.LinkIdleTimeout = "250ms"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+
+	var statusL sync.Mutex
+	var downs int
+	ntb.c1.AddConnectionStatusCallback(func(_ NodeID, connected bool) {
+		statusL.Lock()
+		defer statusL.Unlock()
+		if !connected {
+			downs++
+		}
+	})
+
+	events1, mbox1 := ntb.c1.NewMailbox()
+	defer mbox1.Terminate()
+	ntb.c1.SubscribeLinkEvents(events1)
+	events2, mbox2 := ntb.c2.NewMailbox()
+	defer mbox2.Terminate()
+	ntb.c2.SubscribeLinkEvents(events2)
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+
+	awaitIdleLink(t, mbox1, 2)
+	awaitIdleLink(t, mbox2, 1)
+	if !ntb.remote1to2.isDormant() || !ntb.remote2to1.isDormant() {
+		t.Fatal("Idle link was not dormant on both sides")
+	}
+
+	// The dialing node makes the link again as soon as it has something
+	// to send.
+	ntb.rem1_2.Send("wake up")
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "wake up" {
+		t.Fatal("Message over the idle link was not delivered:", msg)
+	}
+
+	// The other node's messages wait for the dialing node to check in.
+	awaitIdleLink(t, mbox1, 2)
+	awaitIdleLink(t, mbox2, 1)
+	ntb.rem1_1.Send("checking in")
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "checking in" {
+		t.Fatal("Message from the accepting node was not delivered:", msg)
+	}
+
+	statusL.Lock()
+	defer statusL.Unlock()
+	if downs != 0 {
+		t.Fatal("Idle link was reported as disconnected:", downs)
+	}
+}
+
+// While the link is dormant, the messages for the node wait in the queue,
+// and the rest of what Serve does, such as stopping, carries on.
+func TestDormantLinkKeepsServing(t *testing.T) {
+	spec := testSpec()
+	// This has to be long enough for the dialing node not to check in
+	// before the test is done.
+	spec.LinkIdleTimeout = "250ms"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+
+	abandoned := make(chan interface{}, 1)
+	ntb.c2.SetUnroutableHandler(func(_ MailboxID, msg interface{}) bool {
+		abandoned <- msg
+		return true
+	})
+	events, mbox := ntb.c2.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c2.SubscribeLinkEvents(events)
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	awaitIdleLink(t, mbox, 1)
+
+	// The accepting node can't make the link again, so this waits for the
+	// dialing node to check in...
+	ntb.rem1_1.Send("held")
+	deadline := time.Now().Add(timeout)
+	for ntb.remote2to1.outgoingMailbox.len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Message was not held in the queue")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// ... but Serve still stops when asked.
+	ntb.remote2to1.Stop()
+	select {
+	case msg := <-abandoned:
+		if msg != "held" {
+			t.Fatal("Unexpected message abandoned:", msg)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Serve did not stop while the link was dormant")
+	}
+}
+
+func TestLinkIdleTimeoutBusy(t *testing.T) {
+	spec := testSpec()
+	spec.LinkIdleTimeout = "100ms"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	ntb.c1.waitForConnection(2)
+
+	// A link in use is never closed.
+	for i := 0; i < 10; i++ {
+		ntb.rem1_2.Send(i)
+		if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != i {
+			t.Fatal("Message was not delivered:", msg)
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	for {
+		msg, ok := mbox.ReceiveNextAsync()
+		if !ok {
+			break
+		}
+		if event := msg.(LinkEvent); event.State == LinkIdle {
+			t.Fatal("Busy link was closed for being idle")
+		}
+	}
+}
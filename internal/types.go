@@ -11,40 +11,124 @@ package internal
 
 import (
 	"encoding/gob"
+	"time"
 )
 
-func init() {
-	var nnot NotifyNodeOnTerminate
-	var _ ClusterMessage = (*NotifyNodeOnTerminate)(nil)
-	gob.Register(&nnot)
-
-	var rmt RemoteMailboxTerminated
-	var _ ClusterMessage = (*RemoteMailboxTerminated)(nil)
-	gob.Register(&rmt)
-
-	var rnnot RemoveNotifyNodeOnTerminate
-	var _ ClusterMessage = (*RemoveNotifyNodeOnTerminate)(nil)
-	gob.Register(&rnnot)
-
-	var omm OutgoingMailboxMessage
-	var _ ClusterMessage = (*OutgoingMailboxMessage)(nil)
-	gob.Register(&omm)
+// WireTypes holds one of each of the types reign itself sends between
+// nodes, as the pointers they are registered with gob as. They are all
+// registered here, and the reign package checks that each can be encoded
+// when a cluster is created. A new type goes here, and in Normalize.
+var WireTypes = []interface{}{
+	&NotifyNodeOnTerminate{},
+	&RemoteMailboxTerminated{},
+	&RemoteMailboxesTerminated{},
+	&NotifyNodeOnTerminates{},
+	&RemoveNotifyNodeOnTerminate{},
+	&OutgoingMailboxMessage{},
+	&IncomingMailboxMessage{},
+	&PanicHandler{},
+	&Ping{},
+	&Pong{},
+	&LinkIdle{},
+	&ControlMessage{},
+	&ReliableAck{},
+	&NotifyConfirmed{},
+	&StreamAck{},
+	&StreamChunk{},
+	&RegisterName{},
+	&UnregisterName{},
+	&HandoverName{},
+}
 
-	var imm IncomingMailboxMessage
-	var _ ClusterMessage = (*IncomingMailboxMessage)(nil)
-	gob.Register(&imm)
+// These are sent on their own; the rest only travel inside an
+// IncomingMailboxMessage.
+var (
+	_ ClusterMessage = (*NotifyNodeOnTerminate)(nil)
+	_ ClusterMessage = (*RemoteMailboxTerminated)(nil)
+	_ ClusterMessage = (*RemoteMailboxesTerminated)(nil)
+	_ ClusterMessage = (*NotifyNodeOnTerminates)(nil)
+	_ ClusterMessage = (*RemoveNotifyNodeOnTerminate)(nil)
+	_ ClusterMessage = (*OutgoingMailboxMessage)(nil)
+	_ ClusterMessage = (*IncomingMailboxMessage)(nil)
+	_ ClusterMessage = (*PanicHandler)(nil)
+	_ ClusterMessage = (*Ping)(nil)
+	_ ClusterMessage = (*Pong)(nil)
+	_ ClusterMessage = (*LinkIdle)(nil)
+	_ ClusterMessage = (*ControlMessage)(nil)
+	_ ClusterMessage = (*ReliableAck)(nil)
+	_ ClusterMessage = (*NotifyConfirmed)(nil)
+	_ ClusterMessage = (*StreamAck)(nil)
+)
 
-	var ph PanicHandler
-	var _ ClusterMessage = (*PanicHandler)(nil)
-	gob.Register(&ph)
+func init() {
+	for _, wireType := range WireTypes {
+		gob.Register(wireType)
+	}
+}
 
-	var ping Ping
-	var _ ClusterMessage = (*Ping)(nil)
-	gob.Register(&ping)
+// Normalize returns the value form of a message decoded from the wire.
+//
+// The types above are registered with gob as pointers, so that is what
+// decoding produces, while the node itself builds and sends them as
+// values. Everything that receives from a connection passes the message
+// through here, so the handlers only ever see values. The Message of an
+// IncomingMailboxMessage is normalized as well, for the types that travel
+// inside one. A new type in WireTypes must be added here, too.
+func Normalize(cm ClusterMessage) ClusterMessage {
+	switch msg := cm.(type) {
+	case *NotifyNodeOnTerminate:
+		return *msg
+	case *RemoteMailboxTerminated:
+		return *msg
+	case *RemoteMailboxesTerminated:
+		return *msg
+	case *NotifyNodeOnTerminates:
+		return *msg
+	case *RemoveNotifyNodeOnTerminate:
+		return *msg
+	case *OutgoingMailboxMessage:
+		return *msg
+	case *IncomingMailboxMessage:
+		imm := *msg
+		imm.Message = normalizePayload(imm.Message)
+		return imm
+	case IncomingMailboxMessage:
+		msg.Message = normalizePayload(msg.Message)
+		return msg
+	case *PanicHandler:
+		return *msg
+	case *Ping:
+		return *msg
+	case *Pong:
+		return *msg
+	case *LinkIdle:
+		return *msg
+	case *ControlMessage:
+		return *msg
+	case *ReliableAck:
+		return *msg
+	case *NotifyConfirmed:
+		return *msg
+	case *StreamAck:
+		return *msg
+	}
+	return cm
+}
 
-	var pong Pong
-	var _ ClusterMessage = (*Pong)(nil)
-	gob.Register(&pong)
+// normalizePayload is Normalize for the types that are carried in an
+// IncomingMailboxMessage rather than sent on their own.
+func normalizePayload(payload interface{}) interface{} {
+	switch msg := payload.(type) {
+	case *StreamChunk:
+		return *msg
+	case *RegisterName:
+		return *msg
+	case *UnregisterName:
+		return *msg
+	case *HandoverName:
+		return *msg
+	}
+	return payload
 }
 
 // IntNodeID reflects the NodeID type in the main package.
@@ -90,6 +174,21 @@ type UnregisterName struct {
 	Node      IntNodeID
 	Name      string
 	MailboxID IntMailboxID
+	// Successor, if set, is the claim the MailboxID's is being handed
+	// over to, which the receiving registry adds first if it hasn't yet
+	// heard of it.
+	Successor IntMailboxID
+}
+
+// HandoverName is part of the internal registry's private communication,
+// carrying a reign.Names.Handover from the node the To mailbox is on,
+// which registers it, to the one the From mailbox is on, which then
+// unregisters that.
+type HandoverName struct {
+	Name       string
+	From       IntMailboxID
+	To         IntMailboxID
+	Registered bool
 }
 
 // UnregisterMailbox is part of the internal registry's private communication.
@@ -100,9 +199,15 @@ type UnregisterMailbox struct {
 
 // ClusterHandshake is part of the cluster connection process.
 type ClusterHandshake struct {
-	ClusterVersion uint16
-	MyNodeID       IntNodeID
-	YourNodeID     IntNodeID
+	ClusterVersion    uint16
+	MinClusterVersion uint16
+	MyNodeID          IntNodeID
+	YourNodeID        IntNodeID
+	Namespace         string
+	Instance          string
+	// Metadata is the sending node's ClusterSpec.Metadata. Nodes from
+	// before it was added send none, and ignore it.
+	Metadata map[string]string
 }
 
 // ClusterMessage is a tag used to identify messages the cluster can send
@@ -115,9 +220,23 @@ type ClusterMessage interface {
 // gob's sake.
 type NotifyNodeOnTerminate struct {
 	IntMailboxID
+	// ConfirmID is non-zero for a notification registered with
+	// reign.Address.NotifyAddressOnTerminateConfirmed, which the receiving
+	// node confirms with a NotifyConfirmed. It is only sent to nodes of
+	// protocol version 11 or later.
+	ConfirmID uint64
+}
+
+func (nnot NotifyNodeOnTerminate) isClusterMessage() {}
+
+// NotifyNodeOnTerminates is the batched form of NotifyNodeOnTerminate,
+// used when reign.NotifyBatchWindow is set. It is an internal
+// message, public only for gob's sake.
+type NotifyNodeOnTerminates struct {
+	IntMailboxIDs []IntMailboxID
 }
 
-func (nnot *NotifyNodeOnTerminate) isClusterMessage() {}
+func (nnots NotifyNodeOnTerminates) isClusterMessage() {}
 
 // RemoveNotifyNodeOnTerminate is an internal message, public only for
 // gob's sake.
@@ -125,15 +244,53 @@ type RemoveNotifyNodeOnTerminate struct {
 	IntMailboxID
 }
 
-func (rnnot *RemoveNotifyNodeOnTerminate) isClusterMessage() {}
+func (rnnot RemoveNotifyNodeOnTerminate) isClusterMessage() {}
 
 // RemoteMailboxTerminated is an internal message, public only for gob's
 // sake.
 type RemoteMailboxTerminated struct {
 	IntMailboxID
+	// Reason is a reign.TerminationReason. Older nodes don't send it, which
+	// leaves it at zero, a normal termination.
+	Reason uint8
+}
+
+func (rmt RemoteMailboxTerminated) isClusterMessage() {}
+
+// RemoteMailboxesTerminated is the batched form of RemoteMailboxTerminated,
+// used when several terminations are ready to go at once. It is an
+// internal message, public only for gob's sake.
+type RemoteMailboxesTerminated struct {
+	IntMailboxIDs []IntMailboxID
+	// Reasons parallels IntMailboxIDs; see RemoteMailboxTerminated. It is
+	// empty if every termination was normal.
+	Reasons []uint8
 }
 
-func (rmt *RemoteMailboxTerminated) isClusterMessage() {}
+func (rmst RemoteMailboxesTerminated) isClusterMessage() {}
+
+// StreamChunk is one piece of a message sent with SendStream. It travels
+// as the Message of an OutgoingMailboxMessage, so that it takes its place
+// in the queue to the remote node like any other message. It is an
+// internal message, public only for gob's sake.
+type StreamChunk struct {
+	Stream uint64
+	Seq    uint32
+	Data   []byte
+	Final  bool
+	Abort  bool
+}
+
+// StreamAck acknowledges the pieces of the stream up to and including
+// Seq, or, if Refused, tells the sender the receiver has given up on the
+// stream. It is an internal message, public only for gob's sake.
+type StreamAck struct {
+	Stream  uint64
+	Seq     uint32
+	Refused bool
+}
+
+func (sa StreamAck) isClusterMessage() {}
 
 // DestroyConnection is used internally to simulate connection loss.
 type DestroyConnection struct{}
@@ -144,6 +301,9 @@ func (dc DestroyConnection) isClusterMessage() {}
 type OutgoingMailboxMessage struct {
 	Target  IntMailboxID
 	Message interface{}
+	// Queued is when the message was queued, for
+	// Cluster.OutgoingQueueMaxAge.
+	Queued time.Time
 }
 
 func (omm OutgoingMailboxMessage) isClusterMessage() {}
@@ -152,6 +312,35 @@ func (omm OutgoingMailboxMessage) isClusterMessage() {}
 type IncomingMailboxMessage struct {
 	Target  IntMailboxID
 	Message interface{}
+	// Deadline is the zero time unless the message was sent with
+	// SendWithDeadline.
+	Deadline time.Time
+	// TTL is how long the message had left until its Deadline when it was
+	// sent, so the receiving node can expire it by its own clock. Nodes
+	// from before it was added leave it zero.
+	TTL time.Duration
+	// Hops counts the nodes that have relayed the message on; see
+	// reign.ClusterSpec.MaxHops.
+	Hops uint8
+	// Encoded, if set, is the Message gob-encoded on its own, in place of
+	// Message; see reign.ClusterSpec.EncodeWorkers. It is only sent to
+	// nodes of protocol version 6 or later.
+	Encoded []byte
+	// ReliableID is non-zero for a message sent with SendReliable, which
+	// the receiving node acknowledges with a ReliableAck. It is only sent
+	// to nodes of protocol version 7 or later.
+	ReliableID uint64
+	// Compressed is set when Encoded is also compressed with DEFLATE, for
+	// reign.Address.SendCompressed. It is only sent to nodes of protocol
+	// version 10 or later.
+	Compressed bool
+	// EncodeStream, if non-zero, is the encode worker whose gob stream
+	// Encoded is the next part of, rather than a stream of its own, so
+	// that each type is only described the first time the worker sends
+	// it. NewEncodeStream starts the stream over. They are only sent to
+	// nodes of protocol version 13 or later.
+	EncodeStream    uint8
+	NewEncodeStream bool
 }
 
 func (imm IncomingMailboxMessage) isClusterMessage() {}
@@ -181,7 +370,44 @@ type Ping struct{}
 
 func (p Ping) isClusterMessage() {}
 
+// LinkIdle is sent by the dialing node when it is about to close a
+// connection for being idle, so the other node knows it isn't down, with
+// how long the link may then stay closed before it is made again. The
+// other node sends one back once it has stopped sending, and the dialing
+// node closes the connection when that arrives. It is an internal
+// message, public only for gob's sake.
+type LinkIdle struct {
+	Timeout time.Duration
+}
+
+func (li LinkIdle) isClusterMessage() {}
+
 // Pong is sent in reply to a Ping message.
 type Pong struct{}
 
 func (p Pong) isClusterMessage() {}
+
+// ControlMessage carries a message sent with reign's SendControl. It is an
+// internal message, public only for gob's sake.
+type ControlMessage struct {
+	Message interface{}
+}
+
+func (cm ControlMessage) isClusterMessage() {}
+
+// ReliableAck acknowledges the IncomingMailboxMessage with the given
+// ReliableID. It is an internal message, public only for gob's sake.
+type ReliableAck struct {
+	ID uint64
+}
+
+func (ra ReliableAck) isClusterMessage() {}
+
+// NotifyConfirmed confirms the NotifyNodeOnTerminate with the given
+// ConfirmID has been registered. It is an internal message, public only
+// for gob's sake.
+type NotifyConfirmed struct {
+	ID uint64
+}
+
+func (nc NotifyConfirmed) isClusterMessage() {}
@@ -0,0 +1,145 @@
+package reign
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterType(LinkEvent{})
+}
+
+// LinkState is a stage in the life of the link to a remote node. See
+// SubscribeLinkEvents.
+type LinkState int
+
+// The LinkStates a link goes through.
+//
+// The node with the lower NodeID dials the other, so only it will report
+// LinkDialing, LinkHandshaking, and LinkReconnectScheduled; the node that
+// accepts the connection only learns which node is on the other end once
+// the handshake is complete, and goes straight to LinkConnected.
+const (
+	// A TCP connection to the node is being made.
+	LinkDialing LinkState = iota
+	// The TLS and cluster handshakes are being performed.
+	LinkHandshaking
+	// The link is up, and messages can flow across it.
+	LinkConnected
+	// The link is being shut down deliberately, because the cluster is
+	// being stopped.
+	LinkDraining
+	// The link is down. Messages to the node will be dropped.
+	LinkDisconnected
+	// The link failed, and will be redialed after a backoff; see
+	// ReconnectMinDelay.
+	LinkReconnectScheduled
+	// Reconnecting to the node has been given up on, and will not be
+	// tried again; see ReconnectGiveUpAfter.
+	LinkAbandoned
+	// The link was closed for being idle. The node is not considered to
+	// be down, and messages for it are held until the link is made again;
+	// see ClusterSpec.LinkIdleTimeout.
+	LinkIdle
+)
+
+func (ls LinkState) String() string {
+	switch ls {
+	case LinkDialing:
+		return "dialing"
+	case LinkHandshaking:
+		return "handshaking"
+	case LinkConnected:
+		return "connected"
+	case LinkDraining:
+		return "draining"
+	case LinkDisconnected:
+		return "disconnected"
+	case LinkReconnectScheduled:
+		return "reconnect scheduled"
+	case LinkAbandoned:
+		return "abandoned"
+	case LinkIdle:
+		return "idle"
+	default:
+		return "unknown link state"
+	}
+}
+
+// A LinkEvent is sent to the subscribed addresses when the link to a
+// remote node changes state. The Instance is what the node sent the last
+// time it connected, so a LinkConnected with a different Instance than
+// the one before means the node has restarted; see ClusterSpec.Instance.
+type LinkEvent struct {
+	Node     NodeID
+	State    LinkState
+	Time     time.Time
+	Instance string
+}
+
+// linkEvents holds the subscribers to the LinkEvents.
+type linkEvents struct {
+	subscribers map[MailboxID]*Address
+	sync.RWMutex
+}
+
+// SubscribeLinkEvents causes a LinkEvent to be sent to the given address
+// whenever the link to any remote node changes state. This is a more
+// detailed version of AddConnectionStatusCallback, delivered as messages
+// so it can drive a state machine in an ordinary mailbox loop.
+//
+// The events are sent from the goroutines managing the links, after the
+// fact, so by the time one is received the link may have moved on.
+// Subscribing the same address twice has no additional effect.
+func (cs *connectionServer) SubscribeLinkEvents(addr *Address) {
+	cs.linkEvents.Lock()
+	defer cs.linkEvents.Unlock()
+
+	if cs.linkEvents.subscribers == nil {
+		cs.linkEvents.subscribers = make(map[MailboxID]*Address)
+	}
+	cs.linkEvents.subscribers[addr.GetID()] = addr
+}
+
+// UnsubscribeLinkEvents stops sending LinkEvents to the given address.
+func (cs *connectionServer) UnsubscribeLinkEvents(addr *Address) {
+	cs.linkEvents.Lock()
+	defer cs.linkEvents.Unlock()
+
+	delete(cs.linkEvents.subscribers, addr.GetID())
+}
+
+func (cs *connectionServer) linkEvent(node NodeID, state LinkState) {
+	switch state {
+	case LinkConnected:
+		instance := ""
+		if rm, exists := cs.remoteMailboxes[node]; exists {
+			instance = rm.peerInstance()
+		}
+		cs.clusterEvent(EventConnected, node, fmt.Sprintf("instance %q", instance))
+	case LinkDisconnected:
+		cs.clusterEvent(EventDisconnected, node, "")
+	}
+
+	// A subscriber may be on another node, and sending to it may wait for
+	// room in the outgoing queue, so the lock isn't held for the sends.
+	cs.linkEvents.RLock()
+	subscribers := make([]*Address, 0, len(cs.linkEvents.subscribers))
+	for _, addr := range cs.linkEvents.subscribers {
+		subscribers = append(subscribers, addr)
+	}
+	cs.linkEvents.RUnlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	event := LinkEvent{Node: node, State: state, Time: cs.clock.Now()}
+	if rm, exists := cs.remoteMailboxes[node]; exists {
+		event.Instance = rm.peerInstance()
+	}
+	for _, addr := range subscribers {
+		addr.Send(event)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,11 +19,49 @@ import (
 // Defaults to 30 seconds.
 var PingInterval = time.Second * 30
 
+// pingClock times the round trip of the pings sent over a connection.
+type pingClock struct {
+	sent time.Time
+	sync.Mutex
+}
+
+func (pc *pingClock) start() {
+	pc.Lock()
+	defer pc.Unlock()
+	pc.sent = time.Now()
+}
+
+// stop returns how long ago the ping now answered was sent, if there was
+// one.
+func (pc *pingClock) stop() (time.Duration, bool) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.sent.IsZero() {
+		return 0, false
+	}
+	rtt := time.Since(pc.sent)
+	pc.sent = time.Time{}
+	return rtt, true
+}
+
 // DeadlineInterval determine how long to keep the network connection open after
 // a successful read.  The net.Conn deadline value will be reset to time.Now().Add(DeadlineInterval)
 // upon each successful message read over the network.  Defaults to 5 minutes.
 var DeadlineInterval = time.Minute * 5
 
+// ListenerRebindDelay determines how long the listener waits before trying
+// to listen again after its listening socket has failed, for instance
+// because the interface it was bound to went away. A negative value
+// disables rebinding, leaving this node with no incoming connections until
+// the listener is restarted. Defaults to 5 seconds.
+var ListenerRebindDelay = time.Second * 5
+
+// These bound the delay between Accept calls after a temporary error.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
 // This file defines the listener, which listens for incoming node connections,
 // and the handler that the listeners run.
 
@@ -33,6 +72,10 @@ type nodeListener struct {
 	stopped          bool
 	ClusterLogger
 
+	// addr is the address to listen on if this is one of the node's
+	// alternate listeners; nil means the node's listenaddr.
+	addr *net.TCPAddr
+
 	// Once constructed by connection.go, this map is read-only, so no sync
 	// is necessary.
 	remoteMailboxes map[NodeID]*remoteMailboxes
@@ -42,6 +85,10 @@ type nodeListener struct {
 	// test criteria
 	failOnSSLHandshake     bool
 	failOnClusterHandshake bool
+
+	// listen is used by the tests to substitute the listening socket; if
+	// nil, net.ListenTCP is used.
+	listen func(*net.TCPAddr) (net.Listener, error)
 }
 
 func newNodeListener(node *NodeDefinition, connectionServer *connectionServer) *nodeListener {
@@ -51,6 +98,14 @@ func newNodeListener(node *NodeDefinition, connectionServer *connectionServer) *
 	return nl
 }
 
+// listenAddr returns the address this listener binds to.
+func (nl *nodeListener) listenAddr() *net.TCPAddr {
+	if nl.addr != nil {
+		return nl.addr
+	}
+	return nl.node.listenaddr
+}
+
 func (nl *nodeListener) mailboxesForNode(id NodeID) *remoteMailboxes {
 	mailboxes, exists := nl.remoteMailboxes[id]
 	if !exists {
@@ -86,10 +141,15 @@ func (nl *nodeListener) String() string {
 	nl.Lock()
 	defer nl.Unlock()
 
+	if nl.addr != nil {
+		return fmt.Sprintf("nodeListener %d on %s", nl.node.ID, nl.addr)
+	}
 	return fmt.Sprintf("nodeListener %d on %s", nl.node.ID, nl.node.Address)
 }
 
 func (nl *nodeListener) Serve() {
+	defer nl.connectionServer.running(fmt.Sprintf("listener on %s", nl.listenAddr()))()
+
 	// This locks for the duration of a net.ListenTCP call. I *think* we can
 	// assume this is a pretty fast call; either the OS gives it to you or
 	// it doesn't. If so, I think this is all safe with .Stop(). If not,
@@ -108,12 +168,12 @@ func (nl *nodeListener) Serve() {
 
 	nl.listener = nil
 
-	if nl.node.listenaddr == nil {
+	if nl.listenAddr() == nil {
 		nl.Unlock()
 		panic(fmt.Sprintf("Cannot start listener for node %d because we have no ListenAddress", nl.node.ID))
 	}
 
-	listener, err := net.ListenTCP("tcp", nl.node.listenaddr)
+	listener, err := nl.listenTCP()
 	if err != nil {
 		nl.Unlock()
 		panic(fmt.Sprintf("Cannot start listener on node %d because while trying to listen we received: %s", nl.node.ID, err.Error()))
@@ -124,34 +184,142 @@ func (nl *nodeListener) Serve() {
 
 	nl.condition.Broadcast()
 
+	for {
+		err = nl.accept()
+		if nl.isStopped() {
+			return
+		}
+
+		nl.Errorf("Lost listener for cluster on %s: %s", nl.listenAddr(), myString(err))
+		if metrics := nl.connectionServer.metrics.get(); metrics != nil {
+			metrics.AddCounter(MetricListenerFailures, map[string]string{
+				"node": strconv.Itoa(int(nl.node.ID)),
+			}, 1)
+		}
+
+		if ListenerRebindDelay < 0 {
+			nl.Errorf("Listener rebinding is disabled; node %d will accept no cluster connections until the listener is restarted", nl.node.ID)
+			nl.waitForStop(-1)
+			return
+		}
+
+		if !nl.rebind() {
+			return
+		}
+	}
+}
+
+func (nl *nodeListener) listenTCP() (net.Listener, error) {
+	if nl.listen != nil {
+		return nl.listen(nl.listenAddr())
+	}
+	return net.ListenTCP("tcp", nl.listenAddr())
+}
+
+// accept accepts connections until the listener fails, which is also how
+// it stops. Temporary errors are retried with an increasing delay.
+func (nl *nodeListener) accept() error {
+	var delay time.Duration
 	for {
 		conn, err := nl.listener.Accept()
 		if err != nil {
-			if nl.stopped {
-				return
+			if ne, isNetErr := err.(net.Error); isNetErr && ne.Temporary() && !nl.isStopped() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				nl.Warnf("Temporary error accepting cluster connection: %s; retrying in %s", myString(err), delay)
+				<-nl.connectionServer.clock.After(delay)
+				continue
 			}
-
-			nl.Errorf("Lost listener for cluster: %s", myString(err))
-			return
+			return err
 		}
+		delay = 0
 
 		from := conn.RemoteAddr().String()
 		nl.Infof("Cluster connection received from %s", from)
 
 		incoming := &incomingConnection{nodeListener: nl, tcpConn: conn,
 			conn: conn, server: nl.node}
-		go incoming.handleConnection()
+		nl.connectionServer.goroutine("connection from "+from, incoming.handleConnection)
 	}
 }
 
+// rebind waits out the ListenerRebindDelay, then tries to listen again,
+// repeating until it succeeds. It returns false if the listener was
+// stopped in the meantime.
+func (nl *nodeListener) rebind() bool {
+	nl.Lock()
+	nl.listener = nil
+	nl.Unlock()
+
+	for {
+		if nl.waitForStop(ListenerRebindDelay) {
+			return false
+		}
+
+		nl.Infof("Attempting to listen again on %s", nl.listenAddr())
+		listener, err := nl.listenTCP()
+		if err != nil {
+			nl.Errorf("Could not listen again on %s: %s", nl.listenAddr(), myString(err))
+			continue
+		}
+
+		nl.Lock()
+		if nl.stopped {
+			nl.Unlock()
+			listener.Close()
+			return false
+		}
+		nl.listener = listener
+		nl.Unlock()
+		nl.condition.Broadcast()
+		return true
+	}
+}
+
+func (nl *nodeListener) isStopped() bool {
+	nl.Lock()
+	defer nl.Unlock()
+	return nl.stopped
+}
+
+// waitForStop waits up to the given duration for the listener to be
+// stopped, returning whether it was. A negative duration waits forever.
+func (nl *nodeListener) waitForStop(d time.Duration) bool {
+	nl.Lock()
+	defer nl.Unlock()
+
+	expired := false
+	if d >= 0 {
+		timer := time.AfterFunc(d, func() {
+			nl.Lock()
+			expired = true
+			nl.Unlock()
+			nl.condition.Broadcast()
+		})
+		defer timer.Stop()
+	}
+
+	for !nl.stopped && !expired {
+		nl.condition.Wait()
+	}
+	return nl.stopped
+}
+
 // FIXME: When it's more clear what's going on, collapse this with nodeConnection
 // as there's currently a lot of duplication here
 type incomingConnection struct {
 	*nodeListener
 	remoteMailboxes *remoteMailboxes
 
-	output *gob.Encoder
-	input  *gob.Decoder
+	output  *gob.Encoder
+	input   *gob.Decoder
+	streams encodeStreams
 
 	client *NodeDefinition
 	server *NodeDefinition
@@ -159,7 +327,14 @@ type incomingConnection struct {
 	conn      net.Conn // The connection we are actually using to send data
 	tcpConn   net.Conn // The raw TCP connection, no matter what we're doing
 	tls       net.Conn // The TLS connection, if any
-	pingTimer *time.Timer
+	pingTimer clockTimer
+	pings     pingClock
+
+	// the protocol version agreed on in the cluster handshake, and the
+	// Instance and Metadata the other node sent in it
+	version  uint16
+	instance string
+	metadata map[string]string
 }
 
 // resetConnectionDeadline resets the network connection's deadline to
@@ -178,7 +353,7 @@ func (ic *incomingConnection) resetPingTimer(d time.Duration) {
 	defer ic.Unlock()
 
 	if ic.pingTimer == nil {
-		ic.pingTimer = time.NewTimer(d)
+		ic.pingTimer = ic.nodeListener.connectionServer.clock.NewTimer(d)
 
 		return
 	}
@@ -237,6 +412,7 @@ func (ic *incomingConnection) handleConnection() {
 	ic.Tracef("Node %d listener got connection", ic.server.ID)
 	err := ic.sslHandshake()
 	if err != nil {
+		ic.rejected("TLS", err)
 		// FIXME: This ought to wrap the error somehow, not smash to string,
 		// which would frankly be hypocritical
 		panic("Could not SSL handshake the incoming connection: " + err.Error())
@@ -246,12 +422,19 @@ func (ic *incomingConnection) handleConnection() {
 	err = ic.clusterHandshake()
 	if err != nil {
 		ic.Errorf("Could not cluster handshake the incoming connection: " + err.Error())
+		ic.rejected("cluster", err)
+		ic.terminate()
 		return
 	}
 	ic.Tracef("Node %d listener successfully cluster handshook", ic.server.ID)
 
 	ic.remoteMailboxes = ic.mailboxesForNode(ic.client.ID)
-	ic.remoteMailboxes.setConnection(ic)
+	err = ic.remoteMailboxes.openConnection(ic, ic.version, ic.instance, ic.metadata)
+	if err != nil {
+		ic.Errorf("Could not use the incoming connection: %s", err.Error())
+		ic.terminate()
+		return
+	}
 	defer ic.remoteMailboxes.unsetConnection(ic)
 
 	// Synchronize registry with the remote node.
@@ -265,6 +448,28 @@ func (ic *incomingConnection) handleConnection() {
 	ic.handleIncomingMessages()
 }
 
+// rejected records that the incoming connection failed the given stage of
+// the handshake, under the node it claimed to be if it got that far.
+func (ic *incomingConnection) rejected(stage string, err error) {
+	from := "an unknown address"
+	if ic.tcpConn != nil {
+		from = ic.tcpConn.RemoteAddr().String()
+	}
+	detail := fmt.Sprintf("%s handshake from %s: %s", stage, from, myString(err))
+	if ic.client == nil {
+		ic.connectionServer.unidentifiedRejection(detail)
+		return
+	}
+	ic.connectionServer.clusterEvent(EventRejected, ic.client.ID, detail)
+}
+
+func (ic *incomingConnection) tlsState() (tls.ConnectionState, bool) {
+	if tlsConn, isTLS := ic.tls.(*tls.Conn); isTLS {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
 // FIXME: This ought to be refactored with the node
 func (ic *incomingConnection) sslHandshake() (err error) {
 	ic.Tracef("Node %d listener in sslHandshake", ic.server.ID)
@@ -286,7 +491,8 @@ func (ic *incomingConnection) sslHandshake() (err error) {
 	ic.tls = tls
 	ic.conn = tls
 	ic.output = gob.NewEncoder(ic.conn)
-	ic.input = gob.NewDecoder(ic.conn)
+	// This is only for the handshake; see maxHandshakeSize.
+	ic.input = gob.NewDecoder(io.LimitReader(ic.conn, maxHandshakeSize))
 
 	return nil
 }
@@ -307,29 +513,64 @@ func (ic *incomingConnection) clusterHandshake() (err error) {
 	myNodeID := NodeID(clientHandshake.MyNodeID)
 	yourNodeID := NodeID(clientHandshake.YourNodeID)
 
-	if clientHandshake.ClusterVersion != clusterVersion {
-		ic.Warnf("Remote node %d claimed unknown cluster version %v, proceeding in the hope that this will all just work out somehow...",
-			clientHandshake.MyNodeID, clientHandshake.ClusterVersion)
-	}
-	if yourNodeID != ic.nodeListener.connectionServer.Cluster.ThisNode.ID {
-		ic.Warnf("The remote node (claiming ID %d) thinks I'm node %d, but I think I'm node %d. These two nodes can not communicate properly. Standing by, hoping a new node definition will resolve this shortly...",
-			clientHandshake.MyNodeID, clientHandshake.YourNodeID, ic.nodeListener.connectionServer.Cluster.ThisNode.ID)
-	}
+	thisNodeID := ic.nodeListener.connectionServer.Cluster.ThisNode.ID
 
+	// Accepting a peer under the wrong ID would route its messages to
+	// mailboxes on some other node, so these are fatal to the connection.
+	// They are only returned after sending our handshake, so the other
+	// side can log the problem too.
+	var idErr error
 	clientNodeDefinition, exists := ic.nodeListener.connectionServer.Cluster.Nodes[myNodeID]
-	if !exists {
-		ic.Errorf("Connecting node claims to be node %d, but I don't have a definition for that node ID.", clientHandshake.MyNodeID)
+	switch {
+	case yourNodeID != thisNodeID:
+		idErr = fmt.Errorf("the remote node (claiming ID %d) thinks I'm node %d, but I think I'm node %d; refusing the connection until the node definitions agree",
+			myNodeID, yourNodeID, thisNodeID)
+	case myNodeID == thisNodeID:
+		idErr = fmt.Errorf("connecting node claims to be node %d, which is my own node ID", myNodeID)
+	case !exists:
+		idErr = fmt.Errorf("connecting node claims to be node %d, but I don't have a definition for that node ID", myNodeID)
+	case myNodeID > thisNodeID:
+		// Lower node IDs connect to higher ones, so node myNodeID is
+		// one we connect to ourselves.
+		idErr = fmt.Errorf("connecting node claims to be node %d, but I connect to that node, it doesn't connect to me", myNodeID)
 	}
 	ic.client = clientNodeDefinition
 
 	myHandshake := internal.ClusterHandshake{
-		ClusterVersion: clusterVersion,
-		MyNodeID:       internal.IntNodeID(ic.nodeListener.connectionServer.Cluster.ThisNode.ID),
-		YourNodeID:     clientHandshake.MyNodeID,
+		ClusterVersion:    clusterVersion,
+		MinClusterVersion: minClusterVersion,
+		MyNodeID:          internal.IntNodeID(ic.nodeListener.connectionServer.Cluster.ThisNode.ID),
+		YourNodeID:        clientHandshake.MyNodeID,
+		Namespace:         ic.nodeListener.connectionServer.Cluster.Namespace,
+		Instance:          ic.nodeListener.connectionServer.Cluster.Instance,
+		Metadata:          ic.nodeListener.connectionServer.Cluster.Metadata,
 	}
 
+	// We still send our handshake on a version or namespace mismatch, so
+	// the other side can log the problem too.
 	ic.output.Encode(myHandshake)
 
+	if idErr != nil {
+		err = idErr
+		return
+	}
+
+	ic.version, err = negotiateVersion(myNodeID, clientHandshake)
+	if err != nil {
+		return
+	}
+	if ic.version != clusterVersion {
+		ic.Warnf("Node %d only speaks cluster protocol version %d; running the connection to it in degraded mode",
+			myNodeID, ic.version)
+	}
+
+	err = checkNamespace(myNodeID, clientHandshake.Namespace, myHandshake.Namespace)
+	if err != nil {
+		return
+	}
+	ic.instance = remoteInstance(clientHandshake.Instance)
+	ic.metadata = ic.nodeListener.connectionServer.remoteMetadata(myNodeID, clientHandshake.Metadata)
+
 	ic.input = gob.NewDecoder(ic.tls)
 
 	return
@@ -387,14 +628,17 @@ func (ic *incomingConnection) handleIncomingMessages() {
 	)
 
 	// Report the successful connection, and defer the disconnection status change call.
-	ic.connectionServer.changeConnectionStatus(ic.client.ID, true)
-	defer ic.connectionServer.changeConnectionStatus(ic.client.ID, false)
+	ic.remoteMailboxes.reportStatus(true)
+	defer ic.remoteMailboxes.connectionEnded(ic)
+	ic.remoteMailboxes.markReady(ic)
+	ic.connectionServer.linkReady(ic.client.ID)
+	ic.remoteMailboxes.Send(connectionReady{})
 
 	defer close(done)
 
 	ic.resetConnectionDeadline(DeadlineInterval)
 
-	go func() {
+	ic.connectionServer.goroutine(fmt.Sprintf("pings to node %d", ic.client.ID), func() {
 		var pErr error
 
 		// Send PING messages to the remote node at regular intervals.
@@ -404,7 +648,8 @@ func (ic *incomingConnection) handleIncomingMessages() {
 
 		for {
 			select {
-			case <-ic.pingTimer.C:
+			case <-ic.pingTimer.Chan():
+				ic.pings.start()
 				pErr = ic.output.Encode(&ping)
 				if pErr != nil {
 					ic.Errorf("Attempted to ping node %d: %s", ic.client.ID, pErr)
@@ -414,32 +659,48 @@ func (ic *incomingConnection) handleIncomingMessages() {
 				return
 			}
 		}
-	}()
+	})
 
 	for err == nil {
-		err = ic.input.Decode(&cm)
+		cm, err = decodeClusterMessage(ic.input, &ic.streams)
+		if pe, isPayload := err.(payloadError); isPayload {
+			ic.remoteMailboxes.undecodable(pe)
+			ic.resetConnectionDeadline(DeadlineInterval)
+			err = nil
+			continue
+		}
 		switch err {
 		case nil:
 			// We received a message.  No need to PING the remote node.
 			ic.resetPingTimer(PingInterval)
 
 			switch cm.(type) {
-			case *internal.Ping:
+			case internal.Ping:
 				err = ic.output.Encode(&pong)
 				if err != nil {
 					ic.Errorf("Attempted to pong node %d: %s", ic.client.ID, err)
 				}
-			case *internal.Pong:
+			case internal.Pong:
+				if rtt, timed := ic.pings.stop(); timed {
+					ic.remoteMailboxes.recordLatency(rtt)
+				}
+			case internal.LinkIdle:
+				ic.remoteMailboxes.goDormant(ic, cm.(internal.LinkIdle))
 			default:
-				err = ic.remoteMailboxes.Send(cm)
+				err = ic.remoteMailboxes.receive(cm)
 				if err != nil {
 					ic.Errorf("Error handling message %#v:\n%#v", cm, err)
 				}
 			}
 			ic.resetConnectionDeadline(DeadlineInterval)
 		case io.EOF:
-			ic.Errorf("Connection to node ID %v has gone down", ic.client.ID)
+			if !ic.remoteMailboxes.closedIdle(ic) {
+				ic.Errorf("Connection to node ID %v has gone down", ic.client.ID)
+			}
 		default:
+			if ic.remoteMailboxes.closedIdle(ic) {
+				return
+			}
 			panic(fmt.Sprintf("Error decoding message: %s", err))
 		}
 	}
@@ -455,4 +716,7 @@ func (nl *nodeListener) Stop() {
 	} else {
 		nl.stopped = true
 	}
+	if nl.condition != nil {
+		nl.condition.Broadcast()
+	}
 }
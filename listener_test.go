@@ -1,9 +1,16 @@
 package reign
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
 )
 
 func TestCoverNilListener(t *testing.T) {
@@ -85,10 +92,107 @@ func TestNodeListenerErrors(t *testing.T) {
 	}()
 	nl.waitForListen()
 	_ = nl.String() // should not block
-	nl.listener.Close()
+	nl.Stop()
 	<-terminated
 }
 
+type tempError struct{}
+
+func (tempError) Error() string   { return "temporary accept failure" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// failingListener returns the given errors from Accept, then blocks until
+// it is closed.
+type failingListener struct {
+	net.Listener
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (fl *failingListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-fl.errs:
+		return nil, err
+	case <-fl.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (fl *failingListener) Close() error {
+	fl.once.Do(func() { close(fl.closed) })
+	return nil
+}
+
+func TestListenerRebinds(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	defer func(d time.Duration) { ListenerRebindDelay = d }(ListenerRebindDelay)
+	ListenerRebindDelay = time.Millisecond
+
+	listens := make(chan *failingListener, 10)
+	nl := ntb.c2.listener
+	nl.listen = func(*net.TCPAddr) (net.Listener, error) {
+		fl := &failingListener{
+			errs:   make(chan error, 10),
+			closed: make(chan struct{}),
+		}
+		listens <- fl
+		return fl, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		nl.Serve()
+		close(done)
+	}()
+
+	fl := <-listens
+	fl.errs <- tempError{}
+	fl.errs <- tempError{}
+	fl.errs <- errors.New("permanent failure")
+
+	var rebound *failingListener
+	select {
+	case rebound = <-listens:
+	case <-time.After(timeout):
+		t.Fatal("Listener was not rebound")
+	}
+	if len(fl.errs) != 0 {
+		t.Fatal("Temporary errors were not retried")
+	}
+
+	nl.Stop()
+	<-done
+	select {
+	case <-rebound.closed:
+	default:
+		t.Fatal("Stopping did not close the rebound listener")
+	}
+
+	// With rebinding disabled, the listener stays down until stopped.
+	ListenerRebindDelay = -1
+	nl.stopped = false
+	done = make(chan struct{})
+	go func() {
+		nl.Serve()
+		close(done)
+	}()
+	fl = <-listens
+	fl.errs <- errors.New("permanent failure")
+	select {
+	case <-listens:
+		t.Fatal("Listener rebound when rebinding is disabled")
+	case <-done:
+		t.Fatal("Listener returned instead of waiting to be stopped")
+	case <-time.After(50 * time.Millisecond):
+	}
+	nl.Stop()
+	<-done
+}
+
 func TestListenerSSLHandshakeFailures(t *testing.T) {
 	ntb := unstartedTestbed(nil)
 	// we never start the servers, so we only need this
@@ -122,6 +226,246 @@ func TestNodeClusterHandshakeFailure(t *testing.T) {
 	thingsTerminateOnFailure(t, ntb)
 }
 
+func TestNamespaceMismatch(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	ntb.c1.Cluster.Namespace = "generation 2"
+	ntb.c2.Cluster.Namespace = "generation 1"
+	thingsTerminateOnFailure(t, ntb)
+
+	if ntb.remote1to2.connection != nil || ntb.remote2to1.connection != nil {
+		t.Fatal("nodes in different namespaces connected to each other")
+	}
+	if checkNamespace(1, "a", "a") != nil {
+		t.Fatal("matching namespaces rejected")
+	}
+}
+
+func TestNodeIDCollisions(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	// node 1 claims to be node 2, the listener's own ID
+	connector := ntb.c1.nodeConnectors[2]
+	realSource := connector.source
+	impostor := *realSource
+	impostor.ID = 2
+	connector.source = &impostor
+	thingsTerminateOnFailure(t, ntb)
+	if ntb.remote2to1.connection != nil {
+		t.Fatal("listener accepted a node claiming its own ID")
+	}
+	connector.source = realSource
+
+	// some other node 1, of the same instance, is already connected
+	existing := &failingSender{}
+	if ntb.remote2to1.setConnection(existing, clusterVersion, ntb.c1.Cluster.Instance) != nil {
+		t.Fatal("could not set the first connection")
+	}
+	thingsTerminateOnFailure(t, ntb)
+	if ntb.remote2to1.connection != existing {
+		t.Fatal("second connection claiming the same node ID replaced the first")
+	}
+	if ntb.remote2to1.setConnection(&failingSender{}, clusterVersion, "") == nil {
+		t.Fatal("setConnection accepted a second connection")
+	}
+
+	// but a new instance is node 1 having restarted, and replaces it
+	restarted := &failingSender{}
+	if err := ntb.remote2to1.setConnection(restarted, clusterVersion, "restarted"); err != nil {
+		t.Fatal("connection from a restarted node refused:", err)
+	}
+	if ntb.remote2to1.connection != restarted || !existing.terminated {
+		t.Fatal("restarted node's connection did not replace the old one")
+	}
+	ntb.remote2to1.unsetConnection(restarted)
+}
+
+func TestLinkTLSState(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	if _, connected := ntb.c1.LinkTLSState(2); connected {
+		t.Fatal("Got a TLS state before connecting")
+	}
+	if _, exists := ntb.c1.LinkTLSState(3); exists {
+		t.Fatal("Got a TLS state for a node not in the cluster")
+	}
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	ntb.c1.waitForConnection(2)
+	ntb.c2.waitForConnection(1)
+
+	// Both ends see the same handshake, from either side of it.
+	client, connected := ntb.c1.LinkTLSState(2)
+	if !connected || !client.HandshakeComplete {
+		t.Fatal("No TLS state for the connection to node 2")
+	}
+	server, connected := ntb.c2.LinkTLSState(1)
+	if !connected || !server.HandshakeComplete {
+		t.Fatal("No TLS state for the connection to node 1")
+	}
+	if len(client.PeerCertificates) == 0 || client.PeerCertificates[0].Subject.CommonName != "2" {
+		t.Fatal("Node 1 doesn't have node 2's certificate:", client.PeerCertificates)
+	}
+	if client.Version != server.Version || client.CipherSuite != server.CipherSuite {
+		t.Fatal("The two ends disagree on the connection:", client, server)
+	}
+
+	// Anything that isn't over TLS has no state.
+	ntb.remote1to2.unsetConnection(ntb.remote1to2.connection)
+	ntb.remote1to2.setConnection(&failingSender{}, clusterVersion, "")
+	if _, connected := ntb.c1.LinkTLSState(2); connected {
+		t.Fatal("Got a TLS state for a connection not over TLS")
+	}
+}
+
+func TestInstance(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	for _, c := range []*connectionServer{ntb.c1, ntb.c2} {
+		if !strings.Contains(c.Cluster.Instance, fmt.Sprintf("pid %d", os.Getpid())) {
+			t.Fatal("Unexpected default instance:", c.Cluster.Instance)
+		}
+	}
+	if _, connected := ntb.c1.RemoteInstance(2); connected {
+		t.Fatal("Got an instance before connecting")
+	}
+
+	ntb.c1.Cluster.Instance = "node 1, run 1"
+	ntb.c2.Cluster.Instance = "node 2, run 1"
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	ntb.c1.waitForConnection(2)
+	ntb.c2.waitForConnection(1)
+
+	if instance, _ := ntb.c1.RemoteInstance(2); instance != "node 2, run 1" {
+		t.Fatal("Node 1 has the wrong instance for node 2:", instance)
+	}
+	if instance, _ := ntb.c2.RemoteInstance(1); instance != "node 1, run 1" {
+		t.Fatal("Node 2 has the wrong instance for node 1:", instance)
+	}
+
+	// A restarted node is reported as a new instance.
+	events, mbox := ntb.c2.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c2.SubscribeLinkEvents(events)
+	ntb.c1.Cluster.Instance = "node 1, run 2"
+	ntb.remote1to2.Send(internal.DestroyConnection{})
+	awaitLinkState(t, mbox, 1, LinkDisconnected)
+	for {
+		msg, ok := mbox.ReceiveNextTimeout(5 * time.Second)
+		if !ok {
+			t.Fatal("Node 1 never reconnected")
+		}
+		if event := msg.(LinkEvent); event.State == LinkConnected {
+			if event.Instance != "node 1, run 2" {
+				t.Fatal("Reconnection reported the wrong instance:", event.Instance)
+			}
+			break
+		}
+	}
+
+	if remoteInstance(strings.Repeat("x", 1000)) != strings.Repeat("x", maxInstanceLength) {
+		t.Fatal("Overlong instances from other nodes aren't cut down")
+	}
+	spec := testSpec()
+	spec.Instance = strings.Repeat("x", maxInstanceLength+1)
+	if _, _, err := createFromSpec(spec, 1, NullLogger); err == nil {
+		t.Fatal("Overlong instance accepted")
+	}
+}
+
+func TestNodeMetadata(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	if _, connected := ntb.c1.NodeMetadata(2); connected {
+		t.Fatal("Got metadata before connecting")
+	}
+	if _, exists := ntb.c1.NodeMetadata(10); exists {
+		t.Fatal("Got metadata for a node that isn't in the cluster")
+	}
+
+	ntb.c1.Cluster.Metadata = map[string]string{"zone": "a", "role": "web"}
+	ntb.c2.Cluster.Metadata = map[string]string{"zone": "b"}
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	ntb.c1.waitForConnection(2)
+	ntb.c2.waitForConnection(1)
+
+	if metadata, _ := ntb.c1.NodeMetadata(2); len(metadata) != 1 || metadata["zone"] != "b" {
+		t.Fatal("Node 1 has the wrong metadata for node 2:", metadata)
+	}
+	metadata, connected := ntb.c2.NodeMetadata(1)
+	if !connected || len(metadata) != 2 || metadata["zone"] != "a" || metadata["role"] != "web" {
+		t.Fatal("Node 2 has the wrong metadata for node 1:", metadata, connected)
+	}
+	metadata["zone"] = "changed"
+	if metadata, _ = ntb.c2.NodeMetadata(1); metadata["zone"] != "a" {
+		t.Fatal("Metadata returned can change the node's")
+	}
+	if metadata, _ = ntb.c1.NodeMetadata(1); metadata["role"] != "web" {
+		t.Fatal("Wrong metadata for this node:", metadata)
+	}
+
+	big := map[string]string{"key": strings.Repeat("x", maxMetadataSize)}
+	if ntb.c1.remoteMetadata(2, big) != nil {
+		t.Fatal("Oversized metadata from another node accepted")
+	}
+	spec := testSpec()
+	spec.Metadata = big
+	if _, _, err := createFromSpec(spec, 1, NullLogger); err == nil {
+		t.Fatal("Oversized metadata accepted")
+	}
+}
+
+// A handshake too large to be from a well-behaved node is refused
+// without reading it all.
+func TestOversizedHandshake(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	ntb.c1.Cluster.Metadata = map[string]string{"key": strings.Repeat("x", 2*maxHandshakeSize)}
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+
+	if !hasEvent(ntb.c2, EventRejected, 2) {
+		t.Fatal("Oversized handshake was not rejected:", ntb.c2.RecentEvents(0))
+	}
+	if _, connected := ntb.c2.NodeMetadata(1); connected {
+		t.Fatal("Node with an oversized handshake connected")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	for _, test := range []struct {
+		theirs, theirMin uint16
+		expected         uint16
+	}{
+		{clusterVersion, minClusterVersion, clusterVersion},
+		{1, 0, 1},
+		{clusterVersion + 1, clusterVersion, clusterVersion},
+		{clusterVersion + 2, clusterVersion + 1, 0},
+		{0, 0, 0},
+	} {
+		version, err := negotiateVersion(1, internal.ClusterHandshake{
+			ClusterVersion:    test.theirs,
+			MinClusterVersion: test.theirMin,
+		})
+		if version != test.expected || (err == nil) != (test.expected != 0) {
+			t.Fatalf("versions %d-%d: got %d, %v", test.theirMin, test.theirs, version, err)
+		}
+	}
+}
+
 func thingsTerminateOnFailure(t *testing.T, ntb *NetworkTestBed) {
 	// this reaches in to serve the listener socket directly
 	done := make(chan struct{})
@@ -169,3 +513,16 @@ func BenchmarkMinimalMessageSend(b *testing.B) {
 		ntb.mailbox1_1.ReceiveNext()
 	}
 }
+
+// Compare with BenchmarkMinimalMessageSend to see what the network costs.
+func BenchmarkLocalMessageSend(b *testing.B) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ntb.addr1_1.Send("a")
+		ntb.mailbox1_1.ReceiveNext()
+	}
+}
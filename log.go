@@ -3,6 +3,8 @@ package reign
 import (
 	"fmt"
 	"log"
+	"sync"
+	"time"
 )
 
 // A ClusterLogger is the logging interface used by the Cluster system.
@@ -33,7 +35,8 @@ import (
 // The goal is that all Errors are things that should fire alarming
 // systems, and all things that should fire alarming systems are Errors.
 //
-// You can wrap a standard *log.Logger with the provided WrapLogger.
+// You can wrap a standard *log.Logger with the provided WrapLogger. To
+// keep an outage from flooding your logs, see SampleLogger.
 type ClusterLogger interface {
 	Error(...interface{})
 	Errorf(format string, args ...interface{})
@@ -139,7 +142,141 @@ func (nl nullLogger) Infof(format string, args ...interface{})  {}
 func (nl nullLogger) Trace(args ...interface{})                 {}
 func (nl nullLogger) Tracef(format string, args ...interface{}) {}
 
+// SampleLogger wraps a ClusterLogger such that identical messages logged
+// at the same level within the given window are collapsed. The first one
+// is passed through immediately; the repeats are counted, and the count is
+// logged with the message once the window has elapsed and either the
+// message recurs or any other message is logged.
+//
+// This is intended for outages, where every failed send to a down node
+// would otherwise produce its own line. Sampling is off unless you wrap
+// your logger with this; a window <= 0 returns the logger unchanged.
+func SampleLogger(l ClusterLogger, window time.Duration) ClusterLogger {
+	if window <= 0 {
+		return l
+	}
+	return &sampleLogger{
+		logger:  l,
+		window:  window,
+		seen:    make(map[sampleKey]*sampleEntry),
+		nowFunc: time.Now,
+	}
+}
+
+type sampleLevel int
+
+const (
+	sampleError sampleLevel = iota
+	sampleWarn
+	sampleInfo
+	sampleTrace
+)
+
+type sampleKey struct {
+	level sampleLevel
+	msg   string
+}
+
+type sampleEntry struct {
+	start      time.Time
+	suppressed int
+}
+
+type sampleLogger struct {
+	logger    ClusterLogger
+	window    time.Duration
+	seen      map[sampleKey]*sampleEntry
+	lastPrune time.Time
+	nowFunc   func() time.Time
+	sync.Mutex
+}
+
+func (sl *sampleLogger) emit(level sampleLevel, msg string) {
+	switch level {
+	case sampleError:
+		sl.logger.Error(msg)
+	case sampleWarn:
+		sl.logger.Warn(msg)
+	case sampleInfo:
+		sl.logger.Info(msg)
+	case sampleTrace:
+		sl.logger.Trace(msg)
+	}
+}
+
+func (sl *sampleLogger) emitSuppressed(key sampleKey, entry *sampleEntry) {
+	sl.emit(key.level, fmt.Sprintf("%s (repeated %d more times in %v)",
+		key.msg, entry.suppressed, sl.window))
+}
+
+func (sl *sampleLogger) log(level sampleLevel, msg string) {
+	sl.Lock()
+	defer sl.Unlock()
+
+	now := sl.nowFunc()
+	key := sampleKey{level, msg}
+
+	// Retire expired entries, so the map doesn't grow without bound and
+	// suppressed counts make it out even if that message never recurs.
+	if now.Sub(sl.lastPrune) >= sl.window {
+		for k, entry := range sl.seen {
+			if k != key && now.Sub(entry.start) >= sl.window {
+				if entry.suppressed > 0 {
+					sl.emitSuppressed(k, entry)
+				}
+				delete(sl.seen, k)
+			}
+		}
+		sl.lastPrune = now
+	}
+
+	entry, exists := sl.seen[key]
+	if exists && now.Sub(entry.start) < sl.window {
+		entry.suppressed++
+		return
+	}
+
+	if exists && entry.suppressed > 0 {
+		sl.emitSuppressed(key, entry)
+	}
+	sl.seen[key] = &sampleEntry{start: now}
+	sl.emit(level, msg)
+}
+
+func (sl *sampleLogger) Error(args ...interface{}) {
+	sl.log(sampleError, fmt.Sprint(args...))
+}
+
+func (sl *sampleLogger) Errorf(format string, args ...interface{}) {
+	sl.log(sampleError, fmt.Sprintf(format, args...))
+}
+
+func (sl *sampleLogger) Warn(args ...interface{}) {
+	sl.log(sampleWarn, fmt.Sprint(args...))
+}
+
+func (sl *sampleLogger) Warnf(format string, args ...interface{}) {
+	sl.log(sampleWarn, fmt.Sprintf(format, args...))
+}
+
+func (sl *sampleLogger) Info(args ...interface{}) {
+	sl.log(sampleInfo, fmt.Sprint(args...))
+}
+
+func (sl *sampleLogger) Infof(format string, args ...interface{}) {
+	sl.log(sampleInfo, fmt.Sprintf(format, args...))
+}
+
+func (sl *sampleLogger) Trace(args ...interface{}) {
+	sl.log(sampleTrace, fmt.Sprint(args...))
+}
+
+func (sl *sampleLogger) Tracef(format string, args ...interface{}) {
+	sl.log(sampleTrace, fmt.Sprintf(format, args...))
+}
+
 var (
+	_ ClusterLogger = (*sampleLogger)(nil)
 	_ ClusterLogger = (*wrapLogger)(nil)
 	_ ClusterLogger = (*stdLogger)(nil)
 	_ ClusterLogger = (*nullLogger)(nil)
@@ -1,8 +1,10 @@
 package reign
 
 import (
+	"fmt"
 	"log"
 	"testing"
+	"time"
 )
 
 type nullWriter struct{}
@@ -52,3 +54,69 @@ func TestNullLoggerCoverage(t *testing.T) {
 	NullLogger.Trace("Testing trace coverage")
 	NullLogger.Tracef("%s", "Testing tracef coverage")
 }
+
+type recordingLogger struct {
+	nullLogger
+	lines []string
+}
+
+func (rl *recordingLogger) Error(args ...interface{}) {
+	rl.lines = append(rl.lines, "ERROR "+fmt.Sprint(args...))
+}
+
+func (rl *recordingLogger) Trace(args ...interface{}) {
+	rl.lines = append(rl.lines, "TRACE "+fmt.Sprint(args...))
+}
+
+func TestSampleLogger(t *testing.T) {
+	t.Parallel()
+
+	if SampleLogger(NullLogger, 0) != ClusterLogger(NullLogger) {
+		t.Fatal("sampling isn't off for a zero window")
+	}
+
+	rl := &recordingLogger{}
+	now := time.Unix(1000, 0)
+	sl := SampleLogger(rl, time.Minute).(*sampleLogger)
+	sl.nowFunc = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		sl.Errorf("no connection to %d", 2)
+	}
+	sl.Trace("no connection to 2")
+	if len(rl.lines) != 2 ||
+		rl.lines[0] != "ERROR no connection to 2" ||
+		rl.lines[1] != "TRACE no connection to 2" {
+		t.Fatalf("repeated messages not collapsed: %#v", rl.lines)
+	}
+
+	now = now.Add(time.Minute)
+	sl.Error("no connection to 2")
+	expected := []string{
+		"ERROR no connection to 2",
+		"TRACE no connection to 2",
+		"ERROR no connection to 2 (repeated 99 more times in 1m0s)",
+		"ERROR no connection to 2",
+	}
+	if fmt.Sprint(rl.lines) != fmt.Sprint(expected) {
+		t.Fatalf("suppressed count not reported correctly: %#v", rl.lines)
+	}
+
+	// and that it doesn't crash on the rest
+	sl.Warn("Hi!")
+	sl.Warnf("%s", "Hi!")
+	sl.Info("Hi!")
+	sl.Infof("%s", "Hi!")
+	sl.Tracef("%s", "Hi!")
+
+	// Expired entries get pruned, which also flushes their counts
+	sl.Error("no connection to 2")
+	now = now.Add(2 * time.Minute)
+	sl.Error("something else")
+	if len(sl.seen) != 1 {
+		t.Fatal("expired entries not pruned")
+	}
+	if rl.lines[len(rl.lines)-2] != "ERROR no connection to 2 (repeated 1 more times in 1m0s)" {
+		t.Fatalf("pruned entry's suppressed count was lost: %#v", rl.lines)
+	}
+}
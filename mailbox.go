@@ -15,6 +15,10 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -31,6 +35,9 @@ const (
 func init() {
 	var addr Address
 	gob.Register(&addr)
+	// A local mailbox can be told to notify a remote Address directly.
+	RegisterType(MailboxTerminated(0))
+	RegisterType(TerminatedWithReason{})
 }
 
 // ErrIllegalAddressFormat is returned when something attempts to
@@ -39,10 +46,19 @@ var ErrIllegalAddressFormat = errors.New("illegally-formatted address")
 
 var errIllegalNilSlice = errors.New("can't unmarshal nil slice into an address")
 
+// ErrAddressNamespace is returned when unmarshalling an Address that was
+// marshalled in a cluster with a different ClusterSpec.Namespace.
+var ErrAddressNamespace = errors.New("the address is from another cluster namespace")
+
 // ErrMailboxTerminated is returned when the target mailbox has (already) been
 // terminated.
 var ErrMailboxTerminated = errors.New("mailbox has been terminated")
 
+// ErrMailboxFull is returned when a message can not be queued for a remote
+// node because its outgoing queue is full, and the cluster's
+// OutgoingQueuePolicy is OverflowError.
+var ErrMailboxFull = errors.New("outgoing queue to the remote node is full")
+
 // ErrNotLocalMailbox is returned when a remote mailbox's MailboxID is passed
 // into a function that only works on local mailboxes.
 var ErrNotLocalMailbox = errors.New("function required a local mailbox ID but this is a remote MailboxID")
@@ -56,16 +72,14 @@ type address interface {
 	getMailboxID() MailboxID
 }
 
-type message struct {
-	msg interface{}
-}
-
 // An Address is the public face of the Mailbox. It is fine to pass this
 // by value.
 //
 // WARNING: It is not safe to use either Address or *Address for equality
-// testing or as a key in maps! Use .GetID() to obtain a AddressID, which
-// is. (Both Address and *Address are fine to store as values.)
+// testing or as a key in maps! Two Addresses for the same mailbox may
+// differ in what they have cached internally. Use .Equal to compare them,
+// or .GetID() to obtain a MailboxID, which is safe to use as a map key.
+// (Both Address and *Address are fine to store as values.)
 type Address struct {
 	mailboxID MailboxID
 	// mailbox is the cached Mailbox/boundRemoteAddress/noMailbox that we
@@ -84,6 +98,16 @@ func (a *Address) GetID() MailboxID {
 	return a.mailboxID
 }
 
+// Equal returns whether the two Addresses refer to the same mailbox,
+// regardless of how they were obtained. A nil Address is only equal to
+// another nil Address.
+func (a *Address) Equal(other *Address) bool {
+	if a == nil || other == nil {
+		return a == other
+	}
+	return a.mailboxID == other.mailboxID
+}
+
 func (a *Address) canBeGloballyRegistered() bool {
 	// If no mailbox is cached, resolve it now
 	if a.mailbox == nil {
@@ -155,7 +179,26 @@ func (a *Address) getAddress() address {
 //
 // The error is primarily for internal purposes. If the mailbox is
 // local, and has been terminated, ErrMailboxTerminated will be
-// returned.
+// returned. If it is remote, and the message's type can't be sent to
+// other nodes because it has not been registered, or gob otherwise
+// can't encode it, a SendError saying why is returned, rather than the
+// message being dropped when its turn to be written to the connection
+// comes.
+//
+// Messages sent from one goroutine to the same mailbox are received in
+// the order they were sent, whether the mailbox is local or on another
+// node. Messages can be lost, if the connection to the remote node goes
+// down or the cluster's OutgoingQueuePolicy is "drop_oldest", but the
+// ones that arrive will never be out of order. (Messages sent with
+// SendStream are the exception, as they are delivered once the entire
+// stream has arrived.) There is no ordering between different senders,
+// or between messages sent to different mailboxes.
+//
+// A message for a mailbox on this node goes straight into that mailbox's
+// queue. It is not gob-encoded, copied, or routed through the outgoing
+// queue to any node, so the receiver gets the very value that was sent,
+// even one gob can't encode, such as a channel. Code that may be sending
+// to a remote mailbox should of course not count on that.
 //
 // An error guarantees failure, but lack of error does not guarantee
 // success! Arguably, "ErrMailboxTerminated" should be seen as a purely
@@ -168,6 +211,146 @@ func (a *Address) Send(m interface{}) error {
 	return a.getAddress().send(m)
 }
 
+// SendSync sends the message, returning only once it has been enqueued.
+//
+// If the mailbox is local, a nil return means the message is in the
+// mailbox's queue, ahead of anything anyone sends to that mailbox
+// afterwards. If the mailbox has been terminated, the message is
+// discarded and ErrMailboxTerminated is returned.
+//
+// If the mailbox is remote, a nil return means the message is in the
+// outgoing queue for its node, ahead of anything sent to that node
+// afterwards. It is still written to the network asynchronously, so this
+// says nothing about delivery: the message is lost if the connection is
+// down when its turn comes. The cluster's OutgoingQueuePolicy applies, so
+// SendSync may block for room or return ErrMailboxFull, and a
+// "drop_oldest" policy may still discard it later. ErrMailboxTerminated
+// is returned if this node is shutting down.
+//
+// Send currently makes the same guarantees; use SendSync when your code
+// depends on them.
+func (a *Address) SendSync(m interface{}) error {
+	return a.getAddress().send(m)
+}
+
+// SendWithDeadline sends the message like Send, but it is discarded
+// instead of being received if it is still waiting in a mailbox when the
+// deadline passes. Expired messages are discarded as receivers come to
+// them, without disturbing the order of the messages around them, and
+// are counted in MetricMessagesExpired.
+//
+// If the mailbox is remote the deadline also applies while the message
+// waits in the outgoing queue for its node. It then goes along with the
+// message as the time it has left, which the receiving node counts down
+// by its own clock, so the nodes' clocks don't have to agree; the time
+// the message spends crossing the network is not counted. Only nodes
+// running a version of reign from before this was introduced send the
+// deadline itself, which is then subject to ClusterSpec.MaxClockSkew,
+// and nodes from before deadlines were introduced ignore it entirely.
+func (a *Address) SendWithDeadline(m interface{}, deadline time.Time) error {
+	return a.getAddress().send(expiringMessage{deadline, m})
+}
+
+// SendWithTTL is SendWithDeadline, with the deadline the given time from
+// now.
+func (a *Address) SendWithTTL(m interface{}, ttl time.Duration) error {
+	return a.SendWithDeadline(m, a.server().clock.Now().Add(ttl))
+}
+
+// An expiringMessage is a message sent with SendWithDeadline, as it waits
+// in a mailbox.
+type expiringMessage struct {
+	deadline time.Time
+	message  interface{}
+}
+
+// A timedMessage is a message as it waits in a mailbox that records when
+// its messages were queued; see Mailbox.RecordQueueTimes.
+type timedMessage struct {
+	queued  time.Time
+	message interface{}
+}
+
+// queuedAt returns when a message taken from a mailbox was queued, or the
+// zero time if that wasn't recorded.
+func queuedAt(msg interface{}) time.Time {
+	if tm, isTimed := msg.(timedMessage); isTimed {
+		return tm.queued
+	}
+	return time.Time{}
+}
+
+// liveMessage unwraps a message taken from a mailbox, returning false if
+// its deadline had passed as of now.
+func liveMessage(msg interface{}, now time.Time) (interface{}, bool) {
+	if tm, isTimed := msg.(timedMessage); isTimed {
+		msg = tm.message
+	}
+	em, isExpiring := msg.(expiringMessage)
+	if !isExpiring {
+		return msg, true
+	}
+	if now.After(em.deadline) {
+		return nil, false
+	}
+	return em.message, true
+}
+
+// SendWithConnectionWait sends the message like Send, but if the mailbox
+// is on a remote node that is not currently connected, it first waits up
+// to the given timeout for the connection to come back. If it doesn't,
+// the message is not sent and ErrNoConnection is returned. A timeout of
+// zero or less fails immediately if there's no connection.
+//
+// Plain Send queues the message regardless, and it is dropped if the
+// connection is still down when its turn comes. Note that even with this,
+// the connection may drop after the message has been queued, so this
+// still does not guarantee delivery; it only keeps a known outage from
+// silently eating the message.
+//
+// For local mailboxes this is the same as Send.
+func (a *Address) SendWithConnectionWait(m interface{}, timeout time.Duration) error {
+	if bra, isRemote := a.getAddress().(boundRemoteAddress); isRemote {
+		if !bra.remoteMailboxes.waitForConnectionTimeout(timeout) {
+			return ErrNoConnection
+		}
+	}
+	return a.Send(m)
+}
+
+// SendStream sends the entire contents of the reader to the target
+// mailbox, which receives it as a single []byte.
+//
+// If the mailbox is remote, the contents are read and sent in pieces of
+// StreamChunkSize bytes, which are reassembled on the receiving node. No
+// more than StreamWindow pieces are read ahead of the ones the receiving
+// node has acknowledged, so the sender only holds that many in memory at
+// once. (Nodes running a version of reign from before acknowledgements
+// are sent the pieces as fast as they can be read.) The receiving node
+// only holds up to its MaxStreamSize of a stream, and refuses more than
+// MaxOpenStreams arriving from one node at once. If the stream can't be
+// completed, because the link to the node goes down, the reader returns
+// an error, the stream is too large, or it stalls for StreamTimeout, the
+// receiver gets a StreamAborted instead of a truncated payload. Messages
+// sent after the stream may arrive before it.
+//
+// An error from the reader is returned, as is ErrStreamRefused if the
+// receiving node gave up on the stream, ErrStreamInterrupted if the
+// connection was lost or stopped acknowledging it, and
+// ErrStreamingUnsupported if the remote node is running a version of
+// reign too old to receive streams.
+func (a *Address) SendStream(r io.Reader) error {
+	if bra, isRemote := a.getAddress().(boundRemoteAddress); isRemote {
+		return bra.remoteMailboxes.sendStream(bra.MailboxID, r)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return a.Send(data)
+}
+
 // NotifyAddressOnTerminate requests that the target address receive a
 // termination notice when the target address is terminated.
 //
@@ -186,6 +369,9 @@ func (a *Address) Send(m interface{}) error {
 //
 // Calling this more than once with the same address may or may not
 // cause multiple notifications to occur.
+//
+// For a mailbox on another node, this returns before the node has been
+// asked; see NotifyAddressOnTerminateConfirmed to know that it has.
 func (a *Address) NotifyAddressOnTerminate(addr *Address) {
 	a.getAddress().notifyAddressOnTerminate(addr)
 }
@@ -199,12 +385,49 @@ func (a *Address) RemoveNotifyAddress(addr *Address) {
 	a.getAddress().removeNotifyAddress(addr)
 }
 
+// CancelAllNotifications removes every termination notification this
+// Address has asked for with NotifyAddressOnTerminate, from local and
+// remote mailboxes alike, as if RemoveNotifyAddress had been called on
+// each of them. This is for tearing a mailbox down by hand without having
+// to keep track of everything it linked to.
+//
+// Only the mailboxes on this node have notifications to cancel, so this
+// does nothing for the Address of a remote mailbox. It is safe to call on
+// an Address whose mailbox has already terminated. As with
+// RemoveNotifyAddress, a notification already on its way may still
+// arrive.
+func (a *Address) CancelAllNotifications() {
+	c := a.server()
+	if a.mailboxID.NodeID() != c.ThisNode.ID {
+		return
+	}
+
+	c.mailboxes.removeNotifications(a.mailboxID)
+	for _, rm := range c.remoteMailboxes {
+		rm.Send(cancelNotifications{a.mailboxID})
+	}
+}
+
+// server returns the connectionServer the Address belongs to.
+func (a *Address) server() *connectionServer {
+	if a.connectionServer == nil {
+		a.connectionServer = connections
+	}
+	if a.connectionServer == nil {
+		panic("connection server is nil")
+	}
+	return a.connectionServer
+}
+
 // MarshalBinary implements binary marshalling for Addresses.
 //
-// A marshalled Address only carries its identifier. When unmarshalled on
-// the same node, the unmarshalled address will be reconnected to the
-// original Mailbox. If unmarshalled on a different node, a reference to
-// the remote mailbox will be unmarshaled.
+// A marshalled Address only carries its identifier, and the cluster's
+// Namespace, if it has one. When unmarshalled on the same node, the
+// unmarshalled address will be reconnected to the original Mailbox. If
+// unmarshalled on a different node, a reference to the remote mailbox
+// will be unmarshaled. One marshalled in another namespace, such as a
+// previous generation of the cluster, is refused with
+// ErrAddressNamespace, as its mailbox ID may since have been reused.
 func (a *Address) MarshalBinary() ([]byte, error) {
 	addr := a.getAddress()
 
@@ -212,7 +435,8 @@ func (a *Address) MarshalBinary() ([]byte, error) {
 	case *Mailbox:
 		b := make([]byte, 10, 10)
 		written := binary.PutUvarint(b, uint64(mbox.id))
-		return append([]byte("<"), b[:written]...), nil
+		b = append([]byte("<"), b[:written]...)
+		return append(b, mbox.namespace()...), nil
 
 	case noMailbox:
 		return []byte("X"), nil
@@ -220,7 +444,8 @@ func (a *Address) MarshalBinary() ([]byte, error) {
 	case boundRemoteAddress:
 		b := make([]byte, 10, 10)
 		written := binary.PutUvarint(b, uint64(mbox.MailboxID))
-		return append([]byte("<"), b[:written]...), nil
+		b = append([]byte("<"), b[:written]...)
+		return append(b, mbox.namespace()...), nil
 
 	default:
 		return nil, ErrIllegalAddressFormat
@@ -241,9 +466,13 @@ func (a *Address) UnmarshalBinary(b []byte) error {
 
 	if b[0] == 60 { // this is "<"
 		id, readBytes := binary.Uvarint(b[1:])
-		if readBytes == 0 {
+		if readBytes <= 0 {
 			return ErrIllegalAddressFormat
 		}
+		// Whatever follows the ID is the namespace.
+		if string(b[1+readBytes:]) != namespaceOf(connections) {
+			return ErrAddressNamespace
+		}
 		a.mailboxID = MailboxID(id)
 		return nil
 	}
@@ -277,18 +506,30 @@ func (a *Address) UnmarshalText(b []byte) error {
 		mailboxID:        0,
 		connectionServer: connections,
 	}
+	return a.unmarshalText(b, namespaceOf(connections))
+}
 
+// unmarshalText is UnmarshalText, for an Address to be used in the given
+// namespace.
+func (a *Address) unmarshalText(b []byte, namespace string) error {
 	if b == nil {
 		return errIllegalNilSlice
 	}
+	if len(b) == 0 {
+		return ErrIllegalAddressFormat
+	}
 
 	// must be a mailboxID of one sort or another
 	switch b[0] {
 	case byte('<'):
 		// Longest possible text address: A full 3 bytes for the cluster,
 		// a full 16 bytes for the mailboxID, and three more bytes for the
-		// <:>
-		if len(b) > 23 {
+		// <:>, then the namespace and its colon, if there is one.
+		maxLen := 23
+		if namespace != "" {
+			maxLen += 1 + len(namespace)
+		}
+		if len(b) > maxLen {
 			return ErrIllegalAddressFormat
 		}
 
@@ -297,10 +538,17 @@ func (a *Address) UnmarshalText(b []byte) error {
 		}
 
 		b = b[1 : len(b)-1]
-		ids := bytes.Split(b, []byte(":"))
-		if len(ids) != 2 {
+		ids := bytes.SplitN(b, []byte(":"), 3)
+		if len(ids) < 2 {
 			return ErrIllegalAddressFormat
 		}
+		theirs := ""
+		if len(ids) == 3 {
+			theirs = string(ids[2])
+		}
+		if theirs != namespace {
+			return ErrAddressNamespace
+		}
 		nodeID, err := strconv.ParseUint(string(ids[0]), 10, 8)
 		if err != nil {
 			return err
@@ -331,31 +579,61 @@ func (a *Address) UnmarshalText(b []byte) error {
 func (a *Address) MarshalText() ([]byte, error) {
 	switch mbox := a.mailbox.(type) {
 	case *Mailbox:
-		ClusterID := mbox.id.NodeID()
-		mailboxID := mbox.id.mailboxOnlyID()
-		text := fmt.Sprintf("<%d:%d>", ClusterID, mailboxID)
-		return []byte(text), nil
+		return []byte(textAddress(mbox.id, mbox.namespace())), nil
 
 	case noMailbox:
 		return []byte("X"), nil
 
 	case boundRemoteAddress:
-		ClusterID := mbox.MailboxID.NodeID()
-		mailboxID := mbox.MailboxID.mailboxOnlyID()
-		text := fmt.Sprintf("<%d:%d>", ClusterID, mailboxID)
-		return []byte(text), nil
+		return []byte(textAddress(mbox.MailboxID, mbox.namespace())), nil
 
 	default:
 		return nil, errors.New("unknown address type, internal reign error")
 	}
 }
 
+// textAddress returns the text form of the mailbox ID, as marshalled in
+// the given namespace.
+func textAddress(mID MailboxID, namespace string) string {
+	if namespace == "" {
+		return fmt.Sprintf("<%d:%d>", mID.NodeID(), mID.mailboxOnlyID())
+	}
+	return fmt.Sprintf("<%d:%d:%s>", mID.NodeID(), mID.mailboxOnlyID(), namespace)
+}
+
+// namespaceOf returns the Namespace of the connection server's cluster,
+// which is empty if there is none.
+func namespaceOf(cs *connectionServer) string {
+	if cs == nil || cs.Cluster == nil {
+		return ""
+	}
+	return cs.Cluster.Namespace
+}
+
+// namespace returns the Namespace of the mailbox's cluster.
+func (m *Mailbox) namespace() string {
+	if m.parent == nil {
+		return ""
+	}
+	return namespaceOf(m.parent.connectionServer)
+}
+
+// namespace returns the Namespace of the remote mailbox's cluster.
+func (bra boundRemoteAddress) namespace() string {
+	if bra.remoteMailboxes == nil {
+		return ""
+	}
+	return namespaceOf(bra.connectionServer)
+}
+
 func (a *Address) String() string {
 	b, _ := a.MarshalText()
 	return string(b)
 }
 
-// MailboxID is an identifier corresponding to a mailbox.
+// MailboxID is an identifier corresponding to a mailbox. It uniquely
+// identifies the mailbox across the cluster, and unlike an Address it is
+// safe to compare and to use as a map key.
 type MailboxID uint64
 
 // NodeID returns the node ID corresponding to the current mailbox ID.
@@ -367,15 +645,86 @@ func (mID MailboxID) mailboxOnlyID() uint64 {
 	return uint64(mID >> 8)
 }
 
+// TerminationReason says why a mailbox was terminated.
+type TerminationReason uint8
+
+// These are the reasons a TerminatedWithReason can carry.
+//
+// TerminatedNormally is the zero value, so a notice from a node too old
+// to send a reason, or about a mailbox that no longer exists at all,
+// reads as a normal termination.
+const (
+	// TerminatedNormally means Terminate was called on the mailbox.
+	TerminatedNormally TerminationReason = iota
+
+	// TerminatedNodeDown means the mailbox is on another node, and the
+	// connection to that node was lost for good, or for longer than the
+	// LinkGracePeriod. The mailbox itself may well still be running.
+	TerminatedNodeDown
+
+	// TerminatedPanic means the code using the mailbox panicked. reign
+	// doesn't run your goroutines, so this is only ever set by passing it
+	// to TerminateWithReason.
+	TerminatedPanic
+
+	// TerminatedDraining means the node the mailbox is on is shutting
+	// down, and took all of its mailboxes with it.
+	TerminatedDraining
+)
+
+func (tr TerminationReason) String() string {
+	switch tr {
+	case TerminatedNormally:
+		return "normal"
+	case TerminatedNodeDown:
+		return "node down"
+	case TerminatedPanic:
+		return "panic"
+	case TerminatedDraining:
+		return "draining"
+	default:
+		return fmt.Sprintf("unknown termination reason %d", uint8(tr))
+	}
+}
+
 // MailboxTerminated is sent to Addresses that request notification
 // of when a Mailbox is being terminated, with NotifyAddressOnTerminate.
 // If you request termination notification of multiple mailboxes, this can
 // be converted to an MailboxID which can be used to distinguish them.
 type MailboxTerminated MailboxID
 
+// TerminatedWithReason is sent in place of a MailboxTerminated to the
+// mailboxes that ask for it with ReportTerminationReasons. The Reason
+// allows a supervisor to, for instance, retry a mailbox on a node that
+// went down, but not one that terminated normally.
+type TerminatedWithReason struct {
+	ID     MailboxID
+	Reason TerminationReason
+}
+
+// sendTerminated tells the address that the mailbox with the given ID has
+// terminated, with a TerminatedWithReason if it is a local mailbox that
+// reports reasons, and otherwise with a MailboxTerminated.
+func sendTerminated(addr *Address, id MailboxID, reason TerminationReason) {
+	if mbox, isLocal := addr.getAddress().(*Mailbox); isLocal && mbox.reportsReasons() {
+		addr.Send(TerminatedWithReason{id, reason})
+		return
+	}
+	addr.Send(MailboxTerminated(id))
+}
+
 type mailboxes struct {
 	nextMailboxID MailboxID
-	nodeID        NodeID
+	// enqueued counts every message sent to any of the mailboxes, so
+	// quiescent can tell whether anything moved while it was looking.
+	enqueued uint64
+	nodeID   NodeID
+
+	// settling counts the calls waiting in awaitSettled, which are told
+	// of each change that may let them finish by settleGen going up.
+	settling   int32
+	settleGen  uint64
+	settleCond *sync.Cond
 
 	// this isn't an ideal data structure. It's enough to satisfy the author's
 	// use case, but if you throw "enough" cores at this and create mailboxes
@@ -389,19 +738,20 @@ type mailboxes struct {
 }
 
 func (m *mailboxes) newLocalMailbox() (*Address, *Mailbox) {
-	var mutex sync.Mutex
-	cond := sync.NewCond(&mutex)
+	return m.newLocalMailboxWithStore(newMemoryStore())
+}
 
+func (m *mailboxes) newLocalMailboxWithStore(store MailboxStore) (*Address, *Mailbox) {
 	nextID := MailboxID(atomic.AddUint64((*uint64)(&m.nextMailboxID), 1))
 	m.nextMailboxID++
 	id := nextID<<8 + MailboxID(m.nodeID)
 
 	mailbox := &Mailbox{
-		id:       id,
-		messages: make([]message, 0, 1),
-		cond:     cond,
-		parent:   m,
+		id:     id,
+		store:  store,
+		parent: m,
 	}
+	mailbox.cond = sync.NewCond(&mailboxLock{mailbox: mailbox})
 
 	m.registerMailbox(id, mailbox)
 	addr := &Address{
@@ -428,6 +778,36 @@ func (m *mailboxes) unregisterMailbox(mID MailboxID) {
 	delete(m.mailboxes, mID)
 }
 
+func (m *mailboxes) terminateAll() {
+	m.RLock()
+	all := make([]*Mailbox, 0, len(m.mailboxes))
+	for _, mbox := range m.mailboxes {
+		all = append(all, mbox)
+	}
+	m.RUnlock()
+
+	for _, mbox := range all {
+		mbox.TerminateWithReason(TerminatedDraining)
+	}
+}
+
+// removeNotifications removes the given mailbox from the
+// notificationAddresses of every local mailbox.
+func (m *mailboxes) removeNotifications(mID MailboxID) {
+	m.RLock()
+	all := make([]*Mailbox, 0, len(m.mailboxes))
+	for _, mbox := range m.mailboxes {
+		all = append(all, mbox)
+	}
+	m.RUnlock()
+
+	for _, mbox := range all {
+		mbox.cond.L.Lock()
+		delete(mbox.notificationAddresses, mID)
+		mbox.cond.L.Unlock()
+	}
+}
+
 func (m *mailboxes) sendByID(mID MailboxID, msg interface{}) error {
 	mailbox, err := m.mailboxByID(mID)
 	if err != nil {
@@ -436,6 +816,16 @@ func (m *mailboxes) sendByID(mID MailboxID, msg interface{}) error {
 	return mailbox.send(msg)
 }
 
+// sendByIDFrom is sendByID for a message that came from the given remote
+// node.
+func (m *mailboxes) sendByIDFrom(source NodeID, mID MailboxID, msg interface{}) error {
+	mailbox, err := m.mailboxByID(mID)
+	if err != nil {
+		return err
+	}
+	return mailbox.sendFrom(source, msg)
+}
+
 func (m *mailboxes) mailboxByID(mID MailboxID) (mbox *Mailbox, err error) {
 	if mID.NodeID() != m.nodeID {
 		err = ErrNotLocalMailbox
@@ -451,6 +841,170 @@ func (m *mailboxes) mailboxByID(mID MailboxID) (mbox *Mailbox, err error) {
 	return
 }
 
+// MailboxInfo describes a local mailbox, as returned by LocalMailboxes.
+//
+// Depth is how many messages are waiting in it, and Receivers is how many
+// goroutines are currently blocked receiving from it, including those in
+// a Select. Paused is whether it has been Paused.
+type MailboxInfo struct {
+	ID        MailboxID
+	Depth     int
+	Receivers int
+	Paused    bool
+}
+
+type mailboxInfos []MailboxInfo
+
+func (mi mailboxInfos) Len() int           { return len(mi) }
+func (mi mailboxInfos) Less(i, j int) bool { return mi[i].ID < mi[j].ID }
+func (mi mailboxInfos) Swap(i, j int)      { mi[i], mi[j] = mi[j], mi[i] }
+
+func (m *mailboxes) info() []MailboxInfo {
+	m.RLock()
+	all := make([]*Mailbox, 0, len(m.mailboxes))
+	for _, mbox := range m.mailboxes {
+		all = append(all, mbox)
+	}
+	m.RUnlock()
+
+	infos := make(mailboxInfos, 0, len(all))
+	for _, mbox := range all {
+		mbox.cond.L.Lock()
+		if !mbox.terminated {
+			infos = append(infos, MailboxInfo{
+				ID:        mbox.id,
+				Depth:     mbox.store.Len(),
+				Receivers: len(mbox.waiters) + len(mbox.selectors),
+				Paused:    mbox.paused,
+			})
+		}
+		mbox.cond.L.Unlock()
+	}
+	sort.Sort(infos)
+	return infos
+}
+
+// quiescent returns whether every mailbox is empty and none of reign's
+// own loops is in the middle of handling a message.
+func (m *mailboxes) quiescent() bool {
+	before := atomic.LoadUint64(&m.enqueued)
+
+	m.RLock()
+	defer m.RUnlock()
+	for _, mbox := range m.mailboxes {
+		if !mbox.idle() {
+			return false
+		}
+	}
+
+	// A message handed from a mailbox we hadn't looked at yet to one we
+	// already had would otherwise go unnoticed.
+	return atomic.LoadUint64(&m.enqueued) == before
+}
+
+// awaitSettled waits until settled returns true, returning false if it
+// hasn't by the deadline, or by when stop is closed. A zero deadline, or
+// a nil stop, never comes. Rather than polling, settled is called again
+// whenever a mailbox becomes idle, or something else it may be waiting
+// on changes; see changed. It must not be called with any mailbox, or
+// remoteMailboxes, locked.
+func (m *mailboxes) awaitSettled(settled func() bool, deadline time.Time, stop <-chan struct{}) bool {
+	atomic.AddInt32(&m.settling, 1)
+	defer atomic.AddInt32(&m.settling, -1)
+
+	expired := false
+	expire := func() {
+		m.settleCond.L.Lock()
+		expired = true
+		m.settleCond.Broadcast()
+		m.settleCond.L.Unlock()
+	}
+	if !deadline.IsZero() {
+		timer := time.AfterFunc(deadline.Sub(time.Now()), expire)
+		defer timer.Stop()
+	}
+	if stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-stop:
+				expire()
+			case <-finished:
+			}
+		}()
+	}
+
+	m.settleCond.L.Lock()
+	defer m.settleCond.L.Unlock()
+	for {
+		// settled takes other locks, so it can't be called with this
+		// one held; whatever changes meanwhile shows in settleGen.
+		gen := m.settleGen
+		m.settleCond.L.Unlock()
+		done := settled()
+		m.settleCond.L.Lock()
+		if done {
+			return true
+		}
+		if expired {
+			return false
+		}
+		for gen == m.settleGen && !expired {
+			m.settleCond.Wait()
+		}
+	}
+}
+
+// changed wakes any awaitSettled calls to look again. It takes no lock
+// but its own, so it may be called with others held.
+func (m *mailboxes) changed() {
+	if atomic.LoadInt32(&m.settling) == 0 {
+		return
+	}
+	m.settleCond.L.Lock()
+	m.settleGen++
+	m.settleCond.Broadcast()
+	m.settleCond.L.Unlock()
+}
+
+// idle returns whether the mailbox has no messages, and isn't in the
+// middle of handling one, if it is a serving mailbox.
+func (m *Mailbox) idle() bool {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	return m.idleLocked()
+}
+
+// idleLocked is idle, for when the lock is already held.
+func (m *Mailbox) idleLocked() bool {
+	return m.terminated || (m.store.Len() == 0 && !m.busy)
+}
+
+// A mailboxLock is the lock of a Mailbox. While anything is waiting in
+// awaitSettled, it notes whether the mailbox is busy when locked, and
+// tells the waiters if it is idle when unlocked, so they hear of every
+// mailbox that becomes idle however that came about.
+type mailboxLock struct {
+	sync.Mutex
+	mailbox  *Mailbox
+	watching bool
+}
+
+func (l *mailboxLock) Lock() {
+	l.Mutex.Lock()
+	m := l.mailbox
+	l.watching = atomic.LoadInt32(&m.parent.settling) > 0 && !m.idleLocked()
+}
+
+func (l *mailboxLock) Unlock() {
+	if l.watching && l.mailbox.idleLocked() {
+		l.mailbox.parent.changed()
+	}
+	l.watching = false
+	l.Mutex.Unlock()
+}
+
 func (m *mailboxes) mailboxCount() int {
 	m.RLock()
 	defer m.RUnlock()
@@ -466,24 +1020,82 @@ func newMailboxes(connectionServer *connectionServer, nodeID NodeID) *mailboxes
 		nodeID:           nodeID,
 		connectionServer: connectionServer,
 		mailboxes:        make(map[MailboxID]*Mailbox),
+		settleCond:       sync.NewCond(&sync.Mutex{}),
 	}
 }
 
 // A Mailbox is what you receive messages from via Receive or ReceiveNext.
 type Mailbox struct {
 	id                    MailboxID
-	messages              []message
+	store                 MailboxStore
 	cond                  *sync.Cond
 	notificationAddresses map[MailboxID]struct{}
 
 	// used only by testing, to implement the ability to block until
-	// a notification has been processed
+	// a notification has been processed. This gets its own condition
+	// variable, sharing the mailbox's lock, so that the one-waiter-per-message
+	// wakeups in send can never be swallowed by a goroutine that isn't
+	// actually receiving.
 	parent               *mailboxes
+	notifyCond           *sync.Cond
 	broadcastOnAddNotify bool
 	terminated           bool
+	terminationReason    TerminationReason
+
+	// the wakeup channels of any Select calls currently waiting on this
+	// mailbox
+	selectors map[chan voidtype]voidtype
+
+	// when each of the calls blocked in ReceiveNext or Receive started
+	// waiting, for debugging; see WaiterStats
+	waiters    map[uint64]time.Time
+	nextWaiter uint64
+
+	// wakeups counts the times a blocked receiver has been woken, whether
+	// or not it then found anything, so the tests can check that the
+	// wakeup strategy isn't waking receivers for nothing.
+	wakeups uint64
+
+	// signals counts the receivers the senders, and receivers passing a
+	// wakeup on, have signalled for, so the tests can check how many
+	// wakeups CoalesceWakeups saves.
+	signals uint64
+
+	// paused holds back the messages from the receivers; see Pause.
+	paused bool
+
+	// serving is set on the mailboxes of reign's own loops, which are busy
+	// from when ReceiveNext hands them a message until they come back for
+	// the next one. See WaitQuiescent.
+	serving bool
+	busy    bool
+
+	// timed records when each message is queued; see RecordQueueTimes.
+	timed bool
+
+	// reasons has termination notices sent as TerminatedWithReason; see
+	// ReportTerminationReasons.
+	reasons bool
+
+	// removed counts the messages reign has taken out of the mailbox other
+	// than by receiving them, such as those evicted from an outgoing
+	// queue, so receiveFirstIf knows to look through it again.
+	removed uint64
+
+	// coalesce only wakes a receiver when a message arrives in an empty
+	// mailbox; see CoalesceWakeups. matching counts the Receive calls
+	// waiting for a message they match, which have to be woken for every
+	// message regardless.
+	coalesce bool
+	matching int
 }
 
 func (m *Mailbox) send(msg interface{}) error {
+	return m.sendFrom(m.parent.nodeID, msg)
+}
+
+// sendFrom sends a message that came from the given node.
+func (m *Mailbox) sendFrom(source NodeID, msg interface{}) error {
 	m.cond.L.Lock()
 	if m.terminated {
 		// note: can't just defer here, Broadcast must follow Unlock in the
@@ -492,14 +1104,83 @@ func (m *Mailbox) send(msg interface{}) error {
 		return ErrMailboxTerminated
 	}
 
-	m.messages = append(m.messages, message{msg})
+	if m.timed {
+		msg = timedMessage{m.now(), msg}
+	}
+
+	// Receivers other than Receive only wait on an empty mailbox, so
+	// when it already has messages in it, none of them need waking.
+	wake := !m.coalesce || m.matching > 0 || m.store.Len() == 0
+
+	var err error
+	if ss, isSourced := m.store.(sourcedStore); isSourced {
+		err = ss.enqueueFrom(source, msg)
+	} else {
+		err = m.store.Enqueue(msg)
+	}
+	if err == nil {
+		atomic.AddUint64(&m.parent.enqueued, 1)
+		m.wakeSelectors()
+		if wake {
+			m.signals++
+		}
+	}
 	m.cond.L.Unlock()
+	if err != nil {
+		return err
+	}
 
-	m.cond.Broadcast()
+	// One message can only satisfy one receiver, so wake exactly one.
+	// Broadcasting here causes every idle receiver on a shared mailbox to
+	// wake up, contend for the lock, and all but one go right back to
+	// sleep. Terminate still broadcasts, since that does concern everyone.
+	if wake {
+		m.cond.Signal()
+	}
 
 	return nil
 }
 
+// wakeSelectors wakes up the Select calls waiting on this mailbox. It
+// must be called with the lock held.
+func (m *Mailbox) wakeSelectors() {
+	for ch := range m.selectors {
+		select {
+		case ch <- void:
+		default:
+		}
+	}
+}
+
+func (m *Mailbox) addSelector(ch chan voidtype) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	if m.selectors == nil {
+		m.selectors = make(map[chan voidtype]voidtype)
+	}
+	m.selectors[ch] = void
+}
+
+func (m *Mailbox) removeSelector(ch chan voidtype) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	delete(m.selectors, ch)
+}
+
+func (m *Mailbox) len() int {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	return m.store.Len()
+}
+
+func (m *Mailbox) isTerminated() bool {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	return m.terminated
+}
+
 func (m *Mailbox) canBeGloballyRegistered() bool {
 	return true
 }
@@ -510,12 +1191,14 @@ func (m *Mailbox) getMailboxID() MailboxID {
 
 func (m *Mailbox) notifyAddressOnTerminate(target *Address) {
 	m.cond.L.Lock()
-	defer m.cond.L.Unlock()
-
 	if m.terminated {
-		target.Send(MailboxTerminated(m.id))
+		reason := m.terminationReason
+		m.cond.L.Unlock()
+		// not under the lock; see TerminateWithReason
+		sendTerminated(target, m.id, reason)
 		return
 	}
+	defer m.cond.L.Unlock()
 
 	if m.notificationAddresses == nil {
 		m.notificationAddresses = make(map[MailboxID]struct{})
@@ -523,7 +1206,7 @@ func (m *Mailbox) notifyAddressOnTerminate(target *Address) {
 	m.notificationAddresses[target.mailboxID] = struct{}{}
 
 	if m.broadcastOnAddNotify {
-		m.cond.Broadcast()
+		m.notifyCond.Broadcast()
 	}
 }
 
@@ -536,12 +1219,15 @@ func (m *Mailbox) blockUntilNotifyStatus(target *Address, desired bool) {
 	m.cond.L.Lock()
 
 	m.broadcastOnAddNotify = true
+	if m.notifyCond == nil {
+		m.notifyCond = sync.NewCond(m.cond.L)
+	}
 
 	id := target.mailboxID
 
 	_, exists := m.notificationAddresses[id]
 	for exists != desired {
-		m.cond.Wait()
+		m.notifyCond.Wait()
 		_, exists = m.notificationAddresses[id]
 	}
 	m.broadcastOnAddNotify = false
@@ -564,28 +1250,252 @@ func (m *Mailbox) removeNotifyAddress(target *Address) {
 // If you've got multiple receivers on a single mailbox, be sure to check
 // for MailboxTerminated.
 func (m *Mailbox) ReceiveNext() interface{} {
+	msg, _ := m.receiveNext()
+	return msg
+}
+
+// ReceiveOrClosed is ReceiveNext, also returning whether the mailbox is
+// still running. Once it has been terminated, this returns false, along
+// with the MailboxTerminated for this mailbox, and will keep doing so;
+// no more messages will come. Receivers blocked in it when the mailbox is
+// terminated are woken to return false.
+//
+// This makes for a simple loop that ends with its mailbox:
+//
+//  for {
+//      msg, ok := mbox.ReceiveOrClosed()
+//      if !ok {
+//          return
+//      }
+//      ...
+//  }
+//
+// Unlike checking what ReceiveNext returns, this can't mistake the
+// MailboxTerminated sent for the termination of some other mailbox this
+// one is notified about for its own.
+func (m *Mailbox) ReceiveOrClosed() (interface{}, bool) {
+	return m.receiveNext()
+}
+
+// receiveNext is ReceiveNext, also returning whether the mailbox is still
+// running; if not, the message is its MailboxTerminated.
+func (m *Mailbox) receiveNext() (interface{}, bool) {
+	msg, _, running := m.receiveNextTimed()
+	return msg, running
+}
+
+// ReceiveTimed is ReceiveNext, also returning how long the message waited
+// in the mailbox, for profiling the receive path. That is only known for
+// the messages sent after RecordQueueTimes was turned on; for the others,
+// and for the MailboxTerminated of a terminated mailbox, it is zero.
+//
+// The wait is measured from when the message arrived in the mailbox, by
+// this node's clock. For a message from another node, that is once it
+// has been received from the network, so nothing depends on the nodes'
+// clocks agreeing, but neither the time it spent crossing the network nor
+// in the sending node's outgoing queue is counted.
+func (m *Mailbox) ReceiveTimed() (interface{}, time.Duration) {
+	msg, queued, _ := m.receiveNextTimed()
+	if queued.IsZero() {
+		return msg, 0
+	}
+	return msg, m.now().Sub(queued)
+}
+
+// RecordQueueTimes turns recording when each message arrives in the
+// mailbox on or off, for ReceiveTimed. It is off by default, as it costs
+// a little for every message sent to the mailbox.
+func (m *Mailbox) RecordQueueTimes(record bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	m.timed = record
+}
+
+// ReportTerminationReasons, when on, has the termination notices this
+// mailbox asked for with NotifyAddressOnTerminate arrive as
+// TerminatedWithReason, saying why the mailbox terminated, rather than as
+// MailboxTerminated. It is off by default. A mailbox on another node
+// that was told to notify this one directly, rather than through its
+// Address here, always sends a MailboxTerminated.
+func (m *Mailbox) ReportTerminationReasons(report bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	m.reasons = report
+}
+
+func (m *Mailbox) reportsReasons() bool {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	return m.reasons
+}
+
+// receiveNextTimed is receiveNext, also returning when the message was
+// queued, if that was recorded.
+func (m *Mailbox) receiveNextTimed() (interface{}, time.Time, bool) {
 	// FIXME: Verify three listeners on one shared mailbox all get
 	// terminated properly.
 	m.cond.L.Lock()
-	for len(m.messages) == 0 && !m.terminated {
+	defer m.cond.L.Unlock()
+
+	// Whoever called us is done with the last message.
+	m.busy = false
+	start := time.Now()
+	for {
+		m.waitWhile(start, func() bool {
+			return !m.terminated && (m.paused || m.store.Len() == 0)
+		})
+
+		if m.terminated {
+			return MailboxTerminated(m.id), time.Time{}, false
+		}
+
+		// If everything in the mailbox had expired, go back to waiting.
+		if msg, queued, ok := m.dequeueTimed(); ok {
+			m.busy = m.serving
+			m.passWakeup()
+			return msg, queued, true
+		}
+	}
+}
+
+// CoalesceWakeups turns on or off waking the mailbox's receivers only
+// when a message arrives in an empty mailbox, rather than for every
+// message. It is off by default. Under a high message rate, a receiver
+// that is kept busy then rarely has to be woken at all, and with
+// ReceiveAll it takes everything that arrived while it was waking up in
+// one go. When there are several receivers, each one that receives,
+// leaving messages behind, wakes the next, rather than the senders doing
+// so.
+//
+// A Receive waiting for a message it matches is still woken for every
+// message.
+func (m *Mailbox) CoalesceWakeups(coalesce bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+	m.coalesce = coalesce
+}
+
+// passWakeup wakes another waiting receiver if the mailbox is coalescing
+// wakeups and still has messages in it, as the senders won't have. It
+// must be called with the lock held.
+func (m *Mailbox) passWakeup() {
+	if m.coalesce && len(m.waiters) > 0 && m.store.Len() > 0 {
+		m.signals++
+		m.cond.Signal()
+	}
+}
+
+// ReceiveAll receives every message waiting in the mailbox at once, in
+// the order ReceiveNext would have received them. It blocks until there
+// is at least one, which may be forever. This takes the mailbox's lock
+// once for the lot, rather than once for each message, which is best
+// combined with CoalesceWakeups.
+//
+// Like ReceiveOrClosed, once the mailbox has been terminated, this
+// returns its MailboxTerminated alone, and false.
+func (m *Mailbox) ReceiveAll() ([]interface{}, bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	m.busy = false
+	start := time.Now()
+	for {
+		m.waitWhile(start, func() bool {
+			return !m.terminated && (m.paused || m.store.Len() == 0)
+		})
+
+		if m.terminated {
+			return []interface{}{MailboxTerminated(m.id)}, false
+		}
+
+		msgs := make([]interface{}, 0, m.store.Len())
+		for {
+			msg, ok := m.dequeueLive()
+			if !ok {
+				break
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) > 0 {
+			m.busy = m.serving
+			return msgs, true
+		}
+	}
+}
+
+// waitWhile waits on the mailbox until blocked returns false, reporting
+// it to WaiterStats as waiting since the given time, when the receive
+// that called it started; a receive may wait several times before it
+// gets its message. It must be called with the lock held.
+func (m *Mailbox) waitWhile(since time.Time, blocked func() bool) {
+	if !blocked() {
+		return
+	}
+
+	m.nextWaiter++
+	id := m.nextWaiter
+	if m.waiters == nil {
+		m.waiters = make(map[uint64]time.Time)
+	}
+	m.waiters[id] = since
+	for blocked() {
 		m.cond.Wait()
+		m.wakeups++
 	}
+	delete(m.waiters, id)
+}
 
-	if m.terminated {
-		m.cond.L.Unlock()
-		return MailboxTerminated(m.id)
+// WaiterStats returns how many goroutines are blocked receiving from the
+// mailbox, in ReceiveNext, Receive or ReceiveConcurrent, and how long the
+// one that has been blocked the longest has waited. A receiver that stays
+// blocked while messages pile up elsewhere suggests a deadlock.
+//
+// Select and ReceiveNextTimeout are not counted, as they don't block in
+// the same way; LocalMailboxes does include the Select calls.
+func (m *Mailbox) WaiterStats() (count int, oldest time.Duration) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	now := time.Now()
+	for _, since := range m.waiters {
+		if waited := now.Sub(since); waited > oldest {
+			oldest = waited
+		}
 	}
+	return len(m.waiters), oldest
+}
 
-	msg := m.messages[0]
-	// in the common case of not having a message backlog, this
-	// should prevent a lot of garbage buildup by reusing the slot.
-	if len(m.messages) == 1 {
-		m.messages = m.messages[:0]
-	} else {
-		m.messages = m.messages[1:]
+// ReceiveConcurrent receives from the mailbox with n goroutines at once,
+// each calling the handler with every message it receives, for work that
+// can be done in parallel. It returns once the mailbox has been
+// terminated and every handler call in progress has returned; the
+// workers stop as soon as they see the termination, leaving any messages
+// still waiting unhandled, just as ReceiveNext would. The handler is not
+// called with the mailbox's own MailboxTerminated.
+//
+// The messages are not handled in any particular order, not even that
+// they were sent in, so this is only suitable for messages that can be
+// handled independently. An n less than 1 is taken as 1.
+func (m *Mailbox) ReceiveConcurrent(n int, handler func(interface{})) {
+	if n < 1 {
+		n = 1
 	}
-	m.cond.L.Unlock()
-	return msg.msg
+
+	var workers sync.WaitGroup
+	workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer workers.Done()
+			for {
+				msg, running := m.receiveNext()
+				if !running {
+					return
+				}
+				handler(msg)
+			}
+		}()
+	}
+	workers.Wait()
 }
 
 // ReceiveNextAsync will return immediately with (obj, true) if, and only if,
@@ -595,23 +1505,159 @@ func (m *Mailbox) ReceiveNextAsync() (interface{}, bool) {
 	m.cond.L.Lock()
 	defer m.cond.L.Unlock()
 
-	if len(m.messages) == 0 && !m.terminated {
+	if m.terminated {
+		return MailboxTerminated(m.id), true
+	}
+	if m.paused {
 		return nil, false
 	}
 
+	return m.dequeueLive()
+}
+
+// dequeueLive removes and returns the first message in the mailbox that
+// hasn't expired, discarding any expired ones ahead of it. It must be
+// called with the lock held.
+func (m *Mailbox) dequeueLive() (interface{}, bool) {
+	msg, _, ok := m.dequeueTimed()
+	return msg, ok
+}
+
+// dequeueTimed is dequeueLive, also returning when the message was
+// queued, if that was recorded.
+func (m *Mailbox) dequeueTimed() (interface{}, time.Time, bool) {
+	now := m.now()
+	for m.store.Len() > 0 {
+		queued := m.store.Dequeue()
+		msg, live := liveMessage(queued, now)
+		if live {
+			return msg, queuedAt(queued), true
+		}
+		m.expired()
+	}
+	return nil, time.Time{}, false
+}
+
+// now returns the time by the clock of the mailbox's node.
+func (m *Mailbox) now() time.Time {
+	return m.parent.connectionServer.clock.Now()
+}
+
+// expired records that an expired message was discarded. It must be
+// called with the lock held.
+func (m *Mailbox) expired() {
+	m.parent.connectionServer.dropped(DropExpired, m.id.NodeID(), 1)
+	if metrics := m.parent.connectionServer.metrics.get(); metrics != nil {
+		metrics.AddCounter(MetricMessagesExpired, map[string]string{
+			"node": strconv.Itoa(int(m.id.NodeID())),
+		}, 1)
+	}
+}
+
+// receiveNextIf removes and returns the message at the head of the
+// mailbox only if it passes the given test. It never blocks, and it
+// doesn't return a MailboxTerminated for termination.
+func (m *Mailbox) receiveNextIf(test func(interface{}) bool) (interface{}, bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	if m.terminated || m.store.Len() == 0 || !test(m.store.Peek(0)) {
+		return nil, false
+	}
+
+	m.removed++
+	return m.store.Dequeue(), true
+}
+
+// removeFirstIf removes the first message anywhere in the mailbox that
+// passes the given test, returning whether one was found.
+func (m *Mailbox) removeFirstIf(test func(interface{}) bool) bool {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
 	if m.terminated {
-		return MailboxTerminated(m.id), true
+		return false
 	}
 
-	msg := m.messages[0]
-	// in the common case of not having a message backlog, this
-	// should prevent a lot of garbage buildup by reusing the slot.
-	if len(m.messages) == 1 {
-		m.messages = m.messages[:0]
-	} else {
-		m.messages = m.messages[1:]
+	for i := 0; i < m.store.Len(); i++ {
+		if test(m.store.Peek(i)) {
+			m.store.Remove(i)
+			m.removed++
+			return true
+		}
+	}
+	return false
+}
+
+// removeAllIf removes and returns every message in the mailbox that
+// passes the given test, in order.
+func (m *Mailbox) removeAllIf(test func(interface{}) bool) []interface{} {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	if m.terminated {
+		return nil
+	}
+
+	var removed []interface{}
+	for i := 0; i < m.store.Len(); {
+		if test(m.store.Peek(i)) {
+			removed = append(removed, m.store.Remove(i))
+		} else {
+			i++
+		}
+	}
+	m.removed += uint64(len(removed))
+	return removed
+}
+
+// receiveFirstIf removes and returns the first message anywhere in the
+// mailbox that passes take, waiting for one if need be. If stop isn't
+// nil, it instead returns false as soon as there is a message ahead of
+// that one, or any message at all if there is none, that passes stop,
+// which is left where it is. Once the mailbox is terminated, it returns
+// its MailboxTerminated.
+func (m *Mailbox) receiveFirstIf(take, stop func(interface{}) bool) (interface{}, bool) {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	// Like receiveNextTimed, this is where a serving loop is done with its
+	// last message.
+	m.busy = false
+
+	// Every message has to wake this, even when the mailbox coalesces
+	// wakeups, as the one it's waiting for may arrive behind others.
+	m.matching++
+	defer func() { m.matching-- }()
+
+	start := time.Now()
+	checked := 0
+	for {
+		if m.terminated {
+			return MailboxTerminated(m.id), true
+		}
+		for ; checked < m.store.Len(); checked++ {
+			msg := m.store.Peek(checked)
+			if take(msg) {
+				m.store.Remove(checked)
+				m.busy = m.serving
+				return msg, true
+			}
+			if stop != nil && stop(msg) {
+				return nil, false
+			}
+		}
+
+		// Anything taken out of the mailbox moves what follows it, so
+		// that has to be looked at again.
+		length, removed := m.store.Len(), m.removed
+		m.waitWhile(start, func() bool {
+			return !m.terminated && m.store.Len() == length && m.removed == removed
+		})
+		if m.removed != removed {
+			checked = 0
+		}
 	}
-	return msg.msg, true
 }
 
 // ReceiveNextTimeout works like ReceiveNextAsync, but it will wait until either a message
@@ -628,6 +1674,58 @@ func (m *Mailbox) ReceiveNextTimeout(timeout time.Duration) (interface{}, bool)
 	return nil, false
 }
 
+// Select receives the next message from whichever of the given mailboxes
+// has one first, returning the index of that mailbox in the arguments
+// along with the message. It blocks until one of them has a message,
+// which may be forever. When several have messages waiting, the one
+// received from is chosen at random so that none of them can be starved.
+//
+// Like ReceiveNext, a terminated mailbox returns a MailboxTerminated, and
+// will keep doing so, so once one is returned that mailbox should be left
+// out of further Select calls. With no mailboxes, Select returns -1 and nil
+// immediately.
+//
+// Select competes fairly with any other receivers on the same mailboxes;
+// a message is only ever received once.
+func Select(mailboxes ...*Mailbox) (int, interface{}) {
+	if len(mailboxes) == 0 {
+		return -1, nil
+	}
+
+	var wakeup chan voidtype
+	defer func() {
+		if wakeup != nil {
+			for _, mbox := range mailboxes {
+				mbox.removeSelector(wakeup)
+			}
+		}
+	}()
+
+	start := rand.Intn(len(mailboxes))
+	for {
+		for i := range mailboxes {
+			idx := (start + i) % len(mailboxes)
+			if msg, ok := mailboxes[idx].ReceiveNextAsync(); ok {
+				return idx, msg
+			}
+		}
+
+		// Only start listening for wakeups once the mailboxes have been
+		// found empty, then check them all once more, since a message
+		// could have arrived in between.
+		if wakeup == nil {
+			wakeup = make(chan voidtype, 1)
+			for _, mbox := range mailboxes {
+				mbox.addSelector(wakeup)
+			}
+			continue
+		}
+
+		<-wakeup
+		start = rand.Intn(len(mailboxes))
+	}
+}
+
 // Receive will receive the next message sent to this mailbox that matches
 // according to the passed-in function.
 //
@@ -649,16 +1747,16 @@ func (m *Mailbox) Receive(matcher func(interface{}) bool) interface{} {
 	m.cond.L.Lock()
 	defer m.cond.L.Unlock()
 
+	start := time.Now()
+	m.waitWhile(start, func() bool { return !m.terminated && m.paused })
+
 	if m.terminated {
 		return MailboxTerminated(m.id)
 	}
 
 	// see if there are any messages that match
-	for i, v := range m.messages {
-		if matcher(v.msg) {
-			m.messages = append(m.messages[:i], m.messages[i+1:]...)
-			return v.msg
-		}
+	if msg, found := m.removeMatch(0, matcher); found {
+		return msg
 	}
 
 	// Loop until we get the message we want
@@ -666,24 +1764,82 @@ func (m *Mailbox) Receive(matcher func(interface{}) bool) interface{} {
 	// so we can tell if another message came in just by looking at the
 	// length of the queue.
 	for {
-		lastIdx := len(m.messages)
+		lastIdx := m.store.Len()
 
-		for len(m.messages) == lastIdx && !m.terminated {
-			m.cond.Wait()
-		}
+		m.matching++
+		m.waitWhile(start, func() bool {
+			return !m.terminated && (m.paused || m.store.Len() == lastIdx)
+		})
+		m.matching--
 
 		if m.terminated {
 			return MailboxTerminated(m.id)
 		}
 
-		for ; lastIdx < len(m.messages); lastIdx++ {
-			if matcher(m.messages[lastIdx].msg) {
-				match := m.messages[lastIdx].msg
-				m.messages = append(m.messages[:lastIdx], m.messages[lastIdx+1:]...)
-				return match
-			}
+		// A sourcedStore may have put the new messages anywhere.
+		if _, isSourced := m.store.(sourcedStore); isSourced {
+			lastIdx = 0
+		}
+		if msg, found := m.removeMatch(lastIdx, matcher); found {
+			return msg
+		}
+	}
+}
+
+// removeMatch removes and returns the first message from index start on
+// that passes the matcher, discarding any expired messages it comes
+// across. It must be called with the lock held.
+func (m *Mailbox) removeMatch(start int, matcher func(interface{}) bool) (interface{}, bool) {
+	now := m.now()
+	for i := start; i < m.store.Len(); {
+		msg, live := liveMessage(m.store.Peek(i), now)
+		if !live {
+			m.store.Remove(i)
+			m.expired()
+			continue
+		}
+		if matcher(msg) {
+			m.store.Remove(i)
+			return msg, true
 		}
+		i++
+	}
+	return nil, false
+}
+
+// Pause stops the mailbox from handing out messages, while it still
+// accepts them, until Resume is called. ReceiveNext, Receive, and Select
+// block as if it were empty, however many messages are waiting, and
+// ReceiveNextAsync and ReceiveNextTimeout find nothing. This lets an
+// actor be quiesced, say to take a consistent snapshot of it, without
+// losing what is sent to it meanwhile. Pausing a paused mailbox does
+// nothing.
+//
+// A paused mailbox can still be terminated, which is reported to its
+// receivers as usual. Note that its messages do keep it from being
+// quiescent for WaitQuiescent.
+func (m *Mailbox) Pause() {
+	m.cond.L.Lock()
+	defer m.cond.L.Unlock()
+
+	m.paused = true
+}
+
+// Resume lets a mailbox stopped by Pause hand out its messages again,
+// waking up anything blocked receiving from it. Resuming a mailbox that
+// isn't paused does nothing.
+func (m *Mailbox) Resume() {
+	m.cond.L.Lock()
+	if !m.paused {
+		m.cond.L.Unlock()
+		return
 	}
+	m.paused = false
+	m.wakeSelectors()
+	m.cond.L.Unlock()
+
+	// Each of the waiting receivers may have a message waiting for it.
+	m.cond.Broadcast()
 }
 
 // Terminate shuts down a given mailbox. Once terminated, a mailbox
@@ -700,7 +1856,25 @@ func (m *Mailbox) Receive(matcher func(interface{}) bool) interface{} {
 // FIXME: What do we do with this upon network partition? What does Erlang do?
 //
 // It is not an error to Terminate an already-Terminated mailbox.
+//
+// The notifications carry TerminatedNormally; see TerminateWithReason.
 func (m *Mailbox) Terminate() {
+	m.TerminateWithReason(TerminatedNormally)
+}
+
+// TerminateWithReason terminates the mailbox just like Terminate, but
+// gives the given reason to the mailboxes notified of it that report
+// reasons, for instance TerminatedPanic from a deferred recover; see
+// ReportTerminationReasons. If the mailbox is already terminated, the
+// original reason stands.
+func (m *Mailbox) TerminateWithReason(reason TerminationReason) {
+	m.terminate(reason, false)
+}
+
+// terminate is TerminateWithReason, also taking the messages still waiting
+// in the mailbox out of it as it is terminated and returning them, if
+// drain is set; see drainLocked.
+func (m *Mailbox) terminate(reason TerminationReason, drain bool) (drained []interface{}) {
 	// I think doing this before locking our own lock is correct; we are
 	// already uninterested in any future operations, and double-deleting
 	// out of this dict is OK.
@@ -714,27 +1888,38 @@ func (m *Mailbox) Terminate() {
 	// this is not redundant; m.terminated is part of what we have to lock
 	if m.terminated {
 		m.cond.L.Unlock()
-		return
+		return nil
 	}
 
 	m.terminated = true
-
-	terminating := MailboxTerminated(m.id)
-	cs := m.parent.connectionServer
-	for mailboxID := range m.notificationAddresses {
-		addr := Address{
-			mailboxID:        mailboxID,
-			connectionServer: cs,
-		}
-		addr.Send(terminating)
+	m.terminationReason = reason
+	if drain {
+		drained = m.drainLocked()
 	}
 
+	notify := m.notificationAddresses
+
 	// chuck out what garbage we can
 	m.notificationAddresses = nil
-	m.messages = nil
+	m.store.Close()
+	m.wakeSelectors()
 
 	m.cond.L.Unlock()
 	m.cond.Broadcast()
+
+	// The notifications go out after unlocking, as a notified address may
+	// be on another node. Sending to it can wait for room in the outgoing
+	// queue, and the loop that would make that room may itself be waiting
+	// to deliver a message to this mailbox.
+	cs := m.parent.connectionServer
+	for mailboxID := range notify {
+		addr := Address{
+			mailboxID:        mailboxID,
+			connectionServer: cs,
+		}
+		sendTerminated(&addr, m.id, reason)
+	}
+	return drained
 }
 
 // This type is returned when unmarshalling a local address that doesn't
@@ -755,7 +1940,7 @@ func (nm noMailbox) send(interface{}) error {
 }
 
 func (nm noMailbox) notifyAddressOnTerminate(target *Address) {
-	target.Send(MailboxTerminated(nm.MailboxID))
+	sendTerminated(target, nm.MailboxID, TerminatedNormally)
 }
 
 func (nm noMailbox) removeNotifyAddress(target *Address) {}
@@ -781,13 +1966,7 @@ type boundRemoteAddress struct {
 }
 
 func (bra boundRemoteAddress) send(message interface{}) error {
-	// FIMXE: Have to pass along the mailboxID here.
-	return bra.remoteMailboxes.Send(
-		internal.OutgoingMailboxMessage{
-			Target:  internal.IntMailboxID(bra.MailboxID),
-			Message: message,
-		},
-	)
+	return bra.remoteMailboxes.sendOutgoing(bra.MailboxID, message)
 }
 
 func (bra boundRemoteAddress) notifyAddressOnTerminate(addr *Address) {
@@ -2,6 +2,7 @@ package reign
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -213,7 +214,7 @@ func TestMailboxReceive(t *testing.T) {
 		t.Fatal("Did not retrieve the correct message")
 	}
 
-	if !reflect.DeepEqual(m.messages, []message{{b}, {d}}) {
+	if !reflect.DeepEqual(m.store.(*memoryStore).messages, []message{{b}, {d}}) {
 		t.Fatal("Did not properly fix up the message queue")
 	}
 
@@ -241,7 +242,7 @@ func TestMailboxReceive(t *testing.T) {
 	<-matching
 	<-waitingDone
 
-	if !reflect.DeepEqual(m.messages, []message{{b}, {d}, {d}}) {
+	if !reflect.DeepEqual(m.store.(*memoryStore).messages, []message{{b}, {d}, {d}}) {
 		t.Fatal("Did not properly fix up the message queue")
 	}
 
@@ -264,6 +265,303 @@ func TestMailboxReceive(t *testing.T) {
 	<-done
 }
 
+func TestTerminatingNodeWakesReceivers(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+
+	_, m := cs.NewMailbox()
+	received := make(chan interface{})
+	for i := 0; i < 3; i++ {
+		go func() {
+			received <- m.ReceiveNext()
+		}()
+	}
+	go func() {
+		received <- m.Receive(func(interface{}) bool { return false })
+	}()
+
+	cs.Terminate()
+	for i := 0; i < 4; i++ {
+		if msg := <-received; msg != MailboxTerminated(m.id) {
+			t.Fatal("receiver woken with the wrong message:", msg)
+		}
+	}
+}
+
+// A message wakes only one of the receivers idling on a mailbox; the
+// rest stay asleep.
+func TestSendWakesOneReceiver(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	received := make(chan interface{})
+	for i := 0; i < 10; i++ {
+		go func() { received <- mbox.ReceiveNext() }()
+	}
+	awaitWaiters(t, mbox, 10)
+
+	addr.Send(1)
+	<-received
+	time.Sleep(10 * time.Millisecond)
+	if wakeups := mboxWakeups(mbox); wakeups != 1 {
+		t.Fatal("One message woke", wakeups, "receivers")
+	}
+
+	mbox.Terminate()
+	for i := 0; i < 9; i++ {
+		<-received
+	}
+}
+
+// awaitWaiters waits for the given number of receivers to block on the
+// mailbox.
+func awaitWaiters(t *testing.T, mbox *Mailbox, n int) {
+	awaitCondition(t, func() bool {
+		count, _ := mbox.WaiterStats()
+		return count == n
+	}, func() string {
+		return "The receivers never blocked"
+	})
+}
+
+func mboxWakeups(mbox *Mailbox) uint64 {
+	mbox.cond.L.Lock()
+	defer mbox.cond.L.Unlock()
+	return mbox.wakeups
+}
+
+func mboxSignals(mbox *Mailbox) uint64 {
+	mbox.cond.L.Lock()
+	defer mbox.cond.L.Unlock()
+	return mbox.signals
+}
+
+func TestLocalMailboxes(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	find := func(id MailboxID) (MailboxInfo, bool) {
+		for _, info := range cs.LocalMailboxes() {
+			if info.ID == id {
+				return info, true
+			}
+		}
+		return MailboxInfo{}, false
+	}
+
+	addr1, m1 := cs.NewMailbox()
+	_, m2 := cs.NewMailbox()
+	_, m3 := cs.NewMailbox()
+	defer m1.Terminate()
+	defer m2.Terminate()
+
+	addr1.Send(1)
+	addr1.Send(2)
+	if info, _ := find(m1.id); info.Depth != 2 || info.Receivers != 0 {
+		t.Fatal("Unexpected info:", info)
+	}
+
+	go m2.ReceiveNext()
+	deadline := time.Now().Add(timeout)
+	for {
+		info, _ := find(m2.id)
+		if info.Receivers == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Blocked receiver never seen:", info)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	m3.Terminate()
+	if _, found := find(m3.id); found {
+		t.Fatal("Terminated mailbox still listed")
+	}
+
+	infos := cs.LocalMailboxes()
+	for i := 1; i < len(infos); i++ {
+		if infos[i-1].ID >= infos[i].ID {
+			t.Fatal("Mailboxes not in order")
+		}
+	}
+
+	// It's safe while mailboxes come and go.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			_, m := cs.NewMailbox()
+			m.Terminate()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		cs.LocalMailboxes()
+	}
+	<-done
+}
+
+func TestSelect(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr1, m1 := cs.NewMailbox()
+	addr2, m2 := cs.NewMailbox()
+	defer m1.Terminate()
+	defer m2.Terminate()
+
+	if idx, msg := Select(); idx != -1 || msg != nil {
+		t.Fatal("Select with no mailboxes received something")
+	}
+
+	addr2.Send("two")
+	if idx, msg := Select(m1, m2); idx != 1 || msg != "two" {
+		t.Fatal("Select received the wrong thing:", idx, msg)
+	}
+
+	// Select blocks until a message arrives.
+	type selected struct {
+		idx int
+		msg interface{}
+	}
+	result := make(chan selected)
+	go func() {
+		idx, msg := Select(m1, m2)
+		result <- selected{idx, msg}
+	}()
+	time.Sleep(time.Millisecond)
+	addr1.Send("one")
+	if r := <-result; r.idx != 0 || r.msg != "one" {
+		t.Fatal("Select received the wrong thing:", r.idx, r.msg)
+	}
+	if len(m1.selectors) != 0 || len(m2.selectors) != 0 {
+		t.Fatal("Select did not clean up after itself")
+	}
+
+	// Neither mailbox may be starved.
+	for i := 0; i < 1000; i++ {
+		addr1.Send(i)
+		addr2.Send(i)
+	}
+	counts := [2]int{}
+	for i := 0; i < 1000; i++ {
+		idx, _ := Select(m1, m2)
+		counts[idx]++
+	}
+	if counts[0] < 300 || counts[1] < 300 {
+		t.Fatal("Select was unfair:", counts)
+	}
+	for m1.store.Len() > 0 || m2.store.Len() > 0 {
+		Select(m1, m2)
+	}
+
+	// A mailbox terminating while selecting wakes the Select.
+	_, m3 := cs.NewMailbox()
+	go func() {
+		idx, msg := Select(m1, m3)
+		result <- selected{idx, msg}
+	}()
+	time.Sleep(time.Millisecond)
+	m3.Terminate()
+	if r := <-result; r.idx != 1 || r.msg != MailboxTerminated(m3.id) {
+		t.Fatal("Select did not report the termination:", r.idx, r.msg)
+	}
+}
+
+func TestSendWithDeadline(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+	metrics := newRecordingMetrics()
+	cs.SetMetrics(metrics)
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+
+	// Expired messages vanish from between the live ones.
+	addr.Send(1)
+	addr.SendWithDeadline(2, past)
+	addr.SendWithDeadline(3, future)
+	addr.SendWithDeadline(4, past)
+	addr.Send(5)
+	for _, expected := range []int{1, 3, 5} {
+		if msg := mbox.ReceiveNext(); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+	addr.SendWithDeadline(6, past)
+	if msg, ok := mbox.ReceiveNextAsync(); ok {
+		t.Fatal("Received an expired message:", msg)
+	}
+	addr.SendWithTTL(7, -time.Second)
+	addr.SendWithTTL(8, time.Hour)
+	if msg, _ := mbox.ReceiveNextAsync(); msg != 8 {
+		t.Fatal("Unexpected message sent with a TTL:", msg)
+	}
+
+	addr.SendWithDeadline(B{1}, past)
+	addr.SendWithDeadline(C{2}, past)
+	addr.SendWithDeadline(C{3}, future)
+	msg := mbox.Receive(func(i interface{}) bool {
+		_, isC := i.(C)
+		return isC
+	})
+	if msg != (C{3}) || mbox.store.Len() != 0 {
+		t.Fatal("Receive got the wrong message:", msg, mbox.store.Len())
+	}
+
+	if metrics.counters[MetricMessagesExpired] != 6 {
+		t.Fatal("Expired messages not counted:", metrics.counters)
+	}
+}
+
+func TestReceiveTimed(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+
+	// Until recording is turned on, there's nothing to measure.
+	addr.Send(1)
+	if msg, wait := mbox.ReceiveTimed(); msg != 1 || wait != 0 {
+		t.Fatal("Untimed message got a wait:", msg, wait)
+	}
+
+	mbox.RecordQueueTimes(true)
+	addr.Send(2)
+	addr.SendWithDeadline(3, time.Now().Add(time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	if msg, wait := mbox.ReceiveTimed(); msg != 2 || wait < 20*time.Millisecond {
+		t.Fatal("Wait was not measured:", msg, wait)
+	}
+	if msg, wait := mbox.ReceiveTimed(); msg != 3 || wait < 20*time.Millisecond {
+		t.Fatal("Wait was not measured for an expiring message:", msg, wait)
+	}
+
+	// The other ways of receiving just unwrap the message.
+	addr.Send(4)
+	addr.Send(C{5})
+	if msg := mbox.ReceiveNext(); msg != 4 {
+		t.Fatal("Timed message not unwrapped:", msg)
+	}
+	msg := mbox.Receive(func(i interface{}) bool {
+		_, isC := i.(C)
+		return isC
+	})
+	if msg != (C{5}) {
+		t.Fatal("Receive did not match the timed message:", msg)
+	}
+
+	mbox.RecordQueueTimes(false)
+	addr.Send(6)
+	if msg, wait := mbox.ReceiveTimed(); msg != 6 || wait != 0 {
+		t.Fatal("Recording was not turned off:", msg, wait)
+	}
+}
+
 func TestBasicTerminate(t *testing.T) {
 	cs, _ := noClustering(NullLogger)
 	defer cs.Terminate()
@@ -316,6 +614,355 @@ func TestBasicTerminate(t *testing.T) {
 	}
 }
 
+func TestTerminationReasons(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	watcher, watcherMailbox := cs.NewMailbox()
+	defer watcherMailbox.Terminate()
+	watcherMailbox.ReportTerminationReasons(true)
+	plain, plainMailbox := cs.NewMailbox()
+	defer plainMailbox.Terminate()
+
+	normal, normalMailbox := cs.NewMailbox()
+	normal.NotifyAddressOnTerminate(watcher)
+	normal.NotifyAddressOnTerminate(plain)
+	normalMailbox.Terminate()
+	msg, _ := watcherMailbox.ReceiveNextAsync()
+	if msg != (TerminatedWithReason{ID: normal.mailboxID, Reason: TerminatedNormally}) {
+		t.Fatal("Wrong termination for Terminate:", msg)
+	}
+	if msg, _ = plainMailbox.ReceiveNextAsync(); msg != MailboxTerminated(normal.mailboxID) {
+		t.Fatal("Wrong termination without reasons:", msg)
+	}
+
+	panicked, panickedMailbox := cs.NewMailbox()
+	panicked.NotifyAddressOnTerminate(watcher)
+	panickedMailbox.TerminateWithReason(TerminatedPanic)
+	// the first reason stands
+	panickedMailbox.Terminate()
+	msg, _ = watcherMailbox.ReceiveNextAsync()
+	if msg != (TerminatedWithReason{ID: panicked.mailboxID, Reason: TerminatedPanic}) {
+		t.Fatal("Wrong termination for TerminateWithReason:", msg)
+	}
+	// as does it for a notification asked for afterwards
+	panicked.NotifyAddressOnTerminate(watcher)
+	msg, _ = watcherMailbox.ReceiveNextAsync()
+	if msg != (TerminatedWithReason{ID: panicked.mailboxID, Reason: TerminatedPanic}) {
+		t.Fatal("Wrong termination for a terminated mailbox:", msg)
+	}
+
+	// The watchers go down along with the rest, so this can only look.
+	_, drained := cs.NewMailbox()
+	cs.mailboxes.terminateAll()
+	if drained.terminationReason != TerminatedDraining {
+		t.Fatal("Wrong termination when the node shut down:", drained.terminationReason)
+	}
+
+	if TerminatedNodeDown.String() != "node down" || TerminationReason(99).String() == "" {
+		t.Fatal("Bad TerminationReason strings")
+	}
+}
+
+func TestMutuallyLinkedTermination(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	// Each mailbox notifies the other as it terminates, so terminating
+	// them both at once must not leave each waiting on the other's lock.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			addr1, m1 := cs.NewMailbox()
+			addr2, m2 := cs.NewMailbox()
+			addr1.NotifyAddressOnTerminate(addr2)
+			addr2.NotifyAddressOnTerminate(addr1)
+
+			var terminated sync.WaitGroup
+			terminated.Add(2)
+			go func() {
+				m1.Terminate()
+				terminated.Done()
+			}()
+			go func() {
+				m2.Terminate()
+				terminated.Done()
+			}()
+			terminated.Wait()
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Terminating mutually linked mailboxes deadlocked")
+	}
+}
+
+func TestReceiveConcurrent(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+
+	// Each handler call waits for all the workers to be busy at once,
+	// which is only possible if they really are concurrent.
+	const workers = 4
+	var busy sync.WaitGroup
+	busy.Add(workers)
+	allBusy := make(chan struct{})
+	go func() {
+		busy.Wait()
+		close(allBusy)
+	}()
+
+	var handledL sync.Mutex
+	handled := map[interface{}]bool{}
+	returned := make(chan struct{})
+	go func() {
+		var startedL sync.Mutex
+		started := 0
+		mbox.ReceiveConcurrent(workers, func(msg interface{}) {
+			startedL.Lock()
+			started++
+			if started <= workers {
+				busy.Done()
+			}
+			startedL.Unlock()
+			<-allBusy
+
+			handledL.Lock()
+			handled[msg] = true
+			handledL.Unlock()
+		})
+		close(returned)
+	}()
+
+	other := MailboxTerminated(1)
+	addr.Send(other)
+	for i := 0; i < 99; i++ {
+		addr.Send(i)
+	}
+	select {
+	case <-allBusy:
+	case <-time.After(timeout):
+		t.Fatal("The workers did not run concurrently")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		handledL.Lock()
+		count := len(handled)
+		handledL.Unlock()
+		if count == 100 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Not every message was handled:", count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !handled[other] {
+		t.Fatal("Another mailbox's termination was not handled")
+	}
+
+	mbox.Terminate()
+	select {
+	case <-returned:
+	case <-time.After(timeout):
+		t.Fatal("ReceiveConcurrent did not return on termination")
+	}
+	if handled[MailboxTerminated(mbox.id)] {
+		t.Fatal("The mailbox's own termination was handled")
+	}
+}
+
+func TestWaiterStats(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+	if count, oldest := mbox.WaiterStats(); count != 0 || oldest != 0 {
+		t.Fatal("Unexpected stats for an idle mailbox:", count, oldest)
+	}
+
+	received := make(chan interface{})
+	for i := 0; i < 2; i++ {
+		go func() { received <- mbox.ReceiveNext() }()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if count, _ := mbox.WaiterStats(); count == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The receivers were never counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, oldest := mbox.WaiterStats(); oldest < 20*time.Millisecond {
+		t.Fatal("The wait was not timed:", oldest)
+	}
+
+	addr.Send(1)
+	addr.Send(2)
+	<-received
+	<-received
+	if count, oldest := mbox.WaiterStats(); count != 0 || oldest != 0 {
+		t.Fatal("Receivers still counted:", count, oldest)
+	}
+
+	// A Receive woken by messages it doesn't match is still waiting from
+	// when it was called.
+	go func() {
+		received <- mbox.Receive(func(msg interface{}) bool { return msg == "wanted" })
+	}()
+	deadline = time.Now().Add(timeout)
+	for {
+		if count, _ := mbox.WaiterStats(); count == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The Receive was never counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	addr.Send("unwanted")
+	time.Sleep(5 * time.Millisecond)
+	if _, oldest := mbox.WaiterStats(); oldest < 20*time.Millisecond {
+		t.Fatal("The wait was restarted by an unmatched message:", oldest)
+	}
+	addr.Send("wanted")
+	<-received
+}
+
+func TestReceiveFirstIf(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+	isInt := func(msg interface{}) bool {
+		_, is := msg.(int)
+		return is
+	}
+	isString := func(msg interface{}) bool {
+		_, is := msg.(string)
+		return is
+	}
+
+	addr.Send("a")
+	addr.Send(1)
+	if msg, ok := mbox.receiveFirstIf(isInt, nil); !ok || msg != 1 {
+		t.Fatal("Did not take the first match:", msg, ok)
+	}
+	addr.Send(2)
+	if _, ok := mbox.receiveFirstIf(isInt, isString); ok {
+		t.Fatal("Did not stop at a message ahead of the match")
+	}
+	if mbox.len() != 2 {
+		t.Fatal("Stopping removed something:", mbox.len())
+	}
+	mbox.receiveFirstIf(isInt, nil)
+
+	// A message that arrives while it waits, behind others that are
+	// taken out of the mailbox, is still found.
+	received := make(chan interface{})
+	go func() {
+		msg, _ := mbox.receiveFirstIf(isInt, nil)
+		received <- msg
+	}()
+	addr.Send("b")
+	time.Sleep(5 * time.Millisecond)
+	mbox.removeFirstIf(isString)
+	addr.Send(3)
+	select {
+	case msg := <-received:
+		if msg != 3 {
+			t.Fatal("Unexpected message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Message that arrived while waiting was not found")
+	}
+	if msg, ok := mbox.ReceiveNextAsync(); !ok || msg != "b" {
+		t.Fatal("Unexpected message left behind:", msg, ok)
+	}
+
+	mbox.Terminate()
+	if msg, ok := mbox.receiveFirstIf(isInt, isString); !ok || msg != MailboxTerminated(mbox.id) {
+		t.Fatal("Termination not returned:", msg, ok)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := cs.NewMailbox()
+	defer mbox.Terminate()
+
+	mbox.Pause()
+	mbox.Pause()
+	addr.Send(1)
+	addr.Send(2)
+	if msg, ok := mbox.ReceiveNextAsync(); ok {
+		t.Fatal("Paused mailbox delivered:", msg)
+	}
+	for _, info := range cs.LocalMailboxes() {
+		if info.ID == addr.mailboxID && (!info.Paused || info.Depth != 2) {
+			t.Fatal("Pause not reported:", info)
+		}
+	}
+
+	received := make(chan interface{}, 3)
+	go func() { received <- mbox.ReceiveNext() }()
+	go func() { received <- mbox.Receive(func(interface{}) bool { return true }) }()
+	go func() {
+		_, msg := Select(mbox)
+		received <- msg
+	}()
+	select {
+	case msg := <-received:
+		t.Fatal("Paused mailbox delivered:", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// More messages can arrive while it's paused, and resuming wakes up
+	// every receiver.
+	addr.Send(3)
+	mbox.Resume()
+	mbox.Resume()
+	got := map[interface{}]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-received:
+			got[msg] = true
+		case <-time.After(timeout):
+			t.Fatal("Resume didn't wake the receivers; received", got)
+		}
+	}
+	if !got[1] || !got[2] || !got[3] {
+		t.Fatal("Unexpected messages received:", got)
+	}
+
+	// Terminating a paused mailbox still wakes its receivers.
+	mbox.Pause()
+	go func() { received <- mbox.ReceiveNext() }()
+	mbox.Terminate()
+	select {
+	case msg := <-received:
+		if _, isTerminated := msg.(MailboxTerminated); !isTerminated {
+			t.Fatal("Unexpected message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Termination didn't wake the paused receiver")
+	}
+}
+
 func TestAsyncTerminateOnReceive(t *testing.T) {
 	cs, _ := noClustering(NullLogger)
 	defer cs.Terminate()
@@ -332,7 +979,7 @@ func TestAsyncTerminateOnReceive(t *testing.T) {
 
 	// This goroutine uses private variables watches to see when the first
 	// message has been sent. The Receive call is not looking for this message,
-	// so once we see that len(m.messages) is no longer 0, we know that the
+	// so once we see that m.store.Len() is no longer 0, we know that the
 	// Receive call is in the for loop part of the call.
 	// Once that happens, this will Terminate the mailbox.
 	go func() {
@@ -340,7 +987,7 @@ func TestAsyncTerminateOnReceive(t *testing.T) {
 		// is in the for loop without klunking up the implementation...
 		time.Sleep(5 * time.Millisecond)
 		mailbox1.cond.L.Lock()
-		for len(mailbox1.messages) != 1 {
+		for mailbox1.store.Len() != 1 {
 			mailbox1.cond.Wait()
 		}
 		mailbox1.cond.L.Unlock()
@@ -399,6 +1046,162 @@ func TestAsyncTerminateOnReceiveNext(t *testing.T) {
 	}
 }
 
+func TestReceiveOrClosed(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := connections.NewMailbox()
+
+	// A notice of some other mailbox's termination is just a message.
+	addr.Send(MailboxTerminated(addr.mailboxID + 256))
+	if msg, ok := mbox.ReceiveOrClosed(); !ok || MailboxID(msg.(MailboxTerminated)) == addr.mailboxID {
+		t.Fatal("Another mailbox's termination ended the loop:", msg, ok)
+	}
+
+	received := make(chan int, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			msg, ok := mbox.ReceiveOrClosed()
+			if !ok {
+				if MailboxID(msg.(MailboxTerminated)) != addr.mailboxID {
+					t.Error("Wrong termination returned:", msg)
+				}
+				return
+			}
+			received <- msg.(int)
+		}
+	}()
+
+	addr.Send(1)
+	if msg := <-received; msg != 1 {
+		t.Fatal("Unexpected message:", msg)
+	}
+	// The loop is now blocked, and must be woken by the termination.
+	mbox.Terminate()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Blocked receiver was not woken by the termination")
+	}
+	if _, ok := mbox.ReceiveOrClosed(); ok {
+		t.Fatal("Terminated mailbox still open")
+	}
+}
+
+func TestCoalesceWakeups(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbox := connections.NewMailbox()
+	mbox.CoalesceWakeups(true)
+
+	// A single receiver taking everything at once gets every message, in
+	// order.
+	go func() {
+		for i := 0; i < 1000; i++ {
+			addr.Send(i)
+		}
+	}()
+	for next := 0; next < 1000; {
+		msgs, ok := mbox.ReceiveAll()
+		if !ok {
+			t.Fatal("Mailbox terminated")
+		}
+		for _, msg := range msgs {
+			if msg != next {
+				t.Fatal("Message out of order:", msg, "expected", next)
+			}
+			next++
+		}
+	}
+
+	// With several receivers, none of the messages is left waiting.
+	var received sync.WaitGroup
+	received.Add(1000)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				if _, ok := mbox.ReceiveOrClosed(); !ok {
+					return
+				}
+				received.Done()
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		addr.Send(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		received.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Messages were left waiting for a receiver")
+	}
+	mbox.Terminate()
+	if msgs, ok := mbox.ReceiveAll(); ok || MailboxID(msgs[0].(MailboxTerminated)) != addr.mailboxID {
+		t.Fatal("Terminated mailbox still open:", msgs)
+	}
+
+	// Only the message arriving in the empty mailbox signals the waiting
+	// receiver; the rest are taken along with it.
+	for _, coalesce := range []bool{false, true} {
+		burstAddr, burstMbox := connections.NewMailbox()
+		burstMbox.CoalesceWakeups(coalesce)
+		batch := make(chan []interface{})
+		go func() {
+			msgs, _ := burstMbox.ReceiveAll()
+			batch <- msgs
+		}()
+		awaitWaiters(t, burstMbox, 1)
+		burstMbox.Pause()
+		for i := 0; i < 100; i++ {
+			burstAddr.Send(i)
+		}
+		burstMbox.Resume()
+		if msgs := <-batch; len(msgs) != 100 {
+			t.Fatal("Burst not received at once:", len(msgs))
+		}
+		expected := uint64(100)
+		if coalesce {
+			expected = 1
+		}
+		if signals := mboxSignals(burstMbox); signals != expected {
+			t.Fatal("Burst signalled", signals, "wakeups with coalescing", coalesce)
+		}
+		burstMbox.Terminate()
+	}
+
+	// Receive is woken for messages arriving in a mailbox that isn't
+	// empty.
+	selAddr, selMbox := connections.NewMailbox()
+	defer selMbox.Terminate()
+	selMbox.CoalesceWakeups(true)
+	selAddr.Send("unmatched")
+	matched := make(chan interface{})
+	go func() {
+		matched <- selMbox.Receive(func(i interface{}) bool {
+			_, isInt := i.(int)
+			return isInt
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	selAddr.Send(1)
+	select {
+	case msg := <-matched:
+		if msg != 1 {
+			t.Fatal("Wrong message matched:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Receive was not woken")
+	}
+}
+
 func TestGetAddress(t *testing.T) {
 	cs, _ := noClustering(NullLogger)
 	defer cs.Terminate()
@@ -563,6 +1366,40 @@ func TestMarshaling(t *testing.T) {
 	}
 }
 
+func TestAddressEqual(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	a, m := connections.NewMailbox()
+	defer m.Terminate()
+
+	// An address obtained via marshaling has nothing cached.
+	text, err := a.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Address
+	if err = b.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	a.Send("populate the cache")
+
+	if !a.Equal(&b) || !b.Equal(a) {
+		t.Fatal("addresses for the same mailbox are not equal")
+	}
+
+	other, m2 := connections.NewMailbox()
+	defer m2.Terminate()
+	if a.Equal(other) {
+		t.Fatal("addresses for different mailboxes are equal")
+	}
+
+	var nilAddr *Address
+	if a.Equal(nil) || nilAddr.Equal(a) || !nilAddr.Equal(nil) {
+		t.Fatal("nil addresses do not compare correctly")
+	}
+}
+
 func TestUnmarshalAddressErrors(t *testing.T) {
 	cs, _ := noClustering(NullLogger)
 	defer cs.Terminate()
@@ -583,6 +1420,7 @@ func TestUnmarshalAddressErrors(t *testing.T) {
 		t.Fatal("Can unmarshal an address from nil bytes?")
 	}
 	for _, addrText := range []string{
+		"",
 		"somethingreallylongthatcan'tpossiblybeanaddress",
 		"1:1>",
 		"<1:1",
@@ -695,3 +1533,86 @@ func TestCoverAddressMarshaling(t *testing.T) {
 		t.Fatal("can marshal nonexistant address to Text")
 	}
 }
+
+// With many receivers idling on one mailbox, each message should only wake
+// up one of them. Compare against a build where Mailbox.send uses
+// Broadcast to see the difference the wakeup strategy makes.
+func BenchmarkManyIdleReceivers(b *testing.B) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbx := cs.NewMailbox()
+
+	var received sync.WaitGroup
+	var done sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			for {
+				if _, terminated := mbx.ReceiveNext().(MailboxTerminated); terminated {
+					return
+				}
+				received.Done()
+			}
+		}()
+	}
+
+	received.Add(b.N)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		addr.Send(i)
+	}
+	received.Wait()
+
+	b.StopTimer()
+	b.Logf("%d receiver wakeups for %d messages", mboxWakeups(mbx), b.N)
+	mbx.Terminate()
+	done.Wait()
+}
+
+func benchmarkBurstReceive(b *testing.B, coalesce bool) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	addr, mbx := cs.NewMailbox()
+	defer mbx.Terminate()
+	mbx.CoalesceWakeups(coalesce)
+
+	done := make(chan struct{})
+	b.ResetTimer()
+
+	go func() {
+		for received := 0; received < b.N; {
+			if coalesce {
+				msgs, _ := mbx.ReceiveAll()
+				received += len(msgs)
+			} else {
+				mbx.ReceiveNext()
+				received++
+			}
+		}
+		close(done)
+	}()
+	for i := 0; i < b.N; i++ {
+		addr.Send(i)
+	}
+	<-done
+
+	b.StopTimer()
+	b.Logf("%d wakeups signalled and %d receiver wakeups for %d messages",
+		mboxSignals(mbx), mboxWakeups(mbx), b.N)
+}
+
+// A receiver keeping up with a sender as fast as it can send, woken for
+// every message it isn't already waiting for.
+func BenchmarkBurstReceive(b *testing.B) {
+	benchmarkBurstReceive(b, false)
+}
+
+// The same, with only a message arriving in an empty mailbox waking the
+// receiver, which then takes everything that has arrived at once.
+func BenchmarkBurstReceiveCoalesced(b *testing.B) {
+	benchmarkBurstReceive(b, true)
+}
@@ -0,0 +1,323 @@
+package reign
+
+import (
+	"sort"
+	"time"
+)
+
+// A MailboxStore holds the messages waiting in a Mailbox to be received.
+// By default they are held in memory; supplying another MailboxStore to
+// NewMailboxWithStore allows for, say, spilling very large backlogs to
+// disk instead.
+//
+// The Mailbox calls the store only while holding its own lock, so the
+// store is never used concurrently and does not need any locking of its
+// own. The calls also block every sender and receiver on the Mailbox, so
+// they should be as fast as possible.
+//
+// The store must uphold these semantics:
+//
+//   - Order: the messages are kept in the order they were enqueued.
+//     Position 0 is the oldest message; Dequeue removes it. Remove takes
+//     out a message from the middle, for the selective Receive, without
+//     disturbing the order of the rest.
+//   - Identity: the value returned for a message must be what was given
+//     to Enqueue, or an equivalent value of the same concrete type, as
+//     the receivers type switch on them. Enqueue is given the messages
+//     exactly as they were sent; the Mailbox keeps any deadline from
+//     SendWithDeadline, and the time from RecordQueueTimes, apart from
+//     the store. A store that serializes
+//     messages, such as to disk, must be able to reproduce their types;
+//     as with sending across the cluster, RegisterType is the way to
+//     make that possible with gob.
+//   - No durability is required. The contents are discarded when the
+//     Mailbox is terminated, at which point Close is called, and nothing
+//     reloads a store's contents into a new Mailbox. A store on disk is
+//     a way to hold more than fits in memory, not a way to survive a
+//     crash.
+//
+// Peek, Remove, and Dequeue are only called with valid positions, i.e.,
+// when the store is not empty. Enqueue may return an error, for instance
+// if the disk is full, which will be returned from the Send.
+//
+// Receive calls Peek on every waiting message until it finds a match, so
+// a store for huge backlogs should be used with ReceiveNext instead.
+type MailboxStore interface {
+	Enqueue(msg interface{}) error
+	Dequeue() interface{}
+	Peek(i int) interface{}
+	Remove(i int) interface{}
+	Len() int
+	Close()
+}
+
+// NewMailboxWithStore creates a new tied pair of Address and Mailbox, like
+// NewMailbox, whose messages are kept in the given store.
+func (cs *connectionServer) NewMailboxWithStore(store MailboxStore) (*Address, *Mailbox) {
+	switch store.(type) {
+	case *fairStore, *sealedStore, sourcedSealedStore:
+		// These take the Mailbox's wrappers apart themselves.
+	default:
+		store = &plainStore{store: store}
+	}
+	return cs.newLocalMailboxWithStore(store)
+}
+
+type message struct {
+	msg interface{}
+}
+
+// memoryStore is the default MailboxStore.
+type memoryStore struct {
+	messages []message
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{messages: make([]message, 0, 1)}
+}
+
+func (ms *memoryStore) Enqueue(msg interface{}) error {
+	ms.messages = append(ms.messages, message{msg})
+	return nil
+}
+
+func (ms *memoryStore) Dequeue() interface{} {
+	msg := ms.messages[0]
+	// in the common case of not having a message backlog, this
+	// should prevent a lot of garbage buildup by reusing the slot.
+	if len(ms.messages) == 1 {
+		ms.messages = ms.messages[:0]
+	} else {
+		ms.messages = ms.messages[1:]
+	}
+	return msg.msg
+}
+
+func (ms *memoryStore) Peek(i int) interface{} {
+	return ms.messages[i].msg
+}
+
+func (ms *memoryStore) Remove(i int) interface{} {
+	msg := ms.messages[i]
+	ms.messages = append(ms.messages[:i], ms.messages[i+1:]...)
+	return msg.msg
+}
+
+func (ms *memoryStore) Len() int {
+	return len(ms.messages)
+}
+
+func (ms *memoryStore) Close() {
+	ms.messages = nil
+}
+
+// messageMeta is what a plainStore keeps alongside each message in the
+// store it wraps.
+type messageMeta struct {
+	expiring bool
+	deadline time.Time
+	queued   time.Time
+}
+
+// plainStore wraps a MailboxStore given to NewMailboxWithStore, so that
+// it only ever sees the messages themselves, and not the expiringMessage
+// and timedMessage wrappers the Mailbox puts around them. Those are kept
+// here, in the same order as the messages in the store, and put back
+// around the messages as they come out.
+type plainStore struct {
+	store MailboxStore
+	meta  []messageMeta
+}
+
+func (ps *plainStore) Enqueue(msg interface{}) error {
+	var meta messageMeta
+	if tm, isTimed := msg.(timedMessage); isTimed {
+		meta.queued = tm.queued
+		msg = tm.message
+	}
+	if em, isExpiring := msg.(expiringMessage); isExpiring {
+		meta.expiring = true
+		meta.deadline = em.deadline
+		msg = em.message
+	}
+	if err := ps.store.Enqueue(msg); err != nil {
+		return err
+	}
+	ps.meta = append(ps.meta, meta)
+	return nil
+}
+
+// wrap puts the wrappers back around a message from the store.
+func (ps *plainStore) wrap(msg interface{}, meta messageMeta) interface{} {
+	if meta.expiring {
+		msg = expiringMessage{meta.deadline, msg}
+	}
+	if !meta.queued.IsZero() {
+		msg = timedMessage{meta.queued, msg}
+	}
+	return msg
+}
+
+func (ps *plainStore) Dequeue() interface{} {
+	meta := ps.meta[0]
+	if len(ps.meta) == 1 {
+		ps.meta = ps.meta[:0]
+	} else {
+		ps.meta = ps.meta[1:]
+	}
+	return ps.wrap(ps.store.Dequeue(), meta)
+}
+
+func (ps *plainStore) Peek(i int) interface{} {
+	return ps.wrap(ps.store.Peek(i), ps.meta[i])
+}
+
+func (ps *plainStore) Remove(i int) interface{} {
+	meta := ps.meta[i]
+	ps.meta = append(ps.meta[:i], ps.meta[i+1:]...)
+	return ps.wrap(ps.store.Remove(i), meta)
+}
+
+func (ps *plainStore) Len() int {
+	return ps.store.Len()
+}
+
+func (ps *plainStore) Close() {
+	ps.meta = nil
+	ps.store.Close()
+}
+
+// A sourcedStore is a MailboxStore that wants to know which node each
+// message came from. Messages sent from this node are attributed to it.
+//
+// Such a store orders the messages itself, so a message may be inserted
+// anywhere rather than at the end.
+type sourcedStore interface {
+	MailboxStore
+	enqueueFrom(source NodeID, msg interface{}) error
+}
+
+// fairScale is the virtual time a message from a node with a weight of
+// one takes up in a fairStore. It is divisible by every weight up to 16,
+// so those divide it evenly.
+const fairScale = 720720
+
+// NewFairStore returns a MailboxStore that shares its Mailbox out fairly
+// among the nodes sending to it, for use with NewMailboxWithStore, so a
+// node that sends a huge burst can not starve the others.
+//
+// Rather than in the order they arrived, the messages are received in a
+// weighted round-robin across the sending nodes, taking the messages sent
+// from this node as one more sender. A node gets as many messages per
+// round as its weight in the given map, which defaults to 1. Each node's
+// messages are still received in the order it sent them.
+//
+// This is weighted fair queuing, which costs a binary search and a copy
+// per message, more as the backlog grows. Mailboxes that don't serve many
+// nodes at once should stick with the default store.
+func NewFairStore(weights map[NodeID]int) MailboxStore {
+	fs := &fairStore{
+		weights: make(map[NodeID]uint64, len(weights)),
+		lastTag: make(map[NodeID]uint64),
+	}
+	for node, weight := range weights {
+		if weight > fairScale {
+			weight = fairScale
+		}
+		if weight > 0 {
+			fs.weights[node] = uint64(weight)
+		}
+	}
+	return fs
+}
+
+type fairMessage struct {
+	msg interface{}
+	tag uint64
+}
+
+// fairStore keeps the messages sorted by their tag, the virtual time at
+// which they are due. Each node's messages are spaced apart by
+// fairScale / its weight, starting from the later of the tag of its last
+// message and the current virtual time, which is the tag of the last
+// message dequeued.
+type fairStore struct {
+	messages []fairMessage
+	weights  map[NodeID]uint64
+	lastTag  map[NodeID]uint64
+	now      uint64
+
+	// Enqueue is only used by code that doesn't know the source, which
+	// then all shares a turn.
+	unattributed uint64
+}
+
+func (fs *fairStore) Enqueue(msg interface{}) error {
+	tag := fs.unattributed
+	if tag < fs.now {
+		tag = fs.now
+	}
+	tag += fairScale
+	fs.unattributed = tag
+	fs.insert(fairMessage{msg, tag})
+	return nil
+}
+
+func (fs *fairStore) enqueueFrom(source NodeID, msg interface{}) error {
+	weight, exists := fs.weights[source]
+	if !exists {
+		weight = 1
+	}
+	tag := fs.lastTag[source]
+	if tag < fs.now {
+		tag = fs.now
+	}
+	tag += fairScale / weight
+	fs.lastTag[source] = tag
+	fs.insert(fairMessage{msg, tag})
+	return nil
+}
+
+// insert puts the message after every message due no later than it, so
+// messages due at the same time stay in the order they arrived.
+func (fs *fairStore) insert(fm fairMessage) {
+	i := sort.Search(len(fs.messages), func(i int) bool {
+		return fs.messages[i].tag > fm.tag
+	})
+	fs.messages = append(fs.messages, fairMessage{})
+	copy(fs.messages[i+1:], fs.messages[i:])
+	fs.messages[i] = fm
+}
+
+func (fs *fairStore) Dequeue() interface{} {
+	fm := fs.messages[0]
+	fs.now = fm.tag
+	fs.messages[0] = fairMessage{}
+	if len(fs.messages) == 1 {
+		fs.messages = fs.messages[:0]
+	} else {
+		fs.messages = fs.messages[1:]
+	}
+	return fm.msg
+}
+
+func (fs *fairStore) Peek(i int) interface{} {
+	return fs.messages[i].msg
+}
+
+func (fs *fairStore) Remove(i int) interface{} {
+	fm := fs.messages[i]
+	if i == 0 {
+		fs.now = fm.tag
+	}
+	fs.messages = append(fs.messages[:i], fs.messages[i+1:]...)
+	return fm.msg
+}
+
+func (fs *fairStore) Len() int {
+	return len(fs.messages)
+}
+
+func (fs *fairStore) Close() {
+	fs.messages = nil
+}
@@ -0,0 +1,158 @@
+package reign
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+var errStoreFull = errors.New("store full")
+
+// cappedStore is a MailboxStore that holds a limited number of messages,
+// built on the default one.
+type cappedStore struct {
+	memoryStore
+	capacity int
+	closed   bool
+}
+
+func (cs *cappedStore) Enqueue(msg interface{}) error {
+	if cs.Len() >= cs.capacity {
+		return errStoreFull
+	}
+	return cs.memoryStore.Enqueue(msg)
+}
+
+func (cs *cappedStore) Close() {
+	cs.closed = true
+	cs.memoryStore.Close()
+}
+
+func TestMailboxStore(t *testing.T) {
+	connectionServer, _ := noClustering(NullLogger)
+	defer connectionServer.Terminate()
+
+	store := &cappedStore{capacity: 3}
+	addr, mbox := connectionServer.NewMailboxWithStore(store)
+
+	for i := 0; i < 3; i++ {
+		if err := addr.Send(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if addr.Send(3) != errStoreFull {
+		t.Fatal("store's error not returned from Send")
+	}
+
+	if msg := mbox.Receive(func(i interface{}) bool { return i == 1 }); msg != 1 {
+		t.Fatal("selective receive through the store failed:", msg)
+	}
+	if msg := mbox.ReceiveNext(); msg != 0 {
+		t.Fatal("receive through the store out of order:", msg)
+	}
+	if msg, _ := mbox.ReceiveNextAsync(); msg != 2 {
+		t.Fatal("receive through the store out of order:", msg)
+	}
+
+	mbox.Terminate()
+	if !store.closed {
+		t.Fatal("store not closed on termination")
+	}
+}
+
+func TestMailboxStorePlainMessages(t *testing.T) {
+	connectionServer, _ := noClustering(NullLogger)
+	defer connectionServer.Terminate()
+
+	store := &cappedStore{capacity: 10}
+	addr, mbox := connectionServer.NewMailboxWithStore(store)
+	mbox.RecordQueueTimes(true)
+
+	addr.SendWithDeadline("expired", time.Now().Add(-time.Second))
+	addr.SendWithTTL("expiring", time.Hour)
+	addr.Send("plain")
+
+	// The store only ever sees what was sent.
+	for i, expected := range []string{"expired", "expiring", "plain"} {
+		if msg := store.Peek(i); msg != expected {
+			t.Fatalf("Store was given %#v, not %q", msg, expected)
+		}
+	}
+
+	// But the Mailbox still knows the deadlines and queue times.
+	msg, queued := mbox.ReceiveTimed()
+	if msg != "expiring" || queued < 0 || queued > time.Hour {
+		t.Fatal("Wrong message received from the store:", msg, queued)
+	}
+	if msg, _ := mbox.ReceiveNextAsync(); msg != "plain" {
+		t.Fatal("Wrong message received from the store:", msg)
+	}
+	if store.Len() != 0 {
+		t.Fatal("Store not emptied:", store.Len())
+	}
+}
+
+func TestFairStore(t *testing.T) {
+	store := NewFairStore(map[NodeID]int{2: 2}).(*fairStore)
+	for _, msg := range []string{"1a", "1b", "1c", "1d"} {
+		store.enqueueFrom(1, msg)
+	}
+	for _, msg := range []string{"2a", "2b", "2c", "2d"} {
+		store.enqueueFrom(2, msg)
+	}
+
+	// Node 2 gets two turns for each of node 1's, and neither's messages
+	// are reordered.
+	expected := []string{"2a", "1a", "2b", "2c", "1b", "2d", "1c", "1d"}
+	for i, exp := range expected {
+		if msg := store.Dequeue(); msg != exp {
+			t.Fatal("Unexpected message at", i, ":", msg)
+		}
+	}
+
+	// A node that was idle takes its turn from where the others are now,
+	// rather than catching up on the turns it didn't use.
+	store.enqueueFrom(1, "1e")
+	store.enqueueFrom(1, "1f")
+	store.enqueueFrom(3, "3a")
+	if msg := store.Dequeue(); msg != "1e" {
+		t.Fatal("Unexpected message:", msg)
+	}
+	if msg := store.Dequeue(); msg != "3a" {
+		t.Fatal("Unexpected message:", msg)
+	}
+}
+
+func TestFairStoreRemoteTraffic(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	addr, mbox := ntb.c1.NewMailboxWithStore(NewFairStore(nil))
+	defer mbox.Terminate()
+
+	for i := 0; i < 4; i++ {
+		addr.Send(i)
+	}
+	for _, msg := range []string{"a", "b"} {
+		ntb.remote1to2.Send(internal.IncomingMailboxMessage{
+			Target:  internal.IntMailboxID(addr.GetID()),
+			Message: msg,
+		})
+	}
+
+	// A selective Receive sees the remote messages, even though they are
+	// put ahead of the local ones it has already looked at.
+	if msg := mbox.Receive(func(i interface{}) bool { return i == "b" }); msg != "b" {
+		t.Fatal("Unexpected message:", msg)
+	}
+
+	// The remote node's message is taken in turn with the local ones.
+	for _, exp := range []interface{}{0, "a", 1, 2, 3} {
+		if msg, _ := mbox.ReceiveNextTimeout(timeout); msg != exp {
+			t.Fatal("Unexpected message:", msg, "expected", exp)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package reign
+
+// maxMetadataSize caps the total length of the keys and values of
+// ClusterSpec.Metadata.
+const maxMetadataSize = 4096
+
+// NodeMetadata returns the Metadata the given node sent the last time it
+// connected to this one, along with whether it has connected at all; see
+// ClusterSpec.Metadata. For this node itself, it returns its own. The map
+// is a copy, and may be changed freely.
+func (cs *connectionServer) NodeMetadata(node NodeID) (map[string]string, bool) {
+	if node == cs.ThisNode.ID {
+		return copyMetadata(cs.Cluster.Metadata), true
+	}
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return nil, false
+	}
+
+	rm.Lock()
+	defer rm.Unlock()
+	return copyMetadata(rm.metadata), rm.version != 0
+}
+
+// remoteMetadata returns the Metadata sent by another node, or nil,
+// with a warning, if it is more than this node would permit of its own.
+func (cs *connectionServer) remoteMetadata(node NodeID, metadata map[string]string) map[string]string {
+	if size := metadataSize(metadata); size > maxMetadataSize {
+		cs.Warnf("Node %d sent %d bytes of metadata, more than the %d permitted; ignoring it",
+			node, size, maxMetadataSize)
+		return nil
+	}
+	return metadata
+}
+
+// metadataSize returns the total length of the keys and values of the
+// metadata.
+func metadataSize(metadata map[string]string) int {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
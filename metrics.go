@@ -0,0 +1,110 @@
+package reign
+
+import (
+	"sync"
+)
+
+// Metrics receives measurements of reign's internals, for forwarding on
+// to whatever metrics system you use. Install one with
+// ConnectionService.SetMetrics; by default nothing is measured.
+//
+// The names passed in are stable and prefixed with "reign_". Durations
+// are passed in seconds. Labels identify things like the node on the
+// other end of a link; the map must not be retained or modified.
+//
+// The methods are called from reign's internal goroutines, potentially
+// concurrently, and must not block.
+type Metrics interface {
+	AddCounter(name string, labels map[string]string, delta uint64)
+	SetGauge(name string, labels map[string]string, value float64)
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// The metrics reign reports.
+const (
+	// Histogram: how long the remote mailboxes, the per-node loop that
+	// handles both directions of traffic on a link, spend on each
+	// message, labelled by "node" and "message" type. Local mailboxes
+	// aren't measured, as the time your own code takes to handle what it
+	// receives is invisible to reign.
+	MetricProcessingSeconds = "reign_remote_mailboxes_processing_seconds"
+
+	// Gauge: how many messages are waiting to be sent to a remote node,
+	// labelled by "node". See ClusterSpec.OutgoingQueueLimit.
+	MetricOutgoingQueueDepth = "reign_remote_mailboxes_outgoing_queue_depth"
+
+	// Counter: how many messages have been discarded from the outgoing
+	// queue to a remote node by the OverflowDropOldest policy, labelled
+	// by "node".
+	MetricOutgoingDropped = "reign_remote_mailboxes_outgoing_dropped_total"
+
+	// Counter: how many messages have been evicted from the outgoing
+	// queue to a remote node for waiting longer than the
+	// OutgoingQueueMaxAge, labelled by "node".
+	MetricOutgoingEvicted = "reign_remote_mailboxes_outgoing_evicted_total"
+
+	// Counter: how many messages were still waiting in the outgoing
+	// queue to a remote node when the loop sending to it was stopped,
+	// and so were never sent, labelled by "node".
+	MetricOutgoingAbandoned = "reign_remote_mailboxes_outgoing_abandoned_total"
+
+	// Counter: how many times the listener's socket has failed, leaving
+	// the node unable to accept cluster connections until it is rebound,
+	// labelled by "node". See ListenerRebindDelay.
+	MetricListenerFailures = "reign_listener_failures_total"
+
+	// Gauge: the configured cap on the messages per second accepted from
+	// a remote node, labelled by "node", reported when the link comes up.
+	// See ClusterSpec.IncomingRateLimit.
+	MetricIncomingRateLimit = "reign_remote_mailboxes_incoming_rate_limit"
+
+	// Counters: how many messages from a remote node went over the
+	// incoming rate limit, and were either held up by the throttle policy
+	// or discarded by the drop policy, labelled by "node".
+	MetricIncomingThrottled = "reign_remote_mailboxes_incoming_throttled_total"
+	MetricIncomingDropped   = "reign_remote_mailboxes_incoming_dropped_total"
+
+	// Counters: how many messages were sent to and received from a
+	// remote node, labelled by "node" and "type". The type is the Go type
+	// of the message for a mailbox, such as "string" or "*mypkg.Event",
+	// and reign's own bookkeeping messages are counted under their
+	// types in its internal package, such as
+	// "internal.NotifyNodeOnTerminate". The keepalive pings aren't
+	// counted.
+	MetricMessagesSent     = "reign_remote_mailboxes_messages_sent_total"
+	MetricMessagesReceived = "reign_remote_mailboxes_messages_received_total"
+
+	// Counter: how many messages sent with SendWithDeadline were discarded
+	// because their deadline passed while they were waiting, labelled by
+	// the "node" they were waiting on: this one for a local mailbox, or
+	// the remote node for the outgoing queue to it.
+	MetricMessagesExpired = "reign_mailbox_messages_expired_total"
+
+	// Counter: how many messages were dropped, labelled by "reason", one
+	// of DropNoConnection and the rest, and by "node": the remote node
+	// the message was coming from or going to, or this one for a local
+	// mailbox. This covers the drops the counters above do, and more;
+	// see ConnectionService.DropStats.
+	MetricMessagesDropped = "reign_messages_dropped_total"
+)
+
+// metricsHolder lets the Metrics be installed or replaced while the
+// internal loops are running.
+type metricsHolder struct {
+	metrics Metrics
+	sync.RWMutex
+}
+
+func (mh *metricsHolder) get() Metrics {
+	mh.RLock()
+	defer mh.RUnlock()
+	return mh.metrics
+}
+
+// SetMetrics installs the Metrics that the cluster will report to. Pass
+// nil to turn measuring off again.
+func (cs *connectionServer) SetMetrics(m Metrics) {
+	cs.metrics.Lock()
+	defer cs.metrics.Unlock()
+	cs.metrics.metrics = m
+}
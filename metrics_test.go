@@ -0,0 +1,148 @@
+package reign
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type observation struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// recordingMetrics records everything it is given.
+type recordingMetrics struct {
+	sync.Mutex
+	counters     map[string]uint64
+	gauges       map[string]float64
+	observations []observation
+	// the counter increments, with their labels
+	increments []observation
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+func (rm *recordingMetrics) AddCounter(name string, labels map[string]string, delta uint64) {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.counters[name] += delta
+	rm.increments = append(rm.increments, observation{name, labels, float64(delta)})
+}
+
+func (rm *recordingMetrics) SetGauge(name string, labels map[string]string, value float64) {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.gauges[name] = value
+}
+
+func (rm *recordingMetrics) ObserveHistogram(name string, labels map[string]string, value float64) {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.observations = append(rm.observations, observation{name, labels, value})
+}
+
+func (rm *recordingMetrics) observed(name string, labels map[string]string) bool {
+	rm.Lock()
+	defer rm.Unlock()
+
+	return matching(rm.observations, name, labels) > 0
+}
+
+// counted returns the total of the increments of the named counter with
+// the given labels.
+func (rm *recordingMetrics) counted(name string, labels map[string]string) uint64 {
+	rm.Lock()
+	defer rm.Unlock()
+
+	return uint64(matching(rm.increments, name, labels))
+}
+
+// matching sums the values of the observations with the given name and
+// labels.
+func matching(observations []observation, name string, labels map[string]string) float64 {
+	total := 0.0
+OBSERVATIONS:
+	for _, o := range observations {
+		if o.name != name {
+			continue
+		}
+		for k, v := range labels {
+			if o.labels[k] != v {
+				continue OBSERVATIONS
+			}
+		}
+		total += o.value
+	}
+	return total
+}
+
+func TestProcessingTimeMetrics(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	metrics := newRecordingMetrics()
+	ntb.c2.SetMetrics(metrics)
+
+	// The observation for a message is made just after it is delivered,
+	// so the second round trip ensures the first has been observed.
+	for i := 0; i < 2; i++ {
+		ntb.rem1_2.Send("hello")
+		if _, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !ok {
+			t.Fatal("message not received")
+		}
+	}
+
+	if !metrics.observed(MetricProcessingSeconds, map[string]string{
+		"node":    "1",
+		"message": "internal.IncomingMailboxMessage",
+	}) {
+		t.Fatalf("processing time not observed: %#v", metrics.observations)
+	}
+}
+
+func TestMessageTypeMetrics(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	metrics1 := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics1)
+	metrics2 := newRecordingMetrics()
+	ntb.c2.SetMetrics(metrics2)
+
+	ntb.rem1_2.Send("hello")
+	if _, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !ok {
+		t.Fatal("message not received")
+	}
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.addr1_2.getAddress().(*Mailbox).blockUntilNotifyStatus(ntb.remote2to1.Address, true)
+
+	for _, expected := range []struct {
+		metrics *recordingMetrics
+		name    string
+		labels  map[string]string
+	}{
+		{metrics1, MetricMessagesSent, map[string]string{"node": "2", "type": "string"}},
+		{metrics2, MetricMessagesReceived, map[string]string{"node": "1", "type": "string"}},
+		{metrics1, MetricMessagesSent, map[string]string{"node": "2", "type": "internal.NotifyNodeOnTerminate"}},
+		{metrics2, MetricMessagesReceived, map[string]string{"node": "1", "type": "internal.NotifyNodeOnTerminate"}},
+	} {
+		// The sender counts a message once it is written, so it may
+		// not have yet, even though the message has arrived.
+		deadline := time.Now().Add(timeout)
+		count := expected.metrics.counted(expected.name, expected.labels)
+		for count == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+			count = expected.metrics.counted(expected.name, expected.labels)
+		}
+		if count != 1 {
+			t.Fatalf("%s %v counted %d times", expected.name, expected.labels, count)
+		}
+	}
+}
@@ -37,17 +37,113 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/thejerf/reign/internal"
 )
 
+// The versions of the cluster protocol. Two nodes speak the lower of their
+// clusterVersions to each other, provided that is no older than either
+// side's minClusterVersion; otherwise they refuse to connect.
+//
+// Version history:
+//  1. The original protocol.
+//  2. Adds the cluster namespace to the handshake, and batched remote
+//     termination notices. With a version 1 node, termination notices
+//     are sent one at a time, and the namespace is considered empty.
+//  3. Adds streamed messages. SendStream refuses to send to older nodes.
+//  4. Adds control messages. SendControl refuses to send to older nodes.
+//  5. Adds batched link registrations, for NotifyBatchWindow. With older
+//     nodes, the links are registered one at a time.
+//  6. Adds messages encoded ahead of time, for EncodeWorkers. Older nodes
+//     are sent messages encoded along with the rest of the stream.
+//  7. Adds reliable messages and their acknowledgements, for
+//     SendReliable. SendReliable refuses to send to older nodes.
+//  8. Adds registry handovers. Handover refuses to involve older nodes,
+//     and older nodes that are only told of one may briefly see neither
+//     claim.
+//  9. Adds closing idle links, for LinkIdleTimeout. Links to older nodes
+//     are never closed for being idle.
+//  10. Adds compressed messages, for SendCompressed. Older nodes are sent
+//     them uncompressed.
+//  11. Adds confirmed termination notifications, for
+//     NotifyAddressOnTerminateConfirmed, which refuses to ask older nodes.
+//  12. Adds acknowledgements of streamed messages, for StreamWindow.
+//     Streams to older nodes are sent without waiting for them.
+//  13. Adds a gob stream for each encode worker, for EncodeWorkers, so
+//     that types are only described once. Older nodes are sent each
+//     message encoded on its own.
 const (
-	clusterVersion = 1
+	clusterVersion    = 13
+	minClusterVersion = 1
+)
+
+// ReconnectMinDelay and ReconnectMaxDelay bound how long to wait before
+// redialing a node after a failed attempt to connect to it. The wait
+// starts at ReconnectMinDelay and doubles with each consecutive failure up
+// to ReconnectMaxDelay, with part of it randomized so that the nodes of a
+// cluster don't all redial in lockstep. A link that was up and then
+// dropped is redialed immediately. Default to 100 milliseconds and 10
+// seconds.
+var (
+	ReconnectMinDelay = time.Millisecond * 100
+	ReconnectMaxDelay = time.Second * 10
+)
+
+// ReconnectGiveUpAfter and ReconnectMaxAttempts, if positive, abandon a
+// node that has not been connected to for that long, or after that many
+// consecutive failed attempts, whichever comes first. This keeps a node
+// from redialing a decommissioned node forever. An abandoned node is
+// reported with LinkAbandoned and not redialed until ReviveNode is called
+// for it; it may still connect to this node itself, if it is the one
+// that dials. Both default to zero, which means never give up.
+var (
+	ReconnectGiveUpAfter time.Duration
+	ReconnectMaxAttempts int
 )
 
+// DialTimeout bounds how long to wait for each address of a node to
+// accept a TCP connection, so that a node with AlternateAddresses moves on
+// to the next one reasonably promptly. Zero means to wait as long as the
+// OS does. Defaults to 10 seconds.
+var DialTimeout = time.Second * 10
+
+// A DialFunc connects to the address of another node, as a "host:port",
+// over the given network, which is always "tcp"; see ClusterSpec.Dialer.
+// It is called for each of the node's addresses in turn, until one
+// connects.
+//
+// It should give up once the timeout has passed, which is the
+// DialTimeout, and is zero for no limit, or once cancel is closed, which
+// happens when the cluster is stopped during the dial; net.Dialer's
+// Timeout and Cancel do just that. As the connection is secured with TLS
+// afterwards, what it returns only has to carry the bytes.
+type DialFunc func(network, address string, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error)
+
+// errDialCancelled is returned by dial when the connector is stopped
+// before it starts.
+var errDialCancelled = errors.New("dial cancelled")
+
+// reconnectDelay returns how long to wait after the given number of
+// consecutive failures, at least half of the capped exponential backoff.
+func reconnectDelay(failures int) time.Duration {
+	delay := ReconnectMinDelay
+	for i := 1; i < failures && delay < ReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > ReconnectMaxDelay {
+		delay = ReconnectMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
 // nodeConnector bundles together all of the information about how to connect
 // to a node. The actual connection is a nodeConnection. This runs as a
 // supervised service.
@@ -69,8 +165,29 @@ type nodeConnector struct {
 
 	cancel bool
 
+	// closed to cancel the dial under way, if there is one
+	dialCancel chan struct{}
+
 	failOnSSLHandshake     bool
 	failOnClusterHandshake bool
+
+	// set once the connector has been stopped, so the end of Serve isn't
+	// reported as a failure
+	stopped  bool
+	stopCond *sync.Cond
+
+	// the consecutive failed attempts to connect, and when the first of
+	// them started
+	failures     int
+	failingSince time.Time
+
+	// set when something is waiting to be sent over the dormant link, so
+	// it should be made again right away; see ClusterSpec.LinkIdleTimeout.
+	// Reconnect and ReviveNode set it too, to cut the backoff short.
+	woken bool
+
+	// set once reconnecting has been given up on, until ReviveNode
+	abandoned bool
 }
 
 // This establishes a connection to the target node. It does NOTHING ELSE,
@@ -79,7 +196,7 @@ type nodeConnector struct {
 // FIXME: Test that a node definition can't establish two connections to
 // the same node.
 func (nc *nodeConnector) connect() (*nodeConnection, error) {
-	conn, err := net.DialTCP("tcp", nc.source.localaddr, nc.dest.ipaddr)
+	conn, err := nc.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -98,6 +215,60 @@ func (nc *nodeConnector) connect() (*nodeConnection, error) {
 	}, nil
 }
 
+// dial tries the destination's Address, then each of its
+// AlternateAddresses in order, returning the first connection made or the
+// last error. Stopping the connector cancels it.
+func (nc *nodeConnector) dial() (net.Conn, error) {
+	nc.Lock()
+	if nc.stopped {
+		nc.Unlock()
+		return nil, errDialCancelled
+	}
+	cancel := make(chan struct{})
+	nc.dialCancel = cancel
+	nc.Unlock()
+	defer func() {
+		nc.Lock()
+		nc.dialCancel = nil
+		nc.Unlock()
+	}()
+
+	dial := nc.connectionServer.Cluster.Dialer
+	if dial == nil {
+		dial = nc.dialDirect
+	}
+
+	addrs := append([]*net.TCPAddr{nc.dest.ipaddr}, nc.dest.altipaddrs...)
+	var err error
+	for i, addr := range addrs {
+		var conn net.Conn
+		conn, err = dial("tcp", addr.String(), DialTimeout, cancel)
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-cancel:
+			return nil, err
+		default:
+		}
+		if i < len(addrs)-1 {
+			nc.Warnf("Could not connect to node %d at %s, trying its next address: %s",
+				nc.dest.ID, addr, myString(err))
+		}
+	}
+	return nil, err
+}
+
+// dialDirect is the DialFunc used when the cluster has no Dialer.
+func (nc *nodeConnector) dialDirect(network, address string, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, Cancel: cancel}
+	// a nil *net.TCPAddr in the net.Addr interface is not a nil LocalAddr.
+	if nc.source.localaddr != nil {
+		dialer.LocalAddr = nc.source.localaddr
+	}
+	return dialer.Dial(network, address)
+}
+
 func (nc *nodeConnector) String() string {
 	// Since the node connector's Serve() method acquires a lock while determining
 	// if it should cancel, we need to make sure that we also acquire that lock before
@@ -109,8 +280,42 @@ func (nc *nodeConnector) String() string {
 }
 
 func (nc *nodeConnector) Serve() {
+	defer nc.connectionServer.running(fmt.Sprintf("connector to node %d", nc.dest.ID))()
 	nc.Tracef("node connection from %d to %d, starting serve", nc.source.ID, nc.dest.ID)
 
+	if !nc.awaitReconnect() {
+		return
+	}
+
+	started := nc.connectionServer.clock.Now()
+	ready := false
+	defer func() {
+		nc.Lock()
+		stopped := nc.stopped
+		if ready {
+			nc.failures = 0
+		} else {
+			if nc.failures == 0 {
+				nc.failingSince = started
+			}
+			nc.failures++
+		}
+		nc.Unlock()
+		if stopped {
+			return
+		}
+		if !nc.remoteMailboxes.isDormant() {
+			nc.connectionServer.linkEvent(nc.dest.ID, LinkReconnectScheduled)
+		} else if !ready {
+			// The dormant link couldn't be made again.
+			nc.remoteMailboxes.endDormancy(time.Time{})
+		}
+	}()
+
+	nc.Lock()
+	nc.woken = false
+	nc.Unlock()
+	nc.connectionServer.linkEvent(nc.dest.ID, LinkDialing)
 	connection, err := nc.connect()
 	nc.connection = connection
 	if err != nil {
@@ -128,9 +333,11 @@ func (nc *nodeConnector) Serve() {
 	defer connection.terminate()
 	nc.Unlock()
 
+	nc.connectionServer.linkEvent(nc.dest.ID, LinkHandshaking)
 	err = connection.sslHandshake()
 	if err != nil {
 		nc.Errorf("Could not SSL handshake to node %v: %s", nc.dest.ID, err.Error())
+		nc.connectionServer.clusterEvent(EventRejected, nc.dest.ID, "TLS handshake: "+err.Error())
 		return
 	}
 	nc.Tracef("%d -> %d ssl handshake successful", nc.source.ID, nc.dest.ID)
@@ -138,12 +345,17 @@ func (nc *nodeConnector) Serve() {
 	err = connection.clusterHandshake()
 	if err != nil {
 		nc.Errorf("Could not perform cluster handshake with node %v: %s", nc.dest.ID, err.Error())
+		nc.connectionServer.clusterEvent(EventRejected, nc.dest.ID, "cluster handshake: "+err.Error())
 		return
 	}
 	nc.Tracef("%d -> %d cluster handshake successful", nc.source.ID, nc.dest.ID)
 
 	// hook up the connection to the permanent message manager
-	nc.remoteMailboxes.setConnection(connection)
+	err = nc.remoteMailboxes.openConnection(connection, connection.version, connection.instance, connection.metadata)
+	if err != nil {
+		nc.Errorf("Could not use connection to node %v: %s", nc.dest.ID, err.Error())
+		return
+	}
 	defer nc.remoteMailboxes.unsetConnection(connection)
 
 	// Synchronize registry with the remote node.
@@ -153,21 +365,127 @@ func (nc *nodeConnector) Serve() {
 		return
 	}
 	nc.Tracef("%d -> %d registry sync successful", nc.source.ID, nc.dest.ID)
+	ready = true
 
 	// and handle all incoming messages
 	connection.handleIncomingMessages()
 }
 
-func (nc *nodeConnector) Stop() {
+// awaitReconnect waits out the backoff after failed attempts to connect,
+// returning whether to go ahead and dial. If the node is to be abandoned,
+// this reports it and then waits for the connector to be stopped.
+//
+// If the link was closed for being idle, this waits for something to be
+// sent over it, or for the LinkIdleTimeout to pass, in which case the
+// link is made only to check in with the other node.
+func (nc *nodeConnector) awaitReconnect() bool {
+	nc.Lock()
+	failures, failingSince := nc.failures, nc.failingSince
+	nc.Unlock()
+
+	if failures == 0 {
+		checkIn := false
+		if nc.remoteMailboxes.isDormant() {
+			if nc.waitForStop(nc.connectionServer.Cluster.LinkIdleTimeout) {
+				return false
+			}
+			nc.Lock()
+			checkIn = !nc.woken
+			nc.Unlock()
+		}
+		nc.remoteMailboxes.Lock()
+		nc.remoteMailboxes.checkIn = checkIn
+		nc.remoteMailboxes.Unlock()
+		return true
+	}
+
+	failingFor := nc.connectionServer.clock.Now().Sub(failingSince)
+	if (ReconnectMaxAttempts > 0 && failures >= ReconnectMaxAttempts) ||
+		(ReconnectGiveUpAfter > 0 && failingFor >= ReconnectGiveUpAfter) {
+		nc.Errorf("Giving up on node %d after %d failed attempts to connect over %s; it will not be redialed",
+			nc.dest.ID, failures, failingFor)
+		nc.connectionServer.clusterEvent(EventAbandoned, nc.dest.ID,
+			fmt.Sprintf("after %d failed attempts over %s", failures, failingFor))
+		nc.connectionServer.linkEvent(nc.dest.ID, LinkAbandoned)
+		nc.Lock()
+		nc.abandoned = true
+		nc.Unlock()
+		return nc.awaitRevival()
+	}
+
+	return !nc.waitForStop(reconnectDelay(failures))
+}
+
+// awaitRevival waits for an abandoned connector to be revived, returning
+// true, or stopped, returning false. Anything else that wakes it, such as
+// a message for the dormant link, is ignored, as only ReviveNode brings
+// back an abandoned node.
+func (nc *nodeConnector) awaitRevival() bool {
+	for {
+		nc.Lock()
+		abandoned := nc.abandoned
+		nc.woken = false
+		nc.Unlock()
+		if !abandoned {
+			return true
+		}
+		if nc.waitForStop(-1) {
+			return false
+		}
+	}
+}
+
+// waitForStop waits up to the given duration for the connector to be
+// stopped, returning whether it was. A negative duration waits forever.
+// It also returns early if the connector is woken.
+func (nc *nodeConnector) waitForStop(d time.Duration) bool {
 	nc.Lock()
 	defer nc.Unlock()
 
-	if nc.connection != nil {
-		nc.connection.terminate()
-		nc.connection = nil
-	} else {
+	if nc.stopCond == nil {
+		nc.stopCond = sync.NewCond(&nc.Mutex)
+	}
+
+	expired := false
+	if d >= 0 {
+		timer := nc.connectionServer.clock.AfterFunc(d, func() {
+			nc.Lock()
+			expired = true
+			nc.Unlock()
+			nc.stopCond.Broadcast()
+		})
+		defer timer.Stop()
+	}
+
+	for !nc.stopped && !expired && !nc.woken {
+		nc.stopCond.Wait()
+	}
+	return nc.stopped
+}
+
+func (nc *nodeConnector) Stop() {
+	nc.Lock()
+	nc.stopped = true
+	if nc.stopCond != nil {
+		nc.stopCond.Broadcast()
+	}
+	if nc.dialCancel != nil {
+		close(nc.dialCancel)
+		nc.dialCancel = nil
+	}
+	connection := nc.connection
+	nc.connection = nil
+	if connection == nil {
 		nc.cancel = true
 	}
+	nc.Unlock()
+
+	// Sending the event may wait on the subscribers, so it waits until the
+	// lock has been released.
+	if connection != nil {
+		nc.connectionServer.linkEvent(nc.dest.ID, LinkDraining)
+		connection.terminate()
+	}
 }
 
 // this is the literal connection to the node.
@@ -178,7 +496,9 @@ type nodeConnection struct {
 	rawInput  io.ReadCloser
 	output    *gob.Encoder
 	input     *gob.Decoder
-	pingTimer *time.Timer
+	streams   encodeStreams
+	pingTimer clockTimer
+	pings     pingClock
 
 	connectionServer *connectionServer
 	source           *NodeDefinition
@@ -189,6 +509,12 @@ type nodeConnection struct {
 	failOnSSLHandshake     bool
 	failOnClusterHandshake bool
 
+	// the protocol version agreed on in the cluster handshake, and the
+	// Instance and Metadata the other node sent in it
+	version  uint16
+	instance string
+	metadata map[string]string
+
 	// Used for testing purposes to peek in on incoming messages.
 	peekFunc func(internal.ClusterMessage)
 }
@@ -231,7 +557,7 @@ func (nc *nodeConnection) resetPingTimer(d time.Duration) {
 	defer nc.Unlock()
 
 	if nc.pingTimer == nil {
-		nc.pingTimer = time.NewTimer(d)
+		nc.pingTimer = nc.connectionServer.clock.NewTimer(d)
 
 		return
 	}
@@ -262,6 +588,13 @@ func (nc *nodeConnection) terminate() {
 	}
 }
 
+func (nc *nodeConnection) tlsState() (tls.ConnectionState, bool) {
+	if nc.tls == nil {
+		return tls.ConnectionState{}, false
+	}
+	return nc.tls.ConnectionState(), true
+}
+
 func (nc *nodeConnection) sslHandshake() (err error) {
 	nc.Tracef("Conn to %d in sslHandshake", nc.dest.ID)
 	if nc.failOnSSLHandshake {
@@ -283,9 +616,10 @@ func (nc *nodeConnection) sslHandshake() (err error) {
 
 	nc.tls = tlsConn
 
-	// Initially, we unconditionally use the TLS connection
+	// Initially, we unconditionally use the TLS connection. The decoder
+	// is only for the handshake; see maxHandshakeSize.
 	nc.output = gob.NewEncoder(nc.tls)
-	nc.input = gob.NewDecoder(nc.tls)
+	nc.input = gob.NewDecoder(io.LimitReader(nc.tls, maxHandshakeSize))
 	return
 }
 
@@ -296,9 +630,13 @@ func (nc *nodeConnection) clusterHandshake() (err error) {
 		return
 	}
 	handshake := internal.ClusterHandshake{
-		ClusterVersion: clusterVersion,
-		MyNodeID:       internal.IntNodeID(nc.source.ID),
-		YourNodeID:     internal.IntNodeID(nc.dest.ID),
+		ClusterVersion:    clusterVersion,
+		MinClusterVersion: minClusterVersion,
+		MyNodeID:          internal.IntNodeID(nc.source.ID),
+		YourNodeID:        internal.IntNodeID(nc.dest.ID),
+		Namespace:         nc.connectionServer.Cluster.Namespace,
+		Instance:          nc.connectionServer.Cluster.Instance,
+		Metadata:          nc.connectionServer.Cluster.Metadata,
 	}
 	nc.output.Encode(handshake)
 
@@ -311,24 +649,115 @@ func (nc *nodeConnection) clusterHandshake() (err error) {
 	myNodeID := NodeID(serverHandshake.MyNodeID)
 	yourNodeID := NodeID(serverHandshake.YourNodeID)
 
-	if serverHandshake.ClusterVersion != clusterVersion {
-		connections.Warnf("Remote node id %v claimed unknown cluster version %v, proceeding in the hope that this will all just work out somehow...",
-			nc.dest.ID, serverHandshake.ClusterVersion)
+	nc.version, err = negotiateVersion(nc.dest.ID, serverHandshake)
+	if err != nil {
+		return
+	}
+	if nc.version != clusterVersion {
+		nc.Warnf("Node %d only speaks cluster protocol version %d; running the connection to it in degraded mode",
+			nc.dest.ID, nc.version)
 	}
+	// Accepting a peer under the wrong ID would route its messages to
+	// mailboxes on some other node, so these are fatal to the connection.
 	if myNodeID != nc.dest.ID {
-		connections.Warnf("The node I thought was #%v is claiming to be #%v instead. These two nodes can not communicate properly. Standing by, hoping a new node definition will resolve this shortly....",
-			nc.dest.ID, serverHandshake.MyNodeID)
+		err = fmt.Errorf("the node I thought was #%v is claiming to be #%v instead; refusing the connection until the node definitions agree",
+			nc.dest.ID, myNodeID)
+		return
 	}
 	if yourNodeID != nc.source.ID {
-		connections.Warnf("The node #%v thinks I'm node #%v, but I think I'm node #%v. These two nodes can not communicate properly. Standing by, hoping a new node definition will resolve this shortly...",
-			nc.dest.ID, serverHandshake.YourNodeID, nc.source.ID)
+		err = fmt.Errorf("node #%v thinks I'm node #%v, but I think I'm node #%v; refusing the connection until the node definitions agree",
+			nc.dest.ID, yourNodeID, nc.source.ID)
+		return
 	}
+	err = checkNamespace(nc.dest.ID, serverHandshake.Namespace, nc.connectionServer.Cluster.Namespace)
+	if err != nil {
+		return
+	}
+	nc.instance = remoteInstance(serverHandshake.Instance)
+	nc.metadata = nc.connectionServer.remoteMetadata(nc.dest.ID, serverHandshake.Metadata)
 
 	nc.input = gob.NewDecoder(nc.tls)
 
 	return
 }
 
+// negotiateVersion returns the protocol version to use with the remote
+// node that sent the given handshake, or an error if we have no version
+// in common.
+func negotiateVersion(remote NodeID, theirs internal.ClusterHandshake) (uint16, error) {
+	// Nodes from before the version window was introduced send no
+	// minimum, which gob decodes as 0. They only speak version 1.
+	theirMin := theirs.MinClusterVersion
+	if theirMin == 0 {
+		theirMin = 1
+	}
+
+	version := uint16(clusterVersion)
+	if theirs.ClusterVersion < version {
+		version = theirs.ClusterVersion
+	}
+	if version < minClusterVersion || version < theirMin {
+		return 0, fmt.Errorf("node %d speaks cluster protocol versions %d-%d, but this node speaks versions %d-%d; refusing to connect",
+			remote, theirMin, theirs.ClusterVersion, minClusterVersion, clusterVersion)
+	}
+	return version, nil
+}
+
+// maxInstanceLength caps the length of ClusterSpec.Instance.
+const maxInstanceLength = 256
+
+// maxHandshakeSize caps how much of the connection is read for the other
+// node's ClusterHandshake, so that one sending a huge Instance or
+// Metadata is refused before it has used up this node's memory. It leaves
+// plenty of room for the maxInstanceLength and maxMetadataSize, which
+// are enforced once the handshake is read.
+const maxHandshakeSize = 64 << 10
+
+// processStarted is roughly when this process started, for the default
+// Instance.
+var processStarted = time.Now()
+
+// defaultInstance returns the Instance used when the ClusterSpec doesn't
+// give one.
+func defaultInstance() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+	instance := fmt.Sprintf("%s pid %d started %s", host, os.Getpid(),
+		processStarted.UTC().Format(time.RFC3339))
+	if len(instance) > maxInstanceLength {
+		instance = instance[:maxInstanceLength]
+	}
+	return instance
+}
+
+// remoteInstance returns the Instance sent by another node, cut down to
+// the length this node would permit of its own, so a misbehaving node
+// can't fill the logs with it.
+func remoteInstance(instance string) string {
+	if len(instance) > maxInstanceLength {
+		return instance[:maxInstanceLength]
+	}
+	return instance
+}
+
+// checkNamespace verifies the remote node is a member of the same logical
+// cluster that we are.
+//
+// With the node ID and mailbox counter sharing 64 bits, there's no room
+// for the namespace in the MailboxIDs themselves, as Erlang does with its
+// node "creation", so it is carried in the marshalled Addresses instead.
+// Every message between nodes travels over a connection that has passed
+// this check, which keeps other namespaces' messages out.
+func checkNamespace(remote NodeID, theirs, mine string) error {
+	if theirs == mine {
+		return nil
+	}
+	return fmt.Errorf("node %d is in cluster namespace %q, but this node is in %q; refusing to connect nodes from different clusters",
+		remote, theirs, mine)
+}
+
 // registrySync sends this node's registry MailboxID and claims to the remote node.
 func (nc *nodeConnection) registrySync() (err error) {
 	// Send our registry synchronization data to the remote node.
@@ -381,15 +810,18 @@ func (nc *nodeConnection) handleIncomingMessages() {
 	)
 
 	// Report the successful connection, and defer the disconnection status change call.
-	nc.connectionServer.changeConnectionStatus(nc.dest.ID, true)
-	defer nc.connectionServer.changeConnectionStatus(nc.dest.ID, false)
+	nc.remoteMailboxes.reportStatus(true)
+	defer nc.remoteMailboxes.connectionEnded(nc)
+	nc.remoteMailboxes.markReady(nc)
+	nc.connectionServer.linkReady(nc.dest.ID)
+	nc.remoteMailboxes.Send(connectionReady{})
 
 	defer close(done)
 
 	nc.Tracef("Connection %d -> %d in handleIncomingMessages", nc.source.ID, nc.dest.ID)
 	nc.resetConnectionDeadline(DeadlineInterval)
 
-	go func() {
+	nc.connectionServer.goroutine(fmt.Sprintf("pings to node %d", nc.dest.ID), func() {
 		var pErr error
 
 		// Send PING messages to the remote node at regular intervals.
@@ -398,7 +830,8 @@ func (nc *nodeConnection) handleIncomingMessages() {
 		nc.resetPingTimer(PingInterval)
 		for {
 			select {
-			case <-nc.pingTimer.C:
+			case <-nc.pingTimer.Chan():
+				nc.pings.start()
 				pErr = nc.output.Encode(&ping)
 				if pErr != nil {
 					nc.Errorf("Attempted to ping node %d: %s", nc.dest.ID, pErr)
@@ -408,10 +841,16 @@ func (nc *nodeConnection) handleIncomingMessages() {
 				return
 			}
 		}
-	}()
+	})
 
 	for err == nil {
-		err = nc.input.Decode(&cm)
+		cm, err = decodeClusterMessage(nc.input, &nc.streams)
+		if pe, isPayload := err.(payloadError); isPayload {
+			nc.nodeConnector.remoteMailboxes.undecodable(pe)
+			nc.resetConnectionDeadline(DeadlineInterval)
+			err = nil
+			continue
+		}
 		switch err {
 		case nil:
 			nc.peekIncomingMessage(cm)
@@ -420,27 +859,69 @@ func (nc *nodeConnection) handleIncomingMessages() {
 			nc.resetPingTimer(PingInterval)
 
 			switch cm.(type) {
-			case *internal.Ping:
+			case internal.Ping:
 				err = nc.output.Encode(&pong)
 				if err != nil {
 					nc.Errorf("Attempted to pong remote node: %s", err)
 				}
-			case *internal.Pong:
+			case internal.Pong:
+				if rtt, timed := nc.pings.stop(); timed {
+					nc.nodeConnector.remoteMailboxes.recordLatency(rtt)
+				}
+			case internal.LinkIdle:
+				// The other node has stopped sending, so the idle
+				// connection can be closed.
+				if nc.nodeConnector.remoteMailboxes.closedIdle(nc) {
+					return
+				}
 			default:
-				err = nc.nodeConnector.remoteMailboxes.Send(cm)
+				err = nc.nodeConnector.remoteMailboxes.receive(cm)
 				if err != nil {
 					nc.Errorf("Error handling message %#v:\n%#v", cm, err)
 				}
 			}
 			nc.resetConnectionDeadline(DeadlineInterval)
 		case io.EOF:
-			nc.Errorf("Connection to node ID %v has gone down", nc.dest.ID)
+			if !nc.nodeConnector.remoteMailboxes.closedIdle(nc) {
+				nc.Errorf("Connection to node ID %v has gone down", nc.dest.ID)
+			}
 		default:
+			if nc.nodeConnector.remoteMailboxes.closedIdle(nc) {
+				return
+			}
 			panic(fmt.Sprintf("Error decoding message: %s", err.Error()))
 		}
 	}
 }
 
+// decodeClusterMessage reads the next message from a connection, in the
+// form the handlers expect; see internal.Normalize. streams holds the
+// connection's EncodeStreams. A message whose Encoded form can't be
+// decoded returns a payloadError, and the connection can carry on.
+func decodeClusterMessage(dec *gob.Decoder, streams *encodeStreams) (internal.ClusterMessage, error) {
+	var cm internal.ClusterMessage
+	if err := dec.Decode(&cm); err != nil {
+		return nil, err
+	}
+	if imm, isIncoming := cm.(*internal.IncomingMailboxMessage); isIncoming && imm.Encoded != nil {
+		var message interface{}
+		var err error
+		switch {
+		case imm.Compressed:
+			message, err = decompressMessage(imm.Encoded)
+		case imm.EncodeStream != 0:
+			message, err = streams.decode(imm)
+		default:
+			message, err = decodeMessage(imm.Encoded)
+		}
+		if err != nil {
+			return nil, payloadError{imm.Target, err}
+		}
+		imm.Message, imm.Encoded = message, nil
+	}
+	return internal.Normalize(cm), nil
+}
+
 func (nc *nodeConnection) send(value *internal.ClusterMessage) error {
 	// If we are not currently connected, silently eat the message.
 	// FIXME: Compare with Erlang.
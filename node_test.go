@@ -17,6 +17,16 @@ package reign
 // * Test linking works normally
 // * Test linking works when connection terminated.
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -119,6 +129,37 @@ func TestMessagesCanSendMailboxes(t *testing.T) {
 	}
 }
 
+func TestLocalSendIsDirect(t *testing.T) {
+	// Nothing is serving the remote mailboxes, so anything that went
+	// through them would stay queued.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	// Neither a channel nor a func can be gob-encoded, so these only
+	// arrive if nothing tries.
+	type unencodable struct {
+		ch chan int
+		f  func()
+	}
+	sent := &unencodable{ch: make(chan int), f: func() {}}
+
+	// An Address that only has the ID, as from UnmarshalFromID, has to
+	// find its way to the local mailbox too.
+	byID := &Address{mailboxID: ntb.addr1_1.mailboxID, connectionServer: ntb.c1}
+	for _, addr := range []*Address{ntb.addr1_1, byID} {
+		if err := addr.Send(sent); err != nil {
+			t.Fatal("Could not send locally:", err)
+		}
+		received, ok := ntb.mailbox1_1.ReceiveNextAsync()
+		if !ok || received != sent {
+			t.Fatal("Local send did not deliver the value itself:", received)
+		}
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 0 {
+		t.Fatal("Local send went through the outgoing queue")
+	}
+}
+
 // Little tests which just get some coverage out of the way.
 func TestCoverage(t *testing.T) {
 	ntb := testbed(nil)
@@ -183,6 +224,429 @@ func TestHappyPathRemoteLink(t *testing.T) {
 	}
 }
 
+func TestRemoteTerminationReason(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	ntb.mailbox1_1.ReportTerminationReasons(true)
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.addr1_2.getAddress().(*Mailbox).blockUntilNotifyStatus(ntb.remote2to1.Address, true)
+
+	ntb.mailbox1_2.TerminateWithReason(TerminatedPanic)
+	termNotice, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+	if !ok || termNotice != (TerminatedWithReason{ID: ntb.mailbox1_2.id, Reason: TerminatedPanic}) {
+		t.Fatal("The termination reason did not cross the network:", termNotice)
+	}
+}
+
+func TestRemoteLinks(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// waitForLinks polls, as the links are recorded and removed by the
+	// remote mailboxes concurrently with the messages we can wait on.
+	waitForLinks := func(expected int) map[MailboxID][]MailboxID {
+		deadline := time.Now().Add(timeout)
+		for {
+			links := ntb.c1.RemoteLinks(2)
+			if len(links) == expected || time.Now().After(deadline) {
+				return links
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	links := waitForLinks(1)
+	locals := links[ntb.mailbox1_2.id]
+	if len(links) != 1 || len(locals) != 1 || locals[0] != ntb.mailbox1_1.id {
+		t.Fatal("Unexpected links:", links)
+	}
+
+	// it's a copy
+	delete(links, ntb.mailbox1_2.id)
+	if len(ntb.c1.RemoteLinks(2)) != 1 {
+		t.Fatal("RemoteLinks returned the live links")
+	}
+
+	ntb.mailbox1_2.Terminate()
+	if links = waitForLinks(0); len(links) != 0 {
+		t.Fatal("Links not removed on termination:", links)
+	}
+
+	if ntb.c1.RemoteLinks(1) != nil || ntb.c1.RemoteLinks(3) != nil {
+		t.Fatal("Got links for a node without remote mailboxes")
+	}
+}
+
+func TestTerminationWatchers(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// Like RemoteLinks, the watchers change concurrently with what we can
+	// wait on.
+	waitForWatchers := func(expected int) []NodeID {
+		deadline := time.Now().Add(timeout)
+		for {
+			watchers := ntb.c2.TerminationWatchers(ntb.mailbox1_2.id)
+			if len(watchers) == expected || time.Now().After(deadline) {
+				return watchers
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if watchers := ntb.c2.TerminationWatchers(ntb.mailbox1_2.id); watchers == nil || len(watchers) != 0 {
+		t.Fatal("Unexpected watchers:", watchers)
+	}
+
+	// A node watches once, however many of its mailboxes link.
+	other, otherMailbox := ntb.c1.NewMailbox()
+	defer otherMailbox.Terminate()
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.rem1_2.NotifyAddressOnTerminate(other)
+	if watchers := waitForWatchers(1); len(watchers) != 1 || watchers[0] != 1 {
+		t.Fatal("Unexpected watchers:", watchers)
+	}
+
+	ntb.rem1_2.RemoveNotifyAddress(ntb.addr1_1)
+	ntb.rem1_2.RemoveNotifyAddress(other)
+	if watchers := waitForWatchers(0); len(watchers) != 0 {
+		t.Fatal("Watchers not removed:", watchers)
+	}
+
+	if ntb.c2.TerminationWatchers(ntb.mailbox1_1.id) != nil {
+		t.Fatal("Got watchers for a remote mailbox")
+	}
+	ntb.mailbox1_2.Terminate()
+	if ntb.c2.TerminationWatchers(ntb.mailbox1_2.id) != nil {
+		t.Fatal("Got watchers for a terminated mailbox")
+	}
+}
+
+func TestCancelAllNotifications(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	waitForLinks := func(expected int) map[MailboxID][]MailboxID {
+		deadline := time.Now().Add(timeout)
+		for {
+			links := ntb.c1.RemoteLinks(2)
+			locals := 0
+			for _, ids := range links {
+				locals += len(ids)
+			}
+			if locals == expected || time.Now().After(deadline) {
+				return links
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	other, otherMailbox := ntb.c1.NewMailbox()
+	defer otherMailbox.Terminate()
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.rem1_2.NotifyAddressOnTerminate(other)
+	ntb.addr2_1.NotifyAddressOnTerminate(ntb.addr1_1)
+	waitForLinks(2)
+
+	ntb.addr1_1.CancelAllNotifications()
+	links := waitForLinks(1)
+	if locals := links[ntb.mailbox1_2.id]; len(locals) != 1 || locals[0] != other.mailboxID {
+		t.Fatal("Unexpected links:", links)
+	}
+	// The other link keeps node 2 notifying this one.
+	if watchers := ntb.c2.TerminationWatchers(ntb.mailbox1_2.id); len(watchers) != 1 {
+		t.Fatal("Unexpected watchers:", watchers)
+	}
+	ntb.mailbox2_1.cond.L.Lock()
+	_, notified := ntb.mailbox2_1.notificationAddresses[ntb.mailbox1_1.id]
+	ntb.mailbox2_1.cond.L.Unlock()
+	if notified {
+		t.Fatal("The local notification was not cancelled")
+	}
+
+	// Once nothing links to the remote mailbox, node 2 is told.
+	other.CancelAllNotifications()
+	if links := waitForLinks(0); len(links) != 0 {
+		t.Fatal("Links not removed:", links)
+	}
+	deadline := time.Now().Add(timeout)
+	for len(ntb.c2.TerminationWatchers(ntb.mailbox1_2.id)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Node 2 was not told to stop notifying")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Neither remote nor terminated mailboxes have anything to cancel.
+	ntb.rem1_2.CancelAllNotifications()
+	ntb.mailbox1_1.Terminate()
+	ntb.addr1_1.CancelAllNotifications()
+}
+
+func TestOutgoingDepth(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	// Nothing is running, so the messages stay queued.
+	for i := 0; i < 3; i++ {
+		ntb.rem1_2.Send(i)
+	}
+	if depth, known := ntb.c1.OutgoingDepth(2); depth != 3 || !known {
+		t.Fatal("Unexpected outgoing depth:", depth, known)
+	}
+	if _, known := ntb.c1.OutgoingDepth(1); known {
+		t.Fatal("Got an outgoing depth for this node")
+	}
+}
+
+func TestEncodeAddress(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// An address from the registry has no mailbox attached yet.
+	unbound := &Address{mailboxID: ntb.mailbox1_2.id}
+	for _, addr := range []*Address{ntb.addr1_2, unbound} {
+		token, err := ntb.c2.EncodeAddress(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Decoding on the other node routes to the remote mailbox.
+		decoded, err := ntb.c1.DecodeAddress(token)
+		if err != nil {
+			t.Fatal("Could not decode", token, err)
+		}
+		decoded.Send(token)
+		if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != token {
+			t.Fatal("Decoded address did not route to the mailbox:", msg)
+		}
+
+		// And on the same node, to the local one.
+		decoded, err = ntb.c2.DecodeAddress(token)
+		if err != nil || !decoded.Equal(ntb.addr1_2) {
+			t.Fatal("Could not decode locally:", token, err)
+		}
+	}
+
+	if _, err := ntb.c1.EncodeAddress(&Address{}); err == nil {
+		t.Fatal("Encoded the empty address")
+	}
+	for _, bad := range []string{"", "X", "<1:0>", "<3:5>", "<1:5", "moo"} {
+		if _, err := ntb.c1.DecodeAddress(bad); err != ErrIllegalAddressFormat {
+			t.Fatalf("Decoded %q: %v", bad, err)
+		}
+	}
+}
+
+func TestAddressNamespace(t *testing.T) {
+	spec := testSpec()
+	spec.Namespace = "generation 2"
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	// Within the namespace, addresses go back and forth as usual.
+	token, err := ntb.c2.EncodeAddress(ntb.addr1_2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ntb.c1.DecodeAddress(token)
+	if err != nil {
+		t.Fatal("Could not decode", token, err)
+	}
+	decoded.Send(token)
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != token {
+		t.Fatal("Decoded address did not route to the mailbox:", msg)
+	}
+	text, _ := ntb.addr1_2.MarshalText()
+	bin, _ := ntb.addr1_2.MarshalBinary()
+	// Unmarshalling goes by the node's global connection server.
+	var addr Address
+	ntb.with2(func() {
+		if err := addr.UnmarshalText(text); err != nil || addr.mailboxID != ntb.addr1_2.mailboxID {
+			t.Fatal("Could not unmarshal text:", string(text), err)
+		}
+		if err := addr.UnmarshalBinary(bin); err != nil || addr.mailboxID != ntb.addr1_2.mailboxID {
+			t.Fatal("Could not unmarshal binary:", bin, err)
+		}
+	})
+
+	// Those from another generation, or from before there were
+	// namespaces, are refused.
+	for _, namespace := range []string{"generation 1", ""} {
+		ntb.c2.Cluster.Namespace = namespace
+		token, _ := ntb.c2.EncodeAddress(ntb.addr1_2)
+		text, _ := ntb.addr1_2.MarshalText()
+		bin, _ := ntb.addr1_2.MarshalBinary()
+		ntb.c2.Cluster.Namespace = spec.Namespace
+
+		if _, err := ntb.c1.DecodeAddress(token); err != ErrIllegalAddressFormat {
+			t.Fatalf("Decoded %q: %v", token, err)
+		}
+		ntb.with2(func() {
+			if err := addr.UnmarshalText(text); err != ErrAddressNamespace {
+				t.Fatalf("Unmarshalled %q: %v", text, err)
+			}
+			if err := addr.UnmarshalBinary(bin); err != ErrAddressNamespace {
+				t.Fatalf("Unmarshalled %v: %v", bin, err)
+			}
+		})
+	}
+}
+
+func TestUnroutableHandler(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	gone := ntb.mailbox1_2.id
+	ntb.mailbox1_2.Terminate()
+
+	unroutable := make(chan interface{}, 2)
+	ntb.c2.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		if target != gone {
+			t.Error("Handler called for the wrong mailbox:", target)
+		}
+		unroutable <- msg
+		if msg == "forward" {
+			ntb.addr2_2.Send(msg)
+			return true
+		}
+		return false
+	})
+
+	ntb.rem1_2.Send("forward")
+	ntb.rem1_2.Send("drop")
+	for _, expected := range []string{"forward", "drop"} {
+		select {
+		case msg := <-unroutable:
+			if msg != expected {
+				t.Fatal("Handler called with the wrong message:", msg)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Handler was not called")
+		}
+	}
+
+	msg, ok := ntb.mailbox2_2.ReceiveNextTimeout(timeout)
+	if !ok || msg != "forward" {
+		t.Fatal("Handled message was not forwarded:", msg)
+	}
+
+	// Deliverable messages don't go near the handler.
+	ntb.rem2_2.Send("normal")
+	if msg, _ = ntb.mailbox2_2.ReceiveNextTimeout(timeout); msg != "normal" {
+		t.Fatal("Normal message not delivered:", msg)
+	}
+	if len(unroutable) != 0 {
+		t.Fatal("Handler called for a deliverable message")
+	}
+}
+
+// Messages from one sender to one remote mailbox must arrive in order,
+// even while other senders share the link.
+func TestRemoteMessageOrdering(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	const count = 5000
+	targets := []struct {
+		addr    *Address
+		mailbox *Mailbox
+	}{
+		{ntb.rem1_2, ntb.mailbox1_2},
+		{ntb.rem2_2, ntb.mailbox2_2},
+	}
+
+	for i, target := range targets {
+		go func(addr *Address, viaID bool) {
+			for j := 0; j < count; j++ {
+				if viaID {
+					ntb.c1.send(addr.GetID(), j)
+				} else {
+					addr.Send(j)
+				}
+			}
+		}(target.addr, i == 1)
+	}
+
+	for _, target := range targets {
+		for j := 0; j < count; j++ {
+			msg, ok := target.mailbox.ReceiveNextTimeout(timeout)
+			if !ok {
+				t.Fatalf("message %d never arrived", j)
+			}
+			if msg != j {
+				t.Fatalf("expected message %d, got %v", j, msg)
+			}
+		}
+	}
+}
+
+// Terminations that happen together may be batched across the wire; they
+// should all still arrive.
+func TestRemoteLinkManyTerminations(t *testing.T) {
+	testRemoteLinkManyTerminations(t, clusterVersion)
+}
+
+// Version 1 nodes don't understand the batches.
+func TestRemoteLinkManyTerminationsVersion1(t *testing.T) {
+	testRemoteLinkManyTerminations(t, 1)
+}
+
+func testRemoteLinkManyTerminations(t *testing.T, version uint16) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	ntb.remote2to1.Lock()
+	ntb.remote2to1.version = version
+	ntb.remote2to1.Unlock()
+
+	var batchesL sync.Mutex
+	batches := 0
+	ntb.c1.nodeConnectors[2].connection.setPeekFunc(func(cm internal.ClusterMessage) {
+		if _, is := cm.(*internal.RemoteMailboxesTerminated); is {
+			batchesL.Lock()
+			batches++
+			batchesL.Unlock()
+		}
+	})
+
+	mailboxes := make([]*Mailbox, 100)
+	expected := make(map[MailboxID]bool)
+	for i := range mailboxes {
+		var addr *Address
+		addr, mailboxes[i] = ntb.c2.NewMailbox()
+		remote := &Address{
+			mailboxID:        addr.mailboxID,
+			connectionServer: ntb.c1,
+		}
+		remote.NotifyAddressOnTerminate(ntb.addr1_1)
+		expected[addr.mailboxID] = true
+	}
+	mailboxes[len(mailboxes)-1].blockUntilNotifyStatus(ntb.remote2to1.Address, true)
+
+	for _, mbox := range mailboxes {
+		mbox.Terminate()
+	}
+	for range mailboxes {
+		termNotice, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+		if !ok {
+			t.Fatal("Not all termination notices arrived")
+		}
+		delete(expected, MailboxID(termNotice.(MailboxTerminated)))
+	}
+	if len(expected) != 0 {
+		t.Fatal("Received the wrong termination notices")
+	}
+
+	batchesL.Lock()
+	defer batchesL.Unlock()
+	if version < 2 && batches != 0 {
+		t.Fatal("Sent batched termination notices to a version 1 node")
+	}
+}
+
 // This tests what happens if we have two notifications, and then
 // unnotify one of them. We still want to receive the termination notice.
 func TestHappyPathPartialUnnotify(t *testing.T) {
@@ -235,7 +699,7 @@ func TestHappyPathFullUnnotify(t *testing.T) {
 	// command when we remove the other notify address
 	gotRemoveNotifyNode := make(chan struct{})
 	ntb.remote2to1.Send(newDoneProcessing{func(x interface{}) bool {
-		_, isRNNOT := x.(*internal.RemoveNotifyNodeOnTerminate)
+		_, isRNNOT := x.(internal.RemoveNotifyNodeOnTerminate)
 		if isRNNOT {
 			gotRemoveNotifyNode <- void
 		}
@@ -256,111 +720,1833 @@ func TestRemoteLinkErrorPaths(t *testing.T) {
 
 	// Send the remoteMailbox a message for the wrong node. (Verified that
 	// this goes down the right code path via coverage analysis.)
-	ntb.remote2to1.Send(&internal.IncomingMailboxMessage{
+	ntb.remote2to1.Send(internal.IncomingMailboxMessage{
 		Target:  internal.IntMailboxID(ntb.mailbox1_1.id),
 		Message: "moo",
 	})
 	time.Sleep(time.Second)
 }
 
-func TestConnectionPanicsClient(t *testing.T) {
+func TestRelayHops(t *testing.T) {
 	ntb := testbed(nil)
 	defer ntb.terminate()
 
-	c := make(chan struct{})
-	ntb.remote2to1.connectionEstablished = func() {
-		c <- struct{}{}
+	unroutable := make(chan interface{}, 1)
+	ntb.c2.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		unroutable <- msg
+		return true
+	})
+
+	// A message that reaches the wrong node is relayed to the right one.
+	ntb.remote2to1.Send(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_1.id),
+		Message: "relayed",
+		Hops:    DefaultMaxHops - 1,
+	})
+	if msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout); !ok || msg != "relayed" {
+		t.Fatal("Message was not relayed:", msg)
 	}
 
-	ntb.remote2to1.Send(internal.PanicHandler{})
+	// But not once it has been relayed too many times.
+	ntb.remote2to1.Send(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_1.id),
+		Message: "looping",
+		Hops:    DefaultMaxHops,
+	})
+	select {
+	case msg := <-unroutable:
+		if msg != "looping" {
+			t.Fatal("Unexpected unroutable message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Looping message was not dead-lettered")
+	}
+	if msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(50 * time.Millisecond); ok {
+		t.Fatal("Looping message was delivered:", msg)
+	}
 
-	// this proves the connection was re-established.
-	<-c
+	// Nor at all, by a node that doesn't relay.
+	ntb.c2.Cluster.MisroutedPolicy = MisroutedDrop
+	ntb.remote2to1.Send(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(ntb.mailbox1_1.id),
+		Message: "misrouted",
+	})
+	select {
+	case msg := <-unroutable:
+		if msg != "misrouted" {
+			t.Fatal("Unexpected unroutable message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Misrouted message was not dead-lettered")
+	}
+	if msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(50 * time.Millisecond); ok {
+		t.Fatal("Misrouted message was delivered:", msg)
+	}
 }
 
-func TestConnectionPanicsServer(t *testing.T) {
+func TestControlMessages(t *testing.T) {
 	ntb := testbed(nil)
 	defer ntb.terminate()
 
-	c := make(chan struct{})
+	type control struct {
+		from NodeID
+		msg  interface{}
+	}
+	received := make(chan control, 2)
+	ntb.c2.SetControlHandler(func(from NodeID, msg interface{}) {
+		received <- control{from, msg}
+	})
 
-	ntb.remote1to2.Lock()
-	ntb.remote1to2.connectionEstablished = func() {
-		c <- struct{}{}
+	if err := ntb.c1.SendControl(2, "upgrade"); err != nil {
+		t.Fatal("Could not send control message:", err)
+	}
+	select {
+	case got := <-received:
+		if got != (control{1, "upgrade"}) {
+			t.Fatal("Unexpected control message:", got)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Control message was not received")
 	}
-	ntb.remote1to2.Unlock()
 
-	ntb.remote1to2.Send(internal.PanicHandler{})
+	// Control messages can't carry reign's own messages, in either
+	// direction.
+	if err := ntb.c1.SendControl(2, internal.PanicHandler{}); err != ErrReservedControlMessage {
+		t.Fatal("Internal message was sent as a control message:", err)
+	}
+	if err := ntb.c1.SendControl(2, &internal.StreamChunk{}); err != ErrReservedControlMessage {
+		t.Fatal("Internal message was sent as a control message:", err)
+	}
+	ntb.remote2to1.Send(internal.ControlMessage{Message: internal.PanicHandler{}})
+	ntb.remote2to1.Send(internal.ControlMessage{Message: "after"})
+	select {
+	case got := <-received:
+		if got != (control{1, "after"}) {
+			t.Fatal("Unexpected control message:", got)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Control message was not received")
+	}
 
-	// this proves the connection was re-established.
-	<-c
+	if err := ntb.c1.SendControl(9, "nobody"); err != ErrUnknownNode {
+		t.Fatal("Sent a control message to an unknown node:", err)
+	}
+
+	ntb.remote1to2.Lock()
+	version := ntb.remote1to2.version
+	ntb.remote1to2.version = 3
+	ntb.remote1to2.Unlock()
+	err := ntb.c1.SendControl(2, "too new")
+	ntb.remote1to2.Lock()
+	ntb.remote1to2.version = version
+	ntb.remote1to2.Unlock()
+	if err != ErrControlUnsupported {
+		t.Fatal("Sent a control message to an old node:", err)
+	}
 }
 
-func TestConnectionDiesClient(t *testing.T) {
-	ntb := testbed(nil)
+func TestBroadcastToNodes(t *testing.T) {
+	// Node 3 never comes up.
+	spec := testSpec()
+	spec.Nodes = append(spec.Nodes, &NodeDefinition{ID: NodeID(3), Address: "127.0.0.1:29878"})
+	ntb := testbed(spec)
 	defer ntb.terminate()
 
-	c := make(chan struct{})
-	ntb.remote2to1.connectionEstablished = func() {
-		c <- struct{}{}
+	type control struct {
+		to   NodeID
+		from NodeID
+		msg  interface{}
+	}
+	received := make(chan control, 4)
+	for _, cs := range []*connectionServer{ntb.c1, ntb.c2} {
+		to := cs.nodeID
+		cs.SetControlHandler(func(from NodeID, msg interface{}) {
+			received <- control{to, from, msg}
+		})
 	}
 
-	ntb.remote2to1.Send(internal.DestroyConnection{})
+	reached, skipped, err := ntb.c1.BroadcastToNodes("flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reached, []NodeID{1, 2}) || !reflect.DeepEqual(skipped, []NodeID{3}) {
+		t.Fatal("Unexpected nodes reached and skipped:", reached, skipped)
+	}
+	got := map[NodeID]control{}
+	for len(got) < 2 {
+		select {
+		case c := <-received:
+			got[c.to] = c
+		case <-time.After(timeout):
+			t.Fatal("Broadcast was not received everywhere:", got)
+		}
+	}
+	if got[1] != (control{1, 1, "flush"}) || got[2] != (control{2, 1, "flush"}) {
+		t.Fatal("Unexpected broadcast received:", got)
+	}
 
-	<-c
-}
+	// Without a handler of its own, this node is skipped too.
+	ntb.c1.SetControlHandler(nil)
+	reached, skipped, err = ntb.c1.BroadcastToNodes("flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reached, []NodeID{2}) || !reflect.DeepEqual(skipped, []NodeID{1, 3}) {
+		t.Fatal("Node without a handler counted as reached:", reached, skipped)
+	}
 
-func TestConnectionDiesServer(t *testing.T) {
-	ntb := testbed(nil)
-	defer ntb.terminate()
+	if _, _, err := ntb.c1.BroadcastToNodes(internal.PanicHandler{}); err != ErrReservedControlMessage {
+		t.Fatal("Internal message was broadcast:", err)
+	}
+}
 
-	c := make(chan struct{})
+// A link that can't be sent to the remote node is reported as a
+// termination, without taking down the remote mailboxes.
+func TestRemoteLinkWithoutConnection(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+	defer func() {
+		ntb.remote1to2.Stop()
+		<-done
+	}()
 
-	ntb.remote1to2.Lock()
-	ntb.remote1to2.connectionEstablished = func() {
-		c <- struct{}{}
+	for i := 0; i < 2; i++ {
+		ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+		termNotice, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+		if !ok {
+			t.Fatal("No termination for the unlinkable mailbox")
+		}
+		if MailboxID(termNotice.(MailboxTerminated)) != ntb.mailbox1_2.id {
+			t.Fatal("Received a termination notice for the wrong mailbox")
+		}
+		if len(ntb.remote1to2.links()) != 0 {
+			t.Fatal("Failed link was recorded")
+		}
 	}
-	ntb.remote1to2.Unlock()
+}
 
-	ntb.remote1to2.Send(internal.DestroyConnection{})
+// failingSender is a connection whose sends all fail.
+type failingSender struct {
+	err        error
+	terminated bool
+}
 
-	<-c
+func (fs *failingSender) send(*internal.ClusterMessage) error {
+	return fs.err
 }
 
-func TestHeartbeatRoundtrip(t *testing.T) {
-	ntb := testbed(nil)
-	defer ntb.terminate()
+func (fs *failingSender) terminate() {
+	fs.terminated = true
+}
 
-	// Set the peekFunc() on c1's node connection to c2 object.
-	c := make(chan internal.ClusterMessage)
-	ntb.c1.nodeConnectors[2].connection.setPeekFunc(func(cm internal.ClusterMessage) { c <- cm })
+// recordingSender is a connection that passes along everything sent on it.
+type recordingSender struct {
+	sent chan internal.ClusterMessage
+}
 
-	var recPing, recPong bool
+func (rs *recordingSender) send(cm *internal.ClusterMessage) error {
+	rs.sent <- *cm
+	return nil
+}
 
-	// Take a peek at the first two messages. The only messages sent between nodes of
-	// this ntb should be alternating PING and PONG messages.  Make sure we get one
-	// of each.
-	for i := 0; i < 2; i++ {
-		switch cm := <-c; cm.(type) {
-		case *internal.Ping:
-			recPing = true
-		case *internal.Pong:
-			recPong = true
-		default:
-			t.Errorf("received unexpected message type: %#v", cm)
+func (rs *recordingSender) terminate() {}
+
+func TestLinkGracePeriod(t *testing.T) {
+	LinkGracePeriod = 50 * time.Millisecond
+	defer func() { LinkGracePeriod = 0 }()
+
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	expectRegistration := func() {
+		select {
+		case cm := <-conn.sent:
+			notify, isNotify := cm.(*internal.NotifyNodeOnTerminate)
+			if !isNotify || MailboxID(notify.IntMailboxID) != ntb.mailbox1_2.id {
+				t.Fatal("Unexpected message:", cm)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Link was not registered with the remote node")
 		}
 	}
 
-	switch {
-	case recPing && !recPong:
-		t.Error("received two PING messages but no PONG messages; the PingInterval may be too short")
-	case !recPing && recPong:
-		t.Error("received two PONG messages but no PING messages; something is very wrong")
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	expectRegistration()
+
+	// A short outage re-registers the link when the connection is back.
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.remote1to2.Send(connectionReady{})
+	expectRegistration()
+	if msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(2 * LinkGracePeriod); ok {
+		t.Fatal("Link terminated despite reconnecting:", msg)
+	}
+
+	// A long one gives it up.
+	ntb.remote1to2.unsetConnection(conn)
+	msg, ok := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+	if !ok || msg != MailboxTerminated(ntb.mailbox1_2.id) {
+		t.Fatal("Link not terminated after the grace period:", msg)
+	}
+	if links := ntb.c1.RemoteLinks(2); len(links) != 0 {
+		t.Fatal("Links kept after the grace period:", links)
 	}
 }
 
-func TestCoverRemoteMailboxes(t *testing.T) {
-	rm := new(remoteMailboxes)
-	rm.ClusterLogger = NullLogger
-	rm.send(internal.PanicHandler{}, "")
+func TestOnNodeDownFanout(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	type fanout struct {
+		node     NodeID
+		notified int
+	}
+	fanouts := make(chan fanout, 10)
+	ntb.c1.OnNodeDownFanout(func(node NodeID, notified int) {
+		fanouts <- fanout{node, notified}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+
+	addr, mailbox := ntb.c1.NewMailbox()
+	defer mailbox.Terminate()
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.rem1_2.NotifyAddressOnTerminate(addr)
+	deadline := time.Now().Add(timeout)
+	for len(ntb.c1.RemoteLinks(2)[ntb.mailbox1_2.id]) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Links were not made:", ntb.c1.RemoteLinks(2))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ntb.remote1to2.Stop()
+	<-done
+	for _, m := range []*Mailbox{ntb.mailbox1_1, mailbox} {
+		if _, ok := m.ReceiveNextTimeout(timeout); !ok {
+			t.Fatal("Linked mailbox was not notified")
+		}
+	}
+	select {
+	case f := <-fanouts:
+		if f != (fanout{2, 2}) {
+			t.Fatal("Unexpected fan-out:", f)
+		}
+	default:
+		t.Fatal("The fan-out was not reported")
+	}
+	if len(fanouts) != 0 {
+		t.Fatal("The fan-out was reported more than once")
+	}
+}
+
+func TestNotifyBatchWindow(t *testing.T) {
+	NotifyBatchWindow = 20 * time.Millisecond
+	defer func() { NotifyBatchWindow = 0 }()
+
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	remotes := make([]*Address, 4)
+	for i := range remotes {
+		remotes[i] = &Address{
+			mailboxID:        MailboxID((i+1)<<8 | 2),
+			connectionServer: ntb.c1,
+		}
+	}
+	link := func() {
+		for _, remote := range remotes {
+			remote.NotifyAddressOnTerminate(ntb.addr1_1)
+		}
+		// A link that is removed within the window is never registered.
+		remotes[3].RemoveNotifyAddress(ntb.addr1_1)
+	}
+	// registered returns the remote mailboxes the links were registered for,
+	// and how many messages that took.
+	registered := func() (map[MailboxID]bool, int) {
+		ids := map[MailboxID]bool{}
+		messages := 0
+		for len(ids) < 3 {
+			select {
+			case cm := <-conn.sent:
+				messages++
+				switch msg := cm.(type) {
+				case *internal.NotifyNodeOnTerminates:
+					for _, id := range msg.IntMailboxIDs {
+						ids[MailboxID(id)] = true
+					}
+				case *internal.NotifyNodeOnTerminate:
+					ids[MailboxID(msg.IntMailboxID)] = true
+				default:
+					t.Fatal("Unexpected message:", cm)
+				}
+			case <-time.After(timeout):
+				t.Fatal("Links were not registered:", ids)
+			}
+		}
+		select {
+		case cm := <-conn.sent:
+			t.Fatal("Unexpected message:", cm)
+		case <-time.After(2 * NotifyBatchWindow):
+		}
+		return ids, messages
+	}
+
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	link()
+	ids, messages := registered()
+	if messages != 1 {
+		t.Fatal("Links were not registered in one message:", messages)
+	}
+	for _, remote := range remotes[:3] {
+		if !ids[remote.mailboxID] {
+			t.Fatal("Link was not registered:", remote.mailboxID)
+		}
+	}
+
+	// Older nodes get them one at a time.
+	for _, remote := range remotes[:3] {
+		remote.RemoveNotifyAddress(ntb.addr1_1)
+	}
+	for range remotes[:3] {
+		select {
+		case <-conn.sent:
+		case <-time.After(timeout):
+			t.Fatal("Links were not removed")
+		}
+	}
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, 4, "")
+	link()
+	if _, messages := registered(); messages != 3 {
+		t.Fatal("Links were not registered one at a time:", messages)
+	}
+}
+
+func TestRemoteSendWithDeadline(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+
+	// The expired message never leaves the outgoing queue.
+	future := time.Now().Add(time.Hour)
+	ntb.rem1_2.SendWithDeadline("stale", time.Now().Add(-time.Second))
+	ntb.rem1_2.SendWithDeadline("fresh", future)
+	select {
+	case cm := <-conn.sent:
+		imm, isIMM := cm.(internal.IncomingMailboxMessage)
+		if !isIMM || imm.Message != "fresh" || !imm.Deadline.Equal(future) ||
+			imm.TTL <= 0 || imm.TTL > time.Hour {
+			t.Fatal("Unexpected message:", cm)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Message was not sent")
+	}
+
+	// And the deadline makes it across to the other node.
+	ntb = testbed(nil)
+	defer ntb.terminate()
+
+	ntb.rem1_2.SendWithDeadline("moo", future)
+	msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if !ok || msg != "moo" {
+		t.Fatal("Message was not delivered:", msg)
+	}
+
+	// Where it is still enforced, once the message has been delivered.
+	ntb.mailbox1_2.Pause()
+	ttl := 100 * time.Millisecond
+	ntb.rem1_2.SendWithTTL("expiring", ttl)
+	deadline := time.Now().Add(timeout)
+	for ntb.mailbox1_2.len() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Message was not delivered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(ttl)
+	ntb.rem1_2.Send("after")
+	ntb.mailbox1_2.Resume()
+	msg, ok = ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if !ok || msg != "after" {
+		t.Fatal("Expired message was received:", msg)
+	}
+	awaitDrops(t, ntb.c2, map[string]uint64{DropExpired: 1})
+}
+
+func TestRemoteDeadlineClocks(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote2to1.Serve()
+
+	// receive sends the message with a deadline as though from node 1, and
+	// returns whichever gets through of it and a message sent after it.
+	receive := func(deadline time.Time, ttl time.Duration) interface{} {
+		for _, msg := range []internal.IncomingMailboxMessage{
+			{Message: "expiring", Deadline: deadline, TTL: ttl},
+			{Message: "after"},
+		} {
+			msg.Target = internal.IntMailboxID(ntb.mailbox1_2.id)
+			ntb.remote2to1.Send(msg)
+		}
+		msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+		if msg != "after" {
+			ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+		}
+		return msg
+	}
+
+	// The time left wins over the deadline, from a clock that is way off.
+	if msg := receive(time.Now().Add(-time.Hour), time.Hour); msg != "expiring" {
+		t.Fatal("The TTL was not used:", msg)
+	}
+
+	// Older nodes only send the deadline, which MaxClockSkew extends.
+	lateDeadline := time.Now().Add(-time.Second)
+	if msg := receive(lateDeadline, 0); msg != "after" {
+		t.Fatal("An expired deadline was kept:", msg)
+	}
+	ntb.c2.Cluster.MaxClockSkew = time.Minute
+	if msg := receive(lateDeadline, 0); msg != "expiring" {
+		t.Fatal("The deadline was not allowed for skew:", msg)
+	}
+}
+
+func TestSendErrorClassification(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&net.OpError{Op: "write", Err: errors.New("broken pipe")}, true},
+		{io.EOF, true},
+		{errors.New("gob: type not registered for interface: main.moo"), false},
+	} {
+		conn := &failingSender{err: test.err}
+		ntb.remote1to2.setConnection(conn, clusterVersion, "")
+
+		err := ntb.remote1to2.send(internal.IncomingMailboxMessage{}, "test")
+		sendErr, isSendErr := err.(*SendError)
+		if !isSendErr || sendErr.Err != test.err || sendErr.Node != 2 {
+			t.Fatalf("Unexpected error for %v: %#v", test.err, err)
+		}
+		if IsRetryable(err) != test.retryable {
+			t.Fatalf("%v classified wrongly", test.err)
+		}
+		// Only network failures should cause a reconnection.
+		if conn.terminated != test.retryable {
+			t.Fatalf("%v: connection terminated is %v", test.err, conn.terminated)
+		}
+		ntb.remote1to2.unsetConnection(conn)
+	}
+
+	if IsRetryable(ErrNoConnection) || IsRetryable(nil) {
+		t.Fatal("Non-SendErrors are retryable")
+	}
+}
+
+type unregisteredMessage struct {
+	Value int
+}
+
+type lateRegisteredMessage struct {
+	Value int
+}
+
+func TestSendUnregisteredType(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	for _, send := range []func() error{
+		func() error { return ntb.rem1_2.Send(unregisteredMessage{1}) },
+		func() error { return ntb.rem1_2.SendWithDeadline(&unregisteredMessage{1}, time.Now().Add(time.Hour)) },
+	} {
+		err := send()
+		sendErr, isSendErr := err.(*SendError)
+		if !isSendErr || sendErr.Node != 2 || IsRetryable(err) ||
+			!strings.Contains(err.Error(), "unregisteredMessage") ||
+			!strings.Contains(err.Error(), "RegisterMessageType") {
+			t.Fatalf("Unexpected error: %#v", err)
+		}
+	}
+	if msgs := queuedMessages(ntb.remote1to2); len(msgs) != 0 {
+		t.Fatal("Unsendable messages were queued:", msgs)
+	}
+
+	// Nothing is encoded for local mailboxes.
+	if err := ntb.addr1_1.Send(unregisteredMessage{1}); err != nil {
+		t.Fatal("Could not send locally:", err)
+	}
+
+	// A failure isn't remembered.
+	if ntb.rem1_2.Send(lateRegisteredMessage{1}) == nil {
+		t.Fatal("Sent an unregistered type")
+	}
+	if err := RegisterMessageType(lateRegisteredMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ntb.rem1_2.Send(lateRegisteredMessage{1}); err != nil {
+		t.Fatal("Could not send once registered:", err)
+	}
+}
+
+func TestSendWithConnectionWait(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	start := time.Now()
+	err := ntb.rem1_2.SendWithConnectionWait("moo", 50*time.Millisecond)
+	if err != ErrNoConnection {
+		t.Fatal("Unexpected error without a connection:", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Did not wait for the connection")
+	}
+	if ntb.rem1_2.SendWithConnectionWait("moo", 0) != ErrNoConnection {
+		t.Fatal("Did not fail fast without a connection")
+	}
+
+	ntb = testbed(nil)
+	defer ntb.terminate()
+
+	err = ntb.rem1_2.SendWithConnectionWait("moo", timeout)
+	if err != nil {
+		t.Fatal("Could not send over a connection:", err)
+	}
+	msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if !ok || msg != "moo" {
+		t.Fatal("Message was not delivered:", msg)
+	}
+}
+
+func TestSendSync(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	// Locally, the message is already in the mailbox.
+	if err := ntb.addr1_1.SendSync("moo"); err != nil {
+		t.Fatal("Could not send locally:", err)
+	}
+	if msg, ok := ntb.mailbox1_1.ReceiveNextAsync(); !ok || msg != "moo" {
+		t.Fatal("Message was not enqueued:", msg)
+	}
+	ntb.mailbox1_1.Terminate()
+	if ntb.addr1_1.SendSync("moo") != ErrMailboxTerminated {
+		t.Fatal("Sent to a terminated mailbox")
+	}
+
+	// Remotely, it's in the outgoing queue.
+	if err := ntb.rem1_2.SendSync("moo"); err != nil {
+		t.Fatal("Could not send remotely:", err)
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 1 {
+		t.Fatal("Message was not queued:", depth)
+	}
+}
+
+func TestWaitQuiescent(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	if err := ntb.c1.WaitQuiescent(timeout); err != nil {
+		t.Fatal("Idle node not quiescent:", err)
+	}
+
+	// A message nobody has received yet keeps it busy.
+	ntb.addr1_1.Send("moo")
+	if ntb.c1.WaitQuiescent(10*time.Millisecond) != ErrNotQuiescent {
+		t.Fatal("Node with a waiting message was quiescent")
+	}
+	ntb.mailbox1_1.ReceiveNext()
+	if err := ntb.c1.WaitQuiescent(timeout); err != nil {
+		t.Fatal("Node not quiescent after receiving:", err)
+	}
+
+	// So does one of the loops being in the middle of a message.
+	release := make(chan struct{})
+	ntb.remote1to2.Send(newExamineMessages{func(interface{}) bool {
+		<-release
+		return false
+	}})
+	ntb.remote1to2.Send(newDoneProcessing{})
+	if ntb.c1.WaitQuiescent(10*time.Millisecond) != ErrNotQuiescent {
+		t.Fatal("Node with a busy loop was quiescent")
+	}
+	close(release)
+	if err := ntb.c1.WaitQuiescent(timeout); err != nil {
+		t.Fatal("Node not quiescent after the loop finished:", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	woken := make(chan interface{})
+	go func() {
+		woken <- ntb.mailbox1_1.ReceiveNext()
+	}()
+	for i := 0; i < 50; i++ {
+		ntb.rem1_2.Send(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ntb.c1.Close(ctx); err != nil {
+		t.Fatal("Could not close:", err)
+	}
+	// The queued messages all made it out before the link was closed.
+	for i := 0; i < 50; i++ {
+		if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != i {
+			t.Fatal("Queued message was lost:", i, msg)
+		}
+	}
+	select {
+	case msg := <-woken:
+		if _, isTerminated := msg.(MailboxTerminated); !isTerminated {
+			t.Fatal("Receiver woke up with:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Blocked receiver was not woken up")
+	}
+	if err := ntb.c1.Close(ctx); err != nil {
+		t.Fatal("Could not close twice:", err)
+	}
+	awaitGoroutines(t, ntb.c1, nil)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	release := make(chan struct{})
+	ntb.remote1to2.Send(newExamineMessages{func(interface{}) bool {
+		<-release
+		return false
+	}})
+	ntb.rem1_2.Send("stuck")
+	short, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := ntb.c1.Close(short); err != context.DeadlineExceeded {
+		t.Fatal("Close did not time out:", err)
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ntb.c1.Close(ctx); err != nil {
+		t.Fatal("Shutdown did not finish:", err)
+	}
+}
+
+func TestCloseCancelled(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// With no deadline, only the cancellation stops the wait for a queue
+	// that never drains.
+	release := make(chan struct{})
+	ntb.remote1to2.Send(newExamineMessages{func(interface{}) bool {
+		<-release
+		return false
+	}})
+	ntb.rem1_2.Send("stuck")
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := make(chan error)
+	go func() {
+		closed <- ntb.c1.Close(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-closed:
+		if err != context.Canceled {
+			t.Fatal("Close was not cancelled:", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Close did not return once cancelled")
+	}
+
+	// The shutdown itself then carries on without the queue.
+	close(release)
+	done, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ntb.c1.Close(done); err != nil {
+		t.Fatal("Shutdown did not finish:", err)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	testFlush(t, 0)
+	// With EncodeWorkers, the messages must also be written by the pool.
+	testFlush(t, 2)
+}
+
+func testFlush(t *testing.T, workers int) {
+	spec := testSpec()
+	spec.EncodeWorkers = workers
+	ntb := testbed(spec)
+	defer ntb.terminate()
+
+	release := make(chan struct{})
+	ntb.remote1to2.Send(newExamineMessages{func(interface{}) bool {
+		<-release
+		return false
+	}})
+	ntb.rem1_2.Send("stuck")
+	if err := ntb.c1.Flush(2, 10*time.Millisecond); err != ErrFlushTimeout {
+		t.Fatal("Flush did not time out:", err)
+	}
+	close(release)
+	for i := 0; i < 50; i++ {
+		ntb.rem1_2.Send(i)
+	}
+	if err := ntb.c1.Flush(2, timeout); err != nil {
+		t.Fatal("Could not flush:", err)
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 0 {
+		t.Fatal("Messages still queued after flushing:", depth)
+	}
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "stuck" {
+		t.Fatal("Flushed message was lost:", msg)
+	}
+
+	if err := ntb.c1.Flush(10, timeout); err != ErrUnknownNode {
+		t.Fatal("Flushed an unknown node:", err)
+	}
+}
+
+func TestFlushNoConnection(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	if err := ntb.c1.Flush(2, timeout); err != ErrNoConnection {
+		t.Fatal("Flushed with the link down:", err)
+	}
+}
+
+func TestOnLinkReady(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	ready := make(chan NodeID, 10)
+	ntb.c1.OnLinkReady(func(node NodeID) {
+		// The link must already be usable.
+		if err := ntb.rem1_2.Send("ready"); err != nil {
+			t.Error("Could not send from OnLinkReady:", err)
+		}
+		ready <- node
+	})
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case node := <-ready:
+			if node != 2 {
+				t.Fatal("Link ready for the wrong node:", node)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Link never became ready")
+		}
+		if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "ready" {
+			t.Fatal("Message from OnLinkReady not delivered:", msg)
+		}
+
+		if i == 0 {
+			ntb.remote1to2.Send(internal.DestroyConnection{})
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(ready) != 0 {
+		t.Fatal("OnLinkReady fired more than once per connection")
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	for _, test := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, ReconnectMinDelay},
+		{2, 2 * ReconnectMinDelay},
+		{3, 4 * ReconnectMinDelay},
+		{100, ReconnectMaxDelay},
+	} {
+		for i := 0; i < 10; i++ {
+			delay := reconnectDelay(test.failures)
+			if delay < test.max/2 || delay > test.max {
+				t.Fatalf("Delay after %d failures out of range: %s", test.failures, delay)
+			}
+		}
+	}
+}
+
+func TestReconnectGiveUp(t *testing.T) {
+	defer func(min time.Duration, attempts int) {
+		ReconnectMinDelay = min
+		ReconnectMaxAttempts = attempts
+	}(ReconnectMinDelay, ReconnectMaxAttempts)
+	ReconnectMinDelay = time.Millisecond
+	ReconnectMaxAttempts = 3
+
+	// Node 2 never comes up, so every attempt to reach it fails.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	go ntb.c1.Serve()
+	defer ntb.c1.Stop()
+
+	dials := 0
+	for {
+		msg, ok := mbox.ReceiveNextTimeout(5 * time.Second)
+		if !ok {
+			t.Fatal("Node 2 was never abandoned")
+		}
+		event := msg.(LinkEvent)
+		if event.State == LinkDialing {
+			dials++
+		}
+		if event.State == LinkAbandoned {
+			break
+		}
+	}
+	if dials != 3 {
+		t.Fatal("Unexpected number of attempts:", dials)
+	}
+
+	if msg, ok := mbox.ReceiveNextTimeout(50 * time.Millisecond); ok {
+		t.Fatal("Abandoned node was redialed:", msg)
+	}
+	if err := ntb.c1.Reconnect(2); err != ErrNodeAbandoned {
+		t.Fatal("Abandoned node was reconnected to:", err)
+	}
+	// Nor is it by being woken, as it would be for a message for a
+	// dormant link.
+	ntb.c1.nodeConnectors[2].wake()
+	if msg, ok := mbox.ReceiveNextTimeout(50 * time.Millisecond); ok {
+		t.Fatal("Abandoned node was redialed once woken:", msg)
+	}
+	abandonments := 0
+	for _, event := range ntb.c1.RecentEvents(0) {
+		if event.Type == EventAbandoned {
+			abandonments++
+		}
+	}
+	if abandonments != 1 {
+		t.Fatal("Node was given up on again once woken:", abandonments)
+	}
+
+	// Until it is revived, when it gets the full set of attempts again.
+	if err := ntb.c1.ReviveNode(2); err != nil {
+		t.Fatal(err)
+	}
+	awaitLinkState(t, mbox, 2, LinkDialing)
+	awaitLinkState(t, mbox, 2, LinkAbandoned)
+}
+
+func TestReconnect(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	for _, node := range []NodeID{1, 9} {
+		if err := ntb.c1.Reconnect(node); err != ErrUnknownNode {
+			t.Fatal("Reconnected to a node not in the cluster:", node, err)
+		}
+		if err := ntb.c1.ReviveNode(node); err != ErrUnknownNode {
+			t.Fatal("Revived a node not in the cluster:", node, err)
+		}
+	}
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	// Whichever side asks for it, the lower node dials again.
+	if err := ntb.c1.Reconnect(2); err != nil {
+		t.Fatal(err)
+	}
+	awaitLinkState(t, mbox, 2, LinkDisconnected)
+	awaitLinkState(t, mbox, 2, LinkConnected)
+
+	if err := ntb.c2.Reconnect(1); err != nil {
+		t.Fatal(err)
+	}
+	awaitLinkState(t, mbox, 2, LinkDisconnected)
+	awaitLinkState(t, mbox, 2, LinkConnected)
+
+	ntb.c1.waitForConnection(2)
+	ntb.rem1_2.Send("after")
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "after" {
+		t.Fatal("Link does not work after reconnecting:", msg)
+	}
+}
+
+func TestAlternateAddresses(t *testing.T) {
+	spec := testSpec()
+	spec.Nodes[1].AlternateAddresses = []string{"‽"}
+	_, _, err := createFromSpec(spec, 1, NullLogger)
+	if err == nil || !strings.Contains(err.Error(), "invalid alternate address") {
+		t.Fatal("Invalid alternate address accepted:", err)
+	}
+
+	// Nothing listens on node 2's Address, so node 1 has to fall back to
+	// its alternate address, which is where node 2 actually listens.
+	spec = testSpec()
+	spec.Nodes[1].Address = "127.0.0.1:29878"
+	spec.Nodes[1].ListenAddress = "127.0.0.1:29877"
+	spec.Nodes[1].AlternateAddresses = []string{"127.0.0.1:29877"}
+	ntb := testbed(spec)
+
+	ntb.rem1_2.Send("hello")
+	msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if !ok || msg != "hello" {
+		t.Fatal("Could not send over the alternate address:", msg)
+	}
+	if len(ntb.c2.alternateListeners) != 0 {
+		t.Fatal("Listening on the alternate address despite a ListenAddress")
+	}
+	ntb.terminate()
+
+	// With no ListenAddress, the node listens on its alternate addresses
+	// too.
+	spec = testSpec()
+	spec.Nodes[1].AlternateAddresses = []string{"127.0.0.1:29878"}
+	ntb = testbed(spec)
+	defer ntb.terminate()
+
+	if len(ntb.c2.alternateListeners) != 1 {
+		t.Fatal("Not listening on the alternate address")
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:29878")
+	if err != nil {
+		t.Fatal("Could not connect to the alternate address:", err)
+	}
+	conn.Close()
+}
+
+func TestCustomDialer(t *testing.T) {
+	var dialedL sync.Mutex
+	var dialed []string
+	spec := testSpec()
+	spec.Dialer = func(network, address string, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+		dialedL.Lock()
+		dialed = append(dialed, address)
+		dialedL.Unlock()
+		if timeout != DialTimeout {
+			t.Error("Dialer was not given the DialTimeout:", timeout)
+		}
+		return net.DialTimeout(network, address, timeout)
+	}
+	ntb := testbed(spec)
+
+	ntb.rem1_2.Send("hello")
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "hello" {
+		t.Fatal("Could not send over the custom dialer's connection:", msg)
+	}
+	dialedL.Lock()
+	if len(dialed) != 1 || dialed[0] != "127.0.0.1:29877" {
+		t.Fatal("Custom dialer was not used:", dialed)
+	}
+	dialedL.Unlock()
+	ntb.terminate()
+
+	// Stopping the cluster cancels a dial that is under way.
+	spec = testSpec()
+	dialing := make(chan struct{})
+	spec.Dialer = func(network, address string, timeout time.Duration, cancel <-chan struct{}) (net.Conn, error) {
+		close(dialing)
+		<-cancel
+		return nil, errors.New("cancelled")
+	}
+	ntb = unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+	go ntb.c1.Serve()
+	<-dialing
+	stopped := make(chan struct{})
+	go func() {
+		ntb.c1.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		t.Fatal("Stopping the cluster did not cancel the dial")
+	}
+}
+
+func TestConnectionPanicsClient(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c2.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c2.SubscribeLinkEvents(events)
+
+	ntb.c2.allowPanicHandler = true
+	ntb.remote2to1.Send(internal.PanicHandler{})
+
+	// this proves the connection was re-established.
+	awaitLinkState(t, mbox, 1, LinkConnected)
+}
+
+func TestConnectionPanicsServer(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	ntb.c1.allowPanicHandler = true
+	ntb.remote1to2.Send(internal.PanicHandler{})
+
+	// this proves the connection was re-established.
+	awaitLinkState(t, mbox, 2, LinkConnected)
+}
+
+// Whether a message was sent as a value or a pointer, gob decodes it as a
+// pointer, and the decoding must hand the handlers the value either way.
+func TestDecodeNormalizesMessages(t *testing.T) {
+	messages := []internal.ClusterMessage{
+		internal.NotifyNodeOnTerminate{IntMailboxID: 0x102},
+		internal.RemoveNotifyNodeOnTerminate{IntMailboxID: 0x102},
+		internal.RemoteMailboxTerminated{IntMailboxID: 0x102, Reason: uint8(TerminatedPanic)},
+		internal.RemoteMailboxesTerminated{IntMailboxIDs: []internal.IntMailboxID{0x102, 0x202}},
+		internal.OutgoingMailboxMessage{Target: 0x102, Message: "moo"},
+		internal.IncomingMailboxMessage{Target: 0x102, Message: "moo"},
+		internal.IncomingMailboxMessage{
+			Target:  0x102,
+			Message: internal.StreamChunk{Stream: 1, Data: []byte("moo"), Final: true},
+		},
+		internal.IncomingMailboxMessage{
+			Target:  0x102,
+			Message: internal.RegisterName{Node: 2, Name: "moo", MailboxID: 0x102},
+		},
+		internal.IncomingMailboxMessage{
+			Target:  0x102,
+			Message: internal.UnregisterName{Node: 2, Name: "moo", MailboxID: 0x102},
+		},
+		internal.PanicHandler{},
+		internal.Ping{},
+		internal.Pong{},
+	}
+
+	// pointerTo returns a pointer to a copy of the message, including the
+	// payload of an IncomingMailboxMessage.
+	pointerTo := func(cm internal.ClusterMessage) internal.ClusterMessage {
+		if imm, isIncoming := cm.(internal.IncomingMailboxMessage); isIncoming {
+			payload := reflect.New(reflect.TypeOf(imm.Message))
+			payload.Elem().Set(reflect.ValueOf(imm.Message))
+			imm.Message = payload.Interface()
+			return &imm
+		}
+		ptr := reflect.New(reflect.TypeOf(cm))
+		ptr.Elem().Set(reflect.ValueOf(cm))
+		return ptr.Interface().(internal.ClusterMessage)
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	dec := gob.NewDecoder(&buf)
+	var streams encodeStreams
+	for _, expected := range messages {
+		for _, sent := range []internal.ClusterMessage{expected, pointerTo(expected)} {
+			if err := enc.Encode(&sent); err != nil {
+				t.Fatalf("Could not encode %#v: %s", sent, err)
+			}
+			received, err := decodeClusterMessage(dec, &streams)
+			if err != nil {
+				t.Fatalf("Could not decode %#v: %s", sent, err)
+			}
+			if !reflect.DeepEqual(received, expected) {
+				t.Fatalf("Sent %#v, received %#v", sent, received)
+			}
+		}
+	}
+
+	// Messages the node builds itself pass through unchanged.
+	for _, cm := range messages {
+		if normalized := internal.Normalize(cm); !reflect.DeepEqual(normalized, cm) {
+			t.Fatalf("Normalizing %#v changed it to %#v", cm, normalized)
+		}
+	}
+}
+
+func TestPanicHandlerRequiresOptIn(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// The done-processing hook only sees messages that were handled
+	// without panicking.
+	handled := make(chan struct{}, 1)
+	ntb.remote1to2.Send(newDoneProcessing{func(x interface{}) bool {
+		_, isPanicHandler := x.(internal.PanicHandler)
+		if isPanicHandler {
+			handled <- void
+		}
+		return !isPanicHandler
+	}})
+
+	ntb.remote1to2.Send(internal.PanicHandler{})
+	select {
+	case <-handled:
+	case <-time.After(timeout):
+		t.Fatal("PanicHandler was not handled without panicking")
+	}
+}
+
+func TestConnectionDiesClient(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c2.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c2.SubscribeLinkEvents(events)
+
+	ntb.remote2to1.Send(internal.DestroyConnection{})
+
+	awaitLinkState(t, mbox, 1, LinkConnected)
+}
+
+func TestConnectionDiesServer(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	ntb.remote1to2.Send(internal.DestroyConnection{})
+
+	// The dialing side goes through the whole cycle.
+	for _, state := range []LinkState{LinkDisconnected, LinkReconnectScheduled,
+		LinkDialing, LinkHandshaking, LinkConnected} {
+		awaitLinkState(t, mbox, 2, state)
+	}
+}
+
+func TestHeartbeatRoundtrip(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// Set the peekFunc() on c1's node connection to c2 object.
+	c := make(chan internal.ClusterMessage)
+	ntb.c1.nodeConnectors[2].connection.setPeekFunc(func(cm internal.ClusterMessage) { c <- cm })
+
+	var recPing, recPong bool
+
+	// Take a peek at the first two messages. The only messages sent between nodes of
+	// this ntb should be alternating PING and PONG messages.  Make sure we get one
+	// of each.
+	for i := 0; i < 2; i++ {
+		switch cm := <-c; cm.(type) {
+		case internal.Ping:
+			recPing = true
+		case internal.Pong:
+			recPong = true
+		default:
+			t.Errorf("received unexpected message type: %#v", cm)
+		}
+	}
+
+	switch {
+	case recPing && !recPong:
+		t.Error("received two PING messages but no PONG messages; the PingInterval may be too short")
+	case !recPing && recPong:
+		t.Error("received two PONG messages but no PING messages; something is very wrong")
+	}
+
+	// The pong to node 1's ping gives the latency to node 2. It is
+	// recorded after the peek, so wait for it.
+	if recPing && recPong {
+		deadline := time.Now().Add(timeout)
+		for {
+			if latency, known := ntb.c1.LinkLatency(2); known {
+				if latency <= 0 || latency > DeadlineInterval {
+					t.Fatal("Implausible latency:", latency)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("The latency was not measured")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// queuedMessages returns the messages waiting to go out to the remote node.
+func queuedMessages(rm *remoteMailboxes) []interface{} {
+	rm.outgoingMailbox.cond.L.Lock()
+	defer rm.outgoingMailbox.cond.L.Unlock()
+
+	msgs := []interface{}{}
+	store := rm.outgoingMailbox.store
+	for i := 0; i < store.Len(); i++ {
+		if out, is := store.Peek(i).(internal.OutgoingMailboxMessage); is {
+			msgs = append(msgs, out.Message)
+		}
+	}
+	return msgs
+}
+
+func TestOutgoingQueueLimit(t *testing.T) {
+	// Nothing is serving the remote mailboxes, so the queue never drains
+	// unless we drain it.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	metrics := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics)
+	ntb.c1.Cluster.OutgoingQueueLimit = 2
+
+	ntb.c1.Cluster.OutgoingQueuePolicy = OverflowError
+	if ntb.rem1_2.Send(1) != nil || ntb.rem1_2.Send(2) != nil {
+		t.Fatal("could not send within the limit")
+	}
+	if ntb.rem1_2.Send(3) != ErrMailboxFull {
+		t.Fatal("could send beyond the limit")
+	}
+	// The bookkeeping messages are not limited.
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	if metrics.gauges[MetricOutgoingQueueDepth] != 2 {
+		t.Fatal("queue depth not reported:", metrics.gauges)
+	}
+
+	ntb.c1.Cluster.OutgoingQueuePolicy = OverflowDropOldest
+	if ntb.rem1_2.Send(3) != nil {
+		t.Fatal("could not send with drop_oldest")
+	}
+	if msgs := queuedMessages(ntb.remote1to2); len(msgs) != 2 || msgs[0] != 2 || msgs[1] != 3 {
+		t.Fatal("oldest message not dropped:", msgs)
+	}
+	if metrics.counters[MetricOutgoingDropped] != 1 {
+		t.Fatal("dropped message not counted:", metrics.counters)
+	}
+
+	ntb.c1.Cluster.OutgoingQueuePolicy = OverflowBlock
+	sent := make(chan error)
+	go func() {
+		sent <- ntb.rem1_2.Send(4)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send did not block on a full queue")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Do what Serve does with the oldest message.
+	ntb.remote1to2.outgoingMailbox.ReceiveNext()
+	ntb.remote1to2.outgoingDone()
+	if err := <-sent; err != nil {
+		t.Fatal("blocked send failed:", err)
+	}
+	if msgs := queuedMessages(ntb.remote1to2); len(msgs) != 2 || msgs[0] != 3 || msgs[1] != 4 {
+		t.Fatal("unexpected queue after blocking:", msgs)
+	}
+}
+
+// warnLogger passes along the warnings logged through it.
+type warnLogger struct {
+	nullLogger
+	warnings chan string
+}
+
+func (wl warnLogger) Warnf(format string, args ...interface{}) {
+	wl.warnings <- fmt.Sprintf(format, args...)
+}
+
+func TestOutgoingBacklogWarning(t *testing.T) {
+	defer func(depth int, period time.Duration) {
+		OutgoingBacklogWarnDepth = depth
+		OutgoingBacklogWarnPeriod = period
+	}(OutgoingBacklogWarnDepth, OutgoingBacklogWarnPeriod)
+	OutgoingBacklogWarnDepth = 3
+	OutgoingBacklogWarnPeriod = 20 * time.Millisecond
+
+	// Nothing is serving the remote mailboxes, and node 2 never comes up.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	warnings := make(chan string, 10)
+	ntb.remote1to2.ClusterLogger = warnLogger{warnings: warnings}
+
+	ntb.rem1_2.Send(1)
+	ntb.rem1_2.Send(2)
+	select {
+	case warning := <-warnings:
+		t.Fatal("Warned below the depth:", warning)
+	case <-time.After(3 * OutgoingBacklogWarnPeriod):
+	}
+
+	ntb.rem1_2.Send(3)
+	for i := 0; i < 2; i++ {
+		select {
+		case warning := <-warnings:
+			if !strings.HasPrefix(warning, "Node 2: 3 messages queued, link down for ") {
+				t.Fatal("Unexpected warning:", warning)
+			}
+		case <-time.After(timeout):
+			t.Fatal("No backlog warning")
+		}
+	}
+
+	// Do what Serve does with the oldest message.
+	ntb.remote1to2.outgoingMailbox.ReceiveNext()
+	ntb.remote1to2.outgoingDone()
+	// a warning may have been on its way already
+	time.Sleep(OutgoingBacklogWarnPeriod)
+	for len(warnings) > 0 {
+		<-warnings
+	}
+	select {
+	case warning := <-warnings:
+		t.Fatal("Warned after the backlog cleared:", warning)
+	case <-time.After(3 * OutgoingBacklogWarnPeriod):
+	}
+}
+
+func TestOutgoingQueueMaxAge(t *testing.T) {
+	// Nothing is serving the remote mailboxes until we start it.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	metrics := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics)
+	ntb.c1.Cluster.OutgoingQueueMaxAge = 20 * time.Millisecond
+	evicted := make(chan interface{}, 10)
+	ntb.c1.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		if target != ntb.rem1_2.mailboxID {
+			t.Error("Evicted message for the wrong mailbox:", target)
+		}
+		evicted <- msg
+		return true
+	})
+	expectEvicted := func(expected interface{}) {
+		select {
+		case msg := <-evicted:
+			if msg != expected {
+				t.Fatal("Wrong message evicted:", msg)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Nothing evicted")
+		}
+	}
+
+	// Sending evicts the stale messages, even though there's no limit.
+	ntb.rem1_2.Send(1)
+	ntb.rem1_2.Send(2)
+	time.Sleep(30 * time.Millisecond)
+	ntb.rem1_2.Send(3)
+	expectEvicted(1)
+	expectEvicted(2)
+	if msgs := queuedMessages(ntb.remote1to2); len(msgs) != 1 || msgs[0] != 3 {
+		t.Fatal("Unexpected queue after eviction:", msgs)
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 1 {
+		t.Fatal("Evicted messages still counted:", depth)
+	}
+
+	// A send blocked on a full queue makes room by evicting the head once
+	// it is stale, rather than waiting for it to be sent.
+	ntb.c1.Cluster.OutgoingQueueLimit = 1
+	sent := make(chan error, 1)
+	go func() {
+		sent <- ntb.rem1_2.Send(4)
+	}()
+	expectEvicted(3)
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatal("Blocked send failed:", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Send still blocked behind a stale message")
+	}
+	ntb.c1.Cluster.OutgoingQueueLimit = 0
+
+	// And so does taking them off the queue to send them.
+	time.Sleep(30 * time.Millisecond)
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	go ntb.remote1to2.Serve()
+	expectEvicted(4)
+
+	ntb.rem1_2.Send(5)
+	select {
+	case cm := <-conn.sent:
+		if imm, isIMM := cm.(internal.IncomingMailboxMessage); !isIMM || imm.Message != 5 {
+			t.Fatal("Unexpected message:", cm)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Fresh message not sent")
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.counters[MetricOutgoingEvicted] != 4 {
+		t.Fatal("Evictions not counted:", metrics.counters)
+	}
+}
+
+func TestRemoteTerminationNoticeDeadlock(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	ntb.c1.Cluster.OutgoingQueueLimit = 1
+	ntb.c1.Cluster.OutgoingQueuePolicy = OverflowBlock
+
+	// Nothing is read off this connection until we say so, which holds
+	// up the loop sending to node 2 with the outgoing queue full.
+	conn := &recordingSender{make(chan internal.ClusterMessage)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	go ntb.remote1to2.Serve()
+	ntb.rem1_2.Send(1)
+	ntb.rem1_2.Send(2)
+
+	// So mailbox1_1's termination notice for node 2 has to wait for room.
+	ntb.addr1_1.NotifyAddressOnTerminate(ntb.rem1_2)
+	terminated := make(chan struct{})
+	go func() {
+		ntb.mailbox1_1.Terminate()
+		close(terminated)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Meanwhile, sending to mailbox1_1 must not wait on the notice. If
+	// this were the loop that has to make room in the queue, as it is
+	// when it's delivering a message from node 2, that would deadlock.
+	sent := make(chan error)
+	go func() {
+		sent <- ntb.addr1_1.Send("late")
+	}()
+	select {
+	case err := <-sent:
+		if err != ErrMailboxTerminated {
+			t.Fatal("Unexpected send result:", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Sending to a terminating mailbox waited on its termination notices")
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-conn.sent:
+		case <-time.After(timeout):
+			t.Fatal("Queued messages never sent")
+		}
+	}
+	select {
+	case <-terminated:
+	case <-time.After(timeout):
+		t.Fatal("Terminate never returned")
+	}
+}
+
+func TestStopReportsAbandoned(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	metrics := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics)
+	var abandoned []interface{}
+	ntb.c1.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		if target != ntb.mailbox1_2.id {
+			t.Error("Unexpected target:", target)
+		}
+		abandoned = append(abandoned, msg)
+		return true
+	})
+
+	// Everything behind the Stop is abandoned.
+	ntb.remote1to2.Stop()
+	ntb.rem1_2.Send("one")
+	ntb.rem1_2.SendWithDeadline("two", time.Now().Add(time.Hour))
+	ntb.rem1_2.Send(3)
+	ntb.rem1_2.NotifyAddressOnTerminate(ntb.addr1_1)
+	ntb.remote1to2.Serve()
+
+	if len(abandoned) != 3 || abandoned[0] != "one" || abandoned[1] != "two" || abandoned[2] != 3 {
+		t.Fatal("Unexpected abandoned messages:", abandoned)
+	}
+	if metrics.counters[MetricOutgoingAbandoned] != 3 {
+		t.Fatal("Abandoned messages not counted:", metrics.counters)
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 1 {
+		t.Fatal("Unexpected queue left behind:", depth)
+	}
+}
+
+func TestTerminateReportsAbandoned(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+
+	metrics := newRecordingMetrics()
+	ntb.c1.SetMetrics(metrics)
+	var abandoned []interface{}
+	ntb.c1.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		abandoned = append(abandoned, msg)
+		return true
+	})
+
+	// Nothing is serving the queue, so Terminate finds it all there.
+	ntb.rem1_2.Send("one")
+	ntb.rem1_2.Send(2)
+	ntb.terminateMailboxes()
+
+	if len(abandoned) != 2 || abandoned[0] != "one" || abandoned[1] != 2 {
+		t.Fatal("Unexpected abandoned messages:", abandoned)
+	}
+	if metrics.counters[MetricOutgoingAbandoned] != 2 {
+		t.Fatal("Abandoned messages not counted:", metrics.counters)
+	}
+	if depth, _ := ntb.c1.OutgoingDepth(2); depth != 0 {
+		t.Fatal("Unexpected queue left behind:", depth)
+	}
+}
+
+func TestTerminatingNodeStopsRemoteMailboxes(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	// fill the queue, and block a sender on it
+	ntb.c1.Cluster.OutgoingQueueLimit = 1
+	ntb.rem1_2.Send(1)
+	sent := make(chan error)
+	go func() {
+		sent <- ntb.rem1_2.Send(2)
+	}()
+
+	// wait for the sender to block
+	time.Sleep(10 * time.Millisecond)
+	ntb.c1.Terminate()
+	if err := <-sent; err != ErrMailboxTerminated {
+		t.Fatal("blocked sender not released by termination:", err)
+	}
+
+	// and the remote mailboxes don't keep running
+	served := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(served)
+	}()
+	<-served
+}
+
+func TestCoverRemoteMailboxes(t *testing.T) {
+	rm := new(remoteMailboxes)
+	rm.ClusterLogger = NullLogger
+	rm.send(internal.PanicHandler{}, "")
+}
+
+// This measures how long it takes for the termination of many mailboxes
+// on one node to make it to a mailbox on the other that is linked to all
+// of them.
+func BenchmarkRemoteTerminationFanIn(b *testing.B) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mailboxes := make([]*Mailbox, 10000)
+		for j := range mailboxes {
+			var addr *Address
+			addr, mailboxes[j] = ntb.c2.NewMailbox()
+			remote := &Address{
+				mailboxID:        addr.mailboxID,
+				connectionServer: ntb.c1,
+			}
+			remote.NotifyAddressOnTerminate(ntb.addr1_1)
+		}
+		last := mailboxes[len(mailboxes)-1]
+		last.blockUntilNotifyStatus(ntb.remote2to1.Address, true)
+		b.StartTimer()
+
+		for _, mbox := range mailboxes {
+			mbox.Terminate()
+		}
+		for range mailboxes {
+			ntb.mailbox1_1.ReceiveNext()
+		}
+	}
+}
+
+func TestEarlyMessages(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+	defer func() {
+		ntb.remote1to2.Stop()
+		<-done
+	}()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	notSent := func() {
+		select {
+		case cm := <-conn.sent:
+			t.Fatal("Sent during the handshake:", cm)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	next := func() interface{} {
+		select {
+		case cm := <-conn.sent:
+			return cm.(internal.IncomingMailboxMessage).Message
+		case <-time.After(timeout):
+			t.Fatal("Nothing was sent")
+		}
+		return nil
+	}
+
+	// What is sent while the connection is having its handshake waits for
+	// it to finish.
+	if err := ntb.remote1to2.openConnection(conn, clusterVersion, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ntb.rem1_2.Send("early")
+	ntb.rem1_2.Send("after")
+	notSent()
+	if ntb.remote1to2.waitForConnectionTimeout(time.Millisecond) {
+		t.Fatal("Connection with a handshake in progress was waited for")
+	}
+	ntb.remote1to2.markReady(conn)
+	for _, expected := range []string{"early", "after"} {
+		if msg := next(); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+
+	// If the handshake fails, it's as if there was no connection.
+	ntb.remote1to2.unsetConnection(conn)
+	if err := ntb.remote1to2.openConnection(conn, clusterVersion, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ntb.rem1_2.Send("failed")
+	notSent()
+	ntb.remote1to2.unsetConnection(conn)
+	awaitDrops(t, ntb.c1, map[string]uint64{DropNoConnection: 1})
+}
+
+// Messages sent while a real connection is having its registry sync wait
+// for it, without holding up everything else Serve does.
+func TestEarlyMessagesDuringRegistrySync(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminate()
+
+	// Node 2 can't send its registry until this is released, so the
+	// connection stays in its handshake.
+	ntb.c2.registry.mu.Lock()
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			ntb.c2.registry.mu.Unlock()
+		}
+	}
+	defer release()
+
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+
+	rm := ntb.remote1to2
+	deadline := time.Now().Add(timeout)
+	for {
+		rm.Lock()
+		opened := rm.connection != nil
+		rm.Unlock()
+		if opened {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Connection was never opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ntb.rem1_2.Send("early")
+	served := make(chan struct{})
+	rm.Send(newDoneProcessing{func(interface{}) bool {
+		close(served)
+		return false
+	}})
+	select {
+	case <-served:
+	case <-time.After(timeout):
+		t.Fatal("Serve was held up by the handshake")
+	}
+	if msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(20 * time.Millisecond); ok {
+		t.Fatal("Sent during the handshake:", msg)
+	}
+
+	release()
+	if msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !ok || msg != "early" {
+		t.Fatal("Message held for the handshake was not sent:", msg)
+	}
+	if drops := ntb.c1.DropStats(); len(drops) != 0 {
+		t.Fatal("Messages dropped:", drops)
+	}
+}
+
+func TestEarlyMessagesRejected(t *testing.T) {
+	spec := testSpec()
+	spec.EarlyMessagePolicy = "reject"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+	defer func() {
+		ntb.remote1to2.Stop()
+		<-done
+	}()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	if err := ntb.remote1to2.openConnection(conn, clusterVersion, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	ntb.rem1_2.Send("early")
+	awaitDrops(t, ntb.c1, map[string]uint64{DropNoConnection: 1})
+
+	ntb.remote1to2.markReady(conn)
+	ntb.rem1_2.Send("ready")
+	select {
+	case cm := <-conn.sent:
+		if msg := cm.(internal.IncomingMailboxMessage).Message; msg != "ready" {
+			t.Fatal("Unexpected message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Nothing was sent once the connection was ready")
+	}
 }
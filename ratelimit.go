@@ -0,0 +1,137 @@
+package reign
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// A RateLimitPolicy says what to do with messages arriving from a remote
+// node faster than ClusterSpec.IncomingRateLimit allows.
+type RateLimitPolicy int
+
+// The available RateLimitPolicy values.
+const (
+	RateLimitThrottle RateLimitPolicy = iota
+	RateLimitDrop
+)
+
+var rateLimitPolicies = map[string]RateLimitPolicy{
+	"throttle": RateLimitThrottle,
+	"drop":     RateLimitDrop,
+}
+
+// How often a link that is dropping messages logs about it.
+const rateLimitWarnInterval = time.Second
+
+// rateLimiter is a token bucket, holding up to burst tokens and refilling
+// at rate tokens per second.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  clock
+
+	sync.Mutex
+}
+
+// newRateLimiter returns a rateLimiter going by the given clock, or nil if
+// the rate is unlimited. A burst less than 1 means enough for a second's
+// worth of the rate.
+func newRateLimiter(rate float64, burst int, clock clock) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if burst < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: b, tokens: b, clock: clock}
+}
+
+func (rl *rateLimiter) refill() {
+	now := rl.clock.Now()
+	if !rl.last.IsZero() {
+		rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	}
+	rl.last = now
+}
+
+// allow takes a token if one is available, returning whether it did.
+func (rl *rateLimiter) allow() bool {
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.refill()
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// reserve takes a token, going into debt if need be, and returns how long
+// the caller must wait before the token is really theirs.
+func (rl *rateLimiter) reserve() time.Duration {
+	rl.Lock()
+	defer rl.Unlock()
+
+	rl.refill()
+	rl.tokens--
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// admitIncoming applies the incoming rate limit to a message that has just
+// been read from the connection, returning whether it should be passed on.
+// Under the throttle policy this waits, holding up the reading of the
+// connection so the other side feels the backpressure.
+//
+// Only messages for mailboxes are limited; reign's own bookkeeping is
+// always let through, as dropping that would corrupt the state of the
+// link.
+func (rm *remoteMailboxes) admitIncoming(cm internal.ClusterMessage) bool {
+	if rm.incomingLimit == nil {
+		return true
+	}
+	if _, isMessage := cm.(internal.IncomingMailboxMessage); !isMessage {
+		return true
+	}
+
+	metrics := rm.connectionServer.metrics.get()
+	var labels map[string]string
+	if metrics != nil {
+		labels = map[string]string{"node": strconv.Itoa(int(rm.remoteNode))}
+	}
+
+	if rm.connectionServer.IncomingRatePolicy == RateLimitDrop {
+		if rm.incomingLimit.allow() {
+			return true
+		}
+		rm.connectionServer.dropped(DropRateLimited, rm.remoteNode, 1)
+		if metrics != nil {
+			metrics.AddCounter(MetricIncomingDropped, labels, 1)
+		}
+		rm.incomingDropped++
+		if now := rm.connectionServer.clock.Now(); now.Sub(rm.lastDropWarning) >= rateLimitWarnInterval {
+			rm.Warnf("Node %d is over the incoming rate limit; dropped %d messages", rm.remoteNode, rm.incomingDropped)
+			rm.incomingDropped = 0
+			rm.lastDropWarning = now
+		}
+		return false
+	}
+
+	if delay := rm.incomingLimit.reserve(); delay > 0 {
+		if metrics != nil {
+			metrics.AddCounter(MetricIncomingThrottled, labels, 1)
+		}
+		<-rm.connectionServer.clock.NewTimer(delay).Chan()
+	}
+	return true
+}
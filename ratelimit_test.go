@@ -0,0 +1,107 @@
+package reign
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0, 10, realClock{}) != nil {
+		t.Fatal("Got a limiter for an unlimited rate")
+	}
+
+	fc := newFakeClock()
+	rl := newRateLimiter(10, 2, fc)
+
+	if !rl.allow() || !rl.allow() {
+		t.Fatal("Burst not allowed")
+	}
+	if rl.allow() {
+		t.Fatal("Allowed beyond the burst")
+	}
+
+	fc.Advance(100 * time.Millisecond)
+	if !rl.allow() || rl.allow() {
+		t.Fatal("Did not refill at the rate")
+	}
+
+	// The bucket never holds more than the burst.
+	fc.Advance(time.Hour)
+	if delay := rl.reserve(); delay != 0 {
+		t.Fatal("Delayed within the burst:", delay)
+	}
+	rl.reserve()
+	if delay := rl.reserve(); delay != 100*time.Millisecond {
+		t.Fatal("Unexpected delay:", delay)
+	}
+	if delay := rl.reserve(); delay != 200*time.Millisecond {
+		t.Fatal("Reservations did not queue up:", delay)
+	}
+
+	if rl := newRateLimiter(2.5, 0, realClock{}); rl.burst != 3 {
+		t.Fatal("Unexpected default burst:", rl.burst)
+	}
+}
+
+func testIncomingRateLimit(t *testing.T, policy string) {
+	spec := testSpec()
+	spec.IncomingRateLimit = 20
+	spec.IncomingRateBurst = 1
+	spec.IncomingRatePolicy = policy
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminate()
+
+	metrics := newRecordingMetrics()
+	ntb.c2.SetMetrics(metrics)
+	go ntb.c2.Serve()
+	ntb.c2.waitForListen()
+	go ntb.c1.Serve()
+	ntb.c1.waitForConnection(2)
+	ntb.c2.waitForConnection(1)
+
+	for i := 0; i < 5; i++ {
+		ntb.rem1_2.Send(i)
+	}
+
+	received := 0
+	for {
+		msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(500 * time.Millisecond)
+		if !ok {
+			break
+		}
+		if msg != received {
+			break
+		}
+		received++
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.gauges[MetricIncomingRateLimit] != 20 {
+		t.Fatal("Rate limit not reported:", metrics.gauges)
+	}
+	switch policy {
+	case "throttle":
+		if received != 5 {
+			t.Fatal("Throttling lost messages:", received)
+		}
+		if metrics.counters[MetricIncomingThrottled] == 0 {
+			t.Fatal("Throttling not reported")
+		}
+	case "drop":
+		if received == 5 || received == 0 {
+			t.Fatal("Unexpected messages received while dropping:", received)
+		}
+		if metrics.counters[MetricIncomingDropped] != uint64(5-received) {
+			t.Fatal("Drops not reported:", metrics.counters, received)
+		}
+	}
+}
+
+func TestIncomingRateLimitThrottle(t *testing.T) {
+	testIncomingRateLimit(t, "throttle")
+}
+
+func TestIncomingRateLimitDrop(t *testing.T) {
+	testIncomingRateLimit(t, "drop")
+}
@@ -0,0 +1,93 @@
+package reign
+
+import (
+	"errors"
+)
+
+// ErrNodeAbandoned is returned by Reconnect for a node that reconnecting
+// to has been given up on; see ReconnectGiveUpAfter and ReviveNode.
+var ErrNodeAbandoned = errors.New("reconnecting to the node has been given up on")
+
+// Reconnect closes the connection to the given node, if there is one, and
+// has it made again right away, without waiting out any backoff from
+// earlier failures. This is for when the route to the node is known to
+// have changed, such as after a DNS change or a failover, rather than
+// waiting for the old connection to be noticed to have failed.
+//
+// The closed connection is handled just as if it had dropped: the link
+// goes through LinkDisconnected, and if it isn't back within the
+// LinkGracePeriod, the mailboxes linked to the node are told it went
+// down. Only the node with the lower NodeID dials, so if this is the
+// higher one, the other node makes the new connection, with its own
+// backoff, which is usually none after a connection that worked.
+//
+// It returns ErrUnknownNode if the node isn't in the cluster, and
+// ErrNodeAbandoned if this node has given up on dialing it.
+func (cs *connectionServer) Reconnect(node NodeID) error {
+	rm, exists := cs.remoteMailboxes[node]
+	if !exists {
+		return ErrUnknownNode
+	}
+	if nc, dials := cs.nodeConnectors[node]; dials {
+		if !nc.redial() {
+			return ErrNodeAbandoned
+		}
+	}
+
+	rm.Lock()
+	conn := rm.connection
+	rm.Unlock()
+	if conn != nil {
+		rm.Infof("Closing the connection to node %d to reconnect to it", node)
+		conn.terminate()
+	}
+	return nil
+}
+
+// ReviveNode has this node start dialing a node it has given up on again,
+// as if it had never failed; see ReconnectGiveUpAfter. Nodes that haven't
+// been given up on, and those that this one doesn't dial, are left as
+// they are. It returns ErrUnknownNode if the node isn't in the cluster.
+func (cs *connectionServer) ReviveNode(node NodeID) error {
+	if _, exists := cs.remoteMailboxes[node]; !exists {
+		return ErrUnknownNode
+	}
+	if nc, dials := cs.nodeConnectors[node]; dials {
+		nc.revive()
+	}
+	return nil
+}
+
+// redial forgets the failures to reach the node, and cuts short the wait
+// before the next attempt, if there is one. It returns false, doing
+// nothing, if the node has been abandoned.
+func (nc *nodeConnector) redial() bool {
+	nc.Lock()
+	defer nc.Unlock()
+
+	if nc.abandoned {
+		return false
+	}
+	nc.failures = 0
+	nc.woken = true
+	if nc.stopCond != nil {
+		nc.stopCond.Broadcast()
+	}
+	return true
+}
+
+// revive has an abandoned connector start dialing again.
+func (nc *nodeConnector) revive() {
+	nc.Lock()
+	defer nc.Unlock()
+
+	if !nc.abandoned {
+		return
+	}
+	nc.abandoned = false
+	nc.failures = 0
+	nc.woken = true
+	if nc.stopCond != nil {
+		nc.stopCond.Broadcast()
+	}
+}
@@ -46,6 +46,7 @@ import (
 	"fmt"
 	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/thejerf/reign/internal"
 )
@@ -53,6 +54,12 @@ import (
 func init() {
 	var mc MultipleClaim
 	RegisterType(&mc)
+	var reg Registered
+	RegisterType(&reg)
+	var unreg Unregistered
+	RegisterType(&unreg)
+	var ho HandedOver
+	RegisterType(&ho)
 }
 
 // ErrNoAddressRegistered is returned when there are no addresses at
@@ -64,6 +71,10 @@ var ErrNoAddressRegistered = errors.New("no address is registered with that name
 // mailboxes created with New() can be registered with the registry.
 var ErrCantGloballyRegister = errors.New("can't globally register this address")
 
+// ErrHandoverUnsupported is returned by Handover when one of the mailboxes
+// is on a node running a version of reign from before handovers.
+var ErrHandoverUnsupported = errors.New("the remote node does not support registry handovers")
+
 // MultipleClaim messages are send to name claimers in the event that
 // there are multiple name claims to a given name. Note that the claimants
 // array is a static snapshot of the claimants at the time of conflict,
@@ -74,8 +85,73 @@ type MultipleClaim struct {
 	Name      string
 }
 
+// Registered is sent to the subscribers of a name when a new claim is
+// made on that name. See Names.Subscribe.
+type Registered struct {
+	Name    string
+	Address Address
+}
+
+// Unregistered is sent to the subscribers of a name when a claim on that
+// name is removed, whether by Unregister, by the claimant terminating, or
+// by the claimant's node being disconnected. See Names.Subscribe.
+type Unregistered struct {
+	Name    string
+	Address Address
+}
+
+// HandedOver is sent to the mailbox a claim was handed over from by
+// Names.Handover, once the claim has been removed in favor of the one
+// handed over to, which is the To Address.
+type HandedOver struct {
+	Name string
+	To   Address
+}
+
+// A RegistryMode says what the registry does with the claims of a node
+// whose connection goes down. See ClusterSpec.RegistryMode.
+type RegistryMode int
+
+// The available RegistryMode values.
+const (
+	RegistryStrict RegistryMode = iota
+	RegistryCached
+)
+
+var registryModes = map[string]RegistryMode{
+	"strict": RegistryStrict,
+	"cached": RegistryCached,
+}
+
+// A LookupResult is the answer to a LookupWithStaleness.
+//
+// Address is nil if nothing has claimed the name. StaleSince is the zero
+// time, unless the Address is on a node that was disconnected at the
+// time, in which case it is when the connection went down, and the
+// claim is only as good as it was then. This only happens when the
+// registry is in RegistryCached mode.
+type LookupResult struct {
+	Address    *Address
+	StaleSince time.Time
+}
+
+// Stale returns whether the claim returned was stale.
+func (lr LookupResult) Stale() bool {
+	return !lr.StaleSince.IsZero()
+}
+
 type stopRegistry struct{}
 
+type subscribeName struct {
+	name string
+	addr *Address
+}
+
+type unsubscribeName struct {
+	name string
+	addr *Address
+}
+
 // synchronizeRegistry is used for unit testing
 type synchronizeRegistry struct {
 	ch chan voidtype
@@ -83,6 +159,9 @@ type synchronizeRegistry struct {
 
 // Names exposes some functionality of registry
 //
+// More of it is in NameRouter and NameHandover, which every Names
+// returned by this package also implements.
+//
 // Lookup looks up a given name and returns a mailbox that can be used to
 // send messages and request termination notifications.
 //
@@ -121,17 +200,102 @@ type synchronizeRegistry struct {
 //
 // If the address passed in is not the current registrant, the call is
 // ignored, thus it is safe to call this.
+//
+// Subscribe arranges for the given Address to receive a Registered message
+// every time a claim is made on the given name, and an Unregistered
+// message every time one is removed, including the removals caused by a
+// node going down. The current claims on the name are sent as Registered
+// messages when the subscription is processed, so there is no gap between
+// a Lookup and the subscription. Like Register, this happens
+// asynchronously.
+//
+// Broadcast sends a message to every mailbox with a claim on the given
+// name, without waiting for room for it anywhere, and returns what became
+// of each. See the package-level Broadcast.
+//
+// Unsubscribe removes a subscription made with Subscribe. A subscription
+// for a local mailbox that has terminated is also dropped the next time a
+// change is sent to it.
 type Names interface {
+	Broadcast(string, interface{}) []DeliveryResult
 	GetDebugger() NamesDebugger
 	Lookup(string) *Address
 	Register(string, *Address) error
 	SeenNames(...string) []bool
 	Serve()
 	Stop()
+	Subscribe(string, *Address)
 	Sync()
 	Unregister(string, *Address)
+	Unsubscribe(string, *Address)
+}
+
+// A NameRouter chooses among the claims on a name in other ways than
+// Lookup.
+//
+// LookupWithStaleness is Lookup, also saying whether the claim it chose
+// is on a node that is currently disconnected, and since when. See
+// LookupResult.
+//
+// LookupNearest is Lookup, choosing the claim nearest to this node: one
+// on this node if there is one, and otherwise one on the connected node
+// with the lowest LinkLatency. Until a latency has been measured for any
+// of the nodes with claims, it chooses among those on nodes that are
+// connected, and only if there are none is it the same as Lookup.
+//
+// RouteKey picks one of the claims on the name by the given key, so that
+// the name can be used for a group of mailboxes sharing out some keyed
+// work, such as the shards of some state. The claims are placed on a
+// consistent-hash ring, and the key goes to the first one after it, so
+// the same key goes to the same mailbox for as long as the claims stay the
+// same, and for every node that knows of the same claims. As the members
+// come and go, only their share of the keys moves: a new claim takes
+// roughly its share of the keys from the existing ones, and the keys of a
+// claim that is removed are spread over the rest, with the other keys
+// staying where they were. Claims on nodes that are down are left out, as
+// their mailboxes can't be reached, even when the RegistryMode keeps them;
+// their keys move back when the node does. The registries of the nodes
+// only learn of changes asynchronously, so while one is spreading two
+// nodes may route the same key to different mailboxes, and the members
+// must be prepared to be sent a key they have just given up.
+type NameRouter interface {
+	LookupNearest(string) *Address
+	LookupWithStaleness(string) LookupResult
+	RouteKey(string, []byte) (*Address, bool)
 }
 
+// A NameHandover moves a claim from one mailbox to another.
+//
+// Handover moves a claim on a name from one mailbox to another, which may
+// be on another node, such as when a singleton is being moved off a node.
+// The mailbox handed over to is registered on its node, which then passes
+// the handover on to the node of the mailbox handed over from, which
+// unregisters that and sends it a HandedOver message. The unregistration
+// tells the other nodes of the new claim as well, and they add it before
+// removing the old one, if they have not yet heard of it from its own
+// node. So on every node, Lookup only ever returns one claim, the other,
+// or, in between, either of them; never nothing. During that overlap,
+// neither claimant is sent a MultipleClaim, subscribers are sent the
+// Registered for the new claim before the Unregistered for the old one,
+// and messages may go to either, so the old claimant must be ready to
+// forward what it receives after it has handed over its state, at least
+// until it receives HandedOver. Like Register, this happens
+// asynchronously. If the mailbox handed over to has terminated by the time
+// its node gets the handover, it is abandoned, leaving the old claim. If
+// the old claimant's node can't be reached, both claims are left in
+// place, and either can be unregistered to finish it. Nodes running a
+// version of reign from before handovers can't be involved in one, and
+// get ErrHandoverUnsupported, as long as they are connected. A node that
+// only hears of one sees the old claim removed just as with Unregister.
+type NameHandover interface {
+	Handover(string, *Address, *Address) error
+}
+
+var (
+	_ NameRouter   = (*registry)(nil)
+	_ NameHandover = (*registry)(nil)
+)
+
 // IMPORTANT: Do not call the private (lowercase) methods of registry without
 // taking out the lock (registry.m).  Most of the functionality required can
 // be accessed through the publically-exposed (uppercase) methods.
@@ -149,6 +313,29 @@ type registry struct {
 	// receive notifications of the new address. This only has remote nodes.
 	nodeRegistries map[NodeID]Address
 
+	// the local subscribers to changes in the claims on a name, organized
+	// as name -> subscriber mailbox ID -> subscriber, and the
+	// notifications for them that are waiting for mu to be released.
+	subscribers map[string]map[MailboxID]*Address
+	notices     []notice
+
+	// In RegistryCached mode, the claims of a node that goes down are
+	// kept; this is when each such node went down, until it resyncs.
+	mode      RegistryMode
+	downSince map[NodeID]time.Time
+
+	// the consistent-hash rings for RouteKey, organized by name. Each is
+	// made when first needed, and dropped when the claims on its name
+	// change, or a node goes down or comes back.
+	rings map[string]*hashRing
+
+	// removed remembers, for claimTombstoneAge, when each remote claim
+	// was removed, so that a handover heard of afterwards doesn't add it
+	// back; see addSuccessor. removedOrder has them in the order they
+	// were removed, to expire them.
+	removed      map[removedClaim]time.Time
+	removedOrder []removedClaim
+
 	*Address
 	*Mailbox
 
@@ -160,6 +347,24 @@ type connectionStatus struct {
 	connected bool
 }
 
+// claimTombstoneAge is how long the registry remembers a removed claim
+// for. It need only outlast the messages of a handover that are still on
+// their way when the claim it hands over to is removed.
+const claimTombstoneAge = time.Minute
+
+// A removedClaim is a claim the registry has removed.
+type removedClaim struct {
+	name string
+	mID  MailboxID
+}
+
+// A notice is a change notification for the subscribers to a name.
+type notice struct {
+	name        string
+	msg         interface{}
+	subscribers []*Address
+}
+
 // NamesDebugger is an interface over the registry struct. These functions acquire locks and
 // are not supposed to be called in a production setting.
 type NamesDebugger interface {
@@ -181,11 +386,17 @@ func newRegistry(cs *connectionServer, node NodeID, log ClusterLogger) *registry
 	r := &registry{
 		claims:         make(map[string]map[MailboxID]voidtype),
 		nodeRegistries: make(map[NodeID]Address),
+		subscribers:    make(map[string]map[MailboxID]*Address),
+		mode:           cs.RegistryMode,
+		downSince:      make(map[NodeID]time.Time),
+		rings:          make(map[string]*hashRing),
+		removed:        make(map[removedClaim]time.Time),
 		thisNode:       node,
 		ClusterLogger:  log,
 	}
 
 	r.Address, r.Mailbox = cs.newLocalMailbox()
+	r.Mailbox.serving = true
 	r.Address.connectionServer = cs
 
 	cs.AddConnectionStatusCallback(r.connectionStatusCallback)
@@ -229,32 +440,50 @@ func (r *registry) String() string {
 }
 
 func (r *registry) Serve() {
+	defer r.connectionServer.running("registry")()
+
 	for {
-		message := r.ReceiveNext()
+		message, running := r.receiveNext()
+		if !running {
+			// The registry's mailbox has been terminated, so nothing
+			// more can arrive, not even a Stop.
+			return
+		}
 		switch msg := message.(type) {
-		case internal.RegisterName: // Received locally
+		case internal.RegisterName:
 			r.register(msg.Name, MailboxID(msg.MailboxID))
 
 			if NodeID(msg.Node) == r.thisNode {
 				r.toOtherNodes(msg)
 			}
 
-		case *internal.RegisterName: // Received over the socket, decoded by gob
-			r.register(msg.Name, MailboxID(msg.MailboxID))
-
 		case internal.UnregisterName:
+			if msg.Successor != 0 {
+				r.mu.Lock()
+				r.addSuccessor(msg.Name, MailboxID(msg.Successor))
+				r.mu.Unlock()
+				r.sendNotices()
+			}
 			r.unregister(msg.Name, MailboxID(msg.MailboxID))
 
 			if NodeID(msg.Node) == r.thisNode {
 				r.toOtherNodes(msg)
 			}
 
-		case *internal.UnregisterName:
-			r.unregister(msg.Name, MailboxID(msg.MailboxID))
+		case internal.HandoverName:
+			r.handover(msg)
 
 			// This should only be called internally
 		case internal.UnregisterMailbox:
-			r.unregisterMailbox(MailboxID(msg.MailboxID))
+			// The other nodes are told of each claim it had, as they
+			// have no way of their own to know it has terminated.
+			for _, name := range r.unregisterMailbox(MailboxID(msg.MailboxID)) {
+				r.toOtherNodes(internal.UnregisterName{
+					Node:      internal.IntNodeID(r.thisNode),
+					Name:      name,
+					MailboxID: msg.MailboxID,
+				})
+			}
 
 		case connectionStatus:
 			// HERE: Handling this and the errors in mailbox.go
@@ -263,6 +492,12 @@ func (r *registry) Serve() {
 		case internal.AllNodeClaims:
 			r.handleAllNodeClaims(msg)
 
+		case subscribeName:
+			r.subscribe(msg.name, msg.addr)
+
+		case unsubscribeName:
+			r.unsubscribe(msg.name, msg.addr)
+
 		case synchronizeRegistry:
 			msg.ch <- void
 
@@ -321,6 +556,8 @@ func (r *registry) generateAllNodeClaims() internal.AllNodeClaims {
 }
 
 func (r *registry) handleAllNodeClaims(msg internal.AllNodeClaims) {
+	r.dropStaleClaims(NodeID(msg.Node), msg.Claims)
+
 	for name, mailboxIDs := range msg.Claims {
 		for intMailboxID := range mailboxIDs {
 			// Sanity check.
@@ -349,6 +586,17 @@ func (r *registry) handleConnectionStatus(msg connectionStatus) {
 		return
 	}
 
+	if r.mode == RegistryCached {
+		r.mu.Lock()
+		if _, alreadyDown := r.downSince[msg.node]; !alreadyDown {
+			r.downSince[msg.node] = r.connectionServer.clock.Now()
+			r.rings = make(map[string]*hashRing)
+		}
+		delete(r.nodeRegistries, msg.node)
+		r.mu.Unlock()
+		return
+	}
+
 	for name, claimants := range r.claims {
 		for claimant := range claimants {
 			if claimant.NodeID() == msg.node {
@@ -363,12 +611,66 @@ func (r *registry) handleConnectionStatus(msg connectionStatus) {
 	r.mu.Unlock()
 }
 
+// dropStaleClaims is called when the given node syncs its claims with
+// us. If its claims were kept while it was down, those it no longer
+// makes are removed, and the rest are no longer stale.
+func (r *registry) dropStaleClaims(node NodeID, current map[string]map[internal.IntMailboxID]struct{}) {
+	r.mu.Lock()
+	_, wasDown := r.downSince[node]
+	delete(r.downSince, node)
+	if wasDown {
+		r.rings = make(map[string]*hashRing)
+	}
+	type claim struct {
+		name string
+		mID  MailboxID
+	}
+	var gone []claim
+	if wasDown {
+		for name, claimants := range r.claims {
+			for claimant := range claimants {
+				if claimant.NodeID() != node {
+					continue
+				}
+				if _, stillClaimed := current[name][internal.IntMailboxID(claimant)]; !stillClaimed {
+					gone = append(gone, claim{name, claimant})
+				}
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, c := range gone {
+		r.unregister(c.name, c.mID)
+		r.Tracef("Dropped stale claim of mailbox %x on %q", c.mID, c.name)
+	}
+}
+
 func (r *registry) toOtherNodes(msg interface{}) {
+	r.mu.Lock()
+	registries := make([]Address, 0, len(r.nodeRegistries))
 	for _, addr := range r.nodeRegistries {
+		registries = append(registries, addr)
+	}
+	r.mu.Unlock()
+
+	for _, addr := range registries {
 		addr.Send(msg)
 	}
 }
 
+// toNode sends the message to the registry of the given node.
+func (r *registry) toNode(node NodeID, msg interface{}) {
+	r.mu.Lock()
+	addr, exists := r.nodeRegistries[node]
+	r.mu.Unlock()
+	if !exists {
+		r.Warnf("Could not send %T to the registry of node %d, which is not connected", msg, node)
+		return
+	}
+	addr.Send(msg)
+}
+
 func (r *registry) GetDebugger() NamesDebugger {
 	return r
 }
@@ -376,33 +678,139 @@ func (r *registry) GetDebugger() NamesDebugger {
 // Lookup returns an Address that can be used to send to the mailboxes
 // registered with the given string.
 //
+// Claims on nodes that are connected are preferred to those kept from
+// nodes that are down.
 func (r *registry) Lookup(s string) *Address {
+	return r.LookupWithStaleness(s).Address
+}
+
+// LookupWithStaleness is Lookup, also saying whether the claim it returns
+// is stale. See LookupResult.
+func (r *registry) LookupWithStaleness(s string) LookupResult {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	claims := r.claims[s]
-	claimIDs := make([]MailboxID, 0, len(claims))
+	live := make([]MailboxID, 0, len(claims))
+	stale := []MailboxID{}
 	for k := range claims {
-		claimIDs = append(claimIDs, k)
+		if _, down := r.downSince[k.NodeID()]; down {
+			stale = append(stale, k)
+		} else {
+			live = append(live, k)
+		}
 	}
 
 	// If there is nothing in the registry with the given name, return nil
+	claimIDs := live
 	if len(claimIDs) == 0 {
-		return nil
+		claimIDs = stale
+	}
+	if len(claimIDs) == 0 {
+		return LookupResult{}
 	}
 
 	// Pick a random ID from our list of IDs registered to this name and return it
-	id := claimIDs[rand.Intn(len(claims))]
+	id := claimIDs[rand.Intn(len(claimIDs))]
 
 	r.Tracef("Lookup for %q returned MailboxID %x", s, id)
 
+	return LookupResult{
+		Address: &Address{
+			mailboxID:        id,
+			connectionServer: r.connectionServer,
+			mailbox:          nil,
+		},
+		StaleSince: r.downSince[id.NodeID()],
+	}
+}
+
+// LookupNearest is Lookup, preferring the claims on this node, and then
+// those on the node with the lowest LinkLatency. If no latency is known
+// yet, it picks among the claims on nodes that can be reached now, and
+// only if there are none of those does it fall back to Lookup.
+func (r *registry) LookupNearest(s string) *Address {
+	r.mu.Lock()
+	claims := make([]MailboxID, 0, len(r.claims[s]))
+	for id := range r.claims[s] {
+		claims = append(claims, id)
+	}
+	r.mu.Unlock()
+
+	// Local claims count as no latency at all; nodes without a latency
+	// aren't considered.
+	var nearest, reachable []MailboxID
+	var nearestLatency time.Duration
+	for _, id := range claims {
+		var latency time.Duration
+		if node := id.NodeID(); node != r.thisNode {
+			rm, exists := r.connectionServer.remoteMailboxes[node]
+			if !exists {
+				continue
+			}
+			if rm.reachable() {
+				reachable = append(reachable, id)
+			}
+			measured, known := rm.peerLatency()
+			if !known {
+				continue
+			}
+			latency = measured
+		}
+		switch {
+		case nearest == nil || latency < nearestLatency:
+			nearest = []MailboxID{id}
+			nearestLatency = latency
+		case latency == nearestLatency:
+			nearest = append(nearest, id)
+		}
+	}
+	if len(nearest) == 0 {
+		nearest = reachable
+	}
+	if len(nearest) == 0 {
+		return r.Lookup(s)
+	}
+
+	id := nearest[rand.Intn(len(nearest))]
+	r.Tracef("LookupNearest for %q returned MailboxID %x", s, id)
 	return &Address{
 		mailboxID:        id,
 		connectionServer: r.connectionServer,
-		mailbox:          nil,
 	}
 }
 
+// RouteKey returns the member of the name that owns the key, by a
+// consistent-hash ring over the claims on it, leaving out those on nodes
+// that are down. It is false if there are none.
+func (r *registry) RouteKey(name string, key []byte) (*Address, bool) {
+	r.mu.Lock()
+	ring, exists := r.rings[name]
+	if !exists {
+		members := make([]MailboxID, 0, len(r.claims[name]))
+		for id := range r.claims[name] {
+			if _, down := r.downSince[id.NodeID()]; !down {
+				members = append(members, id)
+			}
+		}
+		ring = newHashRing(members)
+		// Rings for names nobody claims would only pile up.
+		if len(members) > 0 {
+			r.rings[name] = ring
+		}
+	}
+	r.mu.Unlock()
+
+	id, found := ring.get(key)
+	if !found {
+		return nil, false
+	}
+	return &Address{
+		mailboxID:        id,
+		connectionServer: r.connectionServer,
+	}, true
+}
+
 // Register claims the given global name in the registry.
 //
 // This does not happen synchronously, as there seems to be no reason
@@ -448,6 +856,46 @@ func (r *registry) Unregister(name string, addr *Address) {
 	})
 }
 
+// Handover hands the claim on the name of the from Address over to the to
+// Address.
+func (r *registry) Handover(name string, from, to *Address) error {
+	for _, addr := range []*Address{from, to} {
+		node := addr.mailboxID.NodeID()
+		if node == r.thisNode {
+			if !addr.canBeGloballyRegistered() {
+				return ErrCantGloballyRegister
+			}
+			continue
+		}
+		rm, exists := r.connectionServer.remoteMailboxes[node]
+		if !exists {
+			return ErrCantGloballyRegister
+		}
+		if version := rm.peerVersion(); version != 0 && version < 8 {
+			return ErrHandoverUnsupported
+		}
+	}
+
+	r.Tracef("Handing over %q from address %x to %x", name, from.mailboxID, to.mailboxID)
+
+	return r.Send(internal.HandoverName{
+		Name: name,
+		From: internal.IntMailboxID(from.mailboxID),
+		To:   internal.IntMailboxID(to.mailboxID),
+	})
+}
+
+// Subscribe subscribes the given Address to changes in the claims on the
+// given name.
+func (r *registry) Subscribe(name string, addr *Address) {
+	r.Send(subscribeName{name, addr})
+}
+
+// Unsubscribe removes the given Address's subscription to the given name.
+func (r *registry) Unsubscribe(name string, addr *Address) {
+	r.Send(unsubscribeName{name, addr})
+}
+
 // UnregisterMailbox unregisters all names that belong to the given mailbox.
 // This may only be done locally.  It will subsequently call unregister() for
 // every name associated with mID.
@@ -463,33 +911,162 @@ func (r *registry) UnregisterMailbox(node NodeID, mID MailboxID) {
 
 // register is the internal registration function.
 func (r *registry) register(name string, mID MailboxID) {
+	// This runs after the lock is released.
+	defer r.sendNotices()
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	// A claim made again is no longer gone.
+	delete(r.removed, removedClaim{name, mID})
+	nameClaimants := r.addClaim(name, mID)
+
+	// If there are multiple claims now, and one of them is local,
+	// notify our local Address of the conflict.
+	var claimants []Address
+	if len(nameClaimants) > 1 && mID.NodeID() == r.thisNode {
+		for claimant := range nameClaimants {
+			addr := Address{
+				mailboxID:        claimant,
+				connectionServer: r.connectionServer,
+			}
+			claimants = append(claimants, addr)
+		}
+	}
+	r.mu.Unlock()
+
+	// As with the notices, these are sent once the lock is released.
+	for _, addr := range claimants {
+		r.Tracef("Sending MultipleClaim for %q to Address %x", name, addr.mailboxID)
+		addr.Send(MultipleClaim{Claimants: claimants, Name: name})
+	}
+}
 
+// addClaim adds the claim, notifying the subscribers if it is new, and
+// returns the claims on the name. Unlike register, it doesn't check for
+// multiple claims, so it is used for handovers, where there are meant to
+// be. r.mu must be held.
+func (r *registry) addClaim(name string, mID MailboxID) map[MailboxID]voidtype {
 	nameClaimants, haveNameClaimants := r.claims[name]
 	if !haveNameClaimants {
 		nameClaimants = make(map[MailboxID]voidtype)
 		r.claims[name] = nameClaimants
 	}
 
+	_, alreadyClaimed := nameClaimants[mID]
 	nameClaimants[mID] = void
 
-	// If there are multiple claims now, and one of them is local,
-	// notify our local Address of the conflict.
-	if len(nameClaimants) > 1 && mID.NodeID() == r.thisNode {
-		claimants := []Address{}
-		for claimant := range nameClaimants {
-			addr := Address{
-				mailboxID:        claimant,
+	if !alreadyClaimed {
+		delete(r.rings, name)
+		r.notifySubscribers(name, Registered{
+			Name: name,
+			Address: Address{
+				mailboxID:        mID,
 				connectionServer: r.connectionServer,
+			},
+		})
+	}
+	return nameClaimants
+}
+
+// addSuccessor adds the claim of the mailbox a name has been handed over
+// to, as the node handing it over said to, unless the claim has since
+// been removed. Nothing orders that against the successor's own node
+// removing it, so a removal heard of first must not be undone. A local
+// successor is never added, as it was claimed on this node at the start
+// of the handover, if it was live; the claims here are authoritative for
+// it. r.mu must be held.
+func (r *registry) addSuccessor(name string, mID MailboxID) {
+	if mID.NodeID() == r.thisNode {
+		return
+	}
+	r.expireRemoved()
+	if _, gone := r.removed[removedClaim{name, mID}]; gone {
+		r.Tracef("Not adding the claim of %x on %q handed over to it, as it has been removed", mID, name)
+		return
+	}
+	r.addClaim(name, mID)
+}
+
+// remember notes that the claim has been removed, if it is remote;
+// see addSuccessor. r.mu must be held.
+func (r *registry) remember(c removedClaim) {
+	if c.mID.NodeID() == r.thisNode {
+		return
+	}
+	r.expireRemoved()
+	r.removed[c] = r.connectionServer.clock.Now()
+	r.removedOrder = append(r.removedOrder, c)
+}
+
+// expireRemoved forgets the claims removed more than claimTombstoneAge
+// ago. r.mu must be held.
+func (r *registry) expireRemoved() {
+	now := r.connectionServer.clock.Now()
+	expired := 0
+	for _, c := range r.removedOrder {
+		if at, remembered := r.removed[c]; remembered {
+			if now.Sub(at) < claimTombstoneAge {
+				break
 			}
-			claimants = append(claimants, addr)
+			delete(r.removed, c)
 		}
-		for _, addr := range claimants {
-			r.Tracef("Sending MultipleClaim for %q to Address %x", name, addr.mailboxID)
-			addr.Send(MultipleClaim{Claimants: claimants, Name: name})
+		expired++
+	}
+	r.removedOrder = r.removedOrder[expired:]
+}
+
+// handover carries out a step of a Handover: registering the mailbox
+// handed over to on its node, and then unregistering the one handed over
+// from on its own. Each step is passed on to the node of the next.
+func (r *registry) handover(msg internal.HandoverName) {
+	from, to := MailboxID(msg.From), MailboxID(msg.To)
+
+	if !msg.Registered && to.NodeID() == r.thisNode {
+		if _, err := r.connectionServer.mailboxes.mailboxByID(to); err != nil {
+			r.Warnf("Abandoning the handover of %q from %x, as %x has terminated", msg.Name, from, to)
+			return
 		}
+		r.mu.Lock()
+		r.addClaim(msg.Name, to)
+		r.mu.Unlock()
+		r.sendNotices()
+		r.toOtherNodes(internal.RegisterName{
+			Node:      internal.IntNodeID(r.thisNode),
+			Name:      msg.Name,
+			MailboxID: msg.To,
+		})
+		msg.Registered = true
+	}
+
+	next := to.NodeID()
+	if msg.Registered {
+		next = from.NodeID()
+	}
+	if next != r.thisNode {
+		r.toNode(next, msg)
+		return
 	}
+
+	r.mu.Lock()
+	r.addSuccessor(msg.Name, to)
+	_, claimed := r.claims[msg.Name][from]
+	r.mu.Unlock()
+	r.sendNotices()
+	if !claimed {
+		r.Tracef("Handover of %q from %x to %x found no claim to remove", msg.Name, from, to)
+		return
+	}
+
+	r.unregister(msg.Name, from)
+	r.toOtherNodes(internal.UnregisterName{
+		Node:      internal.IntNodeID(r.thisNode),
+		Name:      msg.Name,
+		MailboxID: msg.From,
+		Successor: msg.To,
+	})
+	fromAddr := Address{mailboxID: from, connectionServer: r.connectionServer}
+	fromAddr.Send(HandedOver{
+		Name: msg.Name,
+		To:   Address{mailboxID: to, connectionServer: r.connectionServer},
+	})
 }
 
 // unregister is the internal unregistration function. In the event that
@@ -497,30 +1074,137 @@ func (r *registry) register(name string, mID MailboxID) {
 // check for anyone currently waiting for a termination notice on that
 // name and send it.
 func (r *registry) unregister(name string, mID MailboxID) {
+	// This runs after the lock is released.
+	defer r.sendNotices()
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	// Even if the claim hasn't been heard of yet, a handover mustn't
+	// add it once it has been removed.
+	r.remember(removedClaim{name, mID})
+
 	currentRegistrants, ok := r.claims[name]
 	if !ok {
 		return
 	}
+	if _, claimed := currentRegistrants[mID]; !claimed {
+		return
+	}
 	delete(currentRegistrants, mID)
+	delete(r.rings, name)
+
+	r.notifySubscribers(name, Unregistered{
+		Name: name,
+		Address: Address{
+			mailboxID:        mID,
+			connectionServer: r.connectionServer,
+		},
+	})
 
 	if len(currentRegistrants) == 0 {
 		delete(r.claims, name)
 	}
 }
 
-// unregisterMailbox unregisters all names associated with the given mailbox ID
-func (r *registry) unregisterMailbox(mID MailboxID) {
+// subscribe is the internal subscription function. The subscriber is sent
+// the current claims on the name as it is added.
+func (r *registry) subscribe(name string, addr *Address) {
+	r.mu.Lock()
+	nameSubscribers, haveNameSubscribers := r.subscribers[name]
+	if !haveNameSubscribers {
+		nameSubscribers = make(map[MailboxID]*Address)
+		r.subscribers[name] = nameSubscribers
+	}
+	nameSubscribers[addr.GetID()] = addr
+
+	claimants := make([]MailboxID, 0, len(r.claims[name]))
+	for claimant := range r.claims[name] {
+		claimants = append(claimants, claimant)
+	}
+	r.mu.Unlock()
+
+	for _, claimant := range claimants {
+		err := addr.Send(Registered{
+			Name: name,
+			Address: Address{
+				mailboxID:        claimant,
+				connectionServer: r.connectionServer,
+			},
+		})
+		if err == ErrMailboxTerminated {
+			r.mu.Lock()
+			r.dropSubscriber(name, addr.GetID())
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// unsubscribe is the internal unsubscription function.
+func (r *registry) unsubscribe(name string, addr *Address) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dropSubscriber(name, addr.GetID())
+}
+
+func (r *registry) dropSubscriber(name string, mID MailboxID) {
+	delete(r.subscribers[name], mID)
+	if len(r.subscribers[name]) == 0 {
+		delete(r.subscribers, name)
+	}
+}
+
+// notifySubscribers queues the given change notification for everything
+// subscribed to the name. r.mu must be held. A subscriber may be remote,
+// and sending to it wait for room in the outgoing queue, so the
+// notification is only sent by sendNotices, once r.mu is released.
+func (r *registry) notifySubscribers(name string, msg interface{}) {
+	subscribers := r.subscribers[name]
+	if len(subscribers) == 0 {
+		return
+	}
+	n := notice{name: name, msg: msg, subscribers: make([]*Address, 0, len(subscribers))}
+	for _, addr := range subscribers {
+		n.subscribers = append(n.subscribers, addr)
+	}
+	r.notices = append(r.notices, n)
+}
+
+// sendNotices sends the notifications queued by notifySubscribers,
+// dropping any subscriber that has terminated.
+func (r *registry) sendNotices() {
+	r.mu.Lock()
+	notices := r.notices
+	r.notices = nil
+	r.mu.Unlock()
+
+	for _, n := range notices {
+		for _, addr := range n.subscribers {
+			if addr.Send(n.msg) == ErrMailboxTerminated {
+				r.Tracef("Dropping terminated subscriber %x for %q", addr.GetID(), n.name)
+				r.mu.Lock()
+				r.dropSubscriber(n.name, addr.GetID())
+				r.mu.Unlock()
+			}
+		}
+	}
+}
+
+// unregisterMailbox unregisters all names associated with the given mailbox ID,
+// returning them.
+func (r *registry) unregisterMailbox(mID MailboxID) []string {
 	// TODO: make this more efficient?
+	var names []string
 	for name, claimants := range r.claims {
 		for claimant := range claimants {
 			if claimant == mID {
 				r.unregister(name, claimant)
+				names = append(names, name)
 			}
 		}
 	}
+	return names
 }
 
 // RegistryDebugger methods
@@ -1,11 +1,23 @@
 package reign
 
 import (
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/thejerf/reign/internal"
 )
 
+// unclaim returns the UnregisterName that removes the claim.
+func unclaim(claim internal.RegisterName) internal.UnregisterName {
+	return internal.UnregisterName{
+		Node:      claim.Node,
+		Name:      claim.Name,
+		MailboxID: claim.MailboxID,
+	}
+}
+
 func TestConnectionStatusCallback(t *testing.T) {
 	cs, r := noClustering(NullLogger)
 	defer cs.Terminate()
@@ -276,3 +288,545 @@ func TestInternalAllNodeClaims(t *testing.T) {
 		}
 	}
 }
+
+func TestSubscribe(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	subscriber, subMbx := cs.NewMailbox()
+	defer subMbx.Terminate()
+
+	addr1, mbx1 := cs.NewMailbox()
+	defer mbx1.Terminate()
+	addr2, mbx2 := cs.NewMailbox()
+
+	expect := func(msg interface{}) {
+		r.Sync()
+		got, ok := subMbx.ReceiveNextAsync()
+		if !ok {
+			t.Fatalf("Expected %#v, got nothing", msg)
+		}
+		switch m := msg.(type) {
+		case Registered:
+			reg, isReg := got.(Registered)
+			if !isReg || reg.Name != m.Name || !reg.Address.Equal(&m.Address) {
+				t.Fatalf("Expected %#v, got %#v", msg, got)
+			}
+		case Unregistered:
+			unreg, isUnreg := got.(Unregistered)
+			if !isUnreg || unreg.Name != m.Name || !unreg.Address.Equal(&m.Address) {
+				t.Fatalf("Expected %#v, got %#v", msg, got)
+			}
+		}
+	}
+
+	name := "service"
+	r.Register(name, addr1)
+	r.Register("other", addr1)
+	r.Sync()
+
+	// The existing claim arrives as the subscription is made.
+	r.Subscribe(name, subscriber)
+	expect(Registered{name, *addr1})
+
+	r.Register(name, addr2)
+	expect(Registered{name, *addr2})
+
+	// Reregistering is not a change.
+	r.Register(name, addr2)
+	r.Unregister(name, addr1)
+	expect(Unregistered{name, *addr1})
+
+	mbx2.Terminate()
+	expect(Unregistered{name, *addr2})
+
+	// Claims from a node that goes down are released.
+	remote := Address{mailboxID: MailboxID(1<<8 | 2), connectionServer: cs}
+	r.send(internal.RegisterName{
+		Node:      2,
+		Name:      name,
+		MailboxID: internal.IntMailboxID(remote.mailboxID),
+	})
+	expect(Registered{name, remote})
+	r.send(connectionStatus{2, false})
+	expect(Unregistered{name, remote})
+
+	r.Unsubscribe(name, subscriber)
+	r.Register(name, addr1)
+	r.Sync()
+	if msg, ok := subMbx.ReceiveNextAsync(); ok {
+		t.Fatalf("Received %#v after unsubscribing", msg)
+	}
+}
+
+func TestCachedRegistry(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+	r.mode = RegistryCached
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	name := "service"
+	remote := Address{mailboxID: MailboxID(1<<8 | 2), connectionServer: cs}
+	r.send(internal.RegisterName{
+		Node:      2,
+		Name:      name,
+		MailboxID: internal.IntMailboxID(remote.mailboxID),
+	})
+	r.Sync()
+	if res := r.LookupWithStaleness(name); !res.Address.Equal(&remote) || res.Stale() {
+		t.Fatalf("Unexpected lookup while connected: %#v", res)
+	}
+
+	// The claim is kept when the node goes down, but is stale.
+	before := time.Now()
+	r.send(connectionStatus{2, false})
+	r.Sync()
+	res := r.LookupWithStaleness(name)
+	if !res.Address.Equal(&remote) || !res.Stale() || res.StaleSince.Before(before) {
+		t.Fatalf("Unexpected lookup while disconnected: %#v", res)
+	}
+	if a := r.Lookup(name); !a.Equal(&remote) {
+		t.Fatal("Lookup did not return the stale claim")
+	}
+
+	// Live claims are preferred.
+	live := Address{mailboxID: MailboxID(1<<8 | 3), connectionServer: cs}
+	liveClaim := internal.RegisterName{
+		Node:      3,
+		Name:      name,
+		MailboxID: internal.IntMailboxID(live.mailboxID),
+	}
+	r.send(liveClaim)
+	r.Sync()
+	for i := 0; i < 20; i++ {
+		if res := r.LookupWithStaleness(name); !res.Address.Equal(&live) || res.Stale() {
+			t.Fatalf("Lookup returned %#v rather than the live claim", res)
+		}
+	}
+	r.send(unclaim(liveClaim))
+
+	// When the node syncs again, the claims it still makes are fresh...
+	other := "other"
+	otherAddr := Address{mailboxID: MailboxID(2<<8 | 2), connectionServer: cs}
+	r.send(internal.RegisterName{
+		Node:      2,
+		Name:      other,
+		MailboxID: internal.IntMailboxID(otherAddr.mailboxID),
+	})
+	r.send(connectionStatus{2, false})
+	r.Sync()
+	r.handleAllNodeClaims(internal.AllNodeClaims{
+		Node: 2,
+		Claims: map[string]map[internal.IntMailboxID]struct{}{
+			other: {internal.IntMailboxID(otherAddr.mailboxID): struct{}{}},
+		},
+	})
+	if res := r.LookupWithStaleness(other); !res.Address.Equal(&otherAddr) || res.Stale() {
+		t.Fatalf("Unexpected lookup after resyncing: %#v", res)
+	}
+
+	// ... and those it doesn't are gone.
+	if res := r.LookupWithStaleness(name); res.Address != nil {
+		t.Fatalf("Claim not dropped after resyncing: %#v", res)
+	}
+}
+
+func TestLookupNearest(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+	r := ntb.c1.registry
+
+	// Node 3 isn't in the cluster, so its latency will never be known.
+	name := "replica"
+	near := Address{mailboxID: MailboxID(1<<8 | 2), connectionServer: ntb.c1}
+	far := Address{mailboxID: MailboxID(1<<8 | 3), connectionServer: ntb.c1}
+	for _, claim := range []Address{near, far} {
+		r.send(internal.RegisterName{
+			Node:      internal.IntNodeID(claim.mailboxID.NodeID()),
+			Name:      name,
+			MailboxID: internal.IntMailboxID(claim.mailboxID),
+		})
+	}
+	r.Sync()
+
+	// Without any latencies, the claims on connected nodes win...
+	for i := 0; i < 20; i++ {
+		if a := r.LookupNearest(name); !a.Equal(&near) {
+			t.Fatal("LookupNearest did not prefer the connected claim:", a)
+		}
+	}
+	// ... and without those, any claim will do.
+	r.send(internal.RegisterName{
+		Node:      internal.IntNodeID(3),
+		Name:      "unreached",
+		MailboxID: internal.IntMailboxID(far.mailboxID),
+	})
+	r.Sync()
+	if a := r.LookupNearest("unreached"); !a.Equal(&far) {
+		t.Fatal("LookupNearest did not fall back to Lookup:", a)
+	}
+
+	ntb.remote1to2.recordLatency(time.Millisecond)
+	if latency, known := ntb.c1.LinkLatency(2); !known || latency != time.Millisecond {
+		t.Fatal("Unexpected latency:", latency, known)
+	}
+	for i := 0; i < 20; i++ {
+		if a := r.LookupNearest(name); !a.Equal(&near) {
+			t.Fatal("LookupNearest did not return the nearest claim:", a)
+		}
+	}
+
+	// Local claims beat them all.
+	local, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	r.Register(name, local)
+	r.Sync()
+	for i := 0; i < 20; i++ {
+		if a := r.LookupNearest(name); !a.Equal(local) {
+			t.Fatal("LookupNearest did not return the local claim:", a)
+		}
+	}
+
+	if r.LookupNearest("nobody") != nil {
+		t.Fatal("LookupNearest found an unclaimed name")
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+	r.mode = RegistryCached
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	name := "shard"
+	claim := func(mID MailboxID) internal.RegisterName {
+		return internal.RegisterName{
+			Node:      internal.IntNodeID(mID.NodeID()),
+			Name:      name,
+			MailboxID: internal.IntMailboxID(mID),
+		}
+	}
+	routes := func() map[string]MailboxID {
+		owners := map[string]MailboxID{}
+		for i := 0; i < 1000; i++ {
+			key := strconv.Itoa(i)
+			a, found := r.RouteKey(name, []byte(key))
+			if !found {
+				t.Fatal("No route for", key)
+			}
+			owners[key] = a.mailboxID
+		}
+		return owners
+	}
+
+	if _, found := r.RouteKey(name, []byte("moo")); found {
+		t.Fatal("Routed a key for an unclaimed name")
+	}
+
+	members := []MailboxID{1<<8 | 2, 2<<8 | 2, 1<<8 | 3, 2<<8 | 3}
+	for _, mID := range members {
+		r.send(claim(mID))
+	}
+	r.Sync()
+	before := routes()
+	shares := map[MailboxID]int{}
+	for _, owner := range before {
+		shares[owner]++
+	}
+	for _, mID := range members {
+		if shares[mID] < 100 {
+			t.Fatal("Keys were not shared out:", shares)
+		}
+	}
+	if again := routes(); !reflect.DeepEqual(before, again) {
+		t.Fatal("The same keys were routed differently")
+	}
+
+	// A new member only takes keys, ...
+	added := MailboxID(3<<8 | 3)
+	r.send(claim(added))
+	r.Sync()
+	moved := 0
+	for key, owner := range routes() {
+		if owner != before[key] {
+			if owner != added {
+				t.Fatal("Key moved between existing members:", key)
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 350 {
+		t.Fatal("Unexpected number of keys moved to the new member:", moved)
+	}
+
+	// ... and the keys of one that goes only move to the rest.
+	r.send(unclaim(claim(added)))
+	r.Sync()
+	if after := routes(); !reflect.DeepEqual(before, after) {
+		t.Fatal("Keys did not move back when the member went")
+	}
+
+	// Members on a node that is down are left out, though the claims
+	// are kept.
+	r.send(connectionStatus{2, false})
+	r.Sync()
+	for key, owner := range routes() {
+		if owner.NodeID() == 2 {
+			t.Fatal("Key routed to a node that is down:", key)
+		}
+		if before[key].NodeID() == 3 && owner != before[key] {
+			t.Fatal("Key moved between members that are up:", key)
+		}
+	}
+}
+
+func TestHandover(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+	go ntb.c1.registry.Serve()
+	defer ntb.c1.registry.Stop()
+	go ntb.c2.registry.Serve()
+	defer ntb.c2.registry.Stop()
+
+	name := "singleton"
+	claimsAre := func(claims ...MailboxID) bool {
+		for _, r := range []*registry{ntb.c1.registry, ntb.c2.registry} {
+			if !reflect.DeepEqual(r.DumpClaims()[name], claims) {
+				return false
+			}
+		}
+		return true
+	}
+	waitForClaims := func(claims ...MailboxID) {
+		deadline := time.Now().Add(timeout)
+		for !claimsAre(claims...) {
+			if time.Now().After(deadline) {
+				t.Fatal("Claims never became", claims, ntb.c1.registry.DumpClaims(), ntb.c2.registry.DumpClaims())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The registries learn of each other just after the connection is
+	// made.
+	synced := func(r *registry, node NodeID) bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, exists := r.nodeRegistries[node]
+		return exists
+	}
+	for !synced(ntb.c1.registry, 2) || !synced(ntb.c2.registry, 1) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := ntb.c1.registry.Register(name, ntb.addr1_1); err != nil {
+		t.Fatal(err)
+	}
+	waitForClaims(ntb.addr1_1.mailboxID)
+
+	if err := ntb.c1.registry.Handover(name, ntb.addr1_1, ntb.rem1_2); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout)
+	if ho, isHandedOver := msg.(HandedOver); !isHandedOver || ho.Name != name || ho.To.mailboxID != ntb.addr1_2.mailboxID {
+		t.Fatal("Old claimant was not told of the handover:", msg)
+	}
+	waitForClaims(ntb.addr1_2.mailboxID)
+	if msg, received := ntb.mailbox1_2.ReceiveNextTimeout(10 * time.Millisecond); received {
+		t.Fatal("New claimant was sent", msg)
+	}
+
+	// A mailbox that has terminated can't take the claim.
+	addr, mbx := ntb.c1.NewMailbox()
+	mbx.Terminate()
+	if err := ntb.c1.registry.Handover(name, ntb.rem1_2, addr); err != nil {
+		t.Fatal(err)
+	}
+	ntb.c1.registry.Sync()
+	if !claimsAre(ntb.addr1_2.mailboxID) {
+		t.Fatal("Handed over to a terminated mailbox:", ntb.c1.registry.DumpClaims())
+	}
+
+	ntb.remote1to2.Lock()
+	ntb.remote1to2.version = 7
+	ntb.remote1to2.Unlock()
+	if err := ntb.c1.registry.Handover(name, ntb.rem1_2, ntb.addr1_1); err != ErrHandoverUnsupported {
+		t.Fatal("Handed over from an older node:", err)
+	}
+}
+
+// A successor that terminates straight after a handover must not have its
+// claim put back by the handover's last steps, on any node.
+func TestHandoverSuccessorTerminates(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+	go ntb.c1.registry.Serve()
+	defer ntb.c1.registry.Stop()
+	go ntb.c2.registry.Serve()
+	defer ntb.c2.registry.Stop()
+
+	synced := func(r *registry, node NodeID) bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, exists := r.nodeRegistries[node]
+		return exists
+	}
+	for !synced(ntb.c1.registry, 2) || !synced(ntb.c2.registry, 1) {
+		time.Sleep(time.Millisecond)
+	}
+	claimed := func(r *registry, name string, mID MailboxID) bool {
+		for _, claimant := range r.DumpClaims()[name] {
+			if claimant == mID {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(timeout)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatal(what, ntb.c1.registry.DumpClaims(), ntb.c2.registry.DumpClaims())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	name := "singleton"
+	if err := ntb.c1.registry.Register(name, ntb.addr1_1); err != nil {
+		t.Fatal(err)
+	}
+	to, toMbx := ntb.c2.NewMailbox()
+	if err := ntb.c1.registry.Handover(name, ntb.addr1_1, &Address{
+		mailboxID:        to.mailboxID,
+		connectionServer: ntb.c1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The successor can only terminate once its node has registered it,
+	// or the handover is abandoned.
+	waitFor("Successor never claimed", func() bool {
+		return claimed(ntb.c2.registry, name, to.mailboxID)
+	})
+	toMbx.Terminate()
+
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg == nil {
+		t.Fatal("Old claimant was not told of the handover")
+	}
+	// Node 1's registry sent the handover's last step to node 2 before
+	// this, so once this arrives, that has been handled, too.
+	if err := ntb.c1.registry.Register("marker", ntb.addr1_1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("Marker never claimed", func() bool {
+		return claimed(ntb.c2.registry, "marker", ntb.addr1_1.mailboxID)
+	})
+	waitFor("Terminated successor's claim was kept", func() bool {
+		return len(ntb.c1.registry.DumpClaims()[name]) == 0 &&
+			len(ntb.c2.registry.DumpClaims()[name]) == 0
+	})
+	ntb.c1.registry.Sync()
+	ntb.c2.registry.Sync()
+	if ntb.c1.registry.Lookup(name) != nil || ntb.c2.registry.Lookup(name) != nil {
+		t.Fatal("Terminated successor's claim came back:", ntb.c1.registry.DumpClaims(), ntb.c2.registry.DumpClaims())
+	}
+}
+
+// The node handing over can be heard from after the successor's own node
+// has removed its claim, which must stay removed.
+func TestHandoverRemovedSuccessor(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	name := "singleton"
+	from, to := MailboxID(1<<8|2), MailboxID(1<<8|3)
+	r.send(internal.RegisterName{Node: 2, Name: name, MailboxID: internal.IntMailboxID(from)})
+	r.send(internal.RegisterName{Node: 3, Name: name, MailboxID: internal.IntMailboxID(to)})
+	r.send(internal.UnregisterName{Node: 3, Name: name, MailboxID: internal.IntMailboxID(to)})
+	r.send(internal.UnregisterName{
+		Node:      2,
+		Name:      name,
+		MailboxID: internal.IntMailboxID(from),
+		Successor: internal.IntMailboxID(to),
+	})
+	r.Sync()
+	if addr := r.Lookup(name); addr != nil {
+		t.Fatal("Removed successor was claimed again:", addr.mailboxID)
+	}
+
+	// A claim made again afterwards is taken, though.
+	r.send(internal.RegisterName{Node: 3, Name: name, MailboxID: internal.IntMailboxID(to)})
+	r.Sync()
+	if addr := r.Lookup(name); addr == nil || addr.mailboxID != to {
+		t.Fatal("Claim made again was not taken:", addr)
+	}
+
+	// A local successor is only ever claimed by this node itself, so one
+	// that has terminated isn't brought back.
+	local, localMbx := cs.NewMailbox()
+	localMbx.Terminate()
+	r.send(internal.UnregisterName{
+		Node:      2,
+		Name:      "local",
+		MailboxID: internal.IntMailboxID(from),
+		Successor: internal.IntMailboxID(local.mailboxID),
+	})
+	r.Sync()
+	if addr := r.Lookup("local"); addr != nil {
+		t.Fatal("Terminated local successor was claimed:", addr.mailboxID)
+	}
+}
+
+func TestHandoverOverlap(t *testing.T) {
+	cs, r := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	go func() { r.Serve() }()
+	defer r.Stop()
+
+	subscriber, subMbx := cs.NewMailbox()
+	defer subMbx.Terminate()
+
+	name := "singleton"
+	from, to := MailboxID(1<<8|2), MailboxID(1<<8|3)
+	r.send(internal.RegisterName{Node: 2, Name: name, MailboxID: internal.IntMailboxID(from)})
+	r.Subscribe(name, subscriber)
+	r.Sync()
+	subMbx.ReceiveNextAsync()
+
+	// Node 2's unregistration comes in ahead of node 3's registration,
+	// but carries it anyhow.
+	r.send(internal.UnregisterName{
+		Node:      2,
+		Name:      name,
+		MailboxID: internal.IntMailboxID(from),
+		Successor: internal.IntMailboxID(to),
+	})
+	r.Sync()
+	if msg, _ := subMbx.ReceiveNextAsync(); msg.(Registered).Address.mailboxID != to {
+		t.Fatal("The new claim was not added first:", msg)
+	}
+	if msg, _ := subMbx.ReceiveNextAsync(); msg.(Unregistered).Address.mailboxID != from {
+		t.Fatal("The old claim was not removed:", msg)
+	}
+	if addr := r.Lookup(name); addr == nil || addr.mailboxID != to {
+		t.Fatal("Lookup did not find the new claim:", addr)
+	}
+
+	// Its own registration arriving afterwards changes nothing.
+	r.send(internal.RegisterName{Node: 3, Name: name, MailboxID: internal.IntMailboxID(to)})
+	r.Sync()
+	if msg, received := subMbx.ReceiveNextAsync(); received {
+		t.Fatal("Repeated registration was sent:", msg)
+	}
+}
@@ -0,0 +1,64 @@
+package reigntest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign"
+)
+
+// AwaitGoroutinesExited waits up to the timeout for all of the goroutines
+// reign started for the node to exit, as they should once it has been
+// shut down with Close, or stopped and terminated. It returns nil if they
+// did, or else the ones still running, by what they are for; see
+// reign.Diagnostics.Goroutines.
+func AwaitGoroutinesExited(cs reign.ConnectionService, timeout time.Duration) map[string]int {
+	diagnostics := cs.(reign.Diagnostics)
+	deadline := time.Now().Add(timeout)
+	for {
+		running := diagnostics.Goroutines()
+		if len(running) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return running
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// AssertGoroutinesExited fails the test if any of the goroutines reign
+// started for the node are still running after the timeout, listing them.
+// Call it after shutting the node down, to catch anything that isn't
+// stopped along with it:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//	defer cancel()
+//	if err := cs.(reign.Drainer).Close(ctx); err != nil {
+//	    t.Fatal(err)
+//	}
+//	reigntest.AssertGoroutinesExited(t, cs, time.Second)
+func AssertGoroutinesExited(t testing.TB, cs reign.ConnectionService, timeout time.Duration) {
+	running := AwaitGoroutinesExited(cs, timeout)
+	if running == nil {
+		return
+	}
+	t.Fatalf("goroutines still running after the node was shut down: %s", describeGoroutines(running))
+}
+
+// describeGoroutines lists the running goroutines in order of what they
+// are for, with how many there are of each.
+func describeGoroutines(running map[string]int) string {
+	labels := make([]string, 0, len(running))
+	for label := range running {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for i, label := range labels {
+		labels[i] = fmt.Sprintf("%s (%d)", label, running[label])
+	}
+	return strings.Join(labels, ", ")
+}
@@ -0,0 +1,37 @@
+package reigntest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign"
+)
+
+func TestAssertGoroutinesExited(t *testing.T) {
+	cs, _ := reign.NewTestNode(1, map[reign.NodeID]reign.ClusterSender{
+		2: NewSender(),
+	}, reign.NullLogger)
+	go cs.Serve()
+	defer cs.Terminate()
+
+	deadline := time.Now().Add(timeout)
+	for AwaitGoroutinesExited(cs, 0)["remote mailboxes for node 2"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Running goroutines not reported:", cs.(reign.Diagnostics).Goroutines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := cs.(reign.Drainer).Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	AssertGoroutinesExited(t, cs, timeout)
+
+	described := describeGoroutines(map[string]int{"registry": 1, "pings to node 2": 2})
+	if described != "pings to node 2 (2), registry (1)" {
+		t.Fatal("Wrong description:", described)
+	}
+}
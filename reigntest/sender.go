@@ -0,0 +1,311 @@
+/*
+Package reigntest helps to unit test code that uses reign's clustering,
+without having to bring up a cluster.
+
+A Sender stands in for the connection to a remote node of a node created
+with reign.NewTestNode, recording everything sent to it, and has methods
+to wait for the messages a test expects, and to play the part of the
+remote node:
+
+	sender := reigntest.NewSender()
+	cs, _ := reign.NewTestNode(1, map[reign.NodeID]reign.ClusterSender{
+	    2: sender,
+	}, reign.NullLogger)
+	go cs.Serve()
+	defer func() {
+	    cs.Stop()
+	    cs.Terminate()
+	}()
+
+	remote := &reign.Address{}
+	remote.UnmarshalFromID(reign.MailboxID(1<<8 | 2))
+	remote.Send("hello")
+	if msg, ok := sender.AwaitMessage(remote.GetID(), time.Second); !ok || msg != "hello" {
+	    t.Fatal("message not sent")
+	}
+
+AssertGoroutinesExited checks that a node's goroutines all exit once it
+has been shut down, in tests of reign itself or of code that starts and
+stops nodes.
+*/
+package reigntest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thejerf/reign"
+	"github.com/thejerf/reign/internal"
+)
+
+var errNotConnected = errors.New("the Sender is not connected to a node; pass it to reign.NewTestNode")
+
+// A Message is a message sent to a mailbox on the remote node.
+type Message struct {
+	Target  reign.MailboxID
+	Message interface{}
+	// Deadline is the zero time unless the message was sent with
+	// SendWithDeadline.
+	Deadline time.Time
+}
+
+// Sender is a reign.ClusterSender that records every message sent to it.
+//
+// The Await methods look through everything sent so far, waiting up to
+// the given timeout for the message if it hasn't been sent yet. They
+// don't consume what they find; use Reset to start afresh.
+type Sender struct {
+	m          sync.Mutex
+	cond       *sync.Cond
+	receive    func(internal.ClusterMessage) error
+	sent       []internal.ClusterMessage
+	err        error
+	terminated bool
+}
+
+// NewSender returns a new Sender.
+func NewSender() *Sender {
+	s := &Sender{}
+	s.cond = sync.NewCond(&s.m)
+	return s
+}
+
+// Connected implements reign.ClusterSender.
+func (s *Sender) Connected(receive func(internal.ClusterMessage) error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.receive = receive
+}
+
+// SendClusterMessage implements reign.ClusterSender. It records the
+// message, unless Fail has been called.
+func (s *Sender) SendClusterMessage(cm internal.ClusterMessage) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, cm)
+	s.cond.Broadcast()
+	return nil
+}
+
+// TerminateConnection implements reign.ClusterSender.
+func (s *Sender) TerminateConnection() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.terminated = true
+	s.cond.Broadcast()
+}
+
+// Fail makes every later send fail with the given error, or succeed again
+// if it is nil. A network error such as io.EOF simulates the connection
+// breaking, which makes the node terminate it.
+func (s *Sender) Fail(err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.err = err
+}
+
+// Terminated returns whether the node has terminated the connection.
+func (s *Sender) Terminated() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return s.terminated
+}
+
+// Reset forgets the messages sent so far.
+func (s *Sender) Reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.sent = nil
+}
+
+// Sent returns every message sent so far, in reign's internal wire
+// format. Messages is usually more useful.
+func (s *Sender) Sent() []interface{} {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	sent := make([]interface{}, len(s.sent))
+	for i, cm := range s.sent {
+		sent[i] = cm
+	}
+	return sent
+}
+
+// Messages returns the messages sent so far to mailboxes on the remote
+// node. Messages sent with SendStream are sent in chunks, which are left
+// out.
+func (s *Sender) Messages() []Message {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	messages := []Message{}
+	for _, cm := range s.sent {
+		if msg, isMsg := mailboxMessage(cm); isMsg {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// AwaitMessage waits for a message to be sent to the given remote
+// mailbox, returning the first one and whether there was one.
+func (s *Sender) AwaitMessage(target reign.MailboxID, timeout time.Duration) (interface{}, bool) {
+	var found interface{}
+	ok := s.await(timeout, func(cm internal.ClusterMessage) bool {
+		msg, isMsg := mailboxMessage(cm)
+		if !isMsg || msg.Target != target {
+			return false
+		}
+		found = msg.Message
+		return true
+	})
+	return found, ok
+}
+
+// AwaitNotify waits for the node to ask to be told when the given remote
+// mailbox terminates, which it does when the first local Address is
+// linked to it with NotifyAddressOnTerminate, returning whether it did.
+func (s *Sender) AwaitNotify(remote reign.MailboxID, timeout time.Duration) bool {
+	return s.await(timeout, func(cm internal.ClusterMessage) bool {
+		notify, isNotify := cm.(*internal.NotifyNodeOnTerminate)
+		return isNotify && reign.MailboxID(notify.IntMailboxID) == remote
+	})
+}
+
+// AwaitRemoveNotify waits for the node to withdraw its interest in the
+// given remote mailbox, which it does when the last local link to it is
+// removed, returning whether it did.
+func (s *Sender) AwaitRemoveNotify(remote reign.MailboxID, timeout time.Duration) bool {
+	return s.await(timeout, func(cm internal.ClusterMessage) bool {
+		remove, isRemove := cm.(*internal.RemoveNotifyNodeOnTerminate)
+		return isRemove && reign.MailboxID(remove.IntMailboxID) == remote
+	})
+}
+
+// AwaitTerminated waits for the node to tell the remote node that the
+// given local mailbox has terminated, which it does if the remote node
+// is linked to it, returning the reason and whether it did.
+func (s *Sender) AwaitTerminated(local reign.MailboxID, timeout time.Duration) (reign.TerminationReason, bool) {
+	var reason reign.TerminationReason
+	ok := s.await(timeout, func(cm internal.ClusterMessage) bool {
+		switch msg := cm.(type) {
+		case *internal.RemoteMailboxTerminated:
+			if reign.MailboxID(msg.IntMailboxID) == local {
+				reason = reign.TerminationReason(msg.Reason)
+				return true
+			}
+		case *internal.RemoteMailboxesTerminated:
+			for i, id := range msg.IntMailboxIDs {
+				if reign.MailboxID(id) != local {
+					continue
+				}
+				if i < len(msg.Reasons) {
+					reason = reign.TerminationReason(msg.Reasons[i])
+				}
+				return true
+			}
+		}
+		return false
+	})
+	return reason, ok
+}
+
+// Deliver sends the message to the given local mailbox, as if a mailbox
+// on the remote node had sent it.
+func (s *Sender) Deliver(target reign.MailboxID, msg interface{}) error {
+	return s.deliver(&internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(target),
+		Message: msg,
+	})
+}
+
+// NotifyOnTerminate asks the node to tell the remote node when the given
+// local mailbox terminates, as it does when a remote Address is linked to
+// it. See AwaitTerminated.
+func (s *Sender) NotifyOnTerminate(local reign.MailboxID) error {
+	return s.deliver(&internal.NotifyNodeOnTerminate{
+		IntMailboxID: internal.IntMailboxID(local),
+	})
+}
+
+// TerminateMailbox tells the node that the given remote mailbox has
+// terminated, for the reason given, which sends a MailboxTerminated, or
+// a TerminatedWithReason, to every local mailbox linked to it.
+func (s *Sender) TerminateMailbox(remote reign.MailboxID, reason reign.TerminationReason) error {
+	return s.deliver(&internal.RemoteMailboxTerminated{
+		IntMailboxID: internal.IntMailboxID(remote),
+		Reason:       uint8(reason),
+	})
+}
+
+func (s *Sender) deliver(cm internal.ClusterMessage) error {
+	s.m.Lock()
+	receive := s.receive
+	s.m.Unlock()
+
+	if receive == nil {
+		return errNotConnected
+	}
+	return receive(cm)
+}
+
+// await waits until one of the messages sent satisfies matches, or the
+// timeout passes, returning whether one did.
+func (s *Sender) await(timeout time.Duration, matches func(internal.ClusterMessage) bool) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		s.m.Lock()
+		expired = true
+		s.cond.Broadcast()
+		s.m.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		for _, cm := range s.sent {
+			if matches(cm) {
+				return true
+			}
+		}
+		if expired {
+			return false
+		}
+		s.cond.Wait()
+	}
+}
+
+// mailboxMessage returns the message for a remote mailbox that cm
+// carries, if it carries one.
+func mailboxMessage(cm internal.ClusterMessage) (Message, bool) {
+	var imm internal.IncomingMailboxMessage
+	switch msg := cm.(type) {
+	case internal.IncomingMailboxMessage:
+		imm = msg
+	case *internal.IncomingMailboxMessage:
+		imm = *msg
+	default:
+		return Message{}, false
+	}
+
+	if _, isChunk := imm.Message.(*internal.StreamChunk); isChunk {
+		return Message{}, false
+	}
+	return Message{
+		Target:   reign.MailboxID(imm.Target),
+		Message:  imm.Message,
+		Deadline: imm.Deadline,
+	}, true
+}
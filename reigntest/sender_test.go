@@ -0,0 +1,85 @@
+package reigntest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign"
+)
+
+const timeout = time.Second
+
+func TestSender(t *testing.T) {
+	sender := NewSender()
+	cs, _ := reign.NewTestNode(1, map[reign.NodeID]reign.ClusterSender{
+		2: sender,
+	}, reign.NullLogger)
+	go cs.Serve()
+	defer func() {
+		cs.Stop()
+		cs.Terminate()
+	}()
+
+	remote := &reign.Address{}
+	remote.UnmarshalFromID(reign.MailboxID(1<<8 | 2))
+	addr, mailbox := cs.NewMailbox()
+	defer mailbox.Terminate()
+	mailbox.ReportTerminationReasons(true)
+
+	// Messages for the remote node are recorded.
+	remote.Send("hello")
+	msg, ok := sender.AwaitMessage(remote.GetID(), timeout)
+	if !ok || msg != "hello" {
+		t.Fatal("Message was not sent:", msg)
+	}
+	if msgs := sender.Messages(); len(msgs) != 1 || msgs[0].Message != "hello" {
+		t.Fatal("Unexpected messages:", msgs)
+	}
+
+	// And messages from it delivered.
+	if err := sender.Deliver(addr.GetID(), "hi"); err != nil {
+		t.Fatal("Could not deliver:", err)
+	}
+	if msg, ok := mailbox.ReceiveNextTimeout(timeout); !ok || msg != "hi" {
+		t.Fatal("Message was not delivered:", msg)
+	}
+
+	// Linking to a remote mailbox registers with the remote node, which
+	// can then terminate it.
+	remote.NotifyAddressOnTerminate(addr)
+	if !sender.AwaitNotify(remote.GetID(), timeout) {
+		t.Fatal("Link was not registered")
+	}
+	sender.TerminateMailbox(remote.GetID(), reign.TerminatedPanic)
+	msg, ok = mailbox.ReceiveNextTimeout(timeout)
+	if !ok || msg != (reign.TerminatedWithReason{ID: remote.GetID(), Reason: reign.TerminatedPanic}) {
+		t.Fatal("Termination was not delivered:", msg)
+	}
+
+	remote.NotifyAddressOnTerminate(addr)
+	remote.RemoveNotifyAddress(addr)
+	if !sender.AwaitRemoveNotify(remote.GetID(), timeout) {
+		t.Fatal("Link was not removed")
+	}
+
+	// The remote node can link to local mailboxes.
+	linked, linkedMailbox := cs.NewMailbox()
+	sender.NotifyOnTerminate(linked.GetID())
+	linkedMailbox.Terminate()
+	reason, ok := sender.AwaitTerminated(linked.GetID(), timeout)
+	if !ok || reason != reign.TerminatedNormally {
+		t.Fatal("Termination was not sent:", reason, ok)
+	}
+
+	// A broken connection is terminated.
+	sender.Fail(io.EOF)
+	remote.Send("lost")
+	deadline := time.Now().Add(timeout)
+	for !sender.Terminated() {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection was not terminated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
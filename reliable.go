@@ -0,0 +1,409 @@
+package reign
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// ErrReliableUnsupported is returned by SendReliable for a node running a
+// version of reign from before reliable messages, which would never
+// acknowledge them.
+var ErrReliableUnsupported = errors.New("the remote node does not support reliable messages")
+
+// A ReliableMessage is a message sent with SendReliable that the node of
+// its target has not yet acknowledged.
+type ReliableMessage struct {
+	// ID identifies the message among those sent by this node, including
+	// by earlier runs of it whose messages are still in the ReliableStore.
+	ID      uint64
+	Target  MailboxID
+	Message interface{}
+}
+
+// A ReliableStore keeps the messages sent with SendReliable until their
+// target's node acknowledges them, so they can be sent again if the
+// connection to it goes down first.
+//
+// Put is called with each message before it is sent, and any error is
+// returned by SendReliable without sending it. Delete is called once it
+// has been acknowledged. Pending calls the function with each message that
+// is still waiting, in any order; it is called when the cluster's store is
+// set, and whenever a connection to a node is made, to send those for that
+// node again. The function must not call back into the store.
+//
+// The default store just keeps them in memory, which covers the
+// connection dropping, but not this node crashing. A store that keeps them
+// somewhere durable instead lets a node that is restarted send the
+// messages its previous run hadn't had acknowledged, once it is connected
+// again. It will need to encode the Messages itself, which it can do with
+// encoding/gob just as reign does. The methods may be called from many
+// goroutines at once.
+type ReliableStore interface {
+	Put(ReliableMessage) error
+	Delete(id uint64) error
+	Pending(func(ReliableMessage)) error
+}
+
+// memoryReliableStore is the default ReliableStore.
+type memoryReliableStore struct {
+	sync.Mutex
+	messages map[uint64]ReliableMessage
+}
+
+func newMemoryReliableStore() *memoryReliableStore {
+	return &memoryReliableStore{messages: make(map[uint64]ReliableMessage)}
+}
+
+func (mrs *memoryReliableStore) Put(rm ReliableMessage) error {
+	mrs.Lock()
+	defer mrs.Unlock()
+	mrs.messages[rm.ID] = rm
+	return nil
+}
+
+func (mrs *memoryReliableStore) Delete(id uint64) error {
+	mrs.Lock()
+	defer mrs.Unlock()
+	delete(mrs.messages, id)
+	return nil
+}
+
+func (mrs *memoryReliableStore) Pending(f func(ReliableMessage)) error {
+	mrs.Lock()
+	pending := make([]ReliableMessage, 0, len(mrs.messages))
+	for _, rm := range mrs.messages {
+		pending = append(pending, rm)
+	}
+	mrs.Unlock()
+
+	for _, rm := range pending {
+		f(rm)
+	}
+	return nil
+}
+
+// reliableHolder holds the ReliableStore, which may be replaced while the
+// internal loops are running, and hands out the IDs for the messages. It
+// also keeps the IDs of the messages in the store by the node they are
+// for, so PendingReliable doesn't have to read the store.
+type reliableHolder struct {
+	store   ReliableStore
+	lastID  uint64
+	pending map[NodeID]*pendingIDs
+	sync.Mutex
+}
+
+// pendingIDs are the IDs of the reliable messages in the store for one
+// node, as a set, and in order, so the oldest is always at hand. An ID is
+// only dropped from the order once it is the oldest, so the order may
+// still hold some that are no longer in the set.
+type pendingIDs struct {
+	ids   map[uint64]voidtype
+	order []uint64
+}
+
+func (p *pendingIDs) add(id uint64) {
+	if p.ids == nil {
+		p.ids = make(map[uint64]voidtype)
+	}
+	p.ids[id] = void
+	// IDs are handed out in order, but concurrent senders may add them
+	// slightly out of it.
+	i := len(p.order)
+	for i > 0 && p.order[i-1] > id {
+		i--
+	}
+	p.order = append(p.order, 0)
+	copy(p.order[i+1:], p.order[i:])
+	p.order[i] = id
+}
+
+func (p *pendingIDs) remove(id uint64) {
+	delete(p.ids, id)
+	for len(p.order) > 0 {
+		if _, pending := p.ids[p.order[0]]; pending {
+			break
+		}
+		p.order = p.order[1:]
+	}
+}
+
+// oldest returns the lowest ID, which must be in the set.
+func (p *pendingIDs) oldest() uint64 {
+	return p.order[0]
+}
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
+func (rh *reliableHolder) get() ReliableStore {
+	rh.Lock()
+	defer rh.Unlock()
+	if rh.store == nil {
+		rh.store = newMemoryReliableStore()
+	}
+	return rh.store
+}
+
+// track records that the message with the given ID for the node is in
+// the store.
+func (rh *reliableHolder) track(node NodeID, id uint64) {
+	rh.Lock()
+	defer rh.Unlock()
+	if rh.pending == nil {
+		rh.pending = make(map[NodeID]*pendingIDs)
+	}
+	ids := rh.pending[node]
+	if ids == nil {
+		ids = &pendingIDs{}
+		rh.pending[node] = ids
+	}
+	ids.add(id)
+}
+
+// untrack records that the message is no longer in the store.
+func (rh *reliableHolder) untrack(node NodeID, id uint64) {
+	rh.Lock()
+	defer rh.Unlock()
+	if ids := rh.pending[node]; ids != nil {
+		ids.remove(id)
+	}
+}
+
+// nextID returns a new message ID, sent at the given time. They are taken
+// from the clock, so that IDs from earlier runs of the node aren't reused,
+// even if they are no longer in the store, in case an acknowledgement for
+// one is still on its way.
+func (rh *reliableHolder) nextID(now time.Time) uint64 {
+	rh.Lock()
+	defer rh.Unlock()
+	id := uint64(now.UnixNano())
+	if id <= rh.lastID {
+		id = rh.lastID + 1
+	}
+	rh.lastID = id
+	return id
+}
+
+// SetReliableStore installs the ReliableStore for SendReliable, returning
+// any error from reading the messages already pending in it. Install it
+// before starting the ConnectionService, so that those are sent again when
+// the nodes connect.
+func (cs *connectionServer) SetReliableStore(store ReliableStore) error {
+	var lastID uint64
+	pending := make(map[NodeID]*pendingIDs)
+	err := store.Pending(func(rm ReliableMessage) {
+		if rm.ID > lastID {
+			lastID = rm.ID
+		}
+		node := rm.Target.NodeID()
+		if pending[node] == nil {
+			pending[node] = &pendingIDs{ids: make(map[uint64]voidtype)}
+		}
+		pending[node].ids[rm.ID] = void
+	})
+	for _, ids := range pending {
+		for id := range ids.ids {
+			ids.order = append(ids.order, id)
+		}
+		sort.Sort(uint64s(ids.order))
+	}
+
+	cs.reliable.Lock()
+	defer cs.reliable.Unlock()
+	cs.reliable.store = store
+	cs.reliable.pending = pending
+	if lastID > cs.reliable.lastID {
+		cs.reliable.lastID = lastID
+	}
+	return err
+}
+
+// SendReliable sends a message to a mailbox on another node at least
+// once. The message is kept in the cluster's ReliableStore until the
+// target's node acknowledges it, which it does as soon as it receives it,
+// and sent again each time the connection to that node is made until then.
+// It comes after everything sent to that node before it, but resent
+// messages come ahead of whatever is waiting to be sent at the time, and
+// a message that had already been received, whose acknowledgement was
+// lost, is received again. So the receiver must be prepared to see a
+// message more than once, and out of order after a reconnection, unless
+// the receiving node's ClusterSpec.ReliableDedupWindow covers it.
+//
+// A message that arrives after its mailbox has terminated is acknowledged
+// all the same, and passed to the UnroutableHandler, as are those that
+// the receiving node refuses; see NodeDefinition.DeniedTypes. Messages to
+// local mailboxes are just sent; they have no connection to be lost on.
+//
+// Nodes running a version of reign from before this get
+// ErrReliableUnsupported, as long as they are connected; one that
+// replaces a newer one after the message is sent gets it as an ordinary
+// message.
+func (a *Address) SendReliable(m interface{}) error {
+	bra, isRemote := a.getAddress().(boundRemoteAddress)
+	if !isRemote {
+		return a.Send(m)
+	}
+	return bra.remoteMailboxes.sendReliable(bra.MailboxID, m)
+}
+
+// reliableMessage is a message sent with SendReliable, as it waits in the
+// outgoing queue.
+type reliableMessage struct {
+	id      uint64
+	message interface{}
+}
+
+func (rm *remoteMailboxes) sendReliable(target MailboxID, m interface{}) error {
+	if version := rm.peerVersion(); version != 0 && version < 7 {
+		return ErrReliableUnsupported
+	}
+	if err := checkSendable(m, rm.ClusterLogger); err != nil {
+		return &SendError{Node: rm.remoteNode, Err: err}
+	}
+
+	reliable := &rm.connectionServer.reliable
+	store := reliable.get()
+	msg := ReliableMessage{ID: reliable.nextID(rm.connectionServer.clock.Now()), Target: target, Message: m}
+	if err := store.Put(msg); err != nil {
+		return err
+	}
+	reliable.track(rm.remoteNode, msg.ID)
+	err := rm.sendOutgoing(target, reliableMessage{msg.ID, m})
+	if err != nil {
+		rm.forgetReliable(store, msg.ID)
+	}
+	return err
+}
+
+// forgetReliable deletes the message from the store, logging any error.
+func (rm *remoteMailboxes) forgetReliable(store ReliableStore, id uint64) {
+	rm.connectionServer.reliable.untrack(rm.remoteNode, id)
+	if err := store.Delete(id); err != nil {
+		rm.Errorf("Could not delete reliable message %d from the store: %s", id, myString(err))
+	}
+}
+
+// acknowledged handles the remote node's acknowledgement of a reliable
+// message.
+func (rm *remoteMailboxes) acknowledged(ack internal.ReliableAck) {
+	rm.forgetReliable(rm.connectionServer.reliable.get(), ack.ID)
+}
+
+// duplicate returns whether the reliable message with the given ID has
+// already arrived within the Cluster.ReliableDedupWindow, remembering it
+// if it hasn't. The IDs are kept in the order they arrived, so those that
+// have been remembered for the window, or that are beyond the
+// Cluster.ReliableDedupLimit, are forgotten from the front.
+func (rm *remoteMailboxes) duplicate(id uint64) bool {
+	window := rm.connectionServer.Cluster.ReliableDedupWindow
+	if window <= 0 {
+		return false
+	}
+	limit := rm.connectionServer.Cluster.ReliableDedupLimit
+	if limit <= 0 {
+		limit = DefaultReliableDedupLimit
+	}
+
+	now := rm.connectionServer.clock.Now()
+	for len(rm.received) > 0 && now.Sub(rm.received[0].at) >= window {
+		rm.forgetReceived()
+	}
+	if _, seen := rm.receivedIDs[id]; seen {
+		return true
+	}
+	for len(rm.received) >= limit {
+		rm.forgetReceived()
+	}
+	if rm.receivedIDs == nil {
+		rm.receivedIDs = make(map[uint64]voidtype)
+	}
+	rm.receivedIDs[id] = void
+	rm.received = append(rm.received, receivedReliable{id, now})
+	return false
+}
+
+// forgetReceived forgets the oldest of the reliable messages remembered.
+func (rm *remoteMailboxes) forgetReceived() {
+	delete(rm.receivedIDs, rm.received[0].id)
+	rm.received = rm.received[1:]
+}
+
+// receivedReliable is when the reliable message with the given ID
+// arrived.
+type receivedReliable struct {
+	id uint64
+	at time.Time
+}
+
+// acknowledge tells the remote node that its reliable message arrived.
+func (rm *remoteMailboxes) acknowledge(id uint64) {
+	_ = rm.send(&internal.ReliableAck{ID: id}, "reliable message acknowledgement")
+}
+
+// PendingReliable returns how many messages sent with SendReliable to
+// mailboxes on the given node are waiting to be acknowledged, including
+// any left in the ReliableStore by an earlier run of this node, and how
+// long ago the oldest of them was first sent. A count that keeps growing
+// while the link is up means the node is receiving the messages without
+// acknowledging them. It is (0, 0) for a node with none pending, or that
+// isn't in the cluster.
+func (cs *connectionServer) PendingReliable(node NodeID) (int, time.Duration) {
+	cs.reliable.Lock()
+	defer cs.reliable.Unlock()
+
+	ids := cs.reliable.pending[node]
+	if ids == nil || len(ids.ids) == 0 {
+		return 0, 0
+	}
+	// The IDs are taken from the clock when the messages are sent; see
+	// nextID.
+	return len(ids.ids), cs.clock.Now().Sub(time.Unix(0, int64(ids.oldest())))
+}
+
+// reliableByID sorts ReliableMessages into the order they were sent.
+type reliableByID []ReliableMessage
+
+func (r reliableByID) Len() int           { return len(r) }
+func (r reliableByID) Less(i, j int) bool { return r[i].ID < r[j].ID }
+func (r reliableByID) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// resendReliable sends the reliable messages for the remote node that it
+// hasn't acknowledged again, as the connection to it has just been made.
+func (rm *remoteMailboxes) resendReliable() {
+	var pending []ReliableMessage
+	err := rm.connectionServer.reliable.get().Pending(func(msg ReliableMessage) {
+		if msg.Target.NodeID() == rm.remoteNode {
+			pending = append(pending, msg)
+		}
+	})
+	if err != nil {
+		rm.Errorf("Could not read the reliable messages for node %d from the store: %s",
+			rm.remoteNode, myString(err))
+	}
+	if len(pending) == 0 {
+		return
+	}
+	if rm.peerVersion() < 7 {
+		rm.Warnf("Node %d does not support reliable messages; not sending the %d it hasn't acknowledged",
+			rm.remoteNode, len(pending))
+		return
+	}
+
+	sort.Sort(reliableByID(pending))
+	rm.Infof("Sending node %d the %d reliable messages it hasn't acknowledged", rm.remoteNode, len(pending))
+	for _, msg := range pending {
+		rm.sendMessage(internal.IncomingMailboxMessage{
+			Target:     internal.IntMailboxID(msg.Target),
+			Message:    msg.Message,
+			ReliableID: msg.ID,
+		})
+	}
+}
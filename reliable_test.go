@@ -0,0 +1,279 @@
+package reign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+func pendingReliable(cs *connectionServer) []ReliableMessage {
+	var pending []ReliableMessage
+	_ = cs.reliable.get().Pending(func(msg ReliableMessage) {
+		pending = append(pending, msg)
+	})
+	return pending
+}
+
+func waitForAcknowledged(t *testing.T, cs *connectionServer) {
+	deadline := time.Now().Add(timeout)
+	for len(pendingReliable(cs)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Reliable messages were never acknowledged:", pendingReliable(cs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendReliable(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	if err := ntb.rem1_2.SendReliable("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "hello" {
+		t.Fatal("Reliable message was not received:", msg)
+	}
+	waitForAcknowledged(t, ntb.c1)
+
+	// Local mailboxes just get the message.
+	if err := ntb.addr1_1.SendReliable("local"); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "local" {
+		t.Fatal("Local reliable message was not received:", msg)
+	}
+	if pending := pendingReliable(ntb.c1); len(pending) != 0 {
+		t.Fatal("Local reliable message was stored:", pending)
+	}
+}
+
+func TestSendReliableResend(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	next := func() internal.IncomingMailboxMessage {
+		select {
+		case cm := <-conn.sent:
+			imm, isMessage := cm.(internal.IncomingMailboxMessage)
+			if !isMessage {
+				t.Fatal("Unexpected message sent:", cm)
+			}
+			return imm
+		case <-time.After(timeout):
+			t.Fatal("Nothing was sent")
+		}
+		return internal.IncomingMailboxMessage{}
+	}
+	reconnect := func() {
+		ntb.remote1to2.unsetConnection(conn)
+		ntb.remote1to2.setConnection(conn, clusterVersion, "")
+		ntb.remote1to2.Send(connectionReady{})
+	}
+
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	if err := ntb.rem1_2.SendReliable("moo"); err != nil {
+		t.Fatal(err)
+	}
+	sent := next()
+	if sent.Message != "moo" || sent.ReliableID == 0 {
+		t.Fatal("Reliable message was not sent as one:", sent)
+	}
+
+	// Until it is acknowledged, it is sent again on each connection.
+	reconnect()
+	if resent := next(); resent.Message != "moo" || resent.ReliableID != sent.ReliableID {
+		t.Fatal("Reliable message was not resent:", resent)
+	}
+	if count, oldest := ntb.c1.PendingReliable(2); count != 1 || oldest <= 0 || oldest > timeout {
+		t.Fatal("Unacknowledged message not counted as pending:", count, oldest)
+	}
+
+	ntb.remote1to2.Send(internal.ReliableAck{ID: sent.ReliableID})
+	waitForAcknowledged(t, ntb.c1)
+	if count, oldest := ntb.c1.PendingReliable(2); count != 0 || oldest != 0 {
+		t.Fatal("Acknowledged message still counted as pending:", count, oldest)
+	}
+	reconnect()
+	ntb.rem1_2.Send("after")
+	if msg := next(); msg.Message != "after" {
+		t.Fatal("Acknowledged message was resent:", msg)
+	}
+
+	// Nodes from before reliable messages are refused them.
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, 6, "")
+	if err := ntb.rem1_2.SendReliable("moo"); err != ErrReliableUnsupported {
+		t.Fatal("Reliable message was sent to an older node:", err)
+	}
+}
+
+func TestReliableStoreRecovery(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	// This is what a durable store would have kept from a previous run
+	// that didn't hear back from node 2.
+	store := newMemoryReliableStore()
+	_ = store.Put(ReliableMessage{ID: 7, Target: ntb.rem1_2.mailboxID, Message: "second"})
+	_ = store.Put(ReliableMessage{ID: 5, Target: ntb.rem1_2.mailboxID, Message: "first"})
+	_ = store.Put(ReliableMessage{ID: 6, Target: ntb.addr1_1.mailboxID, Message: "elsewhere"})
+	if err := ntb.c1.SetReliableStore(store); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := ntb.c1.PendingReliable(2); count != 2 {
+		t.Fatal("Recovered messages not counted as pending:", count)
+	}
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.remote1to2.Send(connectionReady{})
+	for _, expected := range []ReliableMessage{{ID: 5, Message: "first"}, {ID: 7, Message: "second"}} {
+		select {
+		case cm := <-conn.sent:
+			imm := cm.(internal.IncomingMailboxMessage)
+			if imm.ReliableID != expected.ID || imm.Message != expected.Message {
+				t.Fatal("Recovered message not resent in order:", imm)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Recovered message was not resent")
+		}
+	}
+
+	if id := ntb.c1.reliable.nextID(time.Now()); id <= 7 {
+		t.Fatal("Recovered ID was handed out again:", id)
+	}
+}
+
+func TestReliableAcknowledgement(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.remote1to2.Send(internal.IncomingMailboxMessage{
+		Target:     internal.IntMailboxID(ntb.addr1_1.mailboxID),
+		Message:    "ack me",
+		ReliableID: 9,
+	})
+
+	select {
+	case cm := <-conn.sent:
+		if ack, isAck := cm.(*internal.ReliableAck); !isAck || ack.ID != 9 {
+			t.Fatal("Reliable message was not acknowledged:", cm)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Reliable message was not acknowledged")
+	}
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "ack me" {
+		t.Fatal("Reliable message was not delivered:", msg)
+	}
+}
+
+func TestReliableDedupWindow(t *testing.T) {
+	spec := testSpec()
+	spec.ReliableDedupWindow = "100ms"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	send := func(id uint64, msg string) {
+		ntb.remote1to2.Send(internal.IncomingMailboxMessage{
+			Target:     internal.IntMailboxID(ntb.addr1_1.mailboxID),
+			Message:    msg,
+			ReliableID: id,
+		})
+	}
+
+	send(9, "first")
+	send(9, "duplicate")
+	send(10, "second")
+	for _, expected := range []string{"first", "second"} {
+		if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+	for _, id := range []uint64{9, 9, 10} {
+		select {
+		case cm := <-conn.sent:
+			if ack := cm.(*internal.ReliableAck); ack.ID != id {
+				t.Fatal("Duplicate was not acknowledged:", ack.ID)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Reliable message was not acknowledged")
+		}
+	}
+
+	// Once the window has passed, it is delivered again.
+	time.Sleep(150 * time.Millisecond)
+	send(9, "late")
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "late" {
+		t.Fatal("Message outside the window was discarded:", msg)
+	}
+}
+
+func TestReliableDedupLimit(t *testing.T) {
+	spec := testSpec()
+	spec.ReliableDedupWindow = "1h"
+	spec.ReliableDedupLimit = 2
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+	go ntb.remote1to2.Serve()
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	send := func(id uint64, msg string) {
+		ntb.remote1to2.Send(internal.IncomingMailboxMessage{
+			Target:     internal.IntMailboxID(ntb.addr1_1.mailboxID),
+			Message:    msg,
+			ReliableID: id,
+		})
+	}
+
+	// Only the two most recent are remembered.
+	send(1, "one")
+	send(2, "two")
+	send(3, "three")
+	send(2, "duplicate")
+	send(1, "forgotten")
+	for _, expected := range []string{"one", "two", "three", "forgotten"} {
+		if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+	if n := len(ntb.remote1to2.receivedIDs); n != 2 {
+		t.Fatal("Remembered more than the limit:", n)
+	}
+}
+
+func TestPendingIDs(t *testing.T) {
+	var p pendingIDs
+	for _, id := range []uint64{3, 5, 4, 6} {
+		p.add(id)
+	}
+	if p.oldest() != 3 {
+		t.Fatal("Wrong oldest:", p.oldest())
+	}
+
+	// Acknowledging a later one leaves the oldest alone, until it goes too.
+	p.remove(4)
+	if p.oldest() != 3 {
+		t.Fatal("Wrong oldest:", p.oldest())
+	}
+	p.remove(3)
+	if p.oldest() != 5 || len(p.order) != 2 {
+		t.Fatal("Oldest not advanced past what was acknowledged:", p.order)
+	}
+	p.remove(6)
+	p.remove(5)
+	if len(p.ids) != 0 || len(p.order) != 0 {
+		t.Fatal("IDs left over:", p.ids, p.order)
+	}
+}
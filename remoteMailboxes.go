@@ -1,9 +1,17 @@
 package reign
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/thejerf/reign/internal"
 )
@@ -13,6 +21,11 @@ type messageSender interface {
 	terminate()
 }
 
+// tlsConnection is implemented by the messageSenders that run over TLS.
+type tlsConnection interface {
+	tlsState() (tls.ConnectionState, bool)
+}
+
 // remoteMailboxes, which may need a better name, connects the local
 // mailboxes with the remote connection. Once a node has connected to a
 // remote node, either as the server or a client, the connection becomes
@@ -21,7 +34,14 @@ type messageSender interface {
 // A given instance is responsible only for maintaining communication with
 // a particular node.
 type remoteMailboxes struct {
+	// lastActive is when a message other than a ping was last written to
+	// or read from the connection, in UnixNanos, for LinkIdleTimeout. It
+	// comes first to be aligned for atomic access.
+	lastActive int64
+
 	NodeID
+	// the node on the other end of the link
+	remoteNode NodeID
 	*Address
 	parent          *mailboxes
 	outgoingMailbox *Mailbox
@@ -35,7 +55,11 @@ type remoteMailboxes struct {
 	// all the mailboxes are nicely sorted out for just that node,
 	// then it's the remote mailbox in question, then it's the set of
 	// local mailboxes that are subscribed to that remote mailbox.
+	//
+	// Only Serve modifies this, under linksL, so Serve itself can read it
+	// without locking.
 	linksToRemote map[MailboxID]map[MailboxID]voidtype
+	linksL        sync.Mutex
 
 	// a debugging function that allows us to examine the messages flowing
 	// through
@@ -47,10 +71,113 @@ type remoteMailboxes struct {
 	sync.Mutex
 	condition  *sync.Cond
 	connection messageSender
+	// ready is set once the connection's handshake is done, and it can be
+	// used for messages; see openConnection. earlyRejected is the last
+	// connection a message was refused for, as it wasn't ready yet.
+	ready         bool
+	earlyRejected messageSender
+	// the protocol version negotiated with the remote node, and the
+	// Instance it sent, by the most recent connection
+	version  uint16
+	instance string
+	// the Metadata the remote node sent when it last connected
+	metadata map[string]string
+	// the round trip time of the last ping answered over the current
+	// connection, zero until one has been
+	latency time.Duration
+	// encodes and writes the messages for the connection, if the cluster
+	// has EncodeWorkers and the remote node understands them
+	encoder *encodePool
+
+	// outgoing counts the messages for remote mailboxes that are waiting
+	// in the outgoingMailbox, to enforce Cluster.OutgoingQueueLimit. This
+	// has its own lock, as senders may wait on it.
+	outgoingL    sync.Mutex
+	outgoingCond *sync.Cond
+	outgoing     int
+
+	// backlogSince is when outgoing last reached OutgoingBacklogWarnDepth,
+	// or zero if it is below that; backlogTimer fires the warnings while
+	// it stays there. Both are covered by outgoingL.
+	backlogSince time.Time
+	backlogTimer clockTimer
+
+	// disconnectedSince is when the connection was lost, or the
+	// remoteMailboxes created if there hasn't been one yet. It is zero
+	// while connected, and covered by the main lock.
+	disconnectedSince time.Time
+
+	// dormant is set while the link is closed for being idle, since
+	// dormantSince, and idled is the connection that was closed; see
+	// ClusterSpec.LinkIdleTimeout. checkIn is set when the connection was
+	// made only to check in with the node, and reported is what the
+	// connection status callbacks were last told. parked holds what Serve
+	// was in the middle of sending when the link went dormant, or a new
+	// connection started its handshake; see linkWaiting. These are
+	// covered by the main lock; idleTimer and linkWoken, which is set once
+	// Serve has had a dormant link made again, are only used by Serve.
+	dormant      bool
+	dormantSince time.Time
+	idled        messageSender
+	checkIn      bool
+	reported     bool
+	parked       []parkedSend
+	idleTimer    clockTimer
+	linkWoken    bool
+
+	// the streams being sent to the remote node are numbered with this,
+	// and tracked in sendingStreams, under the main lock. The ones being
+	// received from it are reassembled in streams, which only Serve uses.
+	lastStream     uint64
+	sendingStreams map[uint64]*outgoingStream
+	streams        map[uint64]*partialStream
+
+	// incomingLimit enforces Cluster.IncomingRateLimit, if set. It and
+	// the drop counts are only used by whatever is reading the connection.
+	incomingLimit   *rateLimiter
+	incomingDropped int
+	lastDropWarning time.Time
+
+	// deniedTypes are the names of the types of message that may not
+	// cross this link; see NodeDefinition.DeniedTypes.
+	deniedTypes map[string]voidtype
+
+	// linkEpoch counts the times the connection has gone down or become
+	// ready, so a LinkGracePeriod timer can tell whether the outage it was
+	// started for is still going on. Only Serve uses these.
+	linkEpoch  uint64
+	graceTimer clockTimer
+
+	// The remote mailboxes whose first link is waiting to be registered
+	// with the remote node, and the timer for sending them, when
+	// NotifyBatchWindow is set. Only Serve uses these.
+	pendingNotifies map[MailboxID]voidtype
+	notifyTimer     clockTimer
+
+	// The registrations sent for NotifyAddressOnTerminateConfirmed that
+	// are waiting to be confirmed, by their ConfirmID, and the last ID
+	// used. Only Serve uses these.
+	confirming  map[uint64]chan error
+	lastConfirm uint64
 
-	// a debugging function that allows us to see that a connection has
-	// been re-established.
-	connectionEstablished func()
+	// The IDs of the reliable messages received within the
+	// Cluster.ReliableDedupWindow, in the order they arrived, and as a
+	// set. Only Serve uses these.
+	received    []receivedReliable
+	receivedIDs map[uint64]voidtype
+
+	// The messages sent with SendWithRetries that are waiting for the
+	// connection to be made again. Only Serve uses this.
+	held []heldMessage
+}
+
+// flushNotifies tells Serve that the NotifyBatchWindow is up.
+type flushNotifies struct{}
+
+// cancelNotifications tells Serve to remove all the links the given local
+// mailbox has to remote mailboxes; see Address.CancelAllNotifications.
+type cancelNotifications struct {
+	local MailboxID
 }
 
 type newExamineMessages struct {
@@ -60,18 +187,31 @@ type newDoneProcessing struct {
 	f func(interface{}) bool
 }
 
-func newRemoteMailboxes(connectionServer *connectionServer, mailboxes *mailboxes, logger ClusterLogger, source NodeID) *remoteMailboxes {
+func newRemoteMailboxes(connectionServer *connectionServer, mailboxes *mailboxes, logger ClusterLogger, source NodeID, dest NodeID) *remoteMailboxes {
 	addr, mailbox := mailboxes.newLocalMailbox()
+	mailbox.serving = true
+	// The reasons are passed on to the other node.
+	mailbox.reasons = true
 	rm := &remoteMailboxes{
 		Address:          addr,
 		outgoingMailbox:  mailbox,
 		ClusterLogger:    logger,
 		parent:           mailboxes,
 		NodeID:           source,
+		remoteNode:       dest,
 		connectionServer: connectionServer,
+		sendingStreams:   make(map[uint64]*outgoingStream),
+		streams:          make(map[uint64]*partialStream),
+		pendingNotifies:  make(map[MailboxID]voidtype),
+		confirming:       make(map[uint64]chan error),
+		incomingLimit: newRateLimiter(connectionServer.IncomingRateLimit,
+			connectionServer.IncomingRateBurst, connectionServer.clock),
+		disconnectedSince: connectionServer.clock.Now(),
+		deniedTypes:       deniedTypeSet(connectionServer.Nodes[dest]),
 		// linksToRemote maps the remote MailboxID to all locally linked MailboxIDs
 		linksToRemote: make(map[MailboxID]map[MailboxID]voidtype)}
 	rm.condition = sync.NewCond(&rm.Mutex)
+	rm.outgoingCond = sync.NewCond(&rm.outgoingL)
 	return rm
 }
 
@@ -80,76 +220,1082 @@ func (rm *remoteMailboxes) waitForConnection() {
 	rm.Lock()
 	defer rm.Unlock()
 
-	for rm.connection == nil {
+	for !rm.usable() {
 		rm.condition.Wait()
 	}
 }
 
-func (rm *remoteMailboxes) setConnection(ms messageSender) {
+// waitForConnectionTimeout waits up to the given duration for the
+// remoteMailboxes to have a connection, returning whether they do.
+func (rm *remoteMailboxes) waitForConnectionTimeout(d time.Duration) bool {
 	rm.Lock()
 	defer rm.Unlock()
 
-	rm.connection = ms
+	if rm.usable() || d <= 0 {
+		return rm.usable()
+	}
+
+	expired := false
+	timer := time.AfterFunc(d, func() {
+		rm.Lock()
+		expired = true
+		rm.condition.Broadcast()
+		rm.Unlock()
+	})
+	defer timer.Stop()
+
+	for !rm.usable() && !expired {
+		rm.condition.Wait()
+	}
+	return rm.usable()
+}
+
+// usable returns whether there is a connection that has finished its
+// handshake. rm must be locked.
+func (rm *remoteMailboxes) usable() bool {
+	return rm.connection != nil && rm.ready
+}
 
-	if rm.connectionEstablished != nil {
-		rm.connectionEstablished()
+// setConnection makes ms the connection to the remote node, which sent
+// the given Instance in its handshake, ready to be used.
+func (rm *remoteMailboxes) setConnection(ms messageSender, version uint16, instance string) error {
+	if err := rm.openConnection(ms, version, instance, nil); err != nil {
+		return err
 	}
+	rm.markReady(ms)
+	return nil
+}
+
+// openConnection makes ms the connection to the remote node, which sent
+// the given Instance and Metadata in its handshake, while the rest of the
+// handshake is still going on over it. Until markReady is called, nothing
+// else may be written to it, so messages to send wait or are refused
+// according to the Cluster's EarlyMessagePolicy.
+//
+// If a different connection is already established, ms replaces it if it
+// is from a different Instance, as the node must have restarted before
+// this one noticed the old connection go. From the same Instance, or one
+// that sent none, it is refused, since two live connections claiming the
+// same NodeID means two peers share it.
+func (rm *remoteMailboxes) openConnection(ms messageSender, version uint16, instance string, metadata map[string]string) error {
+	rm.Lock()
+	var replaced messageSender
+	if rm.connection != nil && rm.connection != ms {
+		if instance == "" || instance == rm.instance {
+			rm.Unlock()
+			return fmt.Errorf("node %d is already connected; refusing a second connection claiming the same node ID", rm.remoteNode)
+		}
+		replaced = rm.connection
+		rm.stopEncoder()
+	}
+	previous := rm.instance
+	if rm.encoder == nil && version >= 6 {
+		if workers := rm.connectionServer.Cluster.EncodeWorkers; workers > 0 {
+			rm.encoder = newEncodePool(rm, ms, workers, version >= 13)
+		}
+	}
+	rm.connection = ms
+	rm.ready = false
+	rm.version = version
+	rm.instance = instance
+	rm.metadata = metadata
+	rm.latency = 0
+	rm.disconnectedSince = time.Time{}
+	rm.dormant = false
 	rm.condition.Broadcast()
+	rm.Unlock()
+	rm.active()
+
+	if replaced != nil {
+		rm.Warnf("Node %d has restarted as instance %q; dropping the connection to its old instance %q",
+			rm.remoteNode, instance, previous)
+		replaced.terminate()
+		// The old connection's loop won't unset it, now it's been
+		// replaced, so this does what that would.
+		rm.Send(connectionLost{})
+		rm.connectionServer.linkEvent(rm.remoteNode, LinkDisconnected)
+	}
+
+	switch {
+	case previous == "":
+		rm.Infof("Connected to node %d, instance %q", rm.remoteNode, instance)
+	case previous != instance:
+		rm.Infof("Reconnected to node %d, which is a new instance %q (was %q)", rm.remoteNode, instance, previous)
+	default:
+		rm.Infof("Reconnected to node %d, the same instance %q", rm.remoteNode, instance)
+	}
+
+	if rm.incomingLimit != nil {
+		if metrics := rm.connectionServer.metrics.get(); metrics != nil {
+			metrics.SetGauge(MetricIncomingRateLimit, map[string]string{
+				"node": strconv.Itoa(int(rm.remoteNode)),
+			}, rm.incomingLimit.rate)
+		}
+	}
+	rm.connectionServer.linkEvent(rm.remoteNode, LinkConnected)
+	return nil
 }
 
-func (rm *remoteMailboxes) unsetConnection(ms messageSender) {
+// markReady lets messages be written to ms, which has finished its
+// handshake, if it is still the connection.
+func (rm *remoteMailboxes) markReady(ms messageSender) {
 	rm.Lock()
-	defer rm.Unlock()
+	marked := rm.connection == ms && !rm.ready
+	if marked {
+		rm.ready = true
+		rm.condition.Broadcast()
+	}
+	rm.Unlock()
+
+	if marked {
+		rm.Send(handshakeDone{})
+	}
+}
 
-	if rm.connection == ms {
+// drained returns whether everything queued for the remote node has been
+// written to the connection, or can't be, as there is no connection.
+func (rm *remoteMailboxes) drained() bool {
+	rm.Lock()
+	connected, encoder := rm.connection != nil, rm.encoder
+	rm.Unlock()
+	if !connected {
+		return true
+	}
+	return rm.outgoingMailbox.idle() && (encoder == nil || encoder.idle())
+}
+
+// flushed returns whether everything queued for the remote node has been
+// written to the connection, or ErrNoConnection if it can't be, as the
+// link is down; see connectionServer.Flush.
+func (rm *remoteMailboxes) flushed() (bool, error) {
+	rm.Lock()
+	connected, dormant, encoder := rm.connection != nil, rm.dormant, rm.encoder
+	parked := len(rm.parked)
+	rm.Unlock()
+	if !connected && !dormant {
+		return false, ErrNoConnection
+	}
+	return parked == 0 && rm.outgoingMailbox.idle() && (encoder == nil || encoder.idle()), nil
+}
+
+// stopEncoder stops the connection's encodePool, if it has one. rm must
+// be locked.
+func (rm *remoteMailboxes) stopEncoder() {
+	if rm.encoder != nil {
+		rm.encoder.shutdown()
+		rm.encoder = nil
+		rm.parent.changed()
+	}
+}
+
+func (rm *remoteMailboxes) unsetConnection(ms messageSender) {
+	rm.Lock()
+	unset := rm.connection == ms
+	if unset {
 		rm.connection = nil
+		rm.ready = false
+		rm.disconnectedSince = rm.connectionServer.clock.Now()
+		rm.stopEncoder()
+		// Wake up anything waiting for the handshake to finish, or for
+		// the queue to be flushed.
+		rm.condition.Broadcast()
+		rm.parent.changed()
 	}
+	rm.Unlock()
+
+	if unset {
+		// Let Serve know, so it can abort any partially received streams.
+		rm.Send(connectionLost{})
+		rm.connectionServer.linkEvent(rm.remoteNode, LinkDisconnected)
+	}
+}
+
+// LinkGracePeriod, if positive, is how long the connection to a node may
+// be down before the links to mailboxes on that node are given up. Every
+// local mailbox that asked to be notified of the termination of one of
+// them receives a MailboxTerminated, or a TerminatedWithReason with
+// TerminatedNodeDown, just as if the node had shut down, so a long
+// partition can be treated as the remote node dying. If the connection
+// comes back first, the links are re-registered with the remote node.
+// The default of zero holds the links for as long as the node is down.
+var LinkGracePeriod time.Duration
+
+// NotifyBatchWindow, if positive, is how long the first link to a remote
+// mailbox waits to be registered with its node, so that all the first
+// links made to that node within the window are registered in a single
+// message. This cuts down on the traffic when many local mailboxes
+// start watching many remote ones at once, at the cost of delaying each
+// registration by up to the window; a remote mailbox that terminates in
+// the meantime is not noticed until the registration is made. The
+// default of zero registers each link as it is made.
+var NotifyBatchWindow time.Duration
+
+// OutgoingBacklogWarnDepth and OutgoingBacklogWarnPeriod control the
+// warning logged when messages pile up unsent to a node. Once the queue of
+// messages for a node has held at least OutgoingBacklogWarnDepth of them
+// for OutgoingBacklogWarnPeriod, a warning with the depth and how long the
+// link has been down is logged, and again every OutgoingBacklogWarnPeriod
+// until the queue drains below the depth. A zero for either disables the
+// warning. Default to 1000 messages and 30 seconds.
+var (
+	OutgoingBacklogWarnDepth  = 1000
+	OutgoingBacklogWarnPeriod = time.Second * 30
+)
+
+type connectionLost struct{}
+
+// connectionReady tells Serve that a new connection has completed its
+// handshakes and may be used to restore the links.
+type connectionReady struct{}
+
+// handshakeDone tells Serve that the connection it has been holding the
+// messages for while its handshake went on is ready for them; see
+// linkWaiting. A real connection follows it with a connectionReady.
+type handshakeDone struct{}
+
+type linkGraceExpired struct {
+	epoch uint64
 }
 
 type terminateRemoteMailbox struct{}
 
+func isMailboxTerminated(msg interface{}) bool {
+	switch msg.(type) {
+	case MailboxTerminated, TerminatedWithReason:
+		return true
+	}
+	return false
+}
+
+// terminationOf returns the termination notice as a TerminatedWithReason.
+func terminationOf(msg interface{}) TerminatedWithReason {
+	if mt, isPlain := msg.(MailboxTerminated); isPlain {
+		return TerminatedWithReason{ID: MailboxID(mt)}
+	}
+	return msg.(TerminatedWithReason)
+}
+
 func (rm *remoteMailboxes) Stop() {
 	rm.Send(terminateRemoteMailbox{})
 }
 
-var errNoConnection = errors.New("no connection")
+// ErrNoConnection is returned by SendWithConnectionWait when there is no
+// connection to the remote node.
+var ErrNoConnection = errors.New("no connection")
+
+// A SendError is what went wrong writing a message to a remote node.
+//
+// Retryable errors are failures of the network connection itself. The
+// connection is dropped so that it will be re-established, but the
+// message that failed is lost. Errors that are not retryable, such as a
+// message that can not be encoded because its type was never passed to
+// RegisterType, would fail the same way no matter how many times it was
+// sent, so the message is dropped and the connection is left alone.
+type SendError struct {
+	Node      NodeID
+	Retryable bool
+	Err       error
+}
+
+func (se *SendError) Error() string {
+	kind := "fatal"
+	if se.Retryable {
+		kind = "retryable"
+	}
+	return fmt.Sprintf("%s error sending to node %d: %s", kind, se.Node, myString(se.Err))
+}
+
+// IsRetryable returns whether the given error is a SendError for a failure
+// of the connection, as opposed to a problem with the message itself.
+func IsRetryable(err error) bool {
+	se, isSendError := err.(*SendError)
+	return isSendError && se.Retryable
+}
+
+// isNetworkError returns whether the error came from the underlying
+// connection. The encoder only returns errors of its own for things
+// wrong with the value it was given, and it checks those before anything
+// is written, so they leave the stream intact.
+func isNetworkError(err error) bool {
+	if _, isNetErr := err.(net.Error); isNetErr {
+		return true
+	}
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe, io.ErrShortWrite:
+		return true
+	}
+	return false
+}
 
+// send sends the message to the remote node, returning once it has been
+// written to the connection, or failed to be.
 func (rm *remoteMailboxes) send(cm internal.ClusterMessage, desc string) error {
-	rm.Lock()
-	defer rm.Unlock()
+	return rm.sendWaiting(cm, desc, true)
+}
+
+// sendMessage is send for the messages to remote mailboxes, whose errors
+// are only logged, and counted in the DropStats. With EncodeWorkers, it
+// doesn't wait for the message to be encoded and written.
+func (rm *remoteMailboxes) sendMessage(imm internal.IncomingMailboxMessage) {
+	if err := rm.sendWaiting(imm, "normal message", false); err != nil {
+		rm.unsent(imm, err)
+	}
+}
 
+func (rm *remoteMailboxes) sendWaiting(cm internal.ClusterMessage, desc string, wait bool) error {
+	rm.Lock()
+	if rm.holdingForLink() {
+		// The link went dormant, or a new connection started its
+		// handshake, as Serve was taking this message.
+		rm.parked = append(rm.parked, parkedSend{cm, desc})
+		rm.Unlock()
+		return nil
+	}
 	if rm.connection == nil {
+		rm.Unlock()
 		if rm.ClusterLogger != nil {
 			rm.Errorf("Could send message \"%s\" because there's no connection", desc)
 		}
-		return errNoConnection
+		return ErrNoConnection
 	}
+	if !rm.ready {
+		// Only say so once for each connection, rather than for every
+		// message.
+		first := rm.earlyRejected != rm.connection
+		rm.earlyRejected = rm.connection
+		rm.Unlock()
+		if first && rm.ClusterLogger != nil {
+			rm.Warnf("The connection to node %d is still being set up; messages for it are treated as having no connection until it is", rm.remoteNode)
+		}
+		return ErrNoConnection
+	}
+	if encoder := rm.encoder; encoder != nil {
+		rm.Unlock()
+		return encoder.send(cm, desc, wait)
+	}
+	defer rm.Unlock()
+
+	return rm.write(rm.connection, cm, cm, desc)
+}
+
+// write writes wire, which is cm in the form it goes over the wire in, to
+// the connection.
+func (rm *remoteMailboxes) write(conn messageSender, wire, cm internal.ClusterMessage, desc string) error {
+	wire, err := encodeCompressed(wire)
+	if err != nil {
+		return rm.sendFailed(conn, cm, desc, err)
+	}
+	err = conn.send(&wire)
+	if err == nil {
+		rm.active()
+		rm.countMessage(MetricMessagesSent, cm)
+		return nil
+	}
+	return rm.sendFailed(conn, cm, desc, err)
+}
+
+// sendFailed handles an error sending cm on conn, dropping the connection
+// if it can't be written to any more.
+func (rm *remoteMailboxes) sendFailed(conn messageSender, cm internal.ClusterMessage, desc string, err error) error {
+	sendErr := &SendError{
+		Node:      rm.remoteNode,
+		Retryable: isNetworkError(err),
+		Err:       err,
+	}
+	if sendErr.Retryable {
+		rm.Errorf("Error sending msg \"%s\", dropping the connection: %s", desc, myString(err))
+		conn.terminate()
+	} else {
+		rm.Errorf("Could not send msg \"%s\", dropping it: %s", desc, myString(err))
+	}
+	rm.Tracef("Message payload: %#v", cm)
+	return sendErr
+}
+
+// A relayedMessage is a message that arrived for a mailbox on another
+// node, as it waits in the outgoing queue to that node.
+type relayedMessage struct {
+	hops    uint8
+	message interface{}
+}
+
+// relay passes on a message from the remote node for a mailbox on some
+// other node, counting the hop, unless it has been relayed too many times
+// already, or this node doesn't relay; see ClusterSpec.MaxHops and
+// ClusterSpec.MisroutedPolicy.
+func (rm *remoteMailboxes) relay(msg internal.IncomingMailboxMessage) {
+	target := MailboxID(msg.Target)
+	if rm.connectionServer.Cluster.MisroutedPolicy == MisroutedDrop {
+		rm.Warnf("Node %d sent a message for mailbox %x, on node %d; dropping it rather than relaying it",
+			rm.remoteNode, target, target.NodeID())
+		rm.connectionServer.handleUnroutable(DropMisrouted, rm.remoteNode, target, msg.Message)
+		return
+	}
+
+	maxHops := rm.connectionServer.Cluster.MaxHops
+	if maxHops == 0 {
+		maxHops = DefaultMaxHops
+	}
+
+	next, exists := rm.connectionServer.remoteMailboxes[target.NodeID()]
+	if !exists {
+		rm.Warnf("Node %d sent a message for mailbox %x, on node %d, which is not in the cluster",
+			rm.remoteNode, target, target.NodeID())
+		rm.connectionServer.handleUnroutable(DropMisrouted, rm.remoteNode, target, msg.Message)
+		return
+	}
+	if int(msg.Hops) >= maxHops {
+		rm.Warnf("LoopDetected: node %d sent a message for mailbox %x that has already been relayed %d times; dropping it",
+			rm.remoteNode, target, msg.Hops)
+		rm.connectionServer.handleUnroutable(DropLoopDetected, rm.remoteNode, target, msg.Message)
+		return
+	}
+
+	var message interface{} = msg.Message
+	if !msg.Deadline.IsZero() {
+		message = expiringMessage{rm.localDeadline(msg), message}
+	}
+	next.sendOutgoing(target, relayedMessage{msg.Hops + 1, message})
+}
+
+// localDeadline returns when a message from the remote node with a
+// deadline expires by this node's clock: when its TTL runs out if the
+// node sent one, or otherwise its Deadline, allowing for
+// Cluster.MaxClockSkew.
+func (rm *remoteMailboxes) localDeadline(msg internal.IncomingMailboxMessage) time.Time {
+	if msg.TTL > 0 {
+		return rm.connectionServer.clock.Now().Add(msg.TTL)
+	}
+	return msg.Deadline.Add(rm.connectionServer.Cluster.MaxClockSkew)
+}
+
+// receive passes a message that has just been read from the connection on
+// to Serve, subject to the incoming rate limit.
+func (rm *remoteMailboxes) receive(cm internal.ClusterMessage) error {
+	rm.active()
+	rm.countMessage(MetricMessagesReceived, cm)
+	if !rm.admitIncoming(cm) {
+		return nil
+	}
+	return rm.Send(cm)
+}
+
+// countMessage counts the message in the given metric, if metrics are
+// being collected; see MetricMessagesSent.
+func (rm *remoteMailboxes) countMessage(name string, cm internal.ClusterMessage) {
+	metrics := rm.connectionServer.metrics.get()
+	if metrics == nil {
+		return
+	}
+	metrics.AddCounter(name, map[string]string{
+		"node": strconv.Itoa(int(rm.remoteNode)),
+		"type": messageType(cm),
+	}, 1)
+}
+
+// messageType names the type of a message crossing the link for
+// MetricMessagesSent and MetricMessagesReceived. What is sent is
+// normalized first, so both directions agree.
+func messageType(cm internal.ClusterMessage) string {
+	cm = internal.Normalize(cm)
+	if imm, isIncoming := cm.(internal.IncomingMailboxMessage); isIncoming {
+		if imm.Message == nil {
+			return "nil"
+		}
+		return reflect.TypeOf(imm.Message).String()
+	}
+	return reflect.TypeOf(cm).String()
+}
+
+// peerInstance returns the Instance the remote node sent when it last
+// connected.
+func (rm *remoteMailboxes) peerInstance() string {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.instance
+}
+
+// tlsState returns the state of the TLS connection to the remote node,
+// if it is connected over TLS.
+func (rm *remoteMailboxes) tlsState() (tls.ConnectionState, bool) {
+	rm.Lock()
+	connection := rm.connection
+	rm.Unlock()
+
+	if tc, isTLS := connection.(tlsConnection); isTLS {
+		return tc.tlsState()
+	}
+	return tls.ConnectionState{}, false
+}
 
-	err := rm.connection.send(&cm)
+// recordLatency records the round trip time of a ping to the remote node.
+func (rm *remoteMailboxes) recordLatency(rtt time.Duration) {
+	rm.Lock()
+	defer rm.Unlock()
+	rm.latency = rtt
+}
+
+// peerLatency returns the round trip time to the remote node, if it is
+// connected and a ping has been answered since it connected.
+func (rm *remoteMailboxes) peerLatency() (time.Duration, bool) {
+	rm.Lock()
+	defer rm.Unlock()
+	if rm.connection == nil || rm.latency == 0 {
+		return 0, false
+	}
+	return rm.latency, true
+}
+
+// peerVersion returns the protocol version negotiated with the remote
+// node by the current connection.
+func (rm *remoteMailboxes) peerVersion() uint16 {
+	rm.Lock()
+	defer rm.Unlock()
+	return rm.version
+}
+
+func isOutgoingMessage(msg interface{}) bool {
+	_, is := msg.(internal.OutgoingMailboxMessage)
+	return is
+}
+
+// staleOutgoing returns whether msg is an outgoing message that has
+// waited longer than maxAge. Stream chunks never are, as losing one would
+// lose the whole stream, and nor are reliable messages, which would only
+// be sent again.
+func staleOutgoing(msg interface{}, now time.Time, maxAge time.Duration) bool {
+	omm, is := msg.(internal.OutgoingMailboxMessage)
+	if !is || maxAge <= 0 {
+		return false
+	}
+	switch omm.Message.(type) {
+	case *internal.StreamChunk, reliableMessage:
+		return false
+	}
+	return now.Sub(omm.Queued) > maxAge
+}
+
+// sendOutgoing queues a message for the given remote mailbox, applying
+// the cluster's OutgoingQueueLimit and FailFastSends.
+func (rm *remoteMailboxes) sendOutgoing(target MailboxID, message interface{}) error {
+	return rm.queueOutgoing(target, message, rm.connectionServer.Cluster.OutgoingQueuePolicy)
+}
+
+// queueOutgoing is sendOutgoing with the given OverflowPolicy.
+func (rm *remoteMailboxes) queueOutgoing(target MailboxID, message interface{}, policy OverflowPolicy) error {
+	if err := checkSendable(message, rm.ClusterLogger); err != nil {
+		return &SendError{Node: rm.remoteNode, Err: err}
+	}
+	if err := rm.denySend(message, "message"); err != nil {
+		return err
+	}
+	if err := rm.failFast(message); err != nil {
+		return err
+	}
+
+	limit := rm.connectionServer.Cluster.OutgoingQueueLimit
+	dropped := uint64(0)
+	// what was dropped, to give up on once the lock is released
+	var discarded []interface{}
+	var oldest internal.OutgoingMailboxMessage
+	isOldest := func(msg interface{}) bool {
+		omm, is := msg.(internal.OutgoingMailboxMessage)
+		oldest = omm
+		return is
+	}
+	now := rm.connectionServer.clock.Now()
+
+	rm.outgoingL.Lock()
+	evicted := rm.evictStale(now)
+	// Once the mailbox is terminated, the Send below fails, so there's no
+	// point waiting for room.
+	for limit > 0 && rm.outgoing >= limit && !rm.outgoingMailbox.isTerminated() {
+		if policy == OverflowError {
+			rm.outgoingL.Unlock()
+			rm.evicted(evicted)
+			return ErrMailboxFull
+		}
+		// If there's nothing to drop, Serve has just taken the oldest
+		// message, and will shortly make room.
+		if policy == OverflowDropOldest &&
+			rm.outgoingMailbox.removeFirstIf(isOldest) {
+			rm.outgoing--
+			dropped++
+			discarded = append(discarded, oldest.Message)
+			continue
+		}
+		// Messages that have waited too long make room, too, while this
+		// waits for Serve to.
+		now = rm.connectionServer.clock.Now()
+		if stale := rm.evictStale(now); len(stale) > 0 {
+			evicted = append(evicted, stale...)
+			continue
+		}
+		rm.waitForRoom(now)
+	}
+	rm.outgoing++
+	depth := rm.outgoing
+	rm.watchBacklog()
+	rm.outgoingL.Unlock()
+	rm.evicted(evicted)
+	for _, msg := range discarded {
+		gaveUp(msg)
+	}
+
+	err := rm.Send(
+		internal.OutgoingMailboxMessage{
+			Target:  internal.IntMailboxID(target),
+			Message: message,
+			Queued:  now,
+		},
+	)
 	if err != nil {
-		rm.Errorf("Error sending msg \"%s\": %s", desc, myString(err))
-		rm.Tracef("Message payload: %#v", cm)
+		depth = rm.outgoingDone()
+	}
+
+	if dropped > 0 {
+		rm.connectionServer.dropped(DropQueueFull, rm.remoteNode, dropped)
+	}
+	if metrics := rm.connectionServer.metrics.get(); metrics != nil {
+		labels := map[string]string{"node": strconv.Itoa(int(rm.remoteNode))}
+		if dropped > 0 {
+			metrics.AddCounter(MetricOutgoingDropped, labels, dropped)
+		}
+		metrics.SetGauge(MetricOutgoingQueueDepth, labels, float64(depth))
 	}
+
 	return err
 }
 
+// wakeSenders wakes up anything waiting for room in the outgoing queue,
+// so it can notice the queue has been terminated.
+func (rm *remoteMailboxes) wakeSenders() {
+	rm.outgoingL.Lock()
+	defer rm.outgoingL.Unlock()
+	rm.outgoingCond.Broadcast()
+}
+
+// outgoingDone records that a message counted by sendOutgoing has left
+// the queue, returning the new depth.
+func (rm *remoteMailboxes) outgoingDone() int {
+	rm.outgoingL.Lock()
+	defer rm.outgoingL.Unlock()
+
+	rm.dequeued()
+	return rm.outgoing
+}
+
+// dequeued records that a counted message has left the outgoing queue.
+// outgoingL must be held.
+func (rm *remoteMailboxes) dequeued() {
+	rm.outgoing--
+	rm.outgoingCond.Broadcast()
+	if !rm.backlogSince.IsZero() && rm.outgoing < OutgoingBacklogWarnDepth {
+		rm.stopBacklog()
+	}
+}
+
+// evictStale takes the messages at the head of the outgoing queue that
+// are older than the cluster's OutgoingQueueMaxAge out of it, returning
+// them for evicted. outgoingL must be held.
+func (rm *remoteMailboxes) evictStale(now time.Time) (stale []internal.OutgoingMailboxMessage) {
+	maxAge := rm.connectionServer.Cluster.OutgoingQueueMaxAge
+	if maxAge <= 0 {
+		return nil
+	}
+	isStale := func(msg interface{}) bool {
+		return staleOutgoing(msg, now, maxAge)
+	}
+	for {
+		msg, ok := rm.outgoingMailbox.receiveNextIf(isStale)
+		if !ok {
+			return stale
+		}
+		rm.dequeued()
+		stale = append(stale, msg.(internal.OutgoingMailboxMessage))
+	}
+}
+
+// waitForRoom waits for a message to leave the full outgoing queue, or
+// for the one at its head to reach the OutgoingQueueMaxAge, so it can be
+// evicted. outgoingL must be held.
+func (rm *remoteMailboxes) waitForRoom(now time.Time) {
+	maxAge := rm.connectionServer.Cluster.OutgoingQueueMaxAge
+	// the head, if it is a message that can go stale at all, which any
+	// such message already queued will have by a maxAge from now
+	var head internal.OutgoingMailboxMessage
+	headAges := func(msg interface{}) bool {
+		if staleOutgoing(msg, now.Add(maxAge), maxAge) {
+			head = msg.(internal.OutgoingMailboxMessage)
+		}
+		return false
+	}
+	rm.outgoingMailbox.receiveNextIf(headAges)
+	if head.Queued.IsZero() {
+		rm.outgoingCond.Wait()
+		return
+	}
+
+	timer := rm.connectionServer.clock.AfterFunc(head.Queued.Add(maxAge).Sub(now), func() {
+		rm.outgoingL.Lock()
+		defer rm.outgoingL.Unlock()
+		rm.outgoingCond.Broadcast()
+	})
+	rm.outgoingCond.Wait()
+	timer.Stop()
+}
+
+// evicted counts the messages evicted for being older than the
+// OutgoingQueueMaxAge, and gives them to the UnroutableHandler.
+func (rm *remoteMailboxes) evicted(msgs []internal.OutgoingMailboxMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	if metrics := rm.connectionServer.metrics.get(); metrics != nil {
+		metrics.AddCounter(MetricOutgoingEvicted, map[string]string{
+			"node": strconv.Itoa(int(rm.remoteNode)),
+		}, uint64(len(msgs)))
+	}
+	for _, msg := range msgs {
+		gaveUp(msg.Message)
+		rm.connectionServer.handleEvicted(MailboxID(msg.Target), outgoingPayload(msg))
+	}
+}
+
+// outgoingPayload returns the message that was sent, from the wrappers it
+// waits in the outgoing queue in.
+func outgoingPayload(msg internal.OutgoingMailboxMessage) interface{} {
+	message := msg.Message
+	if relayed, isRelayed := message.(relayedMessage); isRelayed {
+		message = relayed.message
+	}
+	if reliable, isReliable := message.(reliableMessage); isReliable {
+		message = reliable.message
+	}
+	if em, isExpiring := message.(expiringMessage); isExpiring {
+		message = em.message
+	}
+	if compressed, isCompressed := message.(compressedMessage); isCompressed {
+		message = compressed.message
+	}
+	if retried, isRetried := message.(retriedMessage); isRetried {
+		message = retried.message
+	}
+	return message
+}
+
+// abandonQueued is called when Serve is stopped, with the messages for
+// remote mailboxes that are still in the outgoing queue, which will now
+// never be sent. So the loss isn't silent, they are counted in
+// MetricOutgoingAbandoned, passed to the UnroutableHandler, and totalled
+// by type in a warning.
+func (rm *remoteMailboxes) abandonQueued() {
+	queued := rm.outgoingMailbox.removeAllIf(isOutgoingMessage)
+	if len(queued) == 0 {
+		return
+	}
+
+	rm.outgoingL.Lock()
+	for range queued {
+		rm.dequeued()
+	}
+	rm.outgoingL.Unlock()
+
+	if metrics := rm.connectionServer.metrics.get(); metrics != nil {
+		metrics.AddCounter(MetricOutgoingAbandoned, map[string]string{
+			"node": strconv.Itoa(int(rm.remoteNode)),
+		}, uint64(len(queued)))
+	}
+
+	counts := map[string]int{}
+	for _, msg := range queued {
+		omm := msg.(internal.OutgoingMailboxMessage)
+		gaveUp(omm.Message)
+		message := outgoingPayload(omm)
+		counts[fmt.Sprintf("%T", message)]++
+		// A piece of a stream means nothing to anyone on its own.
+		if _, isChunk := message.(*internal.StreamChunk); !isChunk {
+			rm.connectionServer.handleAbandoned(MailboxID(omm.Target), message)
+		} else {
+			rm.connectionServer.dropped(DropAbandoned, rm.remoteNode, 1)
+		}
+	}
+	types := make([]string, 0, len(counts))
+	for t := range counts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for i, t := range types {
+		types[i] = fmt.Sprintf("%d %s", counts[t], t)
+	}
+	rm.Warnf("Abandoned %d messages for node %d that were still waiting to be sent when it was stopped: %s",
+		len(queued), rm.remoteNode, strings.Join(types, ", "))
+}
+
+// watchBacklog starts the backlog warnings, if the outgoing queue has just
+// reached OutgoingBacklogWarnDepth. outgoingL must be held.
+func (rm *remoteMailboxes) watchBacklog() {
+	if OutgoingBacklogWarnDepth <= 0 || OutgoingBacklogWarnPeriod <= 0 ||
+		rm.outgoing < OutgoingBacklogWarnDepth || !rm.backlogSince.IsZero() {
+		return
+	}
+	since := rm.connectionServer.clock.Now()
+	rm.backlogSince = since
+	rm.backlogTimer = rm.connectionServer.clock.AfterFunc(OutgoingBacklogWarnPeriod, func() {
+		rm.warnBacklog(since)
+	})
+}
+
+// stopBacklog stops the backlog warnings. outgoingL must be held.
+func (rm *remoteMailboxes) stopBacklog() {
+	rm.backlogSince = time.Time{}
+	if rm.backlogTimer != nil {
+		rm.backlogTimer.Stop()
+		rm.backlogTimer = nil
+	}
+}
+
+// warnBacklog logs how far behind the outgoing queue is, if it has stayed
+// at or above OutgoingBacklogWarnDepth since the given time, and sets up
+// the next warning.
+func (rm *remoteMailboxes) warnBacklog(since time.Time) {
+	rm.outgoingL.Lock()
+	if !rm.backlogSince.Equal(since) || rm.outgoingMailbox.isTerminated() {
+		rm.outgoingL.Unlock()
+		return
+	}
+	depth := rm.outgoing
+	rm.backlogTimer = rm.connectionServer.clock.AfterFunc(OutgoingBacklogWarnPeriod, func() {
+		rm.warnBacklog(since)
+	})
+	rm.outgoingL.Unlock()
+
+	rm.Lock()
+	disconnectedSince := rm.disconnectedSince
+	rm.Unlock()
+
+	now := rm.connectionServer.clock.Now()
+	backlogged := now.Sub(since) / time.Second * time.Second
+	if disconnectedSince.IsZero() {
+		rm.Warnf("Node %d: %d messages queued, link up but backlogged for %s",
+			rm.remoteNode, depth, backlogged)
+		return
+	}
+	rm.Warnf("Node %d: %d messages queued, link down for %s",
+		rm.remoteNode, depth, now.Sub(disconnectedSince)/time.Second*time.Second)
+}
+
 func (rm *remoteMailboxes) String() string {
 	return fmt.Sprintf("remoteMailbox %d", rm.NodeID)
 }
 
+// remoteTerminated handles notification that the given remote mailbox,
+// that we had indicated interest in, has terminated.
+func (rm *remoteMailboxes) remoteTerminated(remoteID MailboxID, reason TerminationReason) {
+	links, linksExist := rm.linksToRemote[remoteID]
+	if !linksExist || len(links) == 0 {
+		return
+	}
+
+	for subscribed := range links {
+		addr := Address{
+			mailboxID:        subscribed,
+			connectionServer: rm.connectionServer,
+		}
+		sendTerminated(&addr, remoteID, reason)
+	}
+
+	rm.linksL.Lock()
+	delete(rm.linksToRemote, remoteID)
+	rm.linksL.Unlock()
+}
+
+// unlink removes the link from the local mailbox to the remote one,
+// telling the remote node it need no longer notify this one if that was
+// the last link to it.
+func (rm *remoteMailboxes) unlink(remoteID, localID MailboxID) {
+	linksToRemote, remoteLinksExist := rm.linksToRemote[remoteID]
+	if !remoteLinksExist || len(linksToRemote) == 0 {
+		return
+	}
+
+	rm.linksL.Lock()
+	delete(linksToRemote, localID)
+	rm.linksL.Unlock()
+
+	if _, pending := rm.pendingNotifies[remoteID]; pending && len(linksToRemote) == 0 {
+		// It was never registered in the first place.
+		delete(rm.pendingNotifies, remoteID)
+		return
+	}
+
+	if len(linksToRemote) == 0 {
+		// if that was the last link, we need to unregister from
+		// the remote node
+		// send does all the error handling I need here
+		rm.send(
+			&internal.RemoveNotifyNodeOnTerminate{IntMailboxID: internal.IntMailboxID(remoteID)},
+			"remove notify node",
+		)
+	}
+}
+
+// links returns a copy of linksToRemote, as a map of remote MailboxIDs to
+// the local MailboxIDs linked to them.
+func (rm *remoteMailboxes) links() map[MailboxID][]MailboxID {
+	rm.linksL.Lock()
+	defer rm.linksL.Unlock()
+
+	links := make(map[MailboxID][]MailboxID, len(rm.linksToRemote))
+	for remoteID, localIDs := range rm.linksToRemote {
+		if len(localIDs) == 0 {
+			continue
+		}
+		locals := make([]MailboxID, 0, len(localIDs))
+		for localID := range localIDs {
+			locals = append(locals, localID)
+		}
+		links[remoteID] = locals
+	}
+	return links
+}
+
+// terminateLinks tells every local mailbox linked to a remote mailbox that
+// the remote mailbox has terminated because its node is down, and forgets
+// the links. If there were any, the OnNodeDownFanout callbacks are told
+// how many notifications went out.
+func (rm *remoteMailboxes) terminateLinks() {
+	notified := 0
+	for remoteID, localIDs := range rm.linksToRemote {
+		for localID := range localIDs {
+			// FIXME: sendByID?
+			addr := Address{
+				mailboxID:        localID,
+				connectionServer: rm.connectionServer,
+			}
+			sendTerminated(&addr, remoteID, TerminatedNodeDown)
+			notified++
+		}
+	}
+	rm.linksL.Lock()
+	rm.linksToRemote = make(map[MailboxID]map[MailboxID]voidtype)
+	rm.linksL.Unlock()
+
+	if notified > 0 {
+		rm.Infof("Node %d is down; notified %d local mailboxes linked to it",
+			rm.remoteNode, notified)
+		rm.connectionServer.clusterEvent(EventNodeDown, rm.remoteNode,
+			fmt.Sprintf("notified %d local mailboxes", notified))
+		rm.connectionServer.nodeDownFanout(rm.remoteNode, notified)
+	}
+}
+
+// restoreLinks re-registers every remote mailbox we have links to with
+// the remote node, which may have lost the registrations while the
+// connection was down. Registering one twice is harmless, and one that
+// terminated in the meantime is reported right away.
+func (rm *remoteMailboxes) restoreLinks() {
+	for remoteID, localIDs := range rm.linksToRemote {
+		if len(localIDs) == 0 {
+			continue
+		}
+		err := rm.send(
+			&internal.NotifyNodeOnTerminate{IntMailboxID: internal.IntMailboxID(remoteID)},
+			"restored termination notification",
+		)
+		if err != nil {
+			// The connection is gone again, and will be restored again.
+			return
+		}
+	}
+}
+
+// flushNotifies registers the links that have been waiting out the
+// NotifyBatchWindow with the remote node, in one message if it can take
+// one.
+func (rm *remoteMailboxes) flushNotifies() {
+	rm.notifyTimer = nil
+	ids := make([]internal.IntMailboxID, 0, len(rm.pendingNotifies))
+	for remoteID := range rm.pendingNotifies {
+		ids = append(ids, internal.IntMailboxID(remoteID))
+	}
+	rm.pendingNotifies = make(map[MailboxID]voidtype)
+	if len(ids) == 0 {
+		return
+	}
+
+	if len(ids) == 1 || rm.peerVersion() < 5 {
+		for _, id := range ids {
+			err := rm.send(
+				&internal.NotifyNodeOnTerminate{IntMailboxID: id},
+				"termination notification",
+			)
+			if err != nil {
+				rm.failLinks([]internal.IntMailboxID{id})
+			}
+		}
+		return
+	}
+
+	err := rm.send(
+		&internal.NotifyNodeOnTerminates{IntMailboxIDs: ids},
+		"termination notifications",
+	)
+	if err != nil {
+		rm.failLinks(ids)
+	}
+}
+
+// failLinks gives up on the links to the given remote mailboxes, which
+// could not be registered with the remote node, telling the linkers the
+// mailboxes are gone, as when a link can't be registered straight away.
+func (rm *remoteMailboxes) failLinks(ids []internal.IntMailboxID) {
+	for _, id := range ids {
+		remoteID := MailboxID(id)
+		rm.linksL.Lock()
+		linksToRemote := rm.linksToRemote[remoteID]
+		delete(rm.linksToRemote, remoteID)
+		rm.linksL.Unlock()
+
+		for localID := range linksToRemote {
+			addr := Address{
+				mailboxID:        localID,
+				connectionServer: rm.connectionServer,
+			}
+			sendTerminated(&addr, remoteID, TerminatedNodeDown)
+		}
+	}
+}
+
+// Serve is the loop that handles both directions of traffic with the
+// remote node.
+//
+// It sends to local mailboxes from many places, including its deferred
+// cleanup, and must not hold rm's locks while doing so. A send only
+// queues the message, and never runs the receiver's code, but a mailbox
+// that is being terminated sends its notifications on, possibly back to
+// a remote node through this very loop's queue.
 func (rm *remoteMailboxes) Serve() {
+	defer rm.connectionServer.running(fmt.Sprintf("remote mailboxes for node %d", rm.remoteNode))()
 	defer func() {
-		for remoteID, localIDs := range rm.linksToRemote {
-			for localID := range localIDs {
-				// FIXME: sendByID?
-				addr := Address{
-					mailboxID:        localID,
-					connectionServer: rm.connectionServer,
-				}
-				addr.Send(MailboxTerminated(remoteID))
-			}
+		rm.terminateLinks()
+		rm.failConfirmations()
+		rm.Lock()
+		rm.stopEncoder()
+		rm.Unlock()
+		if rm.graceTimer != nil {
+			rm.graceTimer.Stop()
+		}
+		if rm.notifyTimer != nil {
+			rm.notifyTimer.Stop()
+		}
+		if rm.idleTimer != nil {
+			rm.idleTimer.Stop()
 		}
-		rm.linksToRemote = make(map[MailboxID]map[MailboxID]voidtype)
+		rm.outgoingL.Lock()
+		rm.stopBacklog()
+		rm.outgoingL.Unlock()
+		rm.abortStreams()
 
 		if r := recover(); r != nil {
 			rm.Errorf("While handling mailbox, got fatal error (this is a serious bug): %s", myString(r))
@@ -163,14 +1309,38 @@ func (rm *remoteMailboxes) Serve() {
 	}()
 
 	var message interface{}
+	var started time.Time
+	var metrics Metrics
 	for {
+		if metrics != nil {
+			metrics.ObserveHistogram(MetricProcessingSeconds, map[string]string{
+				"node":    strconv.Itoa(int(rm.remoteNode)),
+				"message": fmt.Sprintf("%T", message),
+			}, time.Since(started).Seconds())
+		}
+
 		if rm.doneProcessing != nil {
 			if !rm.doneProcessing(message) {
 				rm.doneProcessing = nil
 			}
 		}
 
-		message = rm.outgoingMailbox.ReceiveNext()
+		waiting, parked := rm.linkWaiting()
+		for _, p := range parked {
+			if err := rm.sendWaiting(p.cm, p.desc, false); err != nil {
+				rm.unsent(p.cm, err)
+			}
+		}
+		if waiting {
+			message = rm.receiveAwaitingLink()
+		} else {
+			rm.linkWoken = false
+			message = rm.outgoingMailbox.ReceiveNext()
+		}
+		metrics = rm.connectionServer.metrics.get()
+		if metrics != nil {
+			started = time.Now()
+		}
 
 		if rm.examineMessages != nil {
 			if !rm.examineMessages(message) {
@@ -180,23 +1350,107 @@ func (rm *remoteMailboxes) Serve() {
 
 		switch msg := message.(type) {
 		case internal.OutgoingMailboxMessage:
-			rm.send(
-				internal.IncomingMailboxMessage{
-					Target:  msg.Target,
-					Message: msg.Message,
-				},
-				"normal message",
-			)
+			depth := rm.outgoingDone()
+			if metrics != nil {
+				metrics.SetGauge(MetricOutgoingQueueDepth, map[string]string{
+					"node": strconv.Itoa(int(rm.remoteNode)),
+				}, float64(depth))
+			}
+			if staleOutgoing(msg, rm.connectionServer.clock.Now(), rm.connectionServer.Cluster.OutgoingQueueMaxAge) {
+				rm.evicted([]internal.OutgoingMailboxMessage{msg})
+				continue
+			}
+			incoming := internal.IncomingMailboxMessage{
+				Target:  msg.Target,
+				Message: msg.Message,
+			}
+			if relayed, isRelayed := incoming.Message.(relayedMessage); isRelayed {
+				incoming.Message = relayed.message
+				incoming.Hops = relayed.hops
+			}
+			if reliable, isReliable := incoming.Message.(reliableMessage); isReliable {
+				incoming.Message = reliable.message
+				if rm.peerVersion() >= 7 {
+					incoming.ReliableID = reliable.id
+				} else {
+					// The node was replaced by an older one since this
+					// was sent; it would never be acknowledged.
+					rm.Warnf("Node %d does not support reliable messages; sending one as a normal message", rm.remoteNode)
+					rm.forgetReliable(rm.connectionServer.reliable.get(), reliable.id)
+				}
+			}
+			if em, isExpiring := incoming.Message.(expiringMessage); isExpiring {
+				ttl := em.deadline.Sub(rm.connectionServer.clock.Now())
+				if ttl <= 0 {
+					rm.connectionServer.dropped(DropExpired, rm.remoteNode, 1)
+					if metrics != nil {
+						metrics.AddCounter(MetricMessagesExpired, map[string]string{
+							"node": strconv.Itoa(int(rm.remoteNode)),
+						}, 1)
+					}
+					continue
+				}
+				incoming.Message = em.message
+				incoming.Deadline = em.deadline
+				incoming.TTL = ttl
+			}
+			if compressed, isCompressed := incoming.Message.(compressedMessage); isCompressed {
+				rm.compress(&incoming, compressed)
+			}
+			if retried, isRetried := incoming.Message.(retriedMessage); isRetried {
+				rm.sendRetried(MailboxID(incoming.Target), retried)
+				continue
+			}
+			rm.sendMessage(incoming)
 
-		// all of the gob encoding stuff seems to end up with this getting
-		// an extra layer of pointer indirection added to it.
-		// Edit (adam): It's because we're registering the objects as pointers with gob.
-		case *internal.IncomingMailboxMessage:
-			addr := Address{
-				mailboxID:        MailboxID(msg.Target),
-				connectionServer: rm.connectionServer,
+		// Messages from the connection have been through
+		// internal.Normalize, so these are all values, even though gob
+		// decodes them as pointers.
+		case internal.IncomingMailboxMessage:
+			if msg.ReliableID != 0 {
+				rm.acknowledge(msg.ReliableID)
+				if rm.duplicate(msg.ReliableID) {
+					rm.Tracef("Discarding a duplicate of reliable message %d from node %d",
+						msg.ReliableID, rm.remoteNode)
+					rm.connectionServer.dropped(DropDuplicate, rm.remoteNode, 1)
+					continue
+				}
+			}
+			if rm.denyReceive(msg.Message, "message") {
+				continue
+			}
+			if chunk, isChunk := msg.Message.(internal.StreamChunk); isChunk {
+				rm.receiveChunk(MailboxID(msg.Target), chunk)
+				continue
+			}
+			if MailboxID(msg.Target).NodeID() != rm.NodeID {
+				rm.relay(msg)
+				continue
+			}
+			// This goes straight to the mailbox, rather than through an
+			// Address, so a store from NewFairStore knows where it's from.
+			var delivered interface{} = msg.Message
+			if !msg.Deadline.IsZero() {
+				delivered = expiringMessage{rm.localDeadline(msg), msg.Message}
+			}
+			err := rm.parent.sendByIDFrom(rm.remoteNode, MailboxID(msg.Target), delivered)
+			switch {
+			case err == ErrMailboxTerminated:
+				rm.connectionServer.handleUnroutable(DropUnroutable, rm.remoteNode, MailboxID(msg.Target), msg.Message)
+			case err != nil:
+				rm.Errorf("Mailbox %x refused a message from node %d, dropping it: %s",
+					MailboxID(msg.Target), rm.remoteNode, myString(err))
+				rm.connectionServer.dropped(DropRefused, rm.remoteNode, 1)
 			}
-			addr.Send(msg.Message)
+
+		case internal.ReliableAck:
+			rm.acknowledged(msg)
+
+		case internal.StreamAck:
+			rm.streamAcknowledged(msg)
+
+		case streamStalled:
+			rm.expireStream(msg)
 
 		case internal.NotifyRemote:
 			// FIXME: if the local addr dies, this never cleans out
@@ -215,10 +1469,19 @@ func (rm *remoteMailboxes) Serve() {
 				}
 			} else {
 				linksToRemote = make(map[MailboxID]voidtype)
+				rm.linksL.Lock()
 				rm.linksToRemote[remoteID] = linksToRemote
+				rm.linksL.Unlock()
 			}
 
-			if len(linksToRemote) == 0 {
+			if len(linksToRemote) == 0 && NotifyBatchWindow > 0 {
+				rm.pendingNotifies[remoteID] = void
+				if rm.notifyTimer == nil {
+					rm.notifyTimer = rm.connectionServer.clock.AfterFunc(NotifyBatchWindow, func() {
+						rm.Send(flushNotifies{})
+					})
+				}
+			} else if len(linksToRemote) == 0 {
 				// Since this is the first link to this particular
 				// remote mailbox we are recording, we need to send along
 				// the registration message
@@ -227,59 +1490,65 @@ func (rm *remoteMailboxes) Serve() {
 					"termination notification",
 				)
 				if err != nil {
+					// We can't watch the remote mailbox, so as far as
+					// the linker can tell, it's gone; this is the same
+					// thing that happens to existing links when the
+					// connection goes down. The link is not recorded,
+					// so a later attempt will try again.
 					addr := Address{
 						mailboxID:        localID,
 						connectionServer: rm.connectionServer,
 					}
-					addr.Send(MailboxTerminated(remoteID))
-					// FIXME: Really? Panic?
-					panic(err)
+					sendTerminated(&addr, remoteID, TerminatedNodeDown)
+					rm.linksL.Lock()
+					delete(rm.linksToRemote, remoteID)
+					rm.linksL.Unlock()
+					continue
 				}
 			}
 
+			rm.linksL.Lock()
 			linksToRemote[localID] = void
+			rm.linksL.Unlock()
 
 		case internal.UnnotifyRemote:
-			remoteID := MailboxID(msg.Remote)
-			localID := MailboxID(msg.Local)
+			rm.unlink(MailboxID(msg.Remote), MailboxID(msg.Local))
 
-			linksToRemote, remoteLinksExist := rm.linksToRemote[remoteID]
-			if !remoteLinksExist || len(linksToRemote) == 0 {
-				continue
-			}
+		case confirmedNotify:
+			rm.registerConfirmed(msg)
 
-			delete(linksToRemote, localID)
+		case forgetConfirmation:
+			rm.dropConfirmation(msg.result)
 
-			if len(linksToRemote) == 0 {
-				// if that was the last link, we need to unregister from
-				// the remote node
-				// send does all the error handling I need here
-				rm.send(
-					&internal.RemoveNotifyNodeOnTerminate{IntMailboxID: internal.IntMailboxID(remoteID)},
-					"remove notify node",
-				)
+		case internal.NotifyConfirmed:
+			rm.confirmed(msg)
+
+		case cancelNotifications:
+			remoteIDs := []MailboxID{}
+			for remoteID, localIDs := range rm.linksToRemote {
+				if _, linked := localIDs[msg.local]; linked {
+					remoteIDs = append(remoteIDs, remoteID)
+				}
+			}
+			for _, remoteID := range remoteIDs {
+				rm.unlink(remoteID, msg.local)
 			}
 
-		case *internal.RemoteMailboxTerminated:
+		case internal.RemoteMailboxTerminated:
 			// A remote mailbox has been terminated that we indicated
 			// interest in.
-			remoteID := MailboxID(msg.IntMailboxID)
-			links, linksExist := rm.linksToRemote[remoteID]
-			if !linksExist || len(links) == 0 {
-				continue
-			}
+			rm.remoteTerminated(MailboxID(msg.IntMailboxID), TerminationReason(msg.Reason))
 
-			for subscribed := range links {
-				addr := Address{
-					mailboxID:        subscribed,
-					connectionServer: rm.connectionServer,
+		case internal.RemoteMailboxesTerminated:
+			for i, id := range msg.IntMailboxIDs {
+				reason := TerminatedNormally
+				if i < len(msg.Reasons) {
+					reason = TerminationReason(msg.Reasons[i])
 				}
-				addr.Send(MailboxTerminated(remoteID))
+				rm.remoteTerminated(MailboxID(id), reason)
 			}
 
-			delete(rm.linksToRemote, remoteID)
-
-		case *internal.NotifyNodeOnTerminate:
+		case internal.NotifyNodeOnTerminate:
 			// this has to be a localID, or we wouldn't be receiving this
 			// message
 			localID := MailboxID(msg.IntMailboxID)
@@ -288,8 +1557,26 @@ func (rm *remoteMailboxes) Serve() {
 				connectionServer: rm.connectionServer,
 			}
 			addr.NotifyAddressOnTerminate(rm.Address)
+			if msg.ConfirmID != 0 {
+				_ = rm.send(
+					&internal.NotifyConfirmed{ID: msg.ConfirmID},
+					"termination notification confirmation",
+				)
+			}
+
+		case internal.NotifyNodeOnTerminates:
+			for _, id := range msg.IntMailboxIDs {
+				addr := Address{
+					mailboxID:        MailboxID(id),
+					connectionServer: rm.connectionServer,
+				}
+				addr.NotifyAddressOnTerminate(rm.Address)
+			}
+
+		case flushNotifies:
+			rm.flushNotifies()
 
-		case *internal.RemoveNotifyNodeOnTerminate:
+		case internal.RemoveNotifyNodeOnTerminate:
 			localID := MailboxID(msg.IntMailboxID)
 			addr := Address{
 				mailboxID:        localID,
@@ -298,21 +1585,115 @@ func (rm *remoteMailboxes) Serve() {
 			addr.RemoveNotifyAddress(rm.Address)
 
 		// Note this is a local mailbox.
-		case MailboxTerminated:
-			id := MailboxID(msg)
+		case MailboxTerminated, TerminatedWithReason:
+			terminated := terminationOf(msg)
+			if terminated.ID == rm.outgoingMailbox.id {
+				// We've been terminated along with the rest of the
+				// node's mailboxes.
+				return
+			}
+
 			// if we are receiving this, apparently the other side wants to
-			// hear about it
-			_ = rm.send(
-				&internal.RemoteMailboxTerminated{
-					IntMailboxID: internal.IntMailboxID(id),
-				},
-				"mailbox terminated normally",
-			)
+			// hear about it. When a lot of mailboxes go down at once, their
+			// notifications tend to pile up back-to-back in our mailbox, so
+			// take what's immediately available and send it as one message.
+			// This only takes what's directly at the head of our queue;
+			// reordering the notifications with respect to the other
+			// messages in here would be incorrect.
+			//
+			// In BenchmarkRemoteTerminationFanIn, this gets 10,000
+			// terminations to the other node roughly three times faster
+			// than sending them one at a time. Batching the local deliveries
+			// in the cleanup fan-out at the top of Serve was also tried,
+			// and made no measurable difference; the cost there is
+			// dominated by the receivers, not the sends.
+			ids := []internal.IntMailboxID{internal.IntMailboxID(terminated.ID)}
+			reasons := []uint8{uint8(terminated.Reason)}
+			abnormal := terminated.Reason != TerminatedNormally
+			for {
+				next, ok := rm.outgoingMailbox.receiveNextIf(isMailboxTerminated)
+				if !ok {
+					break
+				}
+				terminated = terminationOf(next)
+				ids = append(ids, internal.IntMailboxID(terminated.ID))
+				reasons = append(reasons, uint8(terminated.Reason))
+				abnormal = abnormal || terminated.Reason != TerminatedNormally
+			}
+
+			if len(ids) == 1 || rm.peerVersion() < 2 {
+				for i, id := range ids {
+					_ = rm.send(
+						&internal.RemoteMailboxTerminated{
+							IntMailboxID: id,
+							Reason:       reasons[i],
+						},
+						"mailbox terminated",
+					)
+				}
+			} else {
+				batch := &internal.RemoteMailboxesTerminated{
+					IntMailboxIDs: ids,
+				}
+				if abnormal {
+					batch.Reasons = reasons
+				}
+				_ = rm.send(batch, "mailboxes terminated")
+			}
+
+		case outgoingControl:
+			rm.sendControl(msg)
+
+		case internal.ControlMessage:
+			rm.receiveControl(msg)
 
 		// This allows us to test proper error handling, despite
 		// the fact I don't know how to panic any of the above code
 		case internal.PanicHandler:
+			if !rm.connectionServer.allowPanicHandler {
+				rm.Errorf("Ignoring a request to panic the node %d mailbox handler; this is only permitted in testing", rm.remoteNode)
+				continue
+			}
 			panic("Panicking as requested due to panic handler")
+		case connectionLost:
+			rm.abortStreams()
+			rm.failConfirmations()
+			rm.linkEpoch++
+			if LinkGracePeriod > 0 {
+				epoch := rm.linkEpoch
+				rm.graceTimer = rm.connectionServer.clock.AfterFunc(LinkGracePeriod, func() {
+					rm.Send(linkGraceExpired{epoch})
+				})
+			}
+
+		case handshakeDone:
+			// Only here to have Serve look at the link again.
+
+		case connectionReady:
+			rm.linkEpoch++
+			if rm.graceTimer != nil {
+				rm.graceTimer.Stop()
+				rm.graceTimer = nil
+			}
+			rm.restoreLinks()
+			rm.resendReliable()
+			rm.sendHeld()
+			if timeout := rm.idleTimeout(); timeout > 0 {
+				rm.scheduleIdleCheck(timeout)
+			}
+
+		case idleCheck:
+			rm.closeIfIdle(msg)
+
+		case linkGraceExpired:
+			if msg.epoch != rm.linkEpoch {
+				// The connection came back before the timer was stopped.
+				continue
+			}
+			rm.Warnf("The connection to node %d has been down for %v; treating the mailboxes linked on it as terminated",
+				rm.remoteNode, LinkGracePeriod)
+			rm.terminateLinks()
+
 		case internal.DestroyConnection:
 			rm.Lock()
 			rm.connection.terminate()
@@ -324,6 +1705,9 @@ func (rm *remoteMailboxes) Serve() {
 			rm.doneProcessing = msg.f
 
 		case terminateRemoteMailbox:
+			rm.abandonQueued()
+			rm.abandonHeld()
+			rm.abandonParked()
 			return
 
 		default:
@@ -0,0 +1,102 @@
+package reign
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRequestTimeout is returned by Request.Wait when no reply arrives in
+// time.
+var ErrRequestTimeout = errors.New("no reply to the request arrived in time")
+
+// ErrRequestCancelled is returned by Request.Wait when the Request has
+// been cancelled.
+var ErrRequestCancelled = errors.New("the request was cancelled")
+
+// A Request is a message sent to a mailbox, along with the temporary
+// mailbox its reply will arrive in. See Address.Request.
+type Request struct {
+	target  *Address
+	reply   *Address
+	mailbox *Mailbox
+	cancel  sync.Once
+}
+
+// requestTimedOut is sent to a Request's mailbox when its Wait times out.
+type requestTimedOut struct{}
+
+// Request sends a message to the mailbox at this Address, expecting a
+// single reply. The message is made by the given function, from the
+// Address of a new mailbox for the reply, so it can be included for the
+// receiver to reply to, such as in an Envelope. Wait for the reply with
+// the returned Request's Wait.
+//
+// Until the Request is done with, the reply mailbox is linked to this
+// one, as with NotifyAddressOnTerminate, so that Wait notices if it
+// terminates. Once Wait returns, or Cancel is called, the mailbox and the
+// link are cleaned up at once. A reply that comes after that is not
+// delivered anywhere: a local sender gets ErrMailboxTerminated from its
+// Send, and one from another node is passed to the UnroutableHandler.
+// So a request that is no longer wanted, because whatever was waiting
+// for it has gone away, should be cancelled, rather than left to time
+// out.
+func (a *Address) Request(makeMessage func(replyTo *Address) interface{}) (*Request, error) {
+	reply, mailbox := a.server().NewMailbox()
+	r := &Request{
+		target:  a,
+		reply:   reply,
+		mailbox: mailbox,
+	}
+	a.NotifyAddressOnTerminate(reply)
+
+	if err := a.Send(makeMessage(reply)); err != nil {
+		r.Cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Wait returns the reply to the Request. It fails with
+// ErrMailboxTerminated if the mailbox the request was sent to has
+// terminated, including its node going down, ErrRequestTimeout if the
+// timeout passes first, and ErrRequestCancelled if the Request is
+// cancelled while waiting, or already has been. A timeout of zero or
+// less waits for as long as it takes.
+//
+// Only the first reply is returned; the Request is cancelled once it is
+// done. Wait should only be called once.
+func (r *Request) Wait(timeout time.Duration) (interface{}, error) {
+	defer r.Cancel()
+
+	if timeout > 0 {
+		timer := r.reply.server().clock.AfterFunc(timeout, func() {
+			_ = r.reply.Send(requestTimedOut{})
+		})
+		defer timer.Stop()
+	}
+
+	msg := r.mailbox.ReceiveNext()
+	switch msg := msg.(type) {
+	case requestTimedOut:
+		return nil, ErrRequestTimeout
+	case MailboxTerminated:
+		switch MailboxID(msg) {
+		case r.target.mailboxID:
+			return nil, ErrMailboxTerminated
+		case r.reply.mailboxID:
+			return nil, ErrRequestCancelled
+		}
+	}
+	return msg, nil
+}
+
+// Cancel abandons the Request, cleaning up its reply mailbox and its link
+// to the mailbox the request was sent to, and waking up any Wait for it.
+// It is safe to call more than once, and after Wait has returned.
+func (r *Request) Cancel() {
+	r.cancel.Do(func() {
+		r.target.RemoveNotifyAddress(r.reply)
+		r.mailbox.Terminate()
+	})
+}
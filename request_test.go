@@ -0,0 +1,132 @@
+package reign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+type double struct {
+	ReplyTo *Address
+	N       int
+}
+
+func TestRequest(t *testing.T) {
+	cs, _ := noClustering(NullLogger)
+	defer cs.Terminate()
+
+	server, serverMailbox := cs.NewMailbox()
+	defer serverMailbox.Terminate()
+	ask := func(n int) func(*Address) interface{} {
+		return func(replyTo *Address) interface{} { return double{replyTo, n} }
+	}
+
+	r, err := server.Request(ask(21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := serverMailbox.ReceiveNext().(double)
+	req.ReplyTo.Send(req.N * 2)
+	if reply, err := r.Wait(timeout); err != nil || reply != 42 {
+		t.Fatal("Unexpected reply:", reply, err)
+	}
+	// Only the one reply is taken.
+	if err := req.ReplyTo.Send(req.N * 2); err != ErrMailboxTerminated {
+		t.Fatal("A second reply was accepted:", err)
+	}
+
+	r, _ = server.Request(ask(1))
+	if _, err := r.Wait(10 * time.Millisecond); err != ErrRequestTimeout {
+		t.Fatal("Request did not time out:", err)
+	}
+	serverMailbox.ReceiveNext()
+
+	// A cancelled request cleans up at once, however long it would have
+	// waited, and a late reply goes nowhere.
+	r, _ = server.Request(ask(2))
+	req = serverMailbox.ReceiveNext().(double)
+	waited := make(chan error)
+	go func() {
+		_, err := r.Wait(0)
+		waited <- err
+	}()
+	r.Cancel()
+	select {
+	case err := <-waited:
+		if err != ErrRequestCancelled {
+			t.Fatal("Unexpected error from a cancelled request:", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Cancel did not wake up Wait")
+	}
+	r.Cancel()
+	if err := req.ReplyTo.Send(4); err != ErrMailboxTerminated {
+		t.Fatal("A late reply was accepted:", err)
+	}
+	serverMailbox.cond.L.Lock()
+	links := len(serverMailbox.notificationAddresses)
+	serverMailbox.cond.L.Unlock()
+	if links != 0 {
+		t.Fatal("The reply mailbox is still linked")
+	}
+	if _, err := r.Wait(timeout); err != ErrRequestCancelled {
+		t.Fatal("Waited on a cancelled request:", err)
+	}
+
+	r, _ = server.Request(ask(3))
+	serverMailbox.Terminate()
+	if _, err := r.Wait(timeout); err != ErrMailboxTerminated {
+		t.Fatal("Termination was not noticed:", err)
+	}
+	if _, err := server.Request(ask(4)); err != ErrMailboxTerminated {
+		t.Fatal("Requested from a terminated mailbox:", err)
+	}
+	// Only the registry's mailbox is left.
+	if mailboxes := cs.LocalMailboxes(); len(mailboxes) != 1 {
+		t.Fatal("Reply mailboxes were left behind:", mailboxes)
+	}
+}
+
+func TestRequestRemote(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	unroutable := make(chan interface{}, 1)
+	ntb.c1.SetUnroutableHandler(func(target MailboxID, msg interface{}) bool {
+		unroutable <- msg
+		return true
+	})
+
+	r, err := ntb.rem1_2.Request(func(*Address) interface{} { return "request" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); msg != "request" {
+		t.Fatal("Request was not sent:", msg)
+	}
+	r.Cancel()
+
+	// The link to the remote mailbox goes with it.
+	deadline := time.Now().Add(timeout)
+	for len(ntb.c1.RemoteLinks(2)) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The reply mailbox is still linked:", ntb.c1.RemoteLinks(2))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A reply arriving from node 2 afterwards is dead-lettered.
+	ntb.remote1to2.Send(internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(r.reply.mailboxID),
+		Message: "late",
+	})
+	select {
+	case msg := <-unroutable:
+		if msg != "late" {
+			t.Fatal("Unexpected unroutable message:", msg)
+		}
+	case <-time.After(timeout):
+		t.Fatal("The late reply was not dead-lettered")
+	}
+}
@@ -0,0 +1,100 @@
+package reign
+
+import (
+	"github.com/thejerf/reign/internal"
+)
+
+// SendWithRetries sends the message like Send, but if the mailbox is on
+// another node and the message can't be handed to the connection to it
+// when its turn comes, because the link is down or fails as it is
+// written, the message is held and tried again when the link is made
+// again, up to the given number of times. Held messages go ahead of
+// whatever is waiting to be sent at the time.
+//
+// This is a lighter alternative to SendReliable: once the message has
+// been handed to a connection it is forgotten, so one that is lost in
+// the connection's buffers as it goes down is not sent again, and the
+// remote node doesn't acknowledge anything.
+//
+// If the message is never handed to a connection, because the retries
+// ran out, it could not be encoded, or it was dropped from the outgoing
+// queue by the OutgoingQueuePolicy or OutgoingQueueMaxAge, or was still
+// waiting when the node was stopped, onGiveUp is called, if it isn't
+// nil. It is called from reign's own goroutines, so it must not block.
+// It is not called when SendWithRetries returns an error.
+//
+// For local mailboxes this is the same as Send.
+func (a *Address) SendWithRetries(m interface{}, retries int, onGiveUp func()) error {
+	bra, isRemote := a.getAddress().(boundRemoteAddress)
+	if !isRemote {
+		return a.Send(m)
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return bra.remoteMailboxes.sendOutgoing(bra.MailboxID, retriedMessage{m, retries, onGiveUp})
+}
+
+// retriedMessage is a message sent with SendWithRetries, as it waits in
+// the outgoing queue, or to be tried again, with the retries it has left.
+type retriedMessage struct {
+	message  interface{}
+	retries  int
+	onGiveUp func()
+}
+
+// heldMessage is a retriedMessage waiting for the link to be made again.
+type heldMessage struct {
+	target MailboxID
+	retriedMessage
+}
+
+// sendRetried hands a message sent with SendWithRetries to the
+// connection, holding it for the next one if that fails and it has
+// retries left.
+func (rm *remoteMailboxes) sendRetried(target MailboxID, msg retriedMessage) {
+	imm := internal.IncomingMailboxMessage{
+		Target:  internal.IntMailboxID(target),
+		Message: msg.message,
+	}
+	err := rm.send(imm, "retried message")
+	switch {
+	case err == nil:
+	case (err == ErrNoConnection || IsRetryable(err)) && msg.retries > 0:
+		msg.retries--
+		rm.held = append(rm.held, heldMessage{target, msg})
+	default:
+		rm.unsent(imm, err)
+		gaveUp(msg)
+	}
+}
+
+// sendHeld tries the held messages again, as the connection to the
+// remote node has just been made.
+func (rm *remoteMailboxes) sendHeld() {
+	held := rm.held
+	rm.held = nil
+	for _, msg := range held {
+		rm.sendRetried(msg.target, msg.retriedMessage)
+	}
+}
+
+// abandonHeld gives up on the held messages, as Serve is stopping. They
+// are treated just like those still in the outgoing queue; see
+// abandonQueued.
+func (rm *remoteMailboxes) abandonHeld() {
+	held := rm.held
+	rm.held = nil
+	for _, msg := range held {
+		gaveUp(msg.retriedMessage)
+		rm.connectionServer.handleAbandoned(msg.target, msg.message)
+	}
+}
+
+// gaveUp calls the onGiveUp of a message sent with SendWithRetries that
+// will now never be sent. Other messages are ignored.
+func gaveUp(message interface{}) {
+	if retried, isRetried := message.(retriedMessage); isRetried && retried.onGiveUp != nil {
+		retried.onGiveUp()
+	}
+}
@@ -0,0 +1,125 @@
+package reign
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// awaitProcessed waits for the remote mailboxes to have handled everything
+// sent to them before it was called.
+func awaitProcessed(t *testing.T, rm *remoteMailboxes) {
+	done := make(chan struct{})
+	rm.Send(newDoneProcessing{func(interface{}) bool {
+		close(done)
+		return false
+	}})
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Remote mailboxes did not catch up")
+	}
+}
+
+func TestSendWithRetries(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	done := make(chan struct{})
+	go func() {
+		ntb.remote1to2.Serve()
+		close(done)
+	}()
+
+	gaveUp := make(chan string, 10)
+	giveUp := func(msg string) func() {
+		return func() { gaveUp <- msg }
+	}
+	expectGivenUp := func(expected string) {
+		select {
+		case msg := <-gaveUp:
+			if msg != expected {
+				t.Fatal("Gave up on the wrong message:", msg, "expected", expected)
+			}
+		case <-time.After(timeout):
+			t.Fatal("Did not give up on", expected)
+		}
+	}
+
+	conn := &recordingSender{make(chan internal.ClusterMessage, 10)}
+	next := func() interface{} {
+		select {
+		case cm := <-conn.sent:
+			return cm.(internal.IncomingMailboxMessage).Message
+		case <-time.After(timeout):
+			t.Fatal("Nothing was sent")
+		}
+		return nil
+	}
+
+	// With no connection, the message waits for the next one.
+	if err := ntb.rem1_2.SendWithRetries("held", 1, giveUp("held")); err != nil {
+		t.Fatal(err)
+	}
+	awaitProcessed(t, ntb.remote1to2)
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.remote1to2.Send(connectionReady{})
+	if msg := next(); msg != "held" {
+		t.Fatal("Held message was not sent on reconnection:", msg)
+	}
+
+	// Once it has been handed to a connection, it's forgotten.
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.remote1to2.setConnection(conn, clusterVersion, "")
+	ntb.remote1to2.Send(connectionReady{})
+	ntb.rem1_2.Send("after")
+	if msg := next(); msg != "after" {
+		t.Fatal("Sent message was retried:", msg)
+	}
+
+	// It is given up on when the retries run out...
+	ntb.remote1to2.unsetConnection(conn)
+	ntb.rem1_2.SendWithRetries("no retries", 0, giveUp("no retries"))
+	expectGivenUp("no retries")
+	ntb.rem1_2.SendWithRetries("one retry", 1, giveUp("one retry"))
+	awaitProcessed(t, ntb.remote1to2)
+	if len(gaveUp) != 0 {
+		t.Fatal("Gave up with a retry left")
+	}
+	ntb.remote1to2.Send(connectionReady{})
+	expectGivenUp("one retry")
+	awaitDrops(t, ntb.c1, map[string]uint64{DropNoConnection: 2})
+
+	// ... or when the node is stopped.
+	ntb.rem1_2.SendWithRetries("stopped", 5, giveUp("stopped"))
+	awaitProcessed(t, ntb.remote1to2)
+	ntb.remote1to2.Stop()
+	<-done
+	expectGivenUp("stopped")
+	awaitDrops(t, ntb.c1, map[string]uint64{DropNoConnection: 2, DropAbandoned: 1})
+
+	// Local mailboxes just get the message.
+	ntb.addr1_1.SendWithRetries("local", 1, giveUp("local"))
+	if msg, _ := ntb.mailbox1_1.ReceiveNextTimeout(timeout); msg != "local" {
+		t.Fatal("Local message not delivered:", msg)
+	}
+}
+
+func TestSendWithRetriesDropped(t *testing.T) {
+	spec := testSpec()
+	spec.OutgoingQueueLimit = 1
+	spec.OutgoingQueuePolicy = "drop_oldest"
+	ntb := unstartedTestbed(spec)
+	defer ntb.terminateMailboxes()
+
+	// Nothing is taking messages out of the queue, so the second one
+	// pushes out the first.
+	gaveUp := make(chan struct{}, 1)
+	ntb.rem1_2.SendWithRetries("dropped", 3, func() { gaveUp <- void })
+	ntb.rem1_2.Send("newer")
+	select {
+	case <-gaveUp:
+	case <-time.After(timeout):
+		t.Fatal("Did not give up on a message dropped from the queue")
+	}
+}
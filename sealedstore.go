@@ -0,0 +1,347 @@
+package reign
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterType(SealedFrame{})
+}
+
+// ErrUnknownKey is returned when a SealingKeys is asked to use a key it
+// doesn't have, and is the Err of the UnreadableMessage for a message
+// sealed with a key that has since been removed.
+var ErrUnknownKey = errors.New("unknown sealing key")
+
+// ErrOutOfSequence is the Err of the UnreadableMessage for a sealed frame
+// that the store it was sealed by did not expect where it was found: one
+// that was already taken out, or has been moved or copied.
+var ErrOutOfSequence = errors.New("sealed frame is out of sequence")
+
+// SealingKeys is the set of keys a store from NewSealedStore seals and
+// opens messages with. New messages are sealed with the current key, and
+// each is tagged with the ID of the key that sealed it, so it can be
+// opened with that key even once another is current.
+//
+// To rotate keys, Add the new key, and then Use it. Remove the old key
+// once nothing sealed with it can still be waiting; a message that is
+// sealed with a removed key comes out as an UnreadableMessage.
+//
+// A SealingKeys may be changed while it is in use, and shared among many
+// stores.
+type SealingKeys struct {
+	current uint32
+	keys    map[uint32]cipher.AEAD
+	sync.RWMutex
+}
+
+// NewSealingKeys returns a SealingKeys with the given key as the current
+// one. Keys are AES keys of 16, 24, or 32 bytes, and are used with GCM.
+func NewSealingKeys(id uint32, key []byte) (*SealingKeys, error) {
+	sk := &SealingKeys{keys: make(map[uint32]cipher.AEAD)}
+	if err := sk.Add(id, key); err != nil {
+		return nil, err
+	}
+	sk.current = id
+	return sk, nil
+}
+
+// Add adds a key with the given ID, replacing any key with the same ID.
+func (sk *SealingKeys) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	sk.Lock()
+	defer sk.Unlock()
+	sk.keys[id] = aead
+	return nil
+}
+
+// Use makes the key with the given ID the one new messages are sealed
+// with.
+func (sk *SealingKeys) Use(id uint32) error {
+	sk.Lock()
+	defer sk.Unlock()
+	if _, exists := sk.keys[id]; !exists {
+		return ErrUnknownKey
+	}
+	sk.current = id
+	return nil
+}
+
+// Remove removes the key with the given ID. The current key can't be
+// removed.
+func (sk *SealingKeys) Remove(id uint32) error {
+	sk.Lock()
+	defer sk.Unlock()
+	if id == sk.current {
+		return errors.New("can not remove the current sealing key")
+	}
+	delete(sk.keys, id)
+	return nil
+}
+
+// currentKey returns the current key, with its ID.
+func (sk *SealingKeys) currentKey() (uint32, cipher.AEAD) {
+	sk.RLock()
+	defer sk.RUnlock()
+	return sk.current, sk.keys[sk.current]
+}
+
+// key returns the key with the given ID, or nil.
+func (sk *SealingKeys) key(id uint32) cipher.AEAD {
+	sk.RLock()
+	defer sk.RUnlock()
+	return sk.keys[id]
+}
+
+// A SealedFrame is a message as a store from NewSealedStore hands it to
+// the store it wraps: encoded, then encrypted and authenticated with the
+// key of the given ID, as the Seq'th frame that store has sealed. That
+// store only has to keep the bytes; this is registered with gob, for
+// stores that use it to serialize their messages.
+type SealedFrame struct {
+	KeyID  uint32
+	Seq    uint64
+	Sealed []byte
+}
+
+// An UnreadableMessage is received in place of a message in a store from
+// NewSealedStore that could not be opened: its frame failed
+// authentication, so it was corrupted or tampered with, or sealed by
+// another store; its key has been removed; or it is out of sequence. Err
+// says which.
+type UnreadableMessage struct {
+	KeyID uint32
+	Err   error
+}
+
+// NewSealedStore wraps a MailboxStore so that the messages it holds are
+// encrypted at rest, for use with NewMailboxWithStore. Each message is
+// encoded with encoding/gob, as if it were being sent to another node, so
+// its type must be registered with RegisterType, and then sealed with the
+// current key of the given SealingKeys with AES-GCM. The wrapped store
+// only ever sees SealedFrames, which it can write out wherever it likes.
+// Each is opened and checked again when it is peeked at or taken out, and
+// comes out as an UnreadableMessage if that fails.
+//
+// Each frame is bound to the store that sealed it, by a random ID, and to
+// its place in the sequence of frames that store has sealed, so the
+// wrapped store can't swap in frames from elsewhere, nor replay or reorder
+// its own: a frame that has already been taken out, or isn't where it was
+// put, comes out as an UnreadableMessage with ErrOutOfSequence. Only the
+// store that sealed a frame can open it, so the frames can't outlive it.
+// A wrapped store from NewFairStore still orders the messages as it likes.
+//
+// As every Peek opens a frame, a selective Receive on a large backlog in a
+// sealed store is particularly slow; see MailboxStore. A message that
+// can't be encoded has its error returned by the Send.
+func NewSealedStore(store MailboxStore, keys *SealingKeys) MailboxStore {
+	ss := &sealedStore{store: store, keys: keys}
+	if _, err := io.ReadFull(rand.Reader, ss.id[:]); err != nil {
+		// Without an ID of its own, every frame fails to open.
+		ss.failed = err
+	}
+	if _, isSourced := store.(sourcedStore); isSourced {
+		return sourcedSealedStore{ss}
+	}
+	return ss
+}
+
+type sealedStore struct {
+	store MailboxStore
+	keys  *SealingKeys
+
+	// id is the random ID of the store, and next the Seq of the next frame
+	// it seals. sealed holds the Seqs of the frames in the wrapped store,
+	// in the same order, unless it orders them itself, in which case they
+	// are sorted. failed is set if there is no ID.
+	id     [16]byte
+	next   uint64
+	sealed []uint64
+	failed error
+}
+
+// A sourcedSealedStore is a sealedStore around a sourcedStore, passing on
+// where each message came from.
+type sourcedSealedStore struct {
+	*sealedStore
+}
+
+func (sss sourcedSealedStore) enqueueFrom(source NodeID, msg interface{}) error {
+	frame, err := sss.seal(msg)
+	if err != nil {
+		return err
+	}
+	if err = sss.store.(sourcedStore).enqueueFrom(source, frame); err != nil {
+		return err
+	}
+	// Seqs only go up, so this stays sorted.
+	sss.sealed = append(sss.sealed, frame.Seq)
+	return nil
+}
+
+// sealedMessage is what is encoded for a message in a sealedStore. The
+// wrappers the Mailbox puts around messages have no exported fields, so
+// they are taken apart and put back together around it.
+type sealedMessage struct {
+	Message  interface{}
+	Expiring bool
+	Deadline time.Time
+	Queued   time.Time
+}
+
+func (ss *sealedStore) seal(msg interface{}) (SealedFrame, error) {
+	if ss.failed != nil {
+		return SealedFrame{}, ss.failed
+	}
+	var sm sealedMessage
+	if tm, isTimed := msg.(timedMessage); isTimed {
+		sm.Queued = tm.queued
+		msg = tm.message
+	}
+	if em, isExpiring := msg.(expiringMessage); isExpiring {
+		sm.Expiring = true
+		sm.Deadline = em.deadline
+		msg = em.message
+	}
+	sm.Message = msg
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(sm); err != nil {
+		return SealedFrame{}, err
+	}
+
+	id, aead := ss.keys.currentKey()
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+buf.Len()+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return SealedFrame{}, err
+	}
+	seq := ss.next
+	ss.next++
+	return SealedFrame{
+		KeyID:  id,
+		Seq:    seq,
+		Sealed: aead.Seal(nonce, nonce, buf.Bytes(), ss.frameData(id, seq)),
+	}, nil
+}
+
+// frameData is the additional data a frame is authenticated with, so that
+// its KeyID and Seq can't be changed, and it only opens in this store.
+func (ss *sealedStore) frameData(keyID uint32, seq uint64) []byte {
+	data := make([]byte, len(ss.id)+12)
+	copy(data, ss.id[:])
+	binary.BigEndian.PutUint32(data[len(ss.id):], keyID)
+	binary.BigEndian.PutUint64(data[len(ss.id)+4:], seq)
+	return data
+}
+
+// inSequence returns whether the frame is the one expected at the given
+// place in the wrapped store, forgetting it if it's being taken out. A
+// frame taken out past its place also forgets those before it, which the
+// wrapped store has lost or moved, so one missing frame doesn't put all
+// the rest out of sequence.
+func (ss *sealedStore) inSequence(sf SealedFrame, i int, take bool) bool {
+	j := sort.Search(len(ss.sealed), func(j int) bool { return ss.sealed[j] >= sf.Seq })
+	if j == len(ss.sealed) || ss.sealed[j] != sf.Seq {
+		return false
+	}
+	if _, isSourced := ss.store.(sourcedStore); isSourced {
+		// It orders the frames itself, so any place will do.
+		i = j
+	}
+	if take && j >= i {
+		ss.sealed = append(ss.sealed[:i], ss.sealed[j+1:]...)
+	}
+	return i == j
+}
+
+// open opens the frame found at the given place in the wrapped store,
+// which is being taken out if take is set.
+func (ss *sealedStore) open(frame interface{}, i int, take bool) interface{} {
+	sf, isFrame := frame.(SealedFrame)
+	if !isFrame {
+		return UnreadableMessage{Err: fmt.Errorf("not a sealed frame: %T", frame)}
+	}
+	if !ss.inSequence(sf, i, take) {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: ErrOutOfSequence}
+	}
+	if ss.failed != nil {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: ss.failed}
+	}
+	aead := ss.keys.key(sf.KeyID)
+	if aead == nil {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: ErrUnknownKey}
+	}
+	if len(sf.Sealed) < aead.NonceSize() {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: errors.New("sealed frame is truncated")}
+	}
+	nonce, sealed := sf.Sealed[:aead.NonceSize()], sf.Sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, ss.frameData(sf.KeyID, sf.Seq))
+	if err != nil {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: err}
+	}
+
+	var sm sealedMessage
+	if err := gob.NewDecoder(bytes.NewReader(plain)).Decode(&sm); err != nil {
+		return UnreadableMessage{KeyID: sf.KeyID, Err: err}
+	}
+	msg := sm.Message
+	if sm.Expiring {
+		msg = expiringMessage{sm.Deadline, msg}
+	}
+	if !sm.Queued.IsZero() {
+		msg = timedMessage{sm.Queued, msg}
+	}
+	return msg
+}
+
+func (ss *sealedStore) Enqueue(msg interface{}) error {
+	frame, err := ss.seal(msg)
+	if err != nil {
+		return err
+	}
+	if err = ss.store.Enqueue(frame); err != nil {
+		return err
+	}
+	ss.sealed = append(ss.sealed, frame.Seq)
+	return nil
+}
+
+func (ss *sealedStore) Dequeue() interface{} {
+	return ss.open(ss.store.Dequeue(), 0, true)
+}
+
+func (ss *sealedStore) Peek(i int) interface{} {
+	return ss.open(ss.store.Peek(i), i, false)
+}
+
+func (ss *sealedStore) Remove(i int) interface{} {
+	return ss.open(ss.store.Remove(i), i, true)
+}
+
+func (ss *sealedStore) Len() int {
+	return ss.store.Len()
+}
+
+func (ss *sealedStore) Close() {
+	ss.sealed = nil
+	ss.store.Close()
+}
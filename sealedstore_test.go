@@ -0,0 +1,195 @@
+package reign
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+type sealedTestMessage struct {
+	Value int
+}
+
+func init() {
+	RegisterType(sealedTestMessage{})
+}
+
+func testSealingKeys(t *testing.T) *SealingKeys {
+	keys, err := NewSealingKeys(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestSealedStore(t *testing.T) {
+	connectionServer, _ := noClustering(NullLogger)
+	defer connectionServer.Terminate()
+
+	inner := &cappedStore{capacity: 10}
+	addr, mbox := connectionServer.NewMailboxWithStore(NewSealedStore(inner, testSealingKeys(t)))
+	defer mbox.Terminate()
+
+	addr.Send("secret")
+	addr.Send(sealedTestMessage{1})
+	addr.SendWithDeadline("expired", time.Now().Add(-time.Second))
+	addr.SendWithDeadline("live", time.Now().Add(time.Hour))
+
+	for i := 0; i < inner.Len(); i++ {
+		frame, isFrame := inner.Peek(i).(SealedFrame)
+		if !isFrame || frame.KeyID != 1 {
+			t.Fatal("Wrapped store was given something other than a sealed frame:", inner.Peek(i))
+		}
+		if bytes.Contains(frame.Sealed, []byte("secret")) {
+			t.Fatal("Message was not encrypted")
+		}
+	}
+
+	msg := mbox.Receive(func(i interface{}) bool {
+		_, isTest := i.(sealedTestMessage)
+		return isTest
+	})
+	if msg != (sealedTestMessage{1}) {
+		t.Fatal("Receive did not match the sealed message:", msg)
+	}
+	for _, expected := range []string{"secret", "live"} {
+		if msg, _ := mbox.ReceiveNextAsync(); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+
+	// Frames that have been tampered with fail to open.
+	addr.Send("tampered")
+	frame := inner.Peek(0).(SealedFrame)
+	frame.Sealed[len(frame.Sealed)-1] ^= 1
+	if msg, _ := mbox.ReceiveNextAsync(); msg.(UnreadableMessage).Err == nil {
+		t.Fatal("Tampered frame was opened:", msg)
+	}
+
+	if err := addr.Send(func() {}); err == nil {
+		t.Fatal("Message that can't be encoded was accepted")
+	}
+}
+
+func TestSealedStoreKeyRotation(t *testing.T) {
+	connectionServer, _ := noClustering(NullLogger)
+	defer connectionServer.Terminate()
+
+	keys := testSealingKeys(t)
+	inner := &cappedStore{capacity: 10}
+	addr, mbox := connectionServer.NewMailboxWithStore(NewSealedStore(inner, keys))
+	defer mbox.Terminate()
+
+	addr.Send(1)
+	addr.Send(2)
+	if err := keys.Use(2); err != ErrUnknownKey {
+		t.Fatal("Used a key that was never added:", err)
+	}
+	if err := keys.Add(2, bytes.Repeat([]byte{2}, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Use(2); err != nil {
+		t.Fatal(err)
+	}
+	addr.Send(3)
+	if frame := inner.Peek(2).(SealedFrame); frame.KeyID != 2 {
+		t.Fatal("New message not sealed with the new key:", frame.KeyID)
+	}
+
+	// Messages sealed with the old key still open while it is kept.
+	if msg := mbox.ReceiveNext(); msg != 1 {
+		t.Fatal("Message sealed with the old key did not open:", msg)
+	}
+
+	if err := keys.Remove(2); err == nil {
+		t.Fatal("Removed the current key")
+	}
+	if err := keys.Remove(1); err != nil {
+		t.Fatal(err)
+	}
+	if msg := mbox.ReceiveNext(); msg != (UnreadableMessage{KeyID: 1, Err: ErrUnknownKey}) {
+		t.Fatal("Message sealed with a removed key opened:", msg)
+	}
+	if msg := mbox.ReceiveNext(); msg != 3 {
+		t.Fatal("Message sealed with the new key did not open:", msg)
+	}
+}
+
+func TestSealedStoreSequence(t *testing.T) {
+	connectionServer, _ := noClustering(NullLogger)
+	defer connectionServer.Terminate()
+
+	keys := testSealingKeys(t)
+	inner := &cappedStore{capacity: 10}
+	addr, mbox := connectionServer.NewMailboxWithStore(NewSealedStore(inner, keys))
+	defer mbox.Terminate()
+
+	// A frame the wrapped store replays is out of sequence.
+	addr.Send(1)
+	replayed := inner.Peek(0)
+	if msg := mbox.ReceiveNext(); msg != 1 {
+		t.Fatal("Unexpected message:", msg)
+	}
+	inner.Enqueue(replayed)
+	if msg := mbox.ReceiveNext(); msg != (UnreadableMessage{KeyID: 1, Err: ErrOutOfSequence}) {
+		t.Fatal("Replayed frame was opened:", msg)
+	}
+
+	// As are frames it reorders, but those after them still open.
+	addr.Send(2)
+	addr.Send(3)
+	addr.Send(4)
+	first := inner.Dequeue()
+	inner.Enqueue(first)
+	for _, expected := range []interface{}{
+		UnreadableMessage{KeyID: 1, Err: ErrOutOfSequence},
+		4,
+		UnreadableMessage{KeyID: 1, Err: ErrOutOfSequence},
+	} {
+		if msg := mbox.ReceiveNext(); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+	addr.Send(5)
+	if msg := mbox.ReceiveNext(); msg != 5 {
+		t.Fatal("Unexpected message:", msg)
+	}
+
+	// A frame from another store with the same keys doesn't open, even in
+	// the place of one of this store's own.
+	otherInner := &cappedStore{capacity: 10}
+	otherAddr, other := connectionServer.NewMailboxWithStore(NewSealedStore(otherInner, keys))
+	defer other.Terminate()
+	otherAddr.Send(6)
+	addr.Send(7)
+	inner.Dequeue()
+	inner.Enqueue(otherInner.Peek(0))
+	msg := mbox.ReceiveNext().(UnreadableMessage)
+	if msg.Err == nil {
+		t.Fatal("Frame from another store was opened")
+	}
+}
+
+func TestSealedFairStore(t *testing.T) {
+	store := NewSealedStore(NewFairStore(nil), testSealingKeys(t))
+	sourced, isSourced := store.(sourcedStore)
+	if !isSourced {
+		t.Fatal("Sealed fair store doesn't take the source")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := sourced.enqueueFrom(2, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sourced.enqueueFrom(3, 10); err != nil {
+		t.Fatal(err)
+	}
+	// The fair store takes turns between the sources, which is not the
+	// order the messages were sealed in, and that's fine.
+	for _, expected := range []interface{}{0, 10, 1, 2} {
+		if msg := store.Dequeue(); msg != expected {
+			t.Fatal("Unexpected message:", msg, "expected", expected)
+		}
+	}
+}
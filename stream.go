@@ -0,0 +1,353 @@
+package reign
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+const (
+	defaultStreamChunkSize = 64 * 1024
+	defaultStreamWindow    = 4
+	defaultMaxStreamSize   = 64 * 1024 * 1024
+	defaultMaxOpenStreams  = 16
+	defaultStreamTimeout   = 30 * time.Second
+)
+
+// StreamChunkSize is the largest piece, in bytes, that SendStream will
+// send across the network at once. Values below 1 mean the default of
+// 64KiB.
+var StreamChunkSize = defaultStreamChunkSize
+
+// StreamWindow is how many pieces of a stream SendStream lets be on their
+// way to the remote node before it waits for the node to acknowledge
+// them. Values below 1 mean the default of 4.
+var StreamWindow = defaultStreamWindow
+
+// MaxStreamSize is the largest stream, in bytes, that this node will
+// reassemble; a larger one is aborted once it passes this size. Values
+// below 1 mean the default of 64MiB.
+var MaxStreamSize = defaultMaxStreamSize
+
+// MaxOpenStreams is how many streams this node will reassemble from each
+// other node at once; one started while that many are still arriving is
+// refused. Together with MaxStreamSize, this bounds the memory another
+// node can take up with streams. Values below 1 mean the default of 16.
+var MaxOpenStreams = defaultMaxOpenStreams
+
+// StreamTimeout is how long a stream may go without progress before it
+// is given up on: on the receiving node, without another piece of it
+// arriving, and on the sending node, without the pieces that have been
+// sent being acknowledged. Values below 1 mean the default of 30 seconds.
+var StreamTimeout = defaultStreamTimeout
+
+// ErrStreamingUnsupported is returned by SendStream when the remote node
+// is running a version of reign that can't receive streams.
+var ErrStreamingUnsupported = errors.New("the remote node does not support streamed messages")
+
+// ErrStreamRefused is returned by SendStream when the remote node gave up
+// on receiving the stream, because it was larger than the node's
+// MaxStreamSize, the node already had MaxOpenStreams arriving from this
+// one, part of it was dropped, or too long passed between its pieces.
+var ErrStreamRefused = errors.New("the remote node gave up on receiving the stream")
+
+// ErrStreamInterrupted is returned by SendStream when the connection to
+// the remote node was lost in the middle of the stream, or the node did
+// not acknowledge the pieces sent within the StreamTimeout.
+var ErrStreamInterrupted = errors.New("the stream to the remote node was interrupted")
+
+// StreamAborted is received in place of a message sent with SendStream
+// that could not be completed. Node is the node it was being sent from.
+type StreamAborted struct {
+	Node   NodeID
+	Reason string
+}
+
+// partialStream is a stream being received from the remote node. last is
+// when its last piece arrived, and timer fires StreamTimeout after that.
+type partialStream struct {
+	target MailboxID
+	next   uint32
+	data   []byte
+	last   time.Time
+	timer  clockTimer
+}
+
+// outgoingStream is a stream being sent to the remote node: how many of
+// its pieces have been acknowledged, and whether it was refused or
+// interrupted. It is covered by the main lock.
+type outgoingStream struct {
+	acked       uint32
+	refused     bool
+	interrupted bool
+}
+
+// streamStalled tells Serve that a stream being received may not have had
+// a piece for StreamTimeout.
+type streamStalled struct {
+	stream uint64
+}
+
+func (rm *remoteMailboxes) sendStream(target MailboxID, r io.Reader) error {
+	if version := rm.peerVersion(); version != 0 && version < 3 {
+		return ErrStreamingUnsupported
+	}
+
+	size := StreamChunkSize
+	if size < 1 {
+		size = defaultStreamChunkSize
+	}
+
+	stream := atomic.AddUint64(&rm.lastStream, 1)
+	out := &outgoingStream{}
+	rm.Lock()
+	rm.sendingStreams[stream] = out
+	rm.Unlock()
+	defer func() {
+		rm.Lock()
+		delete(rm.sendingStreams, stream)
+		rm.Unlock()
+	}()
+
+	policy := rm.connectionServer.Cluster.OutgoingQueuePolicy
+	for seq := uint32(0); ; seq++ {
+		if err := rm.awaitStreamWindow(out, seq); err != nil {
+			if err == ErrStreamInterrupted {
+				// Let the receiver free what it has of the stream, if
+				// the pieces already sent do still get there.
+				_ = rm.queueOutgoing(target, &internal.StreamChunk{
+					Stream: stream, Seq: seq, Abort: true,
+				}, OverflowBlock)
+			}
+			return err
+		}
+
+		buf := make([]byte, size)
+		n, err := io.ReadFull(r, buf)
+		chunk := &internal.StreamChunk{Stream: stream, Seq: seq, Data: buf[:n]}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			chunk.Final = true
+		default:
+			chunk.Data = nil
+			chunk.Abort = true
+		}
+
+		sendErr := rm.queueOutgoing(target, chunk, policy)
+		if sendErr != nil {
+			return sendErr
+		}
+		if chunk.Abort {
+			return err
+		}
+		if chunk.Final {
+			return nil
+		}
+
+		// Once the stream has started, failing to queue a piece would
+		// leave the receiver waiting for the rest of it, so the
+		// remaining pieces wait for room instead. (Dropped pieces are
+		// fine; the receiver notices the gap, or the timeout.)
+		if policy == OverflowError {
+			policy = OverflowBlock
+		}
+	}
+}
+
+// awaitStreamWindow waits until the given piece of the stream may be
+// sent, which is once fewer than StreamWindow of the pieces before it are
+// waiting to be acknowledged. Nodes older than protocol version 12 don't
+// acknowledge streams, so nothing waits for those.
+func (rm *remoteMailboxes) awaitStreamWindow(out *outgoingStream, seq uint32) error {
+	window := StreamWindow
+	if window < 1 {
+		window = defaultStreamWindow
+	}
+	timeout := streamTimeout()
+
+	rm.Lock()
+	defer rm.Unlock()
+
+	var deadline time.Time
+	for {
+		switch {
+		case out.refused:
+			return ErrStreamRefused
+		case out.interrupted:
+			return ErrStreamInterrupted
+		case rm.version != 0 && rm.version < 12:
+			return nil
+		case seq < out.acked+uint32(window):
+			return nil
+		}
+
+		if deadline.IsZero() {
+			deadline = time.Now().Add(timeout)
+			timer := time.AfterFunc(timeout, func() {
+				rm.Lock()
+				rm.condition.Broadcast()
+				rm.Unlock()
+			})
+			defer timer.Stop()
+		} else if !time.Now().Before(deadline) {
+			return ErrStreamInterrupted
+		}
+		rm.condition.Wait()
+	}
+}
+
+// streamAcknowledged records the remote node's acknowledgement of a
+// stream being sent to it.
+func (rm *remoteMailboxes) streamAcknowledged(ack internal.StreamAck) {
+	rm.Lock()
+	defer rm.Unlock()
+
+	out, exists := rm.sendingStreams[ack.Stream]
+	if !exists {
+		return
+	}
+	if ack.Refused {
+		out.refused = true
+	} else if ack.Seq >= out.acked {
+		out.acked = ack.Seq + 1
+	}
+	rm.condition.Broadcast()
+}
+
+// acknowledgeChunk tells the sending node that the piece of the stream
+// has arrived, or with refused, that the rest of it is not wanted.
+func (rm *remoteMailboxes) acknowledgeChunk(chunk internal.StreamChunk, refused bool) {
+	if rm.peerVersion() < 12 {
+		return
+	}
+	_ = rm.send(&internal.StreamAck{
+		Stream:  chunk.Stream,
+		Seq:     chunk.Seq,
+		Refused: refused,
+	}, "stream acknowledgement")
+}
+
+// receiveChunk reassembles the streams coming from the remote node.
+func (rm *remoteMailboxes) receiveChunk(target MailboxID, chunk internal.StreamChunk) {
+	partial, exists := rm.streams[chunk.Stream]
+	if !exists {
+		if chunk.Seq != 0 {
+			// The start of this stream was lost, either to a
+			// disconnection, which abortStreams has already reported,
+			// or to the OverflowDropOldest policy, in which case the
+			// whole stream is just as dropped as any other message.
+			// Either way, the sender may as well stop.
+			if !chunk.Abort {
+				rm.acknowledgeChunk(chunk, true)
+			}
+			return
+		}
+		maxOpen := MaxOpenStreams
+		if maxOpen < 1 {
+			maxOpen = defaultMaxOpenStreams
+		}
+		if len(rm.streams) >= maxOpen && !chunk.Abort {
+			// The receiver never hears of a stream refused before it
+			// started to arrive.
+			rm.Warnf("Refusing a stream from node %d, which already has %d streams arriving",
+				rm.remoteNode, len(rm.streams))
+			rm.acknowledgeChunk(chunk, true)
+			return
+		}
+		partial = &partialStream{target: target}
+		stream := chunk.Stream
+		partial.timer = rm.connectionServer.clock.AfterFunc(streamTimeout(), func() {
+			rm.Send(streamStalled{stream})
+		})
+		rm.streams[chunk.Stream] = partial
+	}
+
+	maxSize := MaxStreamSize
+	if maxSize < 1 {
+		maxSize = defaultMaxStreamSize
+	}
+	switch {
+	case chunk.Abort:
+		rm.abortStream(chunk.Stream, "the sender could not finish the stream")
+		return
+	case chunk.Seq != partial.next:
+		rm.abortStream(chunk.Stream, "part of the stream was dropped")
+		rm.acknowledgeChunk(chunk, true)
+		return
+	case len(partial.data)+len(chunk.Data) > maxSize:
+		rm.abortStream(chunk.Stream, "the stream is larger than MaxStreamSize")
+		rm.acknowledgeChunk(chunk, true)
+		return
+	}
+
+	partial.data = append(partial.data, chunk.Data...)
+	partial.next++
+	partial.last = rm.connectionServer.clock.Now()
+	partial.timer.Reset(streamTimeout())
+
+	if chunk.Final {
+		partial.timer.Stop()
+		delete(rm.streams, chunk.Stream)
+		addr := Address{
+			mailboxID:        partial.target,
+			connectionServer: rm.connectionServer,
+		}
+		addr.Send(partial.data)
+		return
+	}
+	rm.acknowledgeChunk(chunk, false)
+}
+
+// expireStream aborts the stream if no more of it has arrived in the
+// StreamTimeout. The timer may have fired just as another piece arrived
+// and reset it, in which case it will fire again.
+func (rm *remoteMailboxes) expireStream(msg streamStalled) {
+	partial, exists := rm.streams[msg.stream]
+	if !exists {
+		return
+	}
+	if rm.connectionServer.clock.Now().Sub(partial.last) < streamTimeout() {
+		return
+	}
+	rm.abortStream(msg.stream, "no more of the stream arrived")
+	rm.acknowledgeChunk(internal.StreamChunk{Stream: msg.stream, Seq: partial.next}, true)
+}
+
+func streamTimeout() time.Duration {
+	if StreamTimeout < 1 {
+		return defaultStreamTimeout
+	}
+	return StreamTimeout
+}
+
+func (rm *remoteMailboxes) abortStream(stream uint64, reason string) {
+	partial := rm.streams[stream]
+	delete(rm.streams, stream)
+	partial.timer.Stop()
+
+	addr := Address{
+		mailboxID:        partial.target,
+		connectionServer: rm.connectionServer,
+	}
+	addr.Send(StreamAborted{Node: rm.remoteNode, Reason: reason})
+}
+
+// abortStreams aborts all the streams being received, and interrupts the
+// ones being sent, such as when the connection they were going over has
+// gone down.
+func (rm *remoteMailboxes) abortStreams() {
+	for stream := range rm.streams {
+		rm.abortStream(stream, "the connection to the sending node was lost")
+	}
+
+	rm.Lock()
+	for _, out := range rm.sendingStreams {
+		out.interrupted = true
+	}
+	rm.condition.Broadcast()
+	rm.Unlock()
+}
@@ -0,0 +1,232 @@
+package reign
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/thejerf/reign/internal"
+)
+
+// failingReader returns the given data, then an error.
+type failingReader struct {
+	data []byte
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if len(fr.data) == 0 {
+		return 0, errors.New("the disk caught fire")
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func TestSendStream(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	defer func(size int) { StreamChunkSize = size }(StreamChunkSize)
+	StreamChunkSize = 10
+
+	payload := make([]byte, 1005)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, size := range []int{0, 10, 1005} {
+		if err := ntb.rem1_2.SendStream(bytes.NewReader(payload[:size])); err != nil {
+			t.Fatal(err)
+		}
+		msg, ok := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+		if !ok {
+			t.Fatal("stream not received")
+		}
+		if data, isBytes := msg.([]byte); !isBytes || !bytes.Equal(data, payload[:size]) {
+			t.Fatalf("stream of %d bytes received incorrectly: %#v", size, msg)
+		}
+	}
+
+	// locally, too
+	if err := ntb.addr1_1.SendStream(bytes.NewReader(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := ntb.mailbox1_1.ReceiveNext(); !bytes.Equal(msg.([]byte), payload) {
+		t.Fatal("local stream received incorrectly")
+	}
+
+	// A failing reader aborts the stream.
+	if err := ntb.rem1_2.SendStream(&failingReader{payload[:25]}); err == nil {
+		t.Fatal("reader error not returned")
+	}
+	msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if aborted, isAborted := msg.(StreamAborted); !isAborted || aborted.Node != 1 {
+		t.Fatalf("expected an aborted stream, got %#v", msg)
+	}
+
+	// So does a lost piece.
+	for _, seq := range []uint32{0, 2} {
+		ntb.remote1to2.sendOutgoing(ntb.mailbox1_2.id, &internal.StreamChunk{
+			Stream: 1000, Seq: seq, Data: []byte("lost"),
+		})
+	}
+	msg, _ = ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if _, isAborted := msg.(StreamAborted); !isAborted {
+		t.Fatalf("expected an aborted stream, got %#v", msg)
+	}
+
+	// Old nodes can't receive streams at all.
+	ntb.remote1to2.Lock()
+	ntb.remote1to2.version = 2
+	ntb.remote1to2.Unlock()
+	if ntb.rem1_2.SendStream(bytes.NewReader(payload)) != ErrStreamingUnsupported {
+		t.Fatal("could stream to a version 2 node")
+	}
+}
+
+func TestSendStreamDisconnection(t *testing.T) {
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	events, mbox := ntb.c1.NewMailbox()
+	defer mbox.Terminate()
+	ntb.c1.SubscribeLinkEvents(events)
+
+	received := make(chan struct{})
+	ntb.remote2to1.Send(newExamineMessages{func(x interface{}) bool {
+		if imm, isIncoming := x.(internal.IncomingMailboxMessage); isIncoming {
+			if _, isChunk := imm.Message.(internal.StreamChunk); isChunk {
+				close(received)
+				return false
+			}
+		}
+		return true
+	}})
+
+	// Send the start of a stream that never finishes, and then lose the
+	// connection.
+	r, w := io.Pipe()
+	go ntb.rem1_2.SendStream(r)
+	w.Write(make([]byte, StreamChunkSize))
+	<-received
+	ntb.remote1to2.Send(internal.DestroyConnection{})
+
+	msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if _, isAborted := msg.(StreamAborted); !isAborted {
+		t.Fatalf("expected an aborted stream, got %#v", msg)
+	}
+
+	awaitLinkState(t, mbox, 2, LinkConnected)
+	w.Close()
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.read += n
+	return n, err
+}
+
+func TestStreamWindow(t *testing.T) {
+	defer func(size, window int, timeout time.Duration) {
+		StreamChunkSize = size
+		StreamWindow = window
+		StreamTimeout = timeout
+	}(StreamChunkSize, StreamWindow, StreamTimeout)
+	StreamChunkSize = 10
+	StreamWindow = 2
+	StreamTimeout = 50 * time.Millisecond
+
+	// Node 2 isn't up to acknowledge anything, so only the window is
+	// read before the sender gives up.
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+
+	r := &countingReader{Reader: bytes.NewReader(make([]byte, 100))}
+	if err := ntb.rem1_2.SendStream(r); err != ErrStreamInterrupted {
+		t.Fatal("Unacknowledged stream not interrupted:", err)
+	}
+	if r.read != 20 {
+		t.Fatal("Read", r.read, "bytes ahead of the acknowledgements")
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	defer func(size, max int, timeout time.Duration) {
+		StreamChunkSize = size
+		MaxStreamSize = max
+		StreamTimeout = timeout
+	}(StreamChunkSize, MaxStreamSize, StreamTimeout)
+	StreamChunkSize = 10
+	MaxStreamSize = 25
+	StreamTimeout = 20 * time.Millisecond
+
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	// A stream that's too large is refused.
+	if err := ntb.rem1_2.SendStream(bytes.NewReader(make([]byte, 100))); err != ErrStreamRefused {
+		t.Fatal("Oversized stream not refused:", err)
+	}
+	msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if _, isAborted := msg.(StreamAborted); !isAborted {
+		t.Fatalf("expected an aborted stream, got %#v", msg)
+	}
+
+	// One whose end never arrives is given up on.
+	ntb.remote1to2.sendOutgoing(ntb.mailbox1_2.id, &internal.StreamChunk{
+		Stream: 1000, Data: []byte("start"),
+	})
+	msg, _ = ntb.mailbox1_2.ReceiveNextTimeout(timeout)
+	if aborted, isAborted := msg.(StreamAborted); !isAborted || aborted.Reason != "no more of the stream arrived" {
+		t.Fatalf("expected a stalled stream, got %#v", msg)
+	}
+}
+
+func TestStreamOpenLimit(t *testing.T) {
+	defer func(size, open int) {
+		StreamChunkSize = size
+		MaxOpenStreams = open
+	}(StreamChunkSize, MaxOpenStreams)
+	StreamChunkSize = 10
+	MaxOpenStreams = 2
+
+	ntb := testbed(nil)
+	defer ntb.terminate()
+
+	for stream := uint64(2000); stream < 2002; stream++ {
+		ntb.remote1to2.sendOutgoing(ntb.mailbox1_2.id, &internal.StreamChunk{
+			Stream: stream, Data: []byte("start"),
+		})
+	}
+
+	// With as many streams arriving as are allowed, another is refused
+	// from the start, and its receiver never hears of it.
+	if err := ntb.rem1_2.SendStream(bytes.NewReader(make([]byte, 100))); err != ErrStreamRefused {
+		t.Fatal("Stream over the limit not refused:", err)
+	}
+	if msg, received := ntb.mailbox1_2.ReceiveNextTimeout(10 * time.Millisecond); received {
+		t.Fatalf("Refused stream was received: %#v", msg)
+	}
+
+	// Once one of them is done, there is room again.
+	ntb.remote1to2.sendOutgoing(ntb.mailbox1_2.id, &internal.StreamChunk{
+		Stream: 2000, Seq: 1, Data: []byte("end"), Final: true,
+	})
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); !bytes.Equal(msg.([]byte), []byte("startend")) {
+		t.Fatalf("Open stream not finished: %#v", msg)
+	}
+	if err := ntb.rem1_2.SendStream(bytes.NewReader(make([]byte, 30))); err != nil {
+		t.Fatal("Stream under the limit failed:", err)
+	}
+	if msg, _ := ntb.mailbox1_2.ReceiveNextTimeout(timeout); len(msg.([]byte)) != 30 {
+		t.Fatalf("Stream under the limit not received: %#v", msg)
+	}
+}
@@ -3,6 +3,7 @@ package reign
 import (
 	"fmt"
 	"runtime"
+	"testing"
 	"time"
 )
 
@@ -107,8 +108,10 @@ func unstartedTestbed(spec *ClusterSpec) *NetworkTestBed {
 
 	var err error
 
-	spec.NodeKeyPEM = string(node2_1Key)
-	spec.NodeCertPEM = string(node2_1Cert)
+	if !spec.DevelopmentMode {
+		spec.NodeKeyPEM = string(node2_1Key)
+		spec.NodeCertPEM = string(node2_1Cert)
+	}
 	setConnections(nil)
 	ntb.c2, _, err = createFromSpec(spec, 2, NullLogger)
 	if err != nil {
@@ -116,8 +119,10 @@ func unstartedTestbed(spec *ClusterSpec) *NetworkTestBed {
 	}
 	setConnections(nil)
 
-	spec.NodeKeyPEM = string(node1_1Key)
-	spec.NodeCertPEM = string(node1_1Cert)
+	if !spec.DevelopmentMode {
+		spec.NodeKeyPEM = string(node1_1Key)
+		spec.NodeCertPEM = string(node1_1Cert)
+	}
 	ntb.c1, _, err = createFromSpec(spec, 1, NullLogger)
 	if err != nil {
 		panic(err)
@@ -177,6 +182,33 @@ func testbed(spec *ClusterSpec) *NetworkTestBed {
 	return ntb
 }
 
+// awaitLinkState receives from a mailbox subscribed to the link events
+// until the given node's link reaches the given state.
+func awaitLinkState(t *testing.T, m *Mailbox, node NodeID, state LinkState) {
+	for {
+		msg, ok := m.ReceiveNextTimeout(5 * time.Second)
+		if !ok {
+			t.Fatalf("link to node %d never became %s", node, state)
+		}
+		if event := msg.(LinkEvent); event.Node == node && event.State == state {
+			return
+		}
+	}
+}
+
+// awaitCondition polls until the condition holds, failing the test with
+// the message if it doesn't within the timeout. The message is only built
+// then, so it can describe what was last seen.
+func awaitCondition(t *testing.T, condition func() bool, msg func() string) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func panics(f func()) (panics bool) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -0,0 +1,100 @@
+package reign
+
+// This file lets a node be tested without a cluster, by replacing its
+// connections to the other nodes with ClusterSenders. The reigntest
+// package provides one that records what is sent.
+
+import "github.com/thejerf/reign/internal"
+
+// A ClusterSender stands in for the network connection to a remote node,
+// in a node created by NewTestNode.
+//
+// SendClusterMessage receives each message the node would have written to
+// the connection. These are the wire types of reign's internal package,
+// which only packages within reign can name, so use reigntest.Sender
+// rather than implementing this yourself. A returned error is handled
+// just as a failed write would be; a network error such as io.EOF drops
+// the connection.
+//
+// Connected is called once, before anything is sent, with the function
+// that hands the node a message as if it had arrived from the remote node.
+//
+// TerminateConnection is called when the node drops the connection,
+// possibly more than once. The remote node is then disconnected for good,
+// and the ClusterSender is not used again.
+type ClusterSender interface {
+	Connected(receive func(internal.ClusterMessage) error)
+	SendClusterMessage(internal.ClusterMessage) error
+	TerminateConnection()
+}
+
+// testConnection adapts a ClusterSender to the messageSender the
+// remoteMailboxes use.
+type testConnection struct {
+	ClusterSender
+	rm *remoteMailboxes
+}
+
+func (tc *testConnection) receive(cm internal.ClusterMessage) error {
+	return tc.rm.receive(internal.Normalize(cm))
+}
+
+func (tc *testConnection) send(cm *internal.ClusterMessage) error {
+	return tc.SendClusterMessage(*cm)
+}
+
+func (tc *testConnection) terminate() {
+	tc.TerminateConnection()
+	// This is called with the remoteMailboxes locked. A real connection
+	// only closes its socket here, and unsets itself when its reader
+	// notices.
+	tc.rm.connectionServer.goroutine("closing the test connection", func() { tc.rm.unsetConnection(tc) })
+}
+
+// NewTestNode creates the given node of a cluster made up of it and the
+// nodes in remotes, without any networking, so code that uses remote
+// Addresses can be unit tested. Each remote node is connected from the
+// start through its ClusterSender, which receives everything sent to it:
+// messages for its mailboxes, link registrations, termination notices,
+// and the registry's traffic. Use Address.UnmarshalFromID to get an
+// Address for a mailbox on a remote node.
+//
+// Messages only arrive from the remote nodes when a ClusterSender passes
+// them along, and once a connection is dropped it stays down.
+//
+// As with the other constructors, only one node may exist at a time; call
+// Terminate on the returned ConnectionService when done with it. It should
+// be run with Serve, or added to a supervisor, for the registry and the
+// remote connections to work.
+func NewTestNode(thisNode NodeID, remotes map[NodeID]ClusterSender, log ClusterLogger) (ConnectionService, Names) {
+	if connections != nil {
+		panic("redefining the cluster is not permitted")
+	}
+	if _, isRemote := remotes[thisNode]; isRemote {
+		panic("the test node can not also be one of its remote nodes")
+	}
+
+	node := &NodeDefinition{ID: thisNode}
+	cluster := &Cluster{
+		Nodes:         map[NodeID]*NodeDefinition{thisNode: node},
+		ThisNode:      node,
+		ClusterLogger: resolveLog(log),
+	}
+	cs := newConnections(cluster, thisNode)
+
+	for nodeID, sender := range remotes {
+		cluster.Nodes[nodeID] = &NodeDefinition{ID: nodeID}
+		rm := newRemoteMailboxes(cs, cs.mailboxes, cluster.ClusterLogger, thisNode, nodeID)
+		cs.remoteMailboxes[nodeID] = rm
+		cs.Add(rm)
+
+		tc := &testConnection{sender, rm}
+		sender.Connected(tc.receive)
+		// This can't fail, as nothing else has connected yet.
+		_ = rm.setConnection(tc, clusterVersion, "test node")
+		rm.Send(connectionReady{})
+	}
+
+	setConnections(cs)
+	return cs, cs.registry
+}
@@ -0,0 +1,76 @@
+package reign
+
+import (
+	"sync"
+)
+
+// An UnroutableHandler is called with messages that arrive from another
+// node for a local mailbox that no longer exists. It returns whether it
+// handled the message; if it did, the message is considered delivered,
+// and if not, it is dropped as it would have been without the handler.
+//
+// The handler could, for instance, forward the message to a mailbox that
+// has taken over from the terminated one. It is called synchronously by
+// the loop that receives everything from the sending node, so it must
+// not block, or that whole node's traffic will wait on it.
+//
+// It is also called with the messages for remote mailboxes that are
+// evicted from the outgoing queue by ClusterSpec.OutgoingQueueMaxAge,
+// which can be told apart by the target's NodeID not being this node's.
+// These calls may come from the sending goroutine as well. So are the
+// messages dropped for being relayed between the nodes more than
+// ClusterSpec.MaxHops times, and those still waiting in the outgoing
+// queue when the node is stopped, which are never sent.
+type UnroutableHandler func(target MailboxID, msg interface{}) (handled bool)
+
+// unroutableHolder lets the UnroutableHandler be installed or replaced
+// while the internal loops are running.
+type unroutableHolder struct {
+	handler UnroutableHandler
+	sync.RWMutex
+}
+
+func (uh *unroutableHolder) get() UnroutableHandler {
+	uh.RLock()
+	defer uh.RUnlock()
+	return uh.handler
+}
+
+// SetUnroutableHandler installs the handler for messages from other nodes
+// whose target mailbox is gone. Pass nil, the default, to just drop them.
+func (cs *connectionServer) SetUnroutableHandler(handler UnroutableHandler) {
+	cs.unroutable.Lock()
+	defer cs.unroutable.Unlock()
+	cs.unroutable.handler = handler
+}
+
+// handleUnroutable is called with a message from the given node that
+// could not be delivered to its target, which is dropped for the given
+// reason unless the handler takes it.
+func (cs *connectionServer) handleUnroutable(reason string, from NodeID, target MailboxID, msg interface{}) {
+	if handler := cs.unroutable.get(); handler != nil && handler(target, msg) {
+		return
+	}
+	cs.dropped(reason, from, 1)
+	cs.Tracef("Dropping message for %x, %s: %#v", target, reason, msg)
+}
+
+// handleEvicted is called with a message for a remote mailbox that waited
+// too long in the outgoing queue to its node.
+func (cs *connectionServer) handleEvicted(target MailboxID, msg interface{}) {
+	if handler := cs.unroutable.get(); handler != nil && handler(target, msg) {
+		return
+	}
+	cs.dropped(DropEvicted, target.NodeID(), 1)
+	cs.Tracef("Dropping message for %x that waited too long to be sent: %#v", target, msg)
+}
+
+// handleAbandoned is called with a message for a remote mailbox that was
+// still waiting to be sent when the loop sending to its node stopped.
+func (cs *connectionServer) handleAbandoned(target MailboxID, msg interface{}) {
+	if handler := cs.unroutable.get(); handler != nil && handler(target, msg) {
+		return
+	}
+	cs.dropped(DropAbandoned, target.NodeID(), 1)
+	cs.Tracef("Dropping message for %x that was never sent: %#v", target, msg)
+}
@@ -0,0 +1,118 @@
+package reign
+
+import (
+	"encoding"
+	"encoding/gob"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// RegisterStandardTypes registers the standard library types that are
+// handy to send as messages in their own right, rather than as fields of
+// a struct, which need no registration: time.Time, time.Duration, net.IP,
+// *big.Int, *big.Rat and *big.Float. They all encode consistently across
+// nodes, with the caveats for time.Time given in WireWarnings.
+//
+// This is not done automatically because gob refuses to register a type
+// twice under different names, so a program that already registers
+// big.Int{} rather than &big.Int{}, say, would panic.
+func RegisterStandardTypes() {
+	RegisterType(time.Time{})
+	RegisterType(time.Duration(0))
+	RegisterType(net.IP{})
+	RegisterType(&big.Int{})
+	RegisterType(&big.Rat{})
+	RegisterType(&big.Float{})
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	gobEncoderType    = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+	binaryMarshalType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// WireWarnings returns what will not survive sending values of the given
+// value's type to another node, even though they encode without error,
+// for the "works locally, breaks remotely" bugs that gob makes easy.
+//
+// Unexported struct fields, and those holding channels or functions, are
+// silently left out, so the receiver gets their zero values. A time.Time
+// loses its monotonic clock reading, and its Location becomes a fixed
+// offset, so received times must be compared with Equal rather than ==,
+// and may print in a different zone.
+//
+// Types that do their own encoding, with GobEncode or MarshalBinary, are
+// taken to know what they are doing, and the contents of fields of
+// interface type can't be known in advance. reign logs these warnings for
+// the first message of each type sent to another node; call this in a
+// test to catch them sooner.
+func WireWarnings(value interface{}) []string {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		return nil
+	}
+	warnings := []string{}
+	wireWarnings(t, t.String(), map[reflect.Type]bool{}, &warnings)
+	return warnings
+}
+
+func wireWarnings(t reflect.Type, path string, seen map[reflect.Type]bool, warnings *[]string) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+
+	if t == timeType {
+		*warnings = append(*warnings, fmt.Sprintf(
+			"%s is a time.Time, which loses its monotonic clock reading and keeps only the offset of its Location",
+			path))
+		return
+	}
+	if encodesItself(t) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		wireWarnings(t.Elem(), path, seen, warnings)
+	case reflect.Map:
+		wireWarnings(t.Key(), path, seen, warnings)
+		wireWarnings(t.Elem(), path, seen, warnings)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fieldPath := path + "." + field.Name
+			switch {
+			case field.PkgPath != "":
+				*warnings = append(*warnings, fmt.Sprintf("%s is unexported, so it is not sent", fieldPath))
+			case field.Type.Kind() == reflect.Chan || field.Type.Kind() == reflect.Func:
+				*warnings = append(*warnings, fmt.Sprintf("%s is a %s, so it is not sent", fieldPath, field.Type.Kind()))
+			default:
+				wireWarnings(field.Type, fieldPath, seen, warnings)
+			}
+		}
+	}
+}
+
+// encodesItself returns whether gob uses the type's own encoding, rather
+// than looking inside it.
+func encodesItself(t reflect.Type) bool {
+	for _, encoder := range []reflect.Type{gobEncoderType, binaryMarshalType} {
+		if t.Implements(encoder) || reflect.PtrTo(t).Implements(encoder) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnLossy logs the WireWarnings for a message, if there are any.
+func warnLossy(msg interface{}, log ClusterLogger) {
+	if warnings := WireWarnings(msg); len(warnings) > 0 {
+		log.Warnf("Messages of type %T will not arrive exactly as they were sent: %s",
+			msg, strings.Join(warnings, "; "))
+	}
+}
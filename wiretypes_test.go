@@ -0,0 +1,95 @@
+package reign
+
+import (
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type lossyInner struct {
+	When   time.Time
+	hidden int
+}
+
+type lossyMessage struct {
+	Name    string
+	Inner   []lossyInner
+	Done    chan struct{}
+	private string
+}
+
+// customMessage does its own encoding, so what is in it is up to it.
+type customMessage struct {
+	hidden int
+}
+
+func (cm customMessage) MarshalBinary() ([]byte, error) {
+	return []byte{byte(cm.hidden)}, nil
+}
+
+func (cm *customMessage) UnmarshalBinary(b []byte) error {
+	cm.hidden = int(b[0])
+	return nil
+}
+
+func init() {
+	RegisterType(lossyMessage{})
+}
+
+func TestWireWarnings(t *testing.T) {
+	expected := []string{
+		"reign.lossyMessage.Inner.When is a time.Time, which loses its monotonic clock reading and keeps only the offset of its Location",
+		"reign.lossyMessage.Inner.hidden is unexported, so it is not sent",
+		"reign.lossyMessage.Done is a chan, so it is not sent",
+		"reign.lossyMessage.private is unexported, so it is not sent",
+	}
+	warnings := WireWarnings(lossyMessage{})
+	if strings.Join(warnings, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected warnings: %#v", warnings)
+	}
+
+	for _, clean := range []interface{}{nil, "moo", customMessage{}, big.NewInt(1), MailboxTerminated(0), TerminatedWithReason{}} {
+		if warnings := WireWarnings(clean); len(warnings) != 0 {
+			t.Fatalf("Unexpected warnings for %T: %#v", clean, warnings)
+		}
+	}
+	if warnings := WireWarnings(time.Now()); len(warnings) != 1 {
+		t.Fatalf("Unexpected warnings for a time: %#v", warnings)
+	}
+}
+
+func TestWireWarningsLogged(t *testing.T) {
+	ntb := unstartedTestbed(nil)
+	defer ntb.terminateMailboxes()
+	warnings := make(chan string, 10)
+	ntb.remote1to2.ClusterLogger = warnLogger{warnings: warnings}
+
+	// Only the first message of the type is checked, so forget any
+	// earlier run of this test.
+	encodable.Lock()
+	delete(encodable.types, reflect.TypeOf(lossyMessage{}))
+	encodable.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := ntb.rem1_2.Send(lossyMessage{Name: "moo"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(warnings) != 1 {
+		t.Fatal("Unexpected number of warnings:", len(warnings))
+	}
+	if warning := <-warnings; !strings.HasPrefix(warning, "Messages of type reign.lossyMessage will not arrive exactly as they were sent: ") {
+		t.Fatal("Unexpected warning:", warning)
+	}
+}
+
+func TestRegisterStandardTypes(t *testing.T) {
+	RegisterStandardTypes()
+	for _, msg := range []interface{}{time.Now(), time.Second, net.IPv4(127, 0, 0, 1), big.NewInt(1), big.NewRat(1, 2), big.NewFloat(1)} {
+		if err := checkEncodable(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}